@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/placer14/moxie/proxyhandler"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var listenPort = flag.Int("port", 8080, "specify which port the proxy should listen on")
 	var defaultHost = flag.String("proxied-host", "http://http_three:8000", "default host to recieve proxied traffic")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "maximum time to wait for in-flight requests when stopping")
+	var tlsCert = flag.String("tls-cert", "", "certificate file to terminate TLS with; reloaded on SIGHUP")
+	var tlsKey = flag.String("tls-key", "", "key file for the certificate given by -tls-cert")
 
 	flag.Parse()
 
@@ -28,6 +36,39 @@ func main() {
 		log.Fatalf("Error creating proxy: %s", err.Error())
 	}
 
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if err := p.ReloadCertificates(); err != nil {
+				log.Printf("Error reloading certificates: %s", err.Error())
+			}
+		}
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := p.Shutdown(ctx); err != nil {
+			log.Printf("Error draining proxy: %s", err.Error())
+		}
+	}()
+
 	log.Printf("Listening on port %d...", *listenPort)
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", *listenPort), p))
+	addr := fmt.Sprintf(":%d", *listenPort)
+	if *tlsCert != "" {
+		err = p.ListenAndServeTLS(addr, *tlsCert, *tlsKey)
+	} else {
+		err = p.ListenAndServe(addr)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+	<-drained
 }
@@ -0,0 +1,71 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseMediaTypes validates the media types a route is restricted to and
+// lowercases them for matching.
+func parseMediaTypes(types []string) ([]string, error) {
+	normalized := make([]string, len(types))
+	for index, mediaType := range types {
+		typeName, subtype, found := strings.Cut(mediaType, "/")
+		if !found || typeName == "" || subtype == "" || strings.Contains(subtype, "/") || strings.ContainsAny(mediaType, "*;, ") {
+			return nil, fmt.Errorf("media type %q must be of the form type/subtype", mediaType)
+		}
+		normalized[index] = strings.ToLower(mediaType)
+	}
+	return normalized, nil
+}
+
+// preferredMediaRanges returns the media ranges of an Accept header with the
+// highest quality value. The */* range, ranges with a quality of 0 and those
+// which cannot be parsed are ignored.
+func preferredMediaRanges(header http.Header) []string {
+	var preferred []string
+	best := 0.0
+	for _, value := range header.Values("Accept") {
+		for _, element := range strings.Split(value, ",") {
+			mediaRange, quality := parseMediaRange(element)
+			if mediaRange == "*/*" || strings.Count(mediaRange, "/") != 1 || strings.Contains(mediaRange, " ") {
+				continue
+			}
+			switch {
+			case quality <= 0 || quality < best:
+			case quality > best:
+				best, preferred = quality, []string{mediaRange}
+			default:
+				preferred = append(preferred, mediaRange)
+			}
+		}
+	}
+	return preferred
+}
+
+// allowsAccept reports whether the route serves request according to its
+// Accept header: every one of the request's most preferred media ranges must
+// cover one of the route's media types.
+func (route *validRouteRule) allowsAccept(request *http.Request) bool {
+	if len(route.acceptTypes) == 0 {
+		return true
+	}
+	preferred := preferredMediaRanges(request.Header)
+	if len(preferred) == 0 {
+		return false
+	}
+	for _, mediaRange := range preferred {
+		served := false
+		for _, mediaType := range route.acceptTypes {
+			if mediaRangeMatches(mediaRange, mediaType) {
+				served = true
+				break
+			}
+		}
+		if !served {
+			return false
+		}
+	}
+	return true
+}
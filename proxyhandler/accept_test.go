@@ -0,0 +1,68 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptRoutesNegotiateContent(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://fallback"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/data", Endpoint: "http://api", Accept: []string{"application/json"}},
+		&RouteRule{Path: "/data", Endpoint: "http://web", Accept: []string{"text/html", "application/xhtml+xml"}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	tests := []struct {
+		accept   []string
+		expected string
+	}{
+		{[]string{"application/json"}, "api"},
+		{[]string{"text/html"}, "web"},
+		{[]string{"text/html;q=0.9, application/json"}, "api"},
+		{[]string{"application/json;q=0.5, text/html;q=0.9"}, "web"},
+		{[]string{"Application/JSON"}, "api"},
+		{[]string{"text/html", "application/json;q=0.8"}, "web"},
+		{[]string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, "web"},
+		{[]string{"text/*, application/json;q=0.1"}, "web"},
+		{[]string{"*/*"}, "fallback"},
+		{[]string{"*/*, application/json;q=0.2"}, "api"},
+		{[]string{"application/json, text/html"}, "fallback"},
+		{[]string{"application/json;q=0, text/html;q=0"}, "fallback"},
+		{[]string{"image/png"}, "fallback"},
+		{[]string{"application/json;q=2"}, "fallback"},
+		{[]string{"not a media type"}, "fallback"},
+		{nil, "fallback"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/data", nil)
+		request.Header["Accept"] = test.accept
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if received := recorder.Body.String(); received != test.expected {
+			t.Errorf("unexpected backend for Accept %q\nexpected: %v\nreceived: %v", test.accept, test.expected, received)
+		}
+	}
+}
+
+func TestAcceptMediaTypesAreValidated(t *testing.T) {
+	for _, mediaType := range []string{"json", "text/*", "*/*", "application/json/extra", ""} {
+		config := buildConfiguration()
+		config.Routes[0].Accept = []string{mediaType}
+		if _, err := config.validate(); err == nil {
+			t.Errorf("expected accept media type %q to be rejected", mediaType)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// maxAdminBodyBytes bounds the body of an admin request.
+const maxAdminBodyBytes = 1 << 20
+
+// AdminHandler returns an http.Handler for managing the ProxyHandler's routes
+// at runtime:
+//
+//	GET    /routes             lists the routes in effect, in matching order
+//	POST   /routes             adds the JSON encoded RouteRule in the body
+//	DELETE /routes?path=/foo   removes the route registered for /foo
+//	GET    /stats              returns the counters reported by Stats
+//
+// A DELETE removes the route whose Path, Host, Methods, Accept and
+// ContentType are given by the path, host, method, accept and content-type
+// query parameters, the last three of which may be repeated, so that routes
+// sharing a path are removed individually. Bodies larger than 1MiB are
+// refused.
+//
+// Routes and counters are encoded as JSON, and route changes are reported to
+// the RouteChangeHook labelled with "admin" and the client's address. The
+// admin handler is not served by the ProxyHandler itself; it should be
+// mounted on a listener which is only reachable internally, since anyone able
+// to reach it can redirect traffic.
+func (handler *ProxyHandler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", handler.serveAdminRoutes)
+	mux.HandleFunc("/stats", handler.serveAdminStats)
+	return mux
+}
+
+func (handler *ProxyHandler) serveAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, handler.Routes())
+	case http.MethodPost:
+		var route RouteRule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodyBytes)).Decode(&route); err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, "decoding route: "+err.Error(), status)
+			return
+		}
+		if err := handler.As(adminLabel(r)).AddRoute(route); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errRouteExists) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		writeJSON(w, http.StatusCreated, route)
+	case http.MethodDelete:
+		query := r.URL.Query()
+		route := RouteRule{
+			Path:        query.Get("path"),
+			Host:        query.Get("host"),
+			Methods:     query["method"],
+			Accept:      query["accept"],
+			ContentType: query["content-type"],
+		}
+		if route.Path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		if err := handler.As(adminLabel(r)).RemoveRouteRule(route); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "DELETE, GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (handler *ProxyHandler) serveAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, handler.Stats())
+}
+
+// adminLabel identifies the admin API client which changes the routing.
+func adminLabel(r *http.Request) string {
+	return "admin " + r.RemoteAddr
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
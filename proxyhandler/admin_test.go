@@ -0,0 +1,149 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func serveAdmin(admin http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return recorder
+}
+
+func TestAdminHandlerManagesRoutes(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/billing", Endpoint: "http://billing"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	admin := h.AdminHandler()
+
+	recorder := serveAdmin(admin, "POST", "/routes", `{"Path": "/users", "Endpoint": "http://users"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected status adding route\nexpected: %v\nreceived: %v %v", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+	if bodies := dispatchBodies(h, []string{"/users/1", "/billing"}); !reflect.DeepEqual(bodies, []string{"users", "billing"}) {
+		t.Errorf("expected the added route to be used\nreceived: %v", bodies)
+	}
+
+	recorder = serveAdmin(admin, "GET", "/routes", "")
+	var routes []RouteRule
+	if err := json.Unmarshal(recorder.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("unable to decode routes: %s", err.Error())
+	}
+	expectedRoutes := []RouteRule{{Path: "/billing", Endpoint: "http://billing"}, {Path: "/users", Endpoint: "http://users"}}
+	if !reflect.DeepEqual(routes, expectedRoutes) {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", expectedRoutes, routes)
+	}
+
+	recorder = serveAdmin(admin, "DELETE", "/routes?path=/billing", "")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("unexpected status removing route\nexpected: %v\nreceived: %v", http.StatusNoContent, recorder.Code)
+	}
+	if bodies := dispatchBodies(h, []string{"/billing"}); bodies[0] != "default" {
+		t.Errorf("expected the removed route to fall through to the default\nreceived: %v", bodies[0])
+	}
+
+	recorder = serveAdmin(admin, "GET", "/stats", "")
+	var stats map[string]RouteStats
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("unable to decode stats: %s", err.Error())
+	}
+	requests := make(map[string]uint64)
+	for path, routeStats := range stats {
+		requests[path] = routeStats.Requests
+	}
+	expectedRequests := map[string]uint64{"/users": 1, "/billing": 1, "": 1}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Errorf("unexpected request counts\nexpected: %v\nreceived: %v", expectedRequests, requests)
+	}
+}
+
+func TestAdminHandlerRejectsInvalidChanges(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	admin := h.AdminHandler()
+	expectedRoutes := h.Routes()
+
+	testCases := []struct {
+		method, target, body string
+		expected             int
+	}{
+		{"POST", "/routes", `{"Path": "/new", "Endpoint": "gopher://nowhere"}`, http.StatusBadRequest},
+		{"POST", "/routes", `{"Path": "/new"`, http.StatusBadRequest},
+		{"POST", "/routes", `{"Path": "/route1", "Endpoint": "http://elsewhere"}`, http.StatusConflict},
+		{"POST", "/routes", `{"Path": "/new", "Endpoint": "http://new", "Labels": {"x": "` + strings.Repeat("x", maxAdminBodyBytes) + `"}}`, http.StatusRequestEntityTooLarge},
+		{"DELETE", "/routes?path=/missing", "", http.StatusNotFound},
+		{"DELETE", "/routes", "", http.StatusBadRequest},
+		{"PUT", "/routes", "", http.StatusMethodNotAllowed},
+		{"POST", "/stats", "", http.StatusMethodNotAllowed},
+	}
+	for _, testCase := range testCases {
+		recorder := serveAdmin(admin, testCase.method, testCase.target, testCase.body)
+		if recorder.Code != testCase.expected {
+			t.Errorf("unexpected status for %s %s\nexpected: %v\nreceived: %v", testCase.method, testCase.target, testCase.expected, recorder.Code)
+		}
+	}
+	if !reflect.DeepEqual(h.Routes(), expectedRoutes) {
+		t.Errorf("expected rejected changes to leave the routes untouched\nexpected: %v\nreceived: %v", expectedRoutes, h.Routes())
+	}
+}
+
+func TestAdminHandlerManagesRoutesSharingAPath(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/items", Endpoint: "http://reader", Methods: []string{"GET"}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	admin := h.AdminHandler()
+
+	recorder := serveAdmin(admin, "POST", "/routes", `{"Path": "/items", "Endpoint": "http://writer", "Methods": ["POST"]}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected status adding route\nexpected: %v\nreceived: %v %v", http.StatusCreated, recorder.Code, recorder.Body.String())
+	}
+	recorder = serveAdmin(admin, "POST", "/routes", `{"Path": "/items", "Endpoint": "http://elsewhere", "Methods": ["GET"]}`)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("unexpected status adding a route matching the same requests\nexpected: %v\nreceived: %v", http.StatusConflict, recorder.Code)
+	}
+
+	recorder = serveAdmin(admin, "DELETE", "/routes?path=/items", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unexpected status removing a route without its methods\nexpected: %v\nreceived: %v", http.StatusNotFound, recorder.Code)
+	}
+	recorder = serveAdmin(admin, "DELETE", "/routes?path=/items&method=GET", "")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("unexpected status removing route\nexpected: %v\nreceived: %v", http.StatusNoContent, recorder.Code)
+	}
+	expectedRoutes := []RouteRule{{Path: "/items", Endpoint: "http://writer", Methods: []string{"POST"}}}
+	if !reflect.DeepEqual(h.Routes(), expectedRoutes) {
+		t.Errorf("expected only the GET route to be removed\nexpected: %v\nreceived: %v", expectedRoutes, h.Routes())
+	}
+}
@@ -0,0 +1,36 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"slices"
+)
+
+// commonMethods are listed in the Allow header when a TRACE request is
+// refused for a route which does not restrict its methods.
+var commonMethods = []string{
+	http.MethodDelete, http.MethodGet, http.MethodHead, http.MethodOptions,
+	http.MethodPatch, http.MethodPost, http.MethodPut,
+}
+
+// refusesMethod reports whether route refuses requests using method after
+// they matched it, either because the method is missing from the route's
+// AllowedMethods or because it is TRACE and tracing is not allowed, and
+// returns the methods to list in the Allow header of the 405 answer.
+func (handler *ProxyHandler) refusesMethod(route *validRouteRule, method string) ([]string, bool) {
+	if len(route.AllowedMethods) > 0 {
+		if slices.Contains(route.AllowedMethods, method) {
+			return nil, false
+		}
+		return append([]string(nil), route.AllowedMethods...), true
+	}
+	if method != http.MethodTrace || handler.configuration.AllowTrace {
+		return nil, false
+	}
+	allowed := slices.Clone(commonMethods)
+	if len(route.Methods) > 0 {
+		allowed = route.methods()
+	}
+	return slices.DeleteFunc(allowed, func(allowed string) bool {
+		return allowed == http.MethodTrace
+	}), true
+}
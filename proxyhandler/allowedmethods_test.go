@@ -0,0 +1,123 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAllowedMethods(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstreamRequests := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		upstreamRequests++
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/users", Methods: []string{"POST"}, Endpoint: "http://writer"},
+		&RouteRule{Path: "/users", Endpoint: "http://reader", AllowedMethods: []string{"GET", "HEAD"}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	serve := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(method, "/users", nil))
+		return recorder
+	}
+
+	if recorder := serve("GET"); recorder.Code != http.StatusOK || recorder.Body.String() != "reader" {
+		t.Errorf("expected an allowed method to be forwarded\nreceived: %d %s", recorder.Code, recorder.Body.String())
+	}
+	// the allowlist applies after matching, so POST still reaches its own route
+	if recorder := serve("POST"); recorder.Code != http.StatusOK || recorder.Body.String() != "writer" {
+		t.Errorf("expected method routing to be unaffected\nreceived: %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder := serve("DELETE")
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status for a denied method\nexpected: %v\nreceived: %v", http.StatusMethodNotAllowed, recorder.Code)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("unexpected Allow header\nexpected: %v\nreceived: %v", "GET, HEAD", allow)
+	}
+	if upstreamRequests != 2 {
+		t.Errorf("expected the denied request not to reach the upstream\nexpected: %v\nreceived: %v", 2, upstreamRequests)
+	}
+	if allowed := h.Routes()[1].AllowedMethods; allowed[0] != "GET" || allowed[1] != "HEAD" {
+		t.Errorf("expected the route's allowlist to be left in order\nreceived: %v", allowed)
+	}
+}
+
+func TestTraceIsDeniedByDefault(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstreamRequests := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		upstreamRequests++
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+	config := buildConfiguration()
+	config.Routes = append(config.Routes,
+		&RouteRule{Path: "/users", Methods: []string{"GET", "TRACE"}, Endpoint: "http://users"},
+		&RouteRule{Path: "/debug", Endpoint: "http://debug", AllowedMethods: []string{"GET", "TRACE"}},
+	)
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("TRACE", path, nil))
+		return recorder
+	}
+
+	expectedAllow := map[string]string{
+		"/route1": "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT",
+		"/users":  "GET, HEAD",
+		"/other":  "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT",
+	}
+	for path, expected := range expectedAllow {
+		recorder := serve(path)
+		if recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("unexpected status for TRACE %s\nexpected: %v\nreceived: %v", path, http.StatusMethodNotAllowed, recorder.Code)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != expected {
+			t.Errorf("unexpected Allow header for TRACE %s\nexpected: %v\nreceived: %v", path, expected, allow)
+		}
+	}
+	if upstreamRequests != 0 {
+		t.Errorf("expected TRACE requests not to reach upstreams\nreceived: %v", upstreamRequests)
+	}
+	if recorder := serve("/debug"); recorder.Code != http.StatusOK {
+		t.Errorf("expected a route listing TRACE to allow it\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+
+	config.AllowTrace = true
+	if h, err = New(config); err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if recorder := serve("/route1"); recorder.Code != http.StatusOK {
+		t.Errorf("expected AllowTrace to permit TRACE\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestAllowedMethodsAreValidated(t *testing.T) {
+	route := RouteRule{Path: "/", AllowedMethods: []string{"GET, POST"}, Endpoint: "http://upstream"}
+	expectedError := `invalid method "GET, POST" in allowed methods`
+	if _, err := route.validate(); err == nil || err.Error() != expectedError {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,128 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// DefaultBufferBodyMemoryBytes is the size beyond which a buffered request
+// body is moved from memory to a temporary file when the Configuration does
+// not specify one.
+const DefaultBufferBodyMemoryBytes = 1 << 20
+
+// bufferedBody holds the start of a request body so it can be sent upstream
+// more than once. When the body was longer than the buffering limit, rest
+// holds the unread remainder and the body can only be sent once.
+type bufferedBody struct {
+	memory []byte
+	file   *os.File
+	size   int64
+	rest   io.Reader
+}
+
+// bufferRequestBody reads up to limit bytes of body, moving them to a
+// temporary file once they exceed memoryLimit. The returned body must be
+// cleaned up once the request is complete, even when an error is returned.
+func bufferRequestBody(body io.Reader, limit, memoryLimit int64) (*bufferedBody, error) {
+	buffered := &bufferedBody{}
+	if limit == 0 {
+		buffered.rest = body
+		return buffered, nil
+	}
+	if memoryLimit > limit {
+		memoryLimit = limit
+	}
+	var memory bytes.Buffer
+	read, err := io.CopyN(&memory, body, memoryLimit+1)
+	buffered.size = read
+	if err == io.EOF {
+		buffered.memory = memory.Bytes()
+		return buffered, nil
+	}
+	if err != nil {
+		return buffered, fmt.Errorf("reading request body: %s", err.Error())
+	}
+	if read > limit {
+		buffered.memory = memory.Bytes()
+		buffered.size = 0
+		buffered.rest = io.MultiReader(bytes.NewReader(buffered.memory), body)
+		return buffered, nil
+	}
+
+	buffered.file, err = os.CreateTemp("", "moxie-body-")
+	if err != nil {
+		return buffered, fmt.Errorf("buffering request body: %s", err.Error())
+	}
+	if _, err := buffered.file.Write(memory.Bytes()); err != nil {
+		return buffered, fmt.Errorf("buffering request body: %s", err.Error())
+	}
+	read, err = io.CopyN(buffered.file, body, limit-buffered.size+1)
+	buffered.size += read
+	if err != nil && err != io.EOF {
+		return buffered, fmt.Errorf("reading request body: %s", err.Error())
+	}
+	if buffered.size > limit {
+		buffered.rest = io.MultiReader(io.NewSectionReader(buffered.file, 0, buffered.size), body)
+		buffered.size = 0
+	}
+	return buffered, nil
+}
+
+// replayable reports whether the body can be sent again. A nil body stands
+// for a request without one.
+func (buffered *bufferedBody) replayable() bool {
+	return buffered == nil || buffered.rest == nil
+}
+
+func (buffered *bufferedBody) reader() io.ReadCloser {
+	switch {
+	case buffered.rest != nil:
+		return io.NopCloser(buffered.rest)
+	case buffered.file != nil:
+		return io.NopCloser(io.NewSectionReader(buffered.file, 0, buffered.size))
+	default:
+		return io.NopCloser(bytes.NewReader(buffered.memory))
+	}
+}
+
+// attach makes the buffered body the body of an upstream request, along with
+// a GetBody for replaying it when the whole body was buffered.
+func (buffered *bufferedBody) attach(request *http.Request, contentLength int64) {
+	if buffered == nil {
+		return
+	}
+	request.Body = buffered.reader()
+	request.ContentLength = contentLength
+	if buffered.replayable() {
+		request.ContentLength = buffered.size
+		request.GetBody = func() (io.ReadCloser, error) {
+			return buffered.reader(), nil
+		}
+	}
+}
+
+// cleanup removes any temporary file backing the body.
+func (buffered *bufferedBody) cleanup() {
+	if buffered == nil || buffered.file == nil {
+		return
+	}
+	buffered.file.Close()
+	os.Remove(buffered.file.Name())
+}
+
+// bufferBody buffers the request body when the route may need to send it more
+// than once, or must hash it before sending it. It returns nil when the
+// request has no body or the route neither retries, hedges nor signs.
+func (handler *ProxyHandler) bufferBody(route *validRouteRule, request *http.Request) (*bufferedBody, error) {
+	if (route.MaxRetries == 0 && route.HedgeDelay == 0 && route.Signer == nil) || request.Body == nil || request.Body == http.NoBody || request.ContentLength == 0 {
+		return nil, nil
+	}
+	memoryLimit := handler.configuration.BufferBodyMemoryBytes
+	if memoryLimit == 0 {
+		memoryLimit = DefaultBufferBodyMemoryBytes
+	}
+	return bufferRequestBody(request.Body, handler.configuration.BufferBodyBytes, memoryLimit)
+}
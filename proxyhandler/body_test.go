@@ -0,0 +1,145 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failFirstAttempt returns a responder which fails its first call and records
+// the body of every later call.
+func failFirstAttempt(attempts *int, bodies *[]string) httpmock.Responder {
+	return func(r *http.Request) (*http.Response, error) {
+		*attempts++
+		if *attempts == 1 {
+			ioutil.ReadAll(r.Body)
+			return nil, fmt.Errorf("connection reset by peer")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		*bodies = append(*bodies, string(body))
+		return httpmock.NewStringResponse(200, "ok"), nil
+	}
+}
+
+func TestRetriedPostDeliversIdenticalBody(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	cases := map[string]string{
+		"in memory":      `{"some":"json"}`,
+		"temporary file": strings.Repeat("0123456789", 100),
+	}
+	for name, expectedBody := range cases {
+		attempts := 0
+		var bodies []string
+		httpmock.RegisterResponder("POST", "http://endpoint.one/route1", failFirstAttempt(&attempts, &bodies))
+		config := buildConfiguration()
+		config.Routes[0].MaxRetries = 2
+		config.BufferBodyBytes = 4096
+		config.BufferBodyMemoryBytes = 64
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("POST", "/route1", strings.NewReader(expectedBody)))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected retry to succeed\nexpected: %v\nreceived: %v", name, http.StatusOK, recorder.Code)
+		}
+		if attempts != 2 || len(bodies) != 1 || bodies[0] != expectedBody {
+			t.Errorf("%s: expected identical body on second attempt\nexpected: %v\nreceived: %v after %d attempts", name, expectedBody, bodies, attempts)
+		}
+	}
+}
+
+func TestBodyOverBufferLimitIsNotRetried(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var received []byte
+	attempts := 0
+	httpmock.RegisterResponder("POST", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		attempts++
+		received, _ = ioutil.ReadAll(r.Body)
+		return nil, fmt.Errorf("connection reset by peer")
+	})
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 2
+	config.BufferBodyBytes = 16
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expectedBody := strings.Repeat("x", 100)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/route1", strings.NewReader(expectedBody)))
+	if attempts != 1 {
+		t.Errorf("expected a single attempt\nexpected: %v\nreceived: %v", 1, attempts)
+	}
+	if string(received) != expectedBody {
+		t.Errorf("expected whole body on the only attempt\nexpected: %v\nreceived: %v", expectedBody, string(received))
+	}
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+}
+
+func TestBufferedBodyTemporaryFileIsRemoved(t *testing.T) {
+	content := bytes.Repeat([]byte("y"), 100)
+	for _, limit := range []int64{200, 50} {
+		buffered, err := bufferRequestBody(bytes.NewReader(content), limit, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if buffered.file == nil {
+			t.Fatal("expected body beyond the memory limit to be held in a file")
+		}
+		replayed, _ := ioutil.ReadAll(buffered.reader())
+		if !bytes.Equal(replayed, content) {
+			t.Errorf("unexpected body with limit %d\nexpected: %s\nreceived: %s", limit, content, replayed)
+		}
+		if buffered.replayable() != (limit >= int64(len(content))) {
+			t.Errorf("unexpected replayability with limit %d\nreceived: %v", limit, buffered.replayable())
+		}
+
+		name := buffered.file.Name()
+		buffered.cleanup()
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected temporary file to be removed\nreceived: %v", err)
+		}
+	}
+}
+
+func TestBufferedBodyIsRemovedAfterPanic(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 1
+	config.Routes[0].Director = func(r *http.Request) {
+		panic("director failed")
+	}
+	config.BufferBodyBytes = 4096
+	config.BufferBodyMemoryBytes = 8
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	pattern := filepath.Join(os.TempDir(), "moxie-body-*")
+	before, _ := filepath.Glob(pattern)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/route1", strings.NewReader(strings.Repeat("z", 64))))
+	after, _ := filepath.Glob(pattern)
+	if len(after) > len(before) {
+		t.Errorf("expected temporary body files to be removed\nbefore: %v\nafter: %v", before, after)
+	}
+}
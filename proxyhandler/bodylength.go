@@ -0,0 +1,77 @@
+package proxyhandler
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// sameBody reports whether body is still original. Bodies of a type which
+// cannot be compared are taken to have been replaced, which at worst sends an
+// unchanged body chunked.
+func sameBody(body, original io.ReadCloser) bool {
+	if body == nil || original == nil {
+		return body == original
+	}
+	bodyType := reflect.TypeOf(body)
+	if bodyType != reflect.TypeOf(original) || !bodyType.Comparable() {
+		return false
+	}
+	return body == original
+}
+
+// syncResponseLength keeps the Content-Length of response true to its body
+// after features such as ModifyResponse may have replaced the body read from
+// the upstream, whose length was originalLength. A replacement body keeps a
+// Content-Length only when its length is known, either because it is empty or
+// because ContentLength was updated along with it. Otherwise the header is
+// removed and the body is sent chunked, rather than leaving clients to wait
+// for bytes which never arrive or to truncate what they receive. A body read
+// in full under BufferResponses is sent with its exact length. Responses which
+// cannot carry a body keep the Content-Length the upstream gave them, which
+// describes the representation rather than a body.
+func syncResponseLength(response *http.Response, original io.ReadCloser, originalLength int64) {
+	if !hasBody(response) {
+		return
+	}
+	if buffer, ok := response.Body.(*responseBuffer); ok {
+		response.ContentLength = int64(buffer.Len())
+		response.Header.Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+		return
+	}
+	if sameBody(response.Body, original) {
+		return
+	}
+	if response.Body == nil || response.Body == http.NoBody {
+		response.Body, response.ContentLength = http.NoBody, 0
+	} else if response.ContentLength == originalLength {
+		response.ContentLength = -1
+	}
+	if response.ContentLength < 0 {
+		response.Header.Del("Content-Length")
+		return
+	}
+	response.Header.Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+}
+
+// syncRequestLength does for a request sent upstream what syncResponseLength
+// does for responses, for bodies replaced by a Director. A replacement body of
+// unknown length is sent chunked.
+func syncRequestLength(request *http.Request, original io.ReadCloser, originalLength int64) {
+	if sameBody(request.Body, original) {
+		return
+	}
+	// GetBody would recreate the body which was replaced
+	request.GetBody = nil
+	if request.Body == nil || request.Body == http.NoBody {
+		request.Body, request.ContentLength = http.NoBody, 0
+	} else if request.ContentLength == originalLength {
+		request.ContentLength = -1
+	}
+	if request.ContentLength < 0 {
+		request.Header.Del("Content-Length")
+		return
+	}
+	request.Header.Set("Content-Length", strconv.FormatInt(request.ContentLength, 10))
+}
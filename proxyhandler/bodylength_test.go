@@ -0,0 +1,150 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplacedResponseBodyLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("original body"))
+	}))
+	defer upstream.Close()
+
+	examples := map[string]struct {
+		modify       func(*http.Response) error
+		expectedBody string
+	}{
+		"longer": {func(response *http.Response) error {
+			response.Body = ioutil.NopCloser(strings.NewReader("a much longer replacement body"))
+			return nil
+		}, "a much longer replacement body"},
+		"shorter": {func(response *http.Response) error {
+			response.Body = ioutil.NopCloser(strings.NewReader("short"))
+			return nil
+		}, "short"},
+		"known length": {func(response *http.Response) error {
+			response.Body = ioutil.NopCloser(strings.NewReader("sized"))
+			response.ContentLength = 5
+			return nil
+		}, "sized"},
+		"removed": {func(response *http.Response) error {
+			response.Body = nil
+			return nil
+		}, ""},
+		"untouched": {func(response *http.Response) error {
+			return nil
+		}, "original body"},
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, mode := range proxyModes {
+		for name, example := range examples {
+			config := buildConfiguration()
+			config.Transport = nil
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = upstream.URL
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/", Endpoint: upstream.URL, ModifyResponse: example.modify},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			proxy := httptest.NewServer(h)
+			response, err := client.Get(proxy.URL + "/")
+			if err != nil {
+				t.Fatalf("%s %s: unexpected error: %s", mode.name, name, err.Error())
+			}
+			body, err := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			proxy.Close()
+
+			if err != nil || string(body) != example.expectedBody {
+				t.Errorf("%s %s: unexpected body\nexpected: %v\nreceived: %v %v", mode.name, name, example.expectedBody, string(body), err)
+			}
+			// the server may measure a short unsized body itself
+			if response.ContentLength != -1 && response.ContentLength != int64(len(body)) {
+				t.Errorf("%s %s: unexpected content length\nexpected: %v\nreceived: %v", mode.name, name, len(body), response.ContentLength)
+			}
+		}
+	}
+}
+
+func TestReplacedRequestBodyLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	type received struct {
+		body   string
+		length int64
+	}
+	receivedBodies := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		receivedBodies <- received{string(body), r.ContentLength}
+	}))
+	defer upstream.Close()
+
+	examples := map[string]struct {
+		direct         func(*http.Request)
+		expectedBody   string
+		expectedLength int64
+	}{
+		"longer": {func(request *http.Request) {
+			request.Body = ioutil.NopCloser(strings.NewReader("a much longer replacement body"))
+		}, "a much longer replacement body", -1},
+		"shorter": {func(request *http.Request) {
+			request.Body = ioutil.NopCloser(strings.NewReader("short"))
+		}, "short", -1},
+		"known length": {func(request *http.Request) {
+			request.Body = ioutil.NopCloser(strings.NewReader("sized"))
+			request.ContentLength = 5
+		}, "sized", 5},
+		"removed": {func(request *http.Request) {
+			request.Body = nil
+		}, "", 0},
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	for _, mode := range proxyModes {
+		for name, example := range examples {
+			config := buildConfiguration()
+			config.Transport = nil
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = upstream.URL
+			config.Routes = []*RouteRule{
+				// retries buffer the body, which must not defeat the check
+				&RouteRule{Path: "/", Endpoint: upstream.URL, Director: example.direct, MaxRetries: 1},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			proxy := httptest.NewServer(h)
+			response, err := client.Post(proxy.URL+"/", "text/plain", bytes.NewReader([]byte("original body")))
+			if err != nil {
+				t.Fatalf("%s %s: unexpected error: %s", mode.name, name, err.Error())
+			}
+			response.Body.Close()
+			proxy.Close()
+
+			select {
+			case got := <-receivedBodies:
+				if got.body != example.expectedBody || got.length != example.expectedLength {
+					t.Errorf("%s %s: unexpected upstream body\nexpected: %v (%d)\nreceived: %v (%d)", mode.name, name, example.expectedBody, example.expectedLength, got.body, got.length)
+				}
+			default:
+				t.Errorf("%s %s: expected the upstream to receive the request", mode.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package proxyhandler
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// countingBody counts the bytes read from a request body, recording them as
+// activity with idle when it is set. The transport may still be reading it
+// when the response has been relayed, so the count is updated atomically.
+type countingBody struct {
+	io.ReadCloser
+	count atomic.Int64
+	idle  *idleTimer
+}
+
+func (body *countingBody) Read(buffer []byte) (int, error) {
+	read, err := body.ReadCloser.Read(buffer)
+	body.count.Add(int64(read))
+	if read > 0 {
+		body.idle.touch()
+	}
+	return read, err
+}
+
+// countRequestBody replaces request's body with one which counts the bytes
+// read from it, returning nil when the request has no body.
+func countRequestBody(request *http.Request) *countingBody {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+	counter := &countingBody{ReadCloser: request.Body}
+	request.Body = counter
+	return counter
+}
+
+func (body *countingBody) bytes() int64 {
+	if body == nil {
+		return 0
+	}
+	return body.count.Load()
+}
+
+// requestHeaderBytes estimates the size of request's request line and header
+// as they would be sent in HTTP/1.1.
+func requestHeaderBytes(request *http.Request) int64 {
+	size := len(request.Method) + len(" ") + len(request.RequestURI) + len(" HTTP/1.1\r\n")
+	size += len("Host: ") + len(request.Host) + len("\r\n")
+	return int64(size) + headerBytes(request.Header)
+}
+
+// responseHeaderBytes estimates the size of a response's status line and
+// header as they would be sent in HTTP/1.1.
+func responseHeaderBytes(status int, header http.Header) int64 {
+	size := len("HTTP/1.1 ") + len(strconv.Itoa(status)) + len(" ") + len(http.StatusText(status)) + len("\r\n")
+	return int64(size) + headerBytes(header)
+}
+
+// headerBytes estimates the size of header's fields, including the blank line
+// which ends them.
+func headerBytes(header http.Header) int64 {
+	size := len("\r\n")
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return int64(size)
+}
@@ -0,0 +1,135 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newObservedHandler proxies /transfer to upstream, recording the observation
+// of the latest request.
+func newObservedHandler(t *testing.T, upstreamURL string) (*ProxyHandler, *Observation) {
+	observation := &Observation{}
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstreamURL
+	config.Routes = []*RouteRule{&RouteRule{Path: "/transfer", Endpoint: upstreamURL}}
+	config.Observer = func(observed *Observation) {
+		*observation = *observed
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h, observation
+}
+
+// chunkedReader hides the length of a body so it is sent chunked.
+type chunkedReader struct {
+	io.Reader
+}
+
+func TestByteCountsForStreamedBodies(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	responseBody := strings.Repeat("r", 200000)
+	var received int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = len(body)
+		w.Header().Set("Content-Type", "text/plain")
+		// flush without a Content-Length so the response is chunked
+		w.(http.Flusher).Flush()
+		io.WriteString(w, responseBody)
+	}))
+	defer upstream.Close()
+	h, observation := newObservedHandler(t, upstream.URL)
+
+	request := httptest.NewRequest("POST", "/transfer", chunkedReader{strings.NewReader(strings.Repeat("q", 150000))})
+	request.ContentLength = -1
+	request.Header.Set("X-Tenant", "acme")
+	expectedIn := requestHeaderBytes(request) + 150000
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+
+	if received != 150000 || recorder.Body.Len() != len(responseBody) {
+		t.Fatalf("unexpected transfer\nexpected: %v up, %v down\nreceived: %v up, %v down", 150000, len(responseBody), received, recorder.Body.Len())
+	}
+	if observation.BytesIn != expectedIn {
+		t.Errorf("unexpected bytes in\nexpected: %v\nreceived: %v", expectedIn, observation.BytesIn)
+	}
+	expectedOut := responseHeaderBytes(http.StatusOK, recorder.Result().Header) + int64(len(responseBody))
+	if observation.BytesOut != expectedOut {
+		t.Errorf("unexpected bytes out\nexpected: %v\nreceived: %v", expectedOut, observation.BytesOut)
+	}
+	stats := h.Stats()["/transfer"]
+	if stats.BytesIn != uint64(expectedIn) || stats.BytesOut != uint64(expectedOut) {
+		t.Errorf("unexpected route stats\nexpected: %v in, %v out\nreceived: %v in, %v out", expectedIn, expectedOut, stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestByteCountsForHeadRequests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5000")
+	}))
+	defer upstream.Close()
+	h, observation := newObservedHandler(t, upstream.URL)
+
+	request := httptest.NewRequest("HEAD", "/transfer", nil)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+
+	if observation.BytesIn != requestHeaderBytes(request) {
+		t.Errorf("unexpected bytes in\nexpected: %v\nreceived: %v", requestHeaderBytes(request), observation.BytesIn)
+	}
+	expectedOut := responseHeaderBytes(http.StatusOK, recorder.Result().Header)
+	if observation.BytesOut != expectedOut {
+		t.Errorf("expected only the header to be counted\nexpected: %v\nreceived: %v", expectedOut, observation.BytesOut)
+	}
+}
+
+// disconnectingWriter accepts limit bytes of body before failing as though
+// the client had gone away.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (writer *disconnectingWriter) Write(body []byte) (int, error) {
+	if writer.ResponseRecorder.Body.Len()+len(body) > writer.limit {
+		accepted := writer.limit - writer.ResponseRecorder.Body.Len()
+		writer.ResponseRecorder.Write(body[:accepted])
+		return accepted, errors.New("client disconnected")
+	}
+	return writer.ResponseRecorder.Write(body)
+}
+
+func TestByteCountsForTruncatedTransfers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("r"), 100000))
+	}))
+	defer upstream.Close()
+	h, observation := newObservedHandler(t, upstream.URL)
+
+	writer := &disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), limit: 40000}
+	h.ServeHTTP(writer, httptest.NewRequest("GET", "/transfer", nil))
+
+	expectedOut := responseHeaderBytes(http.StatusOK, writer.Header()) + 40000
+	if observation.BytesOut != expectedOut {
+		t.Errorf("expected only the delivered bytes to be counted\nexpected: %v\nreceived: %v", expectedOut, observation.BytesOut)
+	}
+}
@@ -0,0 +1,111 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// The callbacks of a RouteRule whose panics are recovered and attributed to
+// the route.
+const (
+	callbackDirector       = "Director"
+	callbackModifyResponse = "ModifyResponse"
+)
+
+// ErrCallbackDisabled is wrapped by the error reported for a request to a
+// route one of whose callbacks has been disabled under CallbackPanicLimit.
+var ErrCallbackDisabled = errors.New("callback disabled")
+
+// CallbackPanicError is the error reported for a request during which one of
+// its route's callbacks panicked. Route is the Path of the route, Callback
+// names the callback, "Director" or "ModifyResponse", and Value is the value
+// the callback panicked with.
+type CallbackPanicError struct {
+	Route    string
+	Callback string
+	Value    interface{}
+}
+
+func (err *CallbackPanicError) Error() string {
+	return fmt.Sprintf("%s of route %s panicked: %v", err.Callback, err.Route, err.Value)
+}
+
+// callbackPanics counts the panics of each of a route's callbacks.
+type callbackPanics struct {
+	director       atomic.Uint64
+	modifyResponse atomic.Uint64
+}
+
+func (panics *callbackPanics) counter(callback string) *atomic.Uint64 {
+	if callback == callbackDirector {
+		return &panics.director
+	}
+	return &panics.modifyResponse
+}
+
+// counts returns the number of panics of each callback which has panicked,
+// keyed by its name.
+func (panics *callbackPanics) counts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, callback := range []string{callbackDirector, callbackModifyResponse} {
+		if count := panics.counter(callback).Load(); count > 0 {
+			counts[callback] = count
+		}
+	}
+	return counts
+}
+
+// guardCallback calls call, which runs the callback of route named callback,
+// recovering a panic as a CallbackPanicError. The panic is logged and counted
+// against the route, both in Stats and towards CallbackPanicLimit.
+func (handler *ProxyHandler) guardCallback(route *validRouteRule, callback string, call func() error) (err error) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if recovered == http.ErrAbortHandler {
+			panic(recovered)
+		}
+		log.Printf("proxy: panic in %s of route %s: %v\n%s", callback, route.Path, recovered, debug.Stack())
+		if route.panics != nil {
+			route.panics.counter(callback).Add(1)
+		}
+		handler.stats.recordPanic(route.Path, callback)
+		err = &CallbackPanicError{Route: route.Path, Callback: callback, Value: recovered}
+	}()
+	return call()
+}
+
+func (handler *ProxyHandler) callDirector(route *validRouteRule, request *http.Request) error {
+	return handler.guardCallback(route, callbackDirector, func() error {
+		route.Director(request)
+		return nil
+	})
+}
+
+func (handler *ProxyHandler) callModifyResponse(route *validRouteRule, response *http.Response) error {
+	return handler.guardCallback(route, callbackModifyResponse, func() error {
+		return route.ModifyResponse(response)
+	})
+}
+
+// checkCallbacks returns an error wrapping ErrCallbackDisabled when one of
+// route's callbacks has panicked CallbackPanicLimit times since the route was
+// registered, in which case the request must not be forwarded.
+func (handler *ProxyHandler) checkCallbacks(route *validRouteRule) error {
+	limit := handler.configuration.CallbackPanicLimit
+	if limit == 0 || route.panics == nil {
+		return nil
+	}
+	for callback, count := range route.panics.counts() {
+		if count >= uint64(limit) {
+			return fmt.Errorf("%w: %s of route %s panicked %d times", ErrCallbackDisabled, callback, route.Path, count)
+		}
+	}
+	return nil
+}
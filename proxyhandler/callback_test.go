@@ -0,0 +1,124 @@
+package proxyhandler
+
+import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestPanickingCallbackIsDisabled(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			upstreamRequests := 0
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				upstreamRequests++
+				return httpmock.NewStringResponse(200, "ok"), nil
+			})
+			panicking := func() []*RouteRule {
+				return []*RouteRule{
+					&RouteRule{
+						Path:           "/team",
+						Endpoint:       "http://team.endpoint",
+						ModifyResponse: func(*http.Response) error { panic("bad callback") },
+					},
+					&RouteRule{Path: "/other", Endpoint: "http://other.endpoint"},
+				}
+			}
+			var errs []error
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.CallbackPanicLimit = 2
+			config.Routes = panicking()
+			config.Observer = func(observation *Observation) {
+				if observation.Route == "/team" {
+					errs = append(errs, observation.Err)
+				}
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			serve := func(path string) int {
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+				return recorder.Code
+			}
+
+			for request := 0; request < 4; request++ {
+				if status := serve("/team"); status != http.StatusInternalServerError {
+					t.Errorf("unexpected status for request %d\nexpected: %v\nreceived: %v", request, http.StatusInternalServerError, status)
+				}
+			}
+			if upstreamRequests != 2 {
+				t.Errorf("expected the route to stop forwarding once disabled\nexpected: %v\nreceived: %v", 2, upstreamRequests)
+			}
+			var panicErr *CallbackPanicError
+			if len(errs) != 4 || !errors.As(errs[1], &panicErr) || panicErr.Route != "/team" || panicErr.Callback != "ModifyResponse" {
+				t.Errorf("expected the panic to be attributed to the route's callback\nreceived: %v", errs)
+			}
+			if len(errs) != 4 || !errors.Is(errs[2], ErrCallbackDisabled) || !errors.Is(errs[3], ErrCallbackDisabled) {
+				t.Errorf("expected requests to the disabled callback's route to fail\nreceived: %v", errs)
+			}
+			if status := serve("/other"); status != http.StatusOK {
+				t.Errorf("unexpected status for another route\nexpected: %v\nreceived: %v", http.StatusOK, status)
+			}
+			expected := map[string]uint64{"ModifyResponse": 2}
+			if received := h.Stats()["/team"].Panics; !reflect.DeepEqual(received, expected) {
+				t.Errorf("unexpected panic counts\nexpected: %v\nreceived: %v", expected, received)
+			}
+			if received := h.Stats()["/other"].Panics; len(received) != 0 {
+				t.Errorf("expected no panics counted for another route\nreceived: %v", received)
+			}
+
+			// registering the route again enables its callback
+			if err := h.Reload(&Configuration{DefaultRoute: "http://default.endpoint", Routes: panicking()}); err != nil {
+				t.Fatalf("unable to reload: %s", err.Error())
+			}
+			serve("/team")
+			if upstreamRequests != 4 {
+				t.Errorf("expected the re-registered route to forward\nexpected: %v\nreceived: %v", 4, upstreamRequests)
+			}
+			expected = map[string]uint64{"ModifyResponse": 3}
+			if received := h.Stats()["/team"].Panics; !reflect.DeepEqual(received, expected) {
+				t.Errorf("unexpected panic counts after re-registering\nexpected: %v\nreceived: %v", expected, received)
+			}
+		})
+	}
+}
+
+func TestPanickingCallbackIsNotDisabledByDefault(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstreamRequests := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		upstreamRequests++
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+	config := buildConfiguration()
+	config.Routes[0].ModifyResponse = func(*http.Response) error { panic("bad callback") }
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	dispatchBodies(h, []string{"/route1", "/route1", "/route1"})
+	if upstreamRequests != 3 {
+		t.Errorf("unexpected upstream requests\nexpected: %v\nreceived: %v", 3, upstreamRequests)
+	}
+	if received := h.Stats()["/route1"].Panics["ModifyResponse"]; received != 3 {
+		t.Errorf("unexpected panic count\nexpected: %v\nreceived: %v", 3, received)
+	}
+}
@@ -0,0 +1,158 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardingHeaders describe the client to the upstream.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// parseTrustedProxies parses CIDR blocks, or single addresses, of proxies
+// whose X-Forwarded-For headers are believed.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %s", cidr, err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (handler *ProxyHandler) trusted(ip net.IP) bool {
+	for _, network := range handler.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedHeaderPolicy determines what becomes of the forwarding headers,
+// Forwarded, X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and
+// X-Real-IP, of requests which do not arrive from a trusted proxy.
+type ForwardedHeaderPolicy string
+
+// ForwardedHeadersStrip removes the client's forwarding headers and sets
+// X-Forwarded-For to the client's address. ForwardedHeadersAppend keeps them
+// and appends the client's address to X-Forwarded-For.
+// ForwardedHeadersPassthrough sends them upstream exactly as received.
+const (
+	ForwardedHeadersStrip       ForwardedHeaderPolicy = "strip"
+	ForwardedHeadersAppend      ForwardedHeaderPolicy = "append"
+	ForwardedHeadersPassthrough ForwardedHeaderPolicy = "passthrough"
+)
+
+func (policy ForwardedHeaderPolicy) validate() error {
+	switch policy {
+	case "", ForwardedHeadersStrip, ForwardedHeadersAppend, ForwardedHeadersPassthrough:
+		return nil
+	}
+	return fmt.Errorf("unknown forwarded header policy %q", policy)
+}
+
+// trustedRemoteIP returns the address of the connection request arrived on
+// when it belongs to a trusted proxy.
+func (handler *ProxyHandler) trustedRemoteIP(request *http.Request) (string, bool) {
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil || !handler.trusted(net.ParseIP(remoteIP)) {
+		return "", false
+	}
+	return remoteIP, true
+}
+
+// trustedChain returns the X-Forwarded-For chain of a request from the trusted
+// proxy at remoteIP, ending with remoteIP. The chain is believed only as far
+// back as its first hop which is not itself a trusted proxy, which is taken to
+// be the client; the hops before it are discarded.
+func (handler *ProxyHandler) trustedChain(request *http.Request, remoteIP string) []string {
+	hops := forwardedForHops(request.Header)
+	first := len(hops)
+	for index := len(hops) - 1; index >= 0; index-- {
+		ip := net.ParseIP(hops[index])
+		if ip == nil {
+			break
+		}
+		first = index
+		if !handler.trusted(ip) {
+			break
+		}
+	}
+	return append(hops[first:], remoteIP)
+}
+
+// forwardedForHops lists the addresses in every X-Forwarded-For header of
+// header, in order.
+func forwardedForHops(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// clientIP returns the IP address of the client which sent request, as
+// resolved through any trusted proxies.
+func (handler *ProxyHandler) clientIP(request *http.Request) string {
+	if remoteIP, ok := handler.trustedRemoteIP(request); ok {
+		return handler.trustedChain(request, remoteIP)[0]
+	}
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return remoteIP
+}
+
+// forwardClient describes the client which sent request in the headers of
+// the request sent upstream. Requests which arrived over TLS terminated by the
+// handler are marked with X-Forwarded-Proto: https.
+func (handler *ProxyHandler) forwardClient(header http.Header, request *http.Request) {
+	if request.TLS != nil {
+		defer header.Set("X-Forwarded-Proto", "https")
+	}
+	if remoteIP, ok := handler.trustedRemoteIP(request); ok {
+		header.Set("X-Forwarded-For", strings.Join(handler.trustedChain(request, remoteIP), ", "))
+		return
+	}
+	switch handler.configuration.ForwardedHeaders {
+	case ForwardedHeadersPassthrough:
+	case ForwardedHeadersAppend:
+		appendForwardedFor(header, request.RemoteAddr)
+	default:
+		for _, name := range forwardingHeaders {
+			header.Del(name)
+		}
+		appendForwardedFor(header, request.RemoteAddr)
+	}
+}
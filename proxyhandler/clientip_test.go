@@ -0,0 +1,131 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxiesResolveClientIP(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.Header.Get("X-Forwarded-For")+"|"+r.Header.Get("Forwarded")), nil
+	})
+	var clientIP string
+	config := buildConfiguration()
+	config.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	config.Observer = func(observation *Observation) {
+		clientIP = observation.ClientIP
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	testCases := []struct {
+		description     string
+		remoteAddr      string
+		forwardedFor    string
+		expectedClient  string
+		expectedForward string
+	}{
+		{"spoofed by an untrusted client", "203.0.113.9:1234", "192.0.2.1", "203.0.113.9", "203.0.113.9|"},
+		{"through the load balancer", "10.0.0.5:1234", "198.51.100.7", "198.51.100.7", "198.51.100.7, 10.0.0.5|for=192.0.2.1"},
+		{"spoofed through the load balancer", "10.0.0.5:1234", "192.0.2.1, 198.51.100.7", "198.51.100.7", "198.51.100.7, 10.0.0.5|for=192.0.2.1"},
+		{"through several trusted proxies", "10.0.0.5:1234", "198.51.100.7, 10.1.1.1", "198.51.100.7", "198.51.100.7, 10.1.1.1, 10.0.0.5|for=192.0.2.1"},
+		{"from a trusted IPv6 proxy", "[2001:db8::1]:1234", "198.51.100.7", "198.51.100.7", "198.51.100.7, 2001:db8::1|for=192.0.2.1"},
+		{"from the load balancer itself", "10.0.0.5:1234", "", "10.0.0.5", "10.0.0.5|for=192.0.2.1"},
+		{"with a malformed hop", "10.0.0.5:1234", "198.51.100.7, unknown", "10.0.0.5", "10.0.0.5|for=192.0.2.1"},
+	}
+	for _, testCase := range testCases {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = testCase.remoteAddr
+		request.Header.Set("Forwarded", "for=192.0.2.1")
+		if testCase.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if clientIP != testCase.expectedClient {
+			t.Errorf("unexpected client %s\nexpected: %v\nreceived: %v", testCase.description, testCase.expectedClient, clientIP)
+		}
+		if recorder.Body.String() != testCase.expectedForward {
+			t.Errorf("unexpected forwarding headers %s\nexpected: %v\nreceived: %v", testCase.description, testCase.expectedForward, recorder.Body.String())
+		}
+	}
+}
+
+func TestTrustedProxiesAreValidated(t *testing.T) {
+	config := buildConfiguration()
+	config.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.0/33"}
+	expectedError := `invalid trusted proxy "10.0.0.0/33"`
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+func TestForwardedHeaderPolicies(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		var values []string
+		for _, name := range forwardingHeaders {
+			values = append(values, name+"="+strings.Join(r.Header.Values(name), ";"))
+		}
+		return httpmock.NewStringResponse(200, strings.Join(values, " ")), nil
+	})
+	clientHeaders := http.Header{
+		"Forwarded":         []string{"for=192.0.2.1"},
+		"X-Forwarded-For":   []string{"192.0.2.1"},
+		"X-Forwarded-Host":  []string{"spoofed.example"},
+		"X-Forwarded-Proto": []string{"https"},
+		"X-Real-Ip":         []string{"192.0.2.1"},
+	}
+	allForwarded := "Forwarded=for=192.0.2.1 X-Forwarded-For=%s X-Forwarded-Host=spoofed.example X-Forwarded-Proto=https X-Real-Ip=192.0.2.1"
+	noneForwarded := "Forwarded= X-Forwarded-For=%s X-Forwarded-Host= X-Forwarded-Proto= X-Real-Ip="
+
+	testCases := []struct {
+		policy        ForwardedHeaderPolicy
+		clientHeaders http.Header
+		expected      string
+	}{
+		{"", clientHeaders, strings.Replace(noneForwarded, "%s", "203.0.113.9", 1)},
+		{ForwardedHeadersStrip, clientHeaders, strings.Replace(noneForwarded, "%s", "203.0.113.9", 1)},
+		{ForwardedHeadersStrip, http.Header{}, strings.Replace(noneForwarded, "%s", "203.0.113.9", 1)},
+		{ForwardedHeadersAppend, clientHeaders, strings.Replace(allForwarded, "%s", "192.0.2.1, 203.0.113.9", 1)},
+		{ForwardedHeadersAppend, http.Header{}, strings.Replace(noneForwarded, "%s", "203.0.113.9", 1)},
+		{ForwardedHeadersPassthrough, clientHeaders, strings.Replace(allForwarded, "%s", "192.0.2.1", 1)},
+		{ForwardedHeadersPassthrough, http.Header{}, strings.Replace(noneForwarded, "%s", "", 1)},
+	}
+	for _, testCase := range testCases {
+		config := buildConfiguration()
+		config.ForwardedHeaders = testCase.policy
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = "203.0.113.9:1234"
+		for name, values := range testCase.clientHeaders {
+			request.Header[name] = values
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Body.String() != testCase.expected {
+			t.Errorf("unexpected forwarding headers under policy %q with %d client headers\nexpected: %v\nreceived: %v",
+				testCase.policy, len(testCase.clientHeaders), testCase.expected, recorder.Body.String())
+		}
+	}
+
+	config := buildConfiguration()
+	config.ForwardedHeaders = "drop"
+	expectedError := `unknown forwarded header policy "drop"`
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,68 @@
+package proxyhandler
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// gzipRequestBody is a request body compressed as it is read. Closing it
+// stops the compression and closes the original body.
+type gzipRequestBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+func (body *gzipRequestBody) Close() error {
+	body.PipeReader.Close()
+	return body.body.Close()
+}
+
+// compressibleType reports whether bodies of the media type are text which
+// gzip shrinks, as opposed to media which is already compressed.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressRequestBody gzips the body of request on its way upstream when the
+// route's CompressRequests allows, reporting whether it did. The body is
+// compressed as it is sent, so the request loses its Content-Length and is
+// sent chunked. The compressing goroutine runs until the body has been read
+// or closed, so the caller must close it when the request is not sent.
+func (route *validRouteRule) compressRequestBody(request *http.Request) bool {
+	if route.CompressRequests == 0 || request.Body == nil || request.Body == http.NoBody {
+		return false
+	}
+	if request.Header.Get("Content-Encoding") != "" || !compressibleType(request.Header.Get("Content-Type")) {
+		return false
+	}
+	if request.ContentLength >= 0 && request.ContentLength <= route.CompressRequests {
+		return false
+	}
+	body := request.Body
+	reader, writer := io.Pipe()
+	go func() {
+		compressor := gzip.NewWriter(writer)
+		_, err := io.Copy(compressor, body)
+		if err == nil {
+			err = compressor.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	request.Body = &gzipRequestBody{reader, body}
+	request.ContentLength = -1
+	request.Header.Del("Content-Length")
+	request.Header.Set("Content-Encoding", "gzip")
+	return true
+}
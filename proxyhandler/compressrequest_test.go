@@ -0,0 +1,160 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestBodiesAreCompressed(t *testing.T) {
+	large := `{"blob":"` + strings.Repeat("abcdefgh", 256) + `"}`
+	small := `{"blob":"abc"}`
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		unknown     bool
+		compressed  bool
+	}{
+		{name: "large json", contentType: "application/json", body: large, compressed: true},
+		{name: "unknown length", contentType: "text/plain; charset=utf-8", body: small, unknown: true, compressed: true},
+		{name: "small json", contentType: "application/json", body: small},
+		{name: "already encoded", contentType: "application/json", encoding: "br", body: large},
+		{name: "incompressible", contentType: "image/png", body: large},
+	}
+	for _, mode := range proxyModes {
+		for _, test := range tests {
+			t.Run(mode.name+"/"+test.name, func(t *testing.T) {
+				beforeTest()
+				defer afterTest()
+				log.SetOutput(ioutil.Discard)
+				defer log.SetOutput(os.Stderr)
+
+				var received *http.Request
+				var receivedBody []byte
+				httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+					received = r
+					receivedBody, _ = io.ReadAll(r.Body)
+					return httpmock.NewStringResponse(200, "ok"), nil
+				})
+				config := buildConfiguration()
+				config.StdlibProxy = mode.stdlib
+				config.Routes[0].CompressRequests = 64
+				h, err := New(config)
+				if err != nil {
+					t.Fatalf("unable to create proxyhandler: %s", err.Error())
+				}
+				var body io.Reader = strings.NewReader(test.body)
+				if test.unknown {
+					body = io.MultiReader(body)
+				}
+				request := httptest.NewRequest("POST", "/route1", body)
+				if test.unknown {
+					request.ContentLength = -1
+				}
+				request.Header.Set("Content-Type", test.contentType)
+				if test.encoding != "" {
+					request.Header.Set("Content-Encoding", test.encoding)
+				}
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, request)
+				if recorder.Code != http.StatusOK || received == nil {
+					t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+				}
+
+				if !test.compressed {
+					if encoding := received.Header.Get("Content-Encoding"); encoding != test.encoding {
+						t.Errorf("unexpected Content-Encoding\nexpected: %q\nreceived: %q", test.encoding, encoding)
+					}
+					if received.ContentLength != int64(len(test.body)) || string(receivedBody) != test.body {
+						t.Errorf("expected the body to pass through unchanged\nexpected: %d bytes\nreceived: %d bytes (Content-Length %d)", len(test.body), len(receivedBody), received.ContentLength)
+					}
+					return
+				}
+				if encoding := received.Header.Get("Content-Encoding"); encoding != "gzip" {
+					t.Errorf("unexpected Content-Encoding\nexpected: %q\nreceived: %q", "gzip", encoding)
+				}
+				if received.ContentLength != -1 || received.Header.Get("Content-Length") != "" {
+					t.Errorf("expected the compressed body to have no Content-Length\nreceived: %d", received.ContentLength)
+				}
+				reader, err := gzip.NewReader(bytes.NewReader(receivedBody))
+				if err != nil {
+					t.Fatalf("expected a gzip stream: %s", err.Error())
+				}
+				decompressed, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("unable to decompress the body: %s", err.Error())
+				}
+				if string(decompressed) != test.body {
+					t.Errorf("unexpected decompressed body\nexpected: %q\nreceived: %q", test.body, decompressed)
+				}
+				if test.body == large && len(receivedBody) >= len(large) {
+					t.Errorf("expected the body to shrink\nreceived: %d of %d bytes", len(receivedBody), len(large))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressRequestsValidation(t *testing.T) {
+	route := RouteRule{Path: "/", Endpoint: "http://one", CompressRequests: -1}
+	expectedError := "request compression threshold is negative"
+	if _, err := route.validate(); err == nil || err.Error() != expectedError {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+// closeRecordingBody reports when it is closed.
+type closeRecordingBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (body *closeRecordingBody) Close() error {
+	close(body.closed)
+	return nil
+}
+
+func TestCompressedBodyIsClosedWhenNotSent(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/upload", Endpoint: "http://upload", CompressRequests: 1, Director: func(request *http.Request) {
+			panic("director failed")
+		}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	body := &closeRecordingBody{Reader: strings.NewReader(strings.Repeat("abcdefgh", 1024)), closed: make(chan struct{})}
+	request := httptest.NewRequest("POST", "/upload", nil)
+	request.Body = body
+	request.ContentLength = -1
+	request.Header.Set("Content-Type", "text/plain")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusInternalServerError, recorder.Code)
+	}
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Error("expected the body to be closed once the request failed")
+	}
+}
@@ -0,0 +1,92 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// readConfigFile decodes the Snapshot held as JSON in the file at path.
+// Fields which a Snapshot does not have are refused, so that a misspelled
+// setting is not silently ignored.
+func readConfigFile(path string) (Snapshot, error) {
+	var snapshot Snapshot
+	file, err := os.Open(path)
+	if err != nil {
+		return snapshot, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&snapshot); err != nil {
+		return snapshot, fmt.Errorf("decoding %s: %s", path, err.Error())
+	}
+	return snapshot, nil
+}
+
+// ReloadConfigFile replaces the routing of the ProxyHandler with that in the
+// file at path, which holds a Snapshot encoded as JSON. The file is applied
+// atomically, as Restore applies a Snapshot, and on error the existing routes
+// are kept. Changes are reported to the RouteChangeHook labeled "file" and
+// the path.
+func (handler *ProxyHandler) ReloadConfigFile(path string) error {
+	snapshot, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	return handler.restore("file "+path, snapshot)
+}
+
+// WatchConfigFile reloads the file at path with ReloadConfigFile whenever the
+// process receives one of signals, or SIGHUP when none are given. Each reload
+// is logged, as is a file which fails to load, in which case the existing
+// routes are kept. The file is checked when watching begins, and an error is
+// returned if it cannot be read or decoded. Calling stop, or closing the
+// handler, ends the watch; stop returns once no further reload can begin.
+func (handler *ProxyHandler) WatchConfigFile(path string, signals ...os.Signal) (stop func(), err error) {
+	if _, err := readConfigFile(path); err != nil {
+		return nil, err
+	}
+	handler.lifecycleMutex.Lock()
+	defer handler.lifecycleMutex.Unlock()
+	if handler.closed {
+		return nil, errClosed
+	}
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-received:
+				if err := handler.ReloadConfigFile(path); err != nil {
+					log.Printf("proxy: keeping routes, reloading %s failed: %s", path, err.Error())
+					continue
+				}
+				log.Printf("proxy: reloaded routes from %s", path)
+			}
+		}
+	}()
+
+	var stopOnce sync.Once
+	stop = func() {
+		stopOnce.Do(func() {
+			signal.Stop(received)
+			close(done)
+			<-stopped
+		})
+	}
+	handler.watches = append(handler.watches, stop)
+	return stop, nil
+}
@@ -0,0 +1,53 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// awaitRoutes waits for the routes of h to become expected.
+func awaitRoutes(t *testing.T, h *ProxyHandler, expected []RouteRule) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(h.Routes(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("routes not reloaded\nexpected: %v\nreceived: %v", expected, h.Routes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchConfigFileReloadsOnSignal(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	path := writeConfigFile(t, `{"DefaultRoute": "http://default.endpoint", "Routes": [{"Path": "/route2", "Endpoint": "http://endpoint.two"}]}`)
+	stop, err := h.WatchConfigFile(path)
+	if err != nil {
+		t.Fatalf("unable to watch config file: %s", err.Error())
+	}
+	defer stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	awaitRoutes(t, h, []RouteRule{{Path: "/route2", Endpoint: "http://endpoint.two"}})
+
+	// an invalid file leaves the routes in place until it is fixed
+	ioutil.WriteFile(path, []byte(`{"DefaultRoute": "http://default.endpoint", "Routes": []}`), 0600)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	time.Sleep(50 * time.Millisecond)
+	awaitRoutes(t, h, []RouteRule{{Path: "/route2", Endpoint: "http://endpoint.two"}})
+	ioutil.WriteFile(path, []byte(`{"DefaultRoute": "http://default.endpoint", "Routes": [{"Path": "/route3", "Endpoint": "http://endpoint.three"}]}`), 0600)
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	awaitRoutes(t, h, []RouteRule{{Path: "/route3", Endpoint: "http://endpoint.three"}})
+
+	// stopping waits for the watch to end and may be repeated
+	stop()
+	stop()
+}
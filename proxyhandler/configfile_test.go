@@ -0,0 +1,76 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes contents to a file in a temporary directory and
+// returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("unable to write config file: %s", err.Error())
+	}
+	return path
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var labels []string
+	config := buildConfiguration()
+	config.RouteChangeHook = func(change RouteChange) {
+		labels = append(labels, change.Label)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	path := writeConfigFile(t, `{"DefaultRoute": "http://default.endpoint", "Routes": [{"Path": "/route2", "Endpoint": "http://endpoint.two"}]}`)
+	if err := h.ReloadConfigFile(path); err != nil {
+		t.Fatalf("unable to reload config file: %s", err.Error())
+	}
+	expected := []RouteRule{{Path: "/route2", Endpoint: "http://endpoint.two"}}
+	if routes := h.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("unexpected routes\nexpected: %v\nreceived: %v", expected, routes)
+	}
+	expectedLabels := []string{"file " + path, "file " + path}
+	if !reflect.DeepEqual(labels, expectedLabels) {
+		t.Errorf("unexpected route change labels\nexpected: %v\nreceived: %v", expectedLabels, labels)
+	}
+
+	examples := map[string]string{
+		`{"DefaultRoute": "http://default.endpoint", "Routes": [{"Path": "", "Endpoint": "http://endpoint.three"}]}`: "path is empty",
+		`{"DefaultRoute": "http://default.endpoint", "Routes": [{"Paht": "/route3"}]}`:                               "unknown field",
+		`{"DefaultRoute": `: "decoding",
+	}
+	for contents, expectedError := range examples {
+		err := h.ReloadConfigFile(writeConfigFile(t, contents))
+		if err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+		if routes := h.Routes(); !reflect.DeepEqual(routes, expected) {
+			t.Errorf("expected routes to be kept\nexpected: %v\nreceived: %v", expected, routes)
+		}
+	}
+}
+
+func TestWatchConfigFileRequiresReadableFile(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	path := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := h.WatchConfigFile(path); !os.IsNotExist(err) {
+		t.Errorf("expected error for missing file\nexpected: %v\nreceived: %v", os.ErrNotExist, err)
+	}
+}
@@ -1,46 +1,685 @@
 package proxyhandler
 
 import (
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
-// Configuration controls the behavior of a newly created ProxyHandler.
-// DefaultRoute is a URL string which is the target of any requests
-// that are not matched to any RouteRules in Routes. Each inbound request
-// has its URL.Path matched against each of the RouteRule.Path in the order
-// listed. The RouteRule.Path will match if it has the prefix of the
-// request URL.Path.
+// Configuration controls the behavior of a newly created ProxyHandler. Each
+// inbound request is matched against Routes, or by Matcher, and requests
+// which match no route are sent to DefaultRoute.
 type Configuration struct {
+	// DefaultRoute is a URL string which is the target of any requests that
+	// are not matched to any RouteRules in Routes.
 	DefaultRoute string
-	Routes       []*RouteRule
+	// Routes are matched in the order listed against each inbound request's
+	// URL.Path, which a RouteRule.Path matches if it is a prefix of it.
+	Routes []*RouteRule
+	// Matcher, when set, replaces matching by Routes entirely: it chooses the
+	// Route of each request from those created with NewRoute, and requests it
+	// does not match go to DefaultRoute. Routes may then be empty.
+	Matcher Matcher
+
+	// MaxIdleConnsPerHost bounds the idle connections the single keep-alive
+	// transport shared by upstream requests keeps open to each upstream host,
+	// and defaults to DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerUpstream, when set, bounds all of the connections, active or
+	// idle, to each upstream host; further requests wait for a connection to
+	// become available.
+	MaxConnsPerUpstream int
+	// Transport, when set, replaces the handler's transport entirely.
+	Transport http.RoundTripper
+
+	// DialContext, when set, is used to establish every upstream connection,
+	// for example to resolve hosts through a custom DNS server. Otherwise
+	// connections are made by a net.Dialer.
+	DialContext DialContextFunc
+	// DialTimeout bounds the dialer's connection attempts and defaults to
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+	// TCPKeepAlive is the dialer's keep-alive period and defaults to
+	// DefaultTCPKeepAlive.
+	TCPKeepAlive time.Duration
+	// FallbackDelay is the dialer's wait for an IPv6 connection before racing
+	// an IPv4 one against it when a host has both, including hosts resolved
+	// under DNSCacheTTL or DNSRoundRobin; it defaults to 300ms, and a negative
+	// value disables the race so that addresses are tried one after another.
+	// RouteRule.DialNetwork confines a single route to one of the two.
+	FallbackDelay time.Duration
+
+	// OutboundProxy, when set, is the URL of an http, https or socks5 proxy
+	// through which upstream requests are sent, in place of any proxy named by
+	// the HTTP_PROXY and HTTPS_PROXY environment variables. Credentials for
+	// the proxy may be given as the URL's userinfo. RouteRule.OutboundProxy
+	// overrides it for a single route. It cannot be combined with Transport,
+	// which would not send requests through it.
+	OutboundProxy string
+
+	// ForceHTTPS upgrades DefaultRoute and the http endpoints of every route
+	// to https, as RouteRule.ForceHTTPS does for a single route, for backends
+	// which have come to require TLS while still registered with the http
+	// scheme.
+	ForceHTTPS bool
+
+	// TLSHandshakeTimeout bounds the TLS handshake with https upstreams and
+	// defaults to DefaultTLSHandshakeTimeout. A dial or TLS handshake timeout
+	// is answered with 502 Bad Gateway, and the error reported to the Observer
+	// and ErrorHandler wraps ErrDialTimeout or ErrTLSHandshakeTimeout. It does
+	// not apply when Transport is set.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for an upstream's response headers
+	// once the request is written, but not the time taken to stream the body;
+	// it is unlimited by default. Exceeding it is answered with 504 Gateway
+	// Timeout and the error reported wraps ErrResponseHeaderTimeout. It does
+	// not apply when Transport is set.
+	ResponseHeaderTimeout time.Duration
+
+	// MaxResponseHeaderBytes bounds the size of the headers accepted in an
+	// upstream response, defaulting to the http.Transport limit of 10 MB, and
+	// does not apply when Transport is set. Responses exceeding it are
+	// answered with 502 Bad Gateway, none of their headers reach the client,
+	// and the error reported wraps ErrResponseHeadersTooLarge.
+	// RouteRule.MaxResponseHeaderBytes overrides it for a single route.
+	MaxResponseHeaderBytes int64
+	// MaxResponseHeaders, when set, bounds the number of header fields of an
+	// upstream response, counting each value of a repeated field, as
+	// MaxResponseHeaderBytes bounds their size. RouteRule.MaxResponseHeaders
+	// overrides it for a single route.
+	MaxResponseHeaders int
+
+	// MaxUpstreamHeaderBytes, when set, bounds all of the headers of a request
+	// sent upstream, including those passed through from the client. The
+	// headers a route's ContextHeaders, SubdomainHeader and Director add are
+	// checked as well: their names and values must be valid and free of
+	// control characters. A request failing the checks is answered with 500
+	// Internal Server Error and the error reported, which names the rule at
+	// fault, wraps ErrInvalidUpstreamHeaders.
+	MaxUpstreamHeaderBytes int
+	// MaxUpstreamHeaderValueBytes, when set, bounds each header added to an
+	// upstream request by a route's ContextHeaders, SubdomainHeader and
+	// Director, counting all of its values, checked as MaxUpstreamHeaderBytes
+	// describes.
+	MaxUpstreamHeaderValueBytes int
+
+	// MaxURLLength, when set, answers a request whose target, path and query
+	// together, is longer than that many bytes with 414 URI Too Long before it
+	// is routed or an upstream contacted. The refusal is logged with the
+	// client's address and the URL, truncated.
+	MaxURLLength int
+	// MaxRequestHeaderBytes, when set, answers a request whose header fields,
+	// including Host, exceed that many bytes with 431 Request Header Fields
+	// Too Large, as MaxURLLength does. Servers started by the handler refuse
+	// headers beyond MaxHeaderBytes before the handler sees them, so it
+	// matters only below that.
+	MaxRequestHeaderBytes int
+
+	// DNSCacheTTL enables caching of upstream hostname lookups for the given
+	// duration. It applies to the handler's dialer but not to per-route
+	// DialContext overrides.
+	DNSCacheTTL time.Duration
+	// DNSRoundRobin spreads new connections across every address of an
+	// upstream host instead of always preferring the first, trying addresses
+	// that recently failed last. It applies to the handler's dialer but not
+	// to per-route DialContext overrides.
+	DNSRoundRobin bool
+	// Resolver makes the lookups of DNSCacheTTL and DNSRoundRobin, and
+	// defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	// ExpandEnv enables expansion of $VAR and ${VAR} references in
+	// DefaultRoute, OutboundProxy and the Endpoint, Endpoints,
+	// EndpointTemplate, SplitEndpoint, CanaryEndpoint and OutboundProxy of
+	// every RouteRule before they are parsed. An unset variable is a
+	// configuration error, and "$$" expands to a literal "$".
+	ExpandEnv bool
+	// LookupEnv looks up the variables of ExpandEnv and defaults to
+	// os.LookupEnv.
+	LookupEnv func(key string) (string, bool)
+
+	// Observer, when set, is called with an Observation after every proxied
+	// HTTP request.
+	Observer func(*Observation)
+	// ClientTrace, when set, is called with every request sent upstream,
+	// including retries, hedges and warm-ups, and the trace it returns is
+	// attached to that request so that its DNS, connection, TLS and response
+	// phases can be timed.
+	ClientTrace func(*http.Request) *httptrace.ClientTrace
+	// Random supplies the numbers in [0, 1) used for traffic splitting and
+	// retry jitter and defaults to math/rand.Float64; it must be safe for
+	// concurrent use.
+	Random func() float64
+
+	// MaxInFlight, when set, bounds the requests served at once. Requests
+	// beyond it and MaxQueued are refused at once with 503 Service Unavailable
+	// and a Retry-After of one second, shedding load rather than queueing it
+	// without bound. A websocket request gives its slot back once the upgrade
+	// succeeds, so long-lived tunnels do not count against the bound; they
+	// remain in InFlight and in the InFlight of Stats.
+	MaxInFlight int
+	// MaxQueued is the number of requests beyond MaxInFlight which wait for
+	// one to finish.
+	MaxQueued int
+	// QueueTimeout, when set, bounds the wait of a queued request, which is
+	// refused once it passes.
+	QueueTimeout time.Duration
+
+	// DrainDelay, when set, closes idle upstream connections that long after a
+	// change to the routing leaves no route referring to their host, so that
+	// connections to removed backends do not linger in the pool. Idle
+	// connections to the hosts still in use are closed along with them.
+	DrainDelay time.Duration
+
+	// ExpvarPrefix, when set, publishes the handler's counters as an
+	// expvar.Map of that name: "requests", "errors", "retries", "bytes_in" and
+	// "bytes_out" total those of Stats, "routes" holds Stats itself,
+	// "in_flight" and "queued" count the requests being served and waiting
+	// under MaxInFlight, and "shed" counts those refused by it. A handler
+	// created with the prefix of an earlier one takes its place in the map.
+	ExpvarPrefix string
+	// ExpvarMap publishes the counters of ExpvarPrefix in the given map
+	// instead, which need not be registered.
+	ExpvarMap *expvar.Map
+
+	// ErrorBudgetAlert, when set, calls a function once the share of a route's
+	// recent requests answered with a 5xx status crosses a threshold, and
+	// again once it recovers.
+	ErrorBudgetAlert *ErrorBudgetAlert
+
+	// RouteChangeHook, when set, is called with a RouteChange for every route
+	// added, removed or redirected once New has returned, including each route
+	// which differs after a Reload, and for every endpoint ejected from or
+	// readmitted to rotation by a route's OutlierDetection, labeled "outlier"
+	// and listing the endpoints in rotation. It is called synchronously, in
+	// the order the changes are made, while further changes wait, so it must
+	// not itself change the routing.
+	RouteChangeHook func(RouteChange)
+
+	// StdlibProxy delegates forwarding to an httputil.ReverseProxy configured
+	// with each route's rewriting, Director, ModifyResponse and status
+	// mapping, for comparison with the handler's own forwarding or to rely on
+	// the standard library's handling of cases such as 1xx informational
+	// responses. Features which only the handler's forwarding provides, namely
+	// retries with their attempt timeouts and headers, hedging, request body
+	// buffering and limits and debug dumps, are not applied.
+	StdlibProxy bool
+
+	// TrustedProxies lists the CIDR blocks, or single addresses, of proxies
+	// such as load balancers which sit in front of the handler. When it is
+	// set, the X-Forwarded-For header of a request arriving from a trusted
+	// proxy is walked from the right, and the first address which is not
+	// itself a trusted proxy is taken as the client; the hops before it are
+	// discarded. The resolved client is reported in Observation.ClientIP.
+	TrustedProxies []string
+	// ForwardedHeaders sets the policy for forwarding headers on requests
+	// which do not arrive from a trusted proxy. It defaults to
+	// ForwardedHeadersStrip, which discards them so that upstreams can rely on
+	// the values the proxy sets.
+	ForwardedHeaders ForwardedHeaderPolicy
+
+	// UserAgentPolicy sets how the User-Agent of forwarded requests is chosen.
+	// It defaults to UserAgentPassthrough, under which requests from clients
+	// which sent no User-Agent are forwarded without one, rather than with the
+	// transport's default.
+	UserAgentPolicy UserAgentPolicy
+	// UserAgent supplies the value used by UserAgentReplace and
+	// UserAgentAppend.
+	UserAgent string
+
+	// CallbackPanicLimit, when set, disables a route's Director or
+	// ModifyResponse once it has panicked that many times: the route's
+	// requests are then answered with 500 Internal Server Error without being
+	// forwarded, with an error wrapping ErrCallbackDisabled, until the route
+	// is registered again by AddRoute, Reload or a config file. A panic in
+	// either is always recovered, answered with a 500, logged and counted
+	// against the route in Stats.
+	CallbackPanicLimit int
+
+	// TimingHeaders adds X-Upstream-Latency and Server-Timing headers to
+	// proxied responses, reporting the time from sending the request upstream
+	// until its response headers arrived and the remainder of the time spent
+	// in the proxy before the response began. With retries, only the relayed
+	// attempt counts as upstream time. The handler has no response cache, so
+	// the timings always describe the request they are sent with.
+	TimingHeaders bool
+	// AttemptHeaders numbers each request sent upstream in an X-Retry-Attempt
+	// header, starting from 1, and reports the number of attempts made to the
+	// client in X-Proxy-Attempts. Every attempt, and any hedged copy, carries
+	// the X-Request-ID of the client's request, which is generated when the
+	// client did not send one, so that upstreams can tell retries from new
+	// requests.
+	AttemptHeaders bool
+	// QueueDurationHeader tells upstreams how long each request waited for a
+	// slot under MaxInFlight, in whole milliseconds, in an X-Queue-Duration-Ms
+	// header, so that those propagating deadlines can account for it.
+	// Requests which did not wait report 0.
+	QueueDurationHeader bool
+
+	// DebugDumpRate, between 0 and 1, is the fraction of proxied exchanges
+	// which are written to the log in full, as sent to and received from the
+	// upstream. Bodies are captured as they stream through the proxy, so
+	// dumping does not delay or alter them.
+	DebugDumpRate float64
+	// DebugDumpRedact names the headers whose values are replaced with
+	// "[REDACTED]" in debug dumps.
+	DebugDumpRedact []string
+	// DebugDumpBodyBytes is how much of each body a debug dump includes, and
+	// defaults to DefaultDebugDumpBodyBytes.
+	DebugDumpBodyBytes int64
+
+	// ReadHeaderTimeout configures the servers started by Serve and
+	// ListenAndServe, and defaults to DefaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout configures the servers started by Serve and ListenAndServe,
+	// and defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes configures the servers started by Serve and
+	// ListenAndServe, and defaults to DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// TLSServerConfig, when set, is the TLS configuration of servers started
+	// by ServeTLS and ListenAndServeTLS, for example to require client
+	// certificates.
+	TLSServerConfig *tls.Config
+
+	// RedirectStatus is the status used by RedirectHTTPHandler, either 301 or
+	// 308, and defaults to 308.
+	RedirectStatus int
+	// HSTSMaxAge, when positive, adds a Strict-Transport-Security header with
+	// that max-age to every response sent over TLS.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains adds the includeSubDomains directive to the
+	// header of HSTSMaxAge.
+	HSTSIncludeSubdomains bool
+	// HSTSPreload adds the preload directive to the header of HSTSMaxAge.
+	HSTSPreload bool
+
+	// WebSocketOrigins, when set, lists the origins, such as
+	// https://app.example.com, from which browsers may open websockets through
+	// ws routes. Upgrade requests from any other Origin are refused with 403
+	// Forbidden before the upstream is contacted. Requests without an Origin
+	// header are not from browsers and are always allowed.
+	WebSocketOrigins []string
+	// TunnelIdleTimeout, when positive, closes a websocket which carries no
+	// data in either direction for that long, unless its route sets an
+	// IdleTimeout of its own.
+	TunnelIdleTimeout time.Duration
+	// SecurityHeaders, when set, adds security headers such as
+	// X-Content-Type-Options to every proxied response, as described by
+	// SecurityHeaderConfig.
+	SecurityHeaders *SecurityHeaderConfig
+
+	// DevOverrideHeader, when set, names a request header with which a client
+	// may send a single HTTP request to one of DevOverrideTargets in place of
+	// the matched route's endpoint, for example to try a local backend.
+	// Requests naming any other target are refused with 403 Forbidden. The
+	// header is never forwarded upstream. Overridden requests are reported
+	// with the "override" variant. The feature is disabled when it is empty.
+	DevOverrideHeader string
+	// DevOverrideTargets lists the endpoints DevOverrideHeader may name.
+	DevOverrideTargets []string
+
+	// DebugHeaders reports how the handler served each request in headers of
+	// its response: X-Proxy-Route holds the Path of the matched route, or
+	// "default", and X-Proxy-Upstream the upstream the request was sent to,
+	// including overrides and the endpoint of a winning hedge.
+	DebugHeaders bool
+	// DebugToken, when set, limits DebugHeaders to requests sending it in an
+	// X-Proxy-Debug header, so that they can be left enabled in production;
+	// the header is then never forwarded upstream.
+	DebugToken string
+
+	// ForwardNormalizedPath forwards the request path upstream as it was
+	// matched, with "." and ".." segments resolved and duplicate slashes
+	// collapsed, rather than as the client sent it. Routes are always matched
+	// against the normalized path, and a path which climbs above the root is
+	// rejected.
+	ForwardNormalizedPath bool
+
+	// ErrorFormats holds the templates with which errors generated by the
+	// proxy itself, such as 502 Bad Gateway when an upstream cannot be
+	// reached, are rendered, keyed by media type. The template best matching
+	// the request's Accept header is used, falling back to a plain text body.
+	// JSONErrorTemplate and HTMLErrorTemplate cover the common formats.
+	ErrorFormats map[string]ErrorTemplate
+	// ErrorHandler, when set, is called with a *ProxyError in place of
+	// ErrorFormats and is responsible for the whole response.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// DecompressForClients decodes gzip encoded upstream responses for clients
+	// which did not send an Accept-Encoding accepting gzip, streaming the
+	// decoded body and removing its Content-Encoding and Content-Length.
+	// Clients which accept gzip receive the compressed bytes unchanged, as do
+	// Range requests and partial content responses.
+	DecompressForClients bool
+
+	// BufferBodyBytes bounds how much of a request body is held so that it can
+	// be sent again when a route retries. Requests with longer bodies are sent
+	// once without retries. Buffering is disabled when it is zero.
+	BufferBodyBytes int64
+	// BufferBodyMemoryBytes is how much of a buffered body is held in memory,
+	// the rest going to a temporary file, and defaults to
+	// DefaultBufferBodyMemoryBytes.
+	BufferBodyMemoryBytes int64
+
+	// CopyBufferSize is the size of the pooled buffers request and response
+	// bodies are copied through, and defaults to DefaultCopyBufferSize.
+	CopyBufferSize int
+
+	// MethodNotAllowed answers 405 Method Not Allowed, with an Allow header
+	// listing the permitted methods, when a request's path matches only routes
+	// restricted to other methods. By default such requests go to
+	// DefaultRoute.
+	MethodNotAllowed bool
+	// AllowTrace lets TRACE requests through to upstreams. By default they are
+	// answered with 405 Method Not Allowed, whichever route they match, unless
+	// the route lists TRACE in its AllowedMethods.
+	AllowTrace bool
 }
 
 type validConfiguration struct {
-	DefaultRoute *url.URL
-	Routes       []*validRouteRule
+	DefaultRoute   *url.URL
+	Routes         []*validRouteRule
+	Transport      http.RoundTripper
+	DNSCache       *dnsCache
+	TrustedProxies []*net.IPNet
+
+	DevOverrideTargets []*url.URL
+	WebSocketOrigins   []string
+}
+
+// ValidateConfiguration checks config as New does, but rather than stopping
+// at the first problem it returns every problem found with the routing, each
+// naming the index and path of the RouteRule concerned. Problems with the
+// handler's other settings are reported first, one at a time. It returns nil
+// for a valid Configuration.
+func ValidateConfiguration(config *Configuration) []error {
+	var errs []error
+	validConfig, err := config.validateSettings()
+	transport := config.Transport
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+		if transport == nil {
+			transport = newTransport(config, nil, nil)
+		}
+	default:
+		transport = validConfig.Transport
+	}
+	_, _, routeErrs := config.validateRouteList(transport)
+	return append(errs, routeErrs...)
 }
 
 func (config *Configuration) validate() (*validConfiguration, error) {
+	validConfig, err := config.validateSettings()
+	if err != nil {
+		return nil, err
+	}
+	validConfig.DefaultRoute, validConfig.Routes, err = config.validateRoutes(validConfig.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return validConfig, nil
+}
+
+// validateSettings validates the parts of a Configuration other than its
+// routing, preparing the transport the routes share.
+func (config *Configuration) validateSettings() (*validConfiguration, error) {
 	var err error
 	var validConfig = &validConfiguration{}
-	if len(config.DefaultRoute) == 0 {
-		return nil, fmt.Errorf("default route is missing")
+	if config.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("max idle connections per host is negative")
+	}
+	if config.MaxConnsPerUpstream < 0 {
+		return nil, fmt.Errorf("max connections per upstream is negative")
+	}
+	if config.DialTimeout < 0 || config.TCPKeepAlive < 0 {
+		return nil, fmt.Errorf("dial timeouts must not be negative")
+	}
+	if config.TLSHandshakeTimeout < 0 || config.ResponseHeaderTimeout < 0 {
+		return nil, fmt.Errorf("upstream timeouts must not be negative")
+	}
+	if config.MaxResponseHeaderBytes < 0 || config.MaxResponseHeaders < 0 {
+		return nil, fmt.Errorf("response header limits must not be negative")
+	}
+	if config.MaxUpstreamHeaderBytes < 0 || config.MaxUpstreamHeaderValueBytes < 0 {
+		return nil, fmt.Errorf("upstream header limits must not be negative")
+	}
+	if config.MaxURLLength < 0 || config.MaxRequestHeaderBytes < 0 {
+		return nil, fmt.Errorf("request limits must not be negative")
+	}
+	if config.BufferBodyBytes < 0 || config.BufferBodyMemoryBytes < 0 {
+		return nil, fmt.Errorf("body buffer sizes must not be negative")
+	}
+	if config.DebugDumpRate < 0 || config.DebugDumpRate > 1 {
+		return nil, fmt.Errorf("debug dump rate %v is not between 0 and 1", config.DebugDumpRate)
+	}
+	if config.CallbackPanicLimit < 0 {
+		return nil, fmt.Errorf("callback panic limit is negative")
+	}
+	if config.DebugToken != "" && !config.DebugHeaders {
+		return nil, fmt.Errorf("debug token set without debug headers")
+	}
+	if config.DebugDumpBodyBytes < 0 {
+		return nil, fmt.Errorf("debug dump body size is negative")
+	}
+	if config.MaxInFlight < 0 || config.MaxQueued < 0 || config.QueueTimeout < 0 {
+		return nil, fmt.Errorf("in-flight limits must not be negative")
+	}
+	if config.MaxInFlight == 0 && (config.MaxQueued != 0 || config.QueueTimeout != 0) {
+		return nil, fmt.Errorf("request queueing requires MaxInFlight")
 	}
-	validConfig.DefaultRoute, err = url.Parse(config.DefaultRoute)
+	if config.DrainDelay < 0 {
+		return nil, fmt.Errorf("drain delay is negative")
+	}
+	if config.ReadHeaderTimeout < 0 || config.IdleTimeout < 0 || config.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("server limits must not be negative")
+	}
+	if err := validateRedirectStatus(config.RedirectStatus); err != nil {
+		return nil, err
+	}
+	if config.SecurityHeaders != nil {
+		if err := config.SecurityHeaders.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.ErrorBudgetAlert != nil {
+		if err := config.ErrorBudgetAlert.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.TunnelIdleTimeout < 0 {
+		return nil, fmt.Errorf("tunnel idle timeout is negative")
+	}
+	if config.HSTSMaxAge < 0 {
+		return nil, fmt.Errorf("hsts max age is negative")
+	}
+	if config.HSTSMaxAge == 0 && (config.HSTSIncludeSubdomains || config.HSTSPreload) {
+		return nil, fmt.Errorf("hsts directives require a max age")
+	}
+	if config.CopyBufferSize < 0 {
+		return nil, fmt.Errorf("copy buffer size is negative")
+	}
+	if err := validateErrorFormats(config.ErrorFormats); err != nil {
+		return nil, err
+	}
+	if config.DNSCacheTTL < 0 {
+		return nil, fmt.Errorf("dns cache ttl is negative")
+	}
+	if err := config.ForwardedHeaders.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.validateUserAgent(); err != nil {
+		return nil, err
+	}
+	validConfig.DevOverrideTargets, err = config.validateDevOverrides()
 	if err != nil {
-		return nil, fmt.Errorf("invalid default route: %s", err.Error())
+		return nil, err
 	}
-	if len(config.Routes) == 0 {
-		return nil, fmt.Errorf("no configured routes")
+	validConfig.WebSocketOrigins, err = parseWebSocketOrigins(config.WebSocketOrigins)
+	if err != nil {
+		return nil, err
+	}
+	validConfig.TrustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	outboundProxy, err := config.expandEnv(config.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	outboundProxyURL, err := parseOutboundProxy(outboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	if outboundProxyURL != nil && config.Transport != nil {
+		return nil, fmt.Errorf("outbound proxy cannot be combined with a custom transport")
 	}
-	validConfig.Routes = make([]*validRouteRule, len(config.Routes))
+	validConfig.Transport = config.Transport
+	if validConfig.Transport == nil {
+		validConfig.DNSCache = newConfiguredDNSCache(config)
+		validConfig.Transport = newTransport(config, outboundProxyURL, validConfig.DNSCache)
+	}
+	return validConfig, nil
+}
+
+// validateRoutes validates DefaultRoute and Routes, which are the parts of a
+// Configuration that may be replaced after the ProxyHandler is created. Every
+// problem found is reported, joined into a single error.
+func (config *Configuration) validateRoutes(transport http.RoundTripper) (*url.URL, []*validRouteRule, error) {
+	defaultRouteURL, routes, errs := config.validateRouteList(transport)
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return defaultRouteURL, routes, nil
+}
+
+// validateRouteList validates DefaultRoute and each of the Routes, returning
+// every problem found.
+func (config *Configuration) validateRouteList(transport http.RoundTripper) (*url.URL, []*validRouteRule, []error) {
+	var errs []error
+	var defaultRouteURL *url.URL
+	if len(config.DefaultRoute) == 0 {
+		errs = append(errs, fmt.Errorf("default route is missing"))
+	} else if defaultRoute, err := config.expandEnv(config.DefaultRoute); err != nil {
+		errs = append(errs, fmt.Errorf("invalid default route: %w", err))
+	} else if defaultRouteURL, err = parseEndpoint(defaultRoute); err != nil {
+		errs = append(errs, fmt.Errorf("invalid default route: %w", err))
+	} else if config.ForceHTTPS {
+		defaultRouteURL = upgradeToHTTPS(defaultRouteURL)
+	}
+	if len(config.Routes) == 0 && config.Matcher == nil {
+		return nil, nil, append(errs, fmt.Errorf("no configured routes"))
+	}
+	routes := make([]*validRouteRule, len(config.Routes))
+	seen := make(map[string]int)
 	for index, route := range config.Routes {
-		validRoute, err := route.validate()
+		if route == nil {
+			errs = append(errs, fmt.Errorf("invalid RouteRule %d: route is nil", index))
+			continue
+		}
+		validRoute, err := config.validateRoute(*route, transport)
 		if err != nil {
-			return nil, fmt.Errorf("invalid RouteRule: %s", err.Error())
+			errs = append(errs, fmt.Errorf("invalid RouteRule %d (%s): %w", index, route.Path, err))
+			continue
 		}
-		validConfig.Routes[index] = validRoute
+		if previous, ok := seen[validRoute.matchKey()]; ok {
+			errs = append(errs, fmt.Errorf("invalid RouteRule %d (%s): duplicates RouteRule %d, so is never matched", index, route.Path, previous))
+			continue
+		}
+		seen[validRoute.matchKey()] = index
+		routes[index] = validRoute
 	}
-	return validConfig, nil
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return defaultRouteURL, routes, nil
+}
+
+// validateRoute expands and validates route as part of this Configuration,
+// preparing a dedicated client for it if it cannot share transport. A
+// dedicated transport is only built once the route is first used.
+func (config *Configuration) validateRoute(route RouteRule, transport http.RoundTripper) (*validRouteRule, error) {
+	validRoute, err := config.expandRoute(route)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareRouteClient(validRoute, transport); err != nil {
+		return nil, err
+	}
+	return validRoute, nil
+}
+
+// expandRoute expands and validates route as validateRoute does, without
+// preparing its client.
+func (config *Configuration) expandRoute(route RouteRule) (*validRouteRule, error) {
+	expandedRoute := route
+	expandedRoute.Endpoints = append([]string(nil), route.Endpoints...)
+	fields := []*string{&expandedRoute.Endpoint, &expandedRoute.EndpointTemplate, &expandedRoute.SplitEndpoint,
+		&expandedRoute.CanaryEndpoint, &expandedRoute.OutboundProxy}
+	for index := range expandedRoute.Endpoints {
+		fields = append(fields, &expandedRoute.Endpoints[index])
+	}
+	for _, field := range fields {
+		expanded, err := config.expandEnv(*field)
+		if err != nil {
+			return nil, err
+		}
+		*field = expanded
+	}
+	expandedRoute.ForceHTTPS = route.ForceHTTPS || config.ForceHTTPS
+	validRoute, err := expandedRoute.validate()
+	if err != nil {
+		return nil, err
+	}
+	// the handler's OutboundProxy was expanded and validated with the settings
+	if outboundProxy, _ := config.expandEnv(config.OutboundProxy); route.ProxyProtocol != 0 && outboundProxy != "" {
+		return nil, fmt.Errorf("proxy protocol cannot be sent through the handler's outbound proxy")
+	}
+	if route.Signer != nil && config.BufferBodyBytes == 0 {
+		return nil, fmt.Errorf("request signing requires BufferBodyBytes")
+	}
+	// keep the endpoints as configured; EndpointURLs and the like hold the
+	// expanded form, upgraded to https under ForceHTTPS, while the template is
+	// filled in expanded
+	validRoute.Endpoint = route.Endpoint
+	validRoute.Endpoints = route.Endpoints
+	validRoute.SplitEndpoint = route.SplitEndpoint
+	validRoute.CanaryEndpoint = route.CanaryEndpoint
+	validRoute.OutboundProxy = route.OutboundProxy
+	validRoute.ForceHTTPS = route.ForceHTTPS
+	return validRoute, nil
+}
+
+func (config *Configuration) expandEnv(endpoint string) (string, error) {
+	if !config.ExpandEnv {
+		return endpoint, nil
+	}
+	lookupEnv := config.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	var unset []string
+	expanded := os.Expand(endpoint, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("unset environment variable %s in %q", strings.Join(unset, ", "), endpoint)
+	}
+	return expanded, nil
 }
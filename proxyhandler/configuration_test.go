@@ -1,16 +1,24 @@
 package proxyhandler
 
 import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 )
 
+// buildConfiguration returns a valid Configuration whose upstream requests are
+// served by httpmock. Tests against real servers should clear Transport.
 func buildConfiguration() *Configuration {
 	return &Configuration{
 		DefaultRoute: "http://default.endpoint",
 		Routes: []*RouteRule{
 			&RouteRule{Path: "/route1", Endpoint: "http://endpoint.one"},
 		},
+		Transport: httpmock.DefaultTransport,
 	}
 }
 
@@ -54,6 +62,57 @@ func TestValidationChecksRoutesArePresent(t *testing.T) {
 	}
 }
 
+func TestValidateConfigurationReportsEveryRouteError(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/good", Endpoint: "http://good"},
+		&RouteRule{Path: "", Endpoint: "http://good"},
+		&RouteRule{Path: "/unparsable", Endpoint: "http://bad host"},
+		&RouteRule{Path: "/scheme", Endpoint: "ftp://good"},
+		&RouteRule{Path: "/good", Endpoint: "http://other"},
+		&RouteRule{Path: "/get", Methods: []string{"GET"}, Endpoint: "http://good"},
+		&RouteRule{Path: "/canary", Endpoint: "http://good", CanaryEndpoint: "http://canary"},
+	}
+	expected := []string{
+		"RouteRule 1 (): path is empty",
+		"RouteRule 2 (/unparsable):",
+		"RouteRule 3 (/scheme):",
+		"RouteRule 4 (/good): duplicates RouteRule 0",
+		"RouteRule 6 (/canary): canary endpoint requires a canary matcher",
+	}
+
+	errs := ValidateConfiguration(config)
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected number of errors\nexpected: %v\nreceived: %v", len(expected), errs)
+	}
+	for index, err := range errs {
+		if !strings.Contains(err.Error(), expected[index]) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expected[index], err.Error())
+		}
+	}
+
+	_, err := New(config)
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	for _, message := range expected {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", message, err.Error())
+		}
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != len(expected) {
+		t.Errorf("expected the route errors to be wrapped individually\nreceived: %#v", err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr.URL != "http://bad host" {
+		t.Errorf("expected the unparsable endpoint's error to be reachable\nreceived: %v", urlErr)
+	}
+	if errs := ValidateConfiguration(buildConfiguration()); errs != nil {
+		t.Errorf("expected a valid configuration\nreceived: %v", errs)
+	}
+}
+
 func TestValidationDetectsInvalidRouteRules(t *testing.T) {
 	expectedError := "invalid RouteRule"
 	config := buildConfiguration()
@@ -99,3 +158,84 @@ func TestValidationChecksDefaultRouteIsValid(t *testing.T) {
 		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
 	}
 }
+
+func TestValidationBuildsDefaultTransport(t *testing.T) {
+	config := buildConfiguration()
+	config.Transport = nil
+	config.MaxIdleConnsPerHost = 5
+
+	validConfig, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	transport, ok := validConfig.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected an *http.Transport to be built\nreceived: %T", validConfig.Transport)
+	}
+	if transport.MaxIdleConnsPerHost != 5 {
+		t.Errorf("unexpected idle connection limit\nexpected: %v\nreceived: %v", 5, transport.MaxIdleConnsPerHost)
+	}
+}
+
+func TestValidationExpandsEnvironmentVariables(t *testing.T) {
+	environment := map[string]string{"BILLING_HOST": "billing.internal", "BILLING_PORT": "9000", "DEFAULT_HOST": "fallback"}
+	config := buildConfiguration()
+	config.ExpandEnv = true
+	config.LookupEnv = func(key string) (string, bool) {
+		value, ok := environment[key]
+		return value, ok
+	}
+	config.DefaultRoute = "http://${DEFAULT_HOST}"
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/billing", Endpoint: "http://$BILLING_HOST:$BILLING_PORT/pa$$word"},
+		&RouteRule{
+			Path:           "/checkout",
+			Endpoint:       "http://${DEFAULT_HOST}",
+			SplitEndpoint:  "http://${BILLING_HOST}:${BILLING_PORT}/split",
+			SplitRatio:     0.5,
+			CanaryEndpoint: "http://${BILLING_HOST}/canary",
+			CanaryMatcher:  func(*http.Request) bool { return false },
+			OutboundProxy:  "http://${DEFAULT_HOST}:3128",
+		},
+	}
+
+	validConfig, err := config.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	checkout := validConfig.Routes[1]
+	expected := []string{"http://billing.internal:9000/split", "http://billing.internal/canary", "http://fallback:3128"}
+	received := []string{checkout.SplitEndpointURL.String(), checkout.CanaryEndpointURL.String(), checkout.outboundProxyURL.String()}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("unexpected split, canary and outbound proxy URLs\nexpected: %v\nreceived: %v", expected, received)
+	}
+	if checkout.SplitEndpoint != config.Routes[1].SplitEndpoint || checkout.CanaryEndpoint != config.Routes[1].CanaryEndpoint {
+		t.Errorf("expected the configured endpoints to be kept\nreceived: %v %v", checkout.SplitEndpoint, checkout.CanaryEndpoint)
+	}
+	if validConfig.DefaultRoute.String() != "http://fallback" {
+		t.Errorf("unexpected default route\nexpected: %v\nreceived: %v", "http://fallback", validConfig.DefaultRoute.String())
+	}
+	expectedEndpoint := "http://billing.internal:9000/pa$word"
+	if validConfig.Routes[0].EndpointURL.String() != expectedEndpoint {
+		t.Errorf("unexpected endpoint\nexpected: %v\nreceived: %v", expectedEndpoint, validConfig.Routes[0].EndpointURL.String())
+	}
+}
+
+func TestValidationRejectsUnsetEnvironmentVariables(t *testing.T) {
+	expectedError := "unset environment variable BILLING_PORT"
+	config := buildConfiguration()
+	config.ExpandEnv = true
+	config.LookupEnv = func(key string) (string, bool) { return "billing.internal", key == "BILLING_HOST" }
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/billing", Endpoint: "http://$BILLING_HOST:$BILLING_PORT"},
+	}
+
+	_, err := config.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
@@ -0,0 +1,24 @@
+package proxyhandler
+
+import (
+	"mime"
+	"net/http"
+)
+
+// allowsContentType reports whether the route serves request according to
+// the media type of its Content-Type header.
+func (route *validRouteRule) allowsContentType(request *http.Request) bool {
+	if len(route.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, allowed := range route.contentTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
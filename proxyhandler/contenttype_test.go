@@ -0,0 +1,62 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentTypeRoutesDispatchUploads(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://fallback"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ingest", Endpoint: "http://streaming", ContentType: []string{"application/x-ndjson"}},
+		&RouteRule{Path: "/ingest", Endpoint: "http://files", ContentType: []string{"multipart/form-data"}},
+		&RouteRule{Path: "/ingest", Endpoint: "http://ingest"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	tests := []struct {
+		contentType []string
+		expected    string
+	}{
+		{[]string{"application/x-ndjson"}, "streaming"},
+		{[]string{"Application/X-NDJSON; charset=utf-8"}, "streaming"},
+		{[]string{"multipart/form-data; boundary=----frontier"}, "files"},
+		{[]string{"application/json"}, "ingest"},
+		{[]string{"multipart/form-data; boundary"}, "ingest"},
+		{[]string{"/"}, "ingest"},
+		{nil, "ingest"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", "/ingest", strings.NewReader("{}\n"))
+		request.Header["Content-Type"] = test.contentType
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("unexpected status for Content-Type %q\nexpected: %v\nreceived: %v", test.contentType, http.StatusOK, recorder.Code)
+		}
+		if received := recorder.Body.String(); received != test.expected {
+			t.Errorf("unexpected backend for Content-Type %q\nexpected: %v\nreceived: %v", test.contentType, test.expected, received)
+		}
+	}
+}
+
+func TestContentTypeMediaTypesAreValidated(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes[0].ContentType = []string{"multipart/form-data; boundary=x"}
+	if _, err := config.validate(); err == nil {
+		t.Error("expected a content type with parameters to be rejected")
+	}
+}
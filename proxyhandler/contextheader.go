@@ -0,0 +1,46 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ContextHeader sets the upstream request header Header from the value stored
+// under Key in the client request's context, such as a tenant ID placed there
+// by middleware in front of the handler. Format renders the value and
+// defaults to fmt.Sprint.
+type ContextHeader struct {
+	Header string
+	Key    interface{}
+	Format func(value interface{}) string
+}
+
+func (contextHeader *ContextHeader) validate() error {
+	if contextHeader.Header == "" {
+		return fmt.Errorf("context header name is empty")
+	}
+	if contextHeader.Key == nil {
+		return fmt.Errorf("context header %s has no key", contextHeader.Header)
+	}
+	return nil
+}
+
+// setContextHeaders sets the route's ContextHeaders on request from the
+// context of clientRequest. A header whose value is missing, or formats as an
+// empty string, is removed, so that clients cannot supply it themselves.
+func (route *validRouteRule) setContextHeaders(request *http.Request, clientRequest *http.Request) {
+	for _, contextHeader := range route.ContextHeaders {
+		request.Header.Del(contextHeader.Header)
+		value := clientRequest.Context().Value(contextHeader.Key)
+		if value == nil {
+			continue
+		}
+		text := fmt.Sprint(value)
+		if contextHeader.Format != nil {
+			text = contextHeader.Format(value)
+		}
+		if text != "" {
+			request.Header.Set(contextHeader.Header, text)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package proxyhandler
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type contextKey string
+
+func TestContextHeadersAreSetFromMiddlewareValues(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+
+	for _, mode := range proxyModes {
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/api", Endpoint: upstream.URL, ContextHeaders: []ContextHeader{
+				{Header: "X-Tenant", Key: contextKey("tenant")},
+				{Header: "X-Subject", Key: contextKey("subject"), Format: func(value interface{}) string {
+					return "user-" + strconv.Itoa(value.(int))
+				}},
+			}},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		// the middleware identifies the tenant from the host and the subject
+		// only for authenticated requests
+		middleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), contextKey("tenant"), strings.Split(r.Host, ".")[0])
+			if r.Header.Get("Authorization") != "" {
+				ctx = context.WithValue(ctx, contextKey("subject"), 42)
+			}
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+
+		request := httptest.NewRequest("GET", "http://acme.example/api", nil)
+		request.Header.Set("Authorization", "Bearer token")
+		middleware.ServeHTTP(httptest.NewRecorder(), request)
+		if received.Get("X-Tenant") != "acme" || received.Get("X-Subject") != "user-42" {
+			t.Errorf("%s: unexpected context headers\nexpected: %v %v\nreceived: %v %v", mode.name, "acme", "user-42", received.Get("X-Tenant"), received.Get("X-Subject"))
+		}
+
+		// a header supplied by the client is not trusted in place of a value
+		request = httptest.NewRequest("GET", "http://acme.example/api", nil)
+		request.Header.Set("X-Subject", "user-1")
+		middleware.ServeHTTP(httptest.NewRecorder(), request)
+		if _, ok := received["X-Subject"]; ok || received.Get("X-Tenant") != "acme" {
+			t.Errorf("%s: expected the missing value to omit its header\nreceived: %v", mode.name, received)
+		}
+	}
+}
+
+func TestContextHeaderValidation(t *testing.T) {
+	examples := map[string]ContextHeader{
+		"context header name is empty":       {Key: contextKey("tenant")},
+		"context header X-Tenant has no key": {Header: "X-Tenant"},
+	}
+	for expectedError, contextHeader := range examples {
+		route := RouteRule{Path: "/", Endpoint: "http://one", ContextHeaders: []ContextHeader{contextHeader}}
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+)
+
+// newRouteCookieJar returns the jar holding the cookies a route's endpoints
+// have set, or nil when the route does not keep them. Without a public suffix
+// list, each cookie is only sent back to the host which set it.
+func newRouteCookieJar(route *RouteRule) http.CookieJar {
+	if !route.CookieJar {
+		return nil
+	}
+	jar, _ := cookiejar.New(nil)
+	return jar
+}
+
+// addJarCookies adds the unexpired cookies the route's jar holds for the
+// upstream of request to it.
+func (route *validRouteRule) addJarCookies(request *http.Request) {
+	if route.jar == nil {
+		return
+	}
+	for _, cookie := range route.jar.Cookies(request.URL) {
+		request.AddCookie(cookie)
+	}
+}
+
+// keepJarCookies stores the cookies set by response in the route's jar and,
+// unless the route passes them through, removes them from the response so
+// that they do not reach the client.
+func (route *validRouteRule) keepJarCookies(response *http.Response) {
+	if route.jar == nil {
+		return
+	}
+	if cookies := response.Cookies(); len(cookies) > 0 && response.Request != nil {
+		route.jar.SetCookies(response.Request.URL, cookies)
+	}
+	if !route.CookieJarPassthrough {
+		response.Header.Del("Set-Cookie")
+	}
+}
@@ -0,0 +1,86 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRouteCookieJarKeepsUpstreamSession(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/logout") {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", MaxAge: -1})
+			return
+		}
+		if cookie, err := r.Cookie("session"); err == nil && cookie.Value == "abc" {
+			w.Write([]byte("welcome"))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	examples := []struct {
+		path     string
+		expected int
+	}{
+		{"/legacy/first", http.StatusUnauthorized},
+		{"/legacy/second", http.StatusOK},
+		{"/legacy/logout", http.StatusOK},
+		{"/legacy/third", http.StatusUnauthorized},
+		{"/stateless/first", http.StatusUnauthorized},
+		{"/stateless/second", http.StatusUnauthorized},
+	}
+	for _, mode := range proxyModes {
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/legacy", Endpoint: upstream.URL, CookieJar: true},
+			&RouteRule{Path: "/stateless", Endpoint: upstream.URL},
+			&RouteRule{Path: "/passthrough", Endpoint: upstream.URL, CookieJar: true, CookieJarPassthrough: true},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+
+		for _, example := range examples {
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", example.path, nil))
+			if recorder.Code != example.expected {
+				t.Errorf("%s %s: unexpected status\nexpected: %v\nreceived: %v", mode.name, example.path, example.expected, recorder.Code)
+			}
+			kept := strings.HasPrefix(example.path, "/legacy")
+			if cookie := recorder.Header().Get("Set-Cookie"); kept && cookie != "" {
+				t.Errorf("%s %s: jar cookie leaked to the client\nreceived: %v", mode.name, example.path, cookie)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/passthrough/first", nil))
+		if cookie := recorder.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "session=abc") {
+			t.Errorf("%s: expected the cookie to be passed through\nexpected: %v\nreceived: %v", mode.name, "session=abc", cookie)
+		}
+	}
+}
+
+func TestRouteCookieJarValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"not supported for websocket routes": RouteRule{Path: "/", Endpoint: "ws://one", CookieJar: true},
+		"requires a cookie jar":              RouteRule{Path: "/", Endpoint: "http://one", CookieJarPassthrough: true},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package proxyhandler
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// DefaultCopyBufferSize is the size of the buffers used to copy bodies when
+// the Configuration does not specify one.
+const DefaultCopyBufferSize = 32 * 1024
+
+// bufferPool shares fixed size buffers between body copies.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size == 0 {
+		size = DefaultCopyBufferSize
+	}
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, size)
+			return &buffer
+		},
+	}}
+}
+
+// copy copies src to dst through a pooled buffer, returning the buffer to the
+// pool however the copy ends.
+func (buffers *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := buffers.pool.Get().(*[]byte)
+	defer buffers.pool.Put(buffer)
+	return io.CopyBuffer(dst, src, *buffer)
+}
+
+// pooledBody lets the transport copy a request body through a pooled buffer,
+// as io.Copy prefers a source's WriteTo.
+type pooledBody struct {
+	io.ReadCloser
+	buffers *bufferPool
+}
+
+func (body *pooledBody) WriteTo(dst io.Writer) (int64, error) {
+	return body.buffers.copy(dst, body.ReadCloser)
+}
+
+// wrapBody makes request's body copy through the pool when it is sent.
+func (buffers *bufferPool) wrapBody(request *http.Request) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return
+	}
+	request.Body = &pooledBody{ReadCloser: request.Body, buffers: buffers}
+}
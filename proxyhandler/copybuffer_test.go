@@ -0,0 +1,61 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// onlyReader and onlyWriter hide WriteTo and ReadFrom so copies go through
+// the copy buffer.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+const benchmarkBodySize = 4 << 20
+
+func TestCopyReusesPooledBuffers(t *testing.T) {
+	buffers := newBufferPool(0)
+	body := bytes.Repeat([]byte("x"), 256*1024)
+	buffers.copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(body)})
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buffers.copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(body)})
+	})
+	// the reader and writer wrappers account for the remaining allocations
+	if allocs > 3 {
+		t.Errorf("expected pooled copies not to allocate buffers\nreceived: %v allocs per copy", allocs)
+	}
+}
+
+func TestPooledBodyCopiesThroughPool(t *testing.T) {
+	buffers := newBufferPool(16)
+	expected := bytes.Repeat([]byte("abc"), 100)
+	body := &pooledBody{ReadCloser: ioutil.NopCloser(onlyReader{bytes.NewReader(expected)}), buffers: buffers}
+	var received bytes.Buffer
+	if _, err := io.Copy(onlyWriter{&received}, body); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !bytes.Equal(received.Bytes(), expected) {
+		t.Errorf("unexpected body\nexpected: %s\nreceived: %s", expected, received.Bytes())
+	}
+}
+
+func BenchmarkBodyCopy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), benchmarkBodySize)
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(benchmarkBodySize)
+		for i := 0; i < b.N; i++ {
+			io.Copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(body)})
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		buffers := newBufferPool(0)
+		b.ReportAllocs()
+		b.SetBytes(benchmarkBodySize)
+		for i := 0; i < b.N; i++ {
+			buffers.copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(body)})
+		}
+	})
+}
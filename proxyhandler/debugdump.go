@@ -0,0 +1,185 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// DefaultDebugDumpBodyBytes is how much of each body a debug dump includes
+// when the Configuration does not specify a limit.
+const DefaultDebugDumpBodyBytes = 4096
+
+const redacted = "[REDACTED]"
+
+// exchangeDump collects a proxied exchange for logging. Bodies are captured
+// as they are streamed rather than read ahead, so dumping does not change
+// what the upstream or client receives. The mutex guards the capture, which
+// Close may log while the exchange is still in flight.
+type exchangeDump struct {
+	mutex        sync.Mutex
+	logged       bool
+	exchange     string
+	redact       []string
+	request      []byte
+	requestBody  *cappedBuffer
+	response     []byte
+	responseBody *cappedBuffer
+}
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit   int64
+	dropped int64
+}
+
+func (buffer *cappedBuffer) Write(data []byte) (int, error) {
+	room := buffer.limit - int64(buffer.Len())
+	if room < int64(len(data)) {
+		if room < 0 {
+			room = 0
+		}
+		buffer.dropped += int64(len(data)) - room
+		buffer.Buffer.Write(data[:room])
+		return len(data), nil
+	}
+	return buffer.Buffer.Write(data)
+}
+
+func (buffer *cappedBuffer) String() string {
+	if buffer.dropped > 0 {
+		return fmt.Sprintf("%s\n[%d more bytes truncated]", buffer.Buffer.String(), buffer.dropped)
+	}
+	return buffer.Buffer.String()
+}
+
+// teeBody copies what is read from a body into a cappedBuffer.
+type teeBody struct {
+	io.ReadCloser
+	copy *cappedBuffer
+	dump *exchangeDump
+}
+
+func (body *teeBody) Read(buffer []byte) (int, error) {
+	read, err := body.ReadCloser.Read(buffer)
+	body.dump.mutex.Lock()
+	body.copy.Write(buffer[:read])
+	body.dump.mutex.Unlock()
+	return read, err
+}
+
+// newDump returns an exchangeDump of request's exchange when it is sampled
+// for dumping, or nil otherwise. The dump is logged by finishDump, or by
+// Close if the exchange is still in flight then.
+func (handler *ProxyHandler) newDump(request *http.Request) *exchangeDump {
+	rate := handler.configuration.DebugDumpRate
+	if rate <= 0 || handler.random() >= rate {
+		return nil
+	}
+	dump := &exchangeDump{
+		exchange: fmt.Sprintf("%s %s", request.Method, request.URL.String()),
+		redact:   handler.configuration.DebugDumpRedact,
+	}
+	handler.dumps.Store(dump, struct{}{})
+	return dump
+}
+
+// finishDump logs dump once its exchange is over.
+func (handler *ProxyHandler) finishDump(dump *exchangeDump) {
+	if dump == nil {
+		return
+	}
+	handler.dumps.Delete(dump)
+	dump.log("")
+}
+
+// flushDumps logs the dumps of the exchanges still in flight, as far as they
+// have been captured, so that closing the handler does not lose them.
+func (handler *ProxyHandler) flushDumps() {
+	handler.dumps.Range(func(dump, _ interface{}) bool {
+		handler.dumps.Delete(dump)
+		dump.(*exchangeDump).log(" (incomplete)")
+		return true
+	})
+}
+
+func (handler *ProxyHandler) debugDumpBodyBytes() int64 {
+	if handler.configuration.DebugDumpBodyBytes == 0 {
+		return DefaultDebugDumpBodyBytes
+	}
+	return handler.configuration.DebugDumpBodyBytes
+}
+
+func (dump *exchangeDump) redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range dump.redact {
+		values := header.Values(name)
+		for index := range values {
+			values[index] = redacted
+		}
+	}
+	return header
+}
+
+// captureRequest records the header of request as it will be sent upstream
+// and arranges for its body to be captured as it is sent. A later attempt
+// replaces the capture of an earlier one.
+func (dump *exchangeDump) captureRequest(request *http.Request, limit int64) {
+	if dump == nil {
+		return
+	}
+	dumped := request.Clone(context.Background())
+	dumped.Header = dump.redactHeader(request.Header)
+	captured, _ := httputil.DumpRequestOut(dumped, false)
+	body := &cappedBuffer{limit: limit}
+	dump.mutex.Lock()
+	dump.request, dump.requestBody = captured, body
+	dump.mutex.Unlock()
+	if request.Body != nil && request.Body != http.NoBody {
+		request.Body = &teeBody{ReadCloser: request.Body, copy: body, dump: dump}
+	}
+}
+
+// captureResponse records the header of response and arranges for its body
+// to be captured as it is relayed.
+func (dump *exchangeDump) captureResponse(response *http.Response, limit int64) {
+	if dump == nil {
+		return
+	}
+	dumped := *response
+	dumped.Header = dump.redactHeader(response.Header)
+	captured, _ := httputil.DumpResponse(&dumped, false)
+	body := &cappedBuffer{limit: limit}
+	dump.mutex.Lock()
+	dump.response, dump.responseBody = captured, body
+	dump.mutex.Unlock()
+	response.Body = &teeBody{ReadCloser: response.Body, copy: body, dump: dump}
+}
+
+// log writes the captured exchange to the log, noting after its name any
+// state it was captured in, once. Later calls do nothing.
+func (dump *exchangeDump) log(state string) {
+	dump.mutex.Lock()
+	if dump.logged || dump.request == nil {
+		dump.mutex.Unlock()
+		return
+	}
+	dump.logged = true
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "proxy: dump of %s%s\n", dump.exchange, state)
+	output.Write(dump.request)
+	output.WriteString(dump.requestBody.String())
+	if dump.response != nil {
+		output.WriteString("\n\n")
+		output.Write(dump.response)
+		output.WriteString(dump.responseBody.String())
+	}
+	dump.mutex.Unlock()
+	log.Print(output.String())
+}
@@ -0,0 +1,91 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugDumpRedactsAndTruncates(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	var receivedBody string
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(r.Body)
+		receivedBody = string(body)
+		response := httpmock.NewStringResponse(200, strings.Repeat("b", 100))
+		response.Header.Set("Set-Cookie", "session=secret")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.DebugDumpRate = 1
+	config.DebugDumpRedact = []string{"authorization", "Set-Cookie"}
+	config.DebugDumpBodyBytes = 10
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	request := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 50)))
+	request.Header.Set("Authorization", "Bearer secret")
+	request.Header.Set("X-Visible", "shown")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+
+	if receivedBody != strings.Repeat("a", 50) || recorder.Body.String() != strings.Repeat("b", 100) {
+		t.Fatalf("expected bodies to pass through intact\nreceived: %q up, %q down", receivedBody, recorder.Body.String())
+	}
+	dump := output.String()
+	if strings.Contains(dump, "secret") {
+		t.Errorf("expected redacted values to be left out of the dump\nreceived: %v", dump)
+	}
+	for _, expected := range []string{
+		"POST / HTTP/1.1", "Authorization: [REDACTED]", "X-Visible: shown",
+		strings.Repeat("a", 10) + "\n[40 more bytes truncated]",
+		"\n\nHTTP/", "Set-Cookie: [REDACTED]",
+		strings.Repeat("b", 10) + "\n[90 more bytes truncated]",
+	} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("expected dump to contain %q\nreceived: %v", expected, dump)
+		}
+	}
+	if request.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("expected redaction to leave the request untouched\nreceived: %v", request.Header.Get("Authorization"))
+	}
+}
+
+func TestDebugDumpSamplesExchanges(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var output bytes.Buffer
+	log.SetOutput(&output)
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, "ok"))
+	samples := []float64{0.9, 0.1, 0.5}
+	config := buildConfiguration()
+	config.DebugDumpRate = 0.25
+	config.Random = func() float64 {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for _, path := range []string{"/first", "/second", "/third"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	dumps := strings.Count(output.String(), "proxy: dump of")
+	if dumps != 1 || !strings.Contains(output.String(), "proxy: dump of GET /second") {
+		t.Errorf("expected only the sampled exchange to be dumped\nreceived: %v", output.String())
+	}
+}
@@ -0,0 +1,43 @@
+package proxyhandler
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// debugRequestHeader carries the DebugToken of requests asking for
+// DebugHeaders.
+const debugRequestHeader = "X-Proxy-Debug"
+
+// wantsDebugHeaders reports whether the response to request is to carry
+// DebugHeaders, which requires the request to present the DebugToken when one
+// is configured.
+func (handler *ProxyHandler) wantsDebugHeaders(request *http.Request) bool {
+	if !handler.configuration.DebugHeaders {
+		return false
+	}
+	token := handler.configuration.DebugToken
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(request.Header.Get(debugRequestHeader)), []byte(token)) == 1
+}
+
+// setDebugHeaders reports the route which served request and the upstream
+// the observation says it was sent to in header, when the request asked for
+// them.
+func (handler *ProxyHandler) setDebugHeaders(header http.Header, request *http.Request, observation *Observation) {
+	if !handler.wantsDebugHeaders(request) {
+		return
+	}
+	route := observation.Route
+	if route == "" {
+		route = "default"
+	}
+	header.Set("X-Proxy-Route", route)
+	if observation.Upstream != nil {
+		header.Set("X-Proxy-Upstream", observation.Upstream.String())
+	} else {
+		header.Del("X-Proxy-Upstream")
+	}
+}
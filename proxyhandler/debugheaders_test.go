@@ -0,0 +1,109 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			var forwardedToken []string
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				forwardedToken = append(forwardedToken, r.Header.Get("X-Proxy-Debug"))
+				response := httpmock.NewStringResponse(200, "ok")
+				response.Header.Set("X-Proxy-Route", "/spoofed")
+				return response, nil
+			})
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DebugHeaders = true
+			config.DebugToken = "s3cret"
+			config.DevOverrideHeader = "X-Dev-Override"
+			config.DevOverrideTargets = []string{"http://localhost:8080"}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			serve := func(path, token string, override string) http.Header {
+				request := httptest.NewRequest("GET", path, nil)
+				if token != "" {
+					request.Header.Set("X-Proxy-Debug", token)
+				}
+				if override != "" {
+					request.Header.Set("X-Dev-Override", override)
+				}
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, request)
+				return recorder.Header()
+			}
+
+			cases := []struct {
+				path, token, override string
+				route, upstream       []string
+			}{
+				{"/route1", "s3cret", "", []string{"/route1"}, []string{"http://endpoint.one"}},
+				{"/other", "s3cret", "", []string{"default"}, []string{"http://default.endpoint"}},
+				{"/route1", "s3cret", "http://localhost:8080", []string{"/route1"}, []string{"http://localhost:8080"}},
+				{"/route1", "wrong", "", []string{"/spoofed"}, nil},
+				{"/route1", "", "", []string{"/spoofed"}, nil},
+			}
+			for _, c := range cases {
+				header := serve(c.path, c.token, c.override)
+				if received := header.Values("X-Proxy-Route"); !reflect.DeepEqual(received, c.route) {
+					t.Errorf("unexpected X-Proxy-Route for %s with token %q\nexpected: %v\nreceived: %v", c.path, c.token, c.route, received)
+				}
+				if received := header.Values("X-Proxy-Upstream"); !reflect.DeepEqual(received, c.upstream) {
+					t.Errorf("unexpected X-Proxy-Upstream for %s with token %q\nexpected: %v\nreceived: %v", c.path, c.token, c.upstream, received)
+				}
+			}
+			for _, token := range forwardedToken {
+				if token != "" {
+					t.Errorf("expected the debug token not to be forwarded upstream\nreceived: %q", token)
+				}
+			}
+		})
+	}
+}
+
+func TestDebugHeadersOnFailedRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	config := buildConfiguration()
+	config.DebugHeaders = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+	if route, upstream := recorder.Header().Get("X-Proxy-Route"), recorder.Header().Get("X-Proxy-Upstream"); route != "/route1" || upstream != "http://endpoint.one" {
+		t.Errorf("expected the error response to report where the request was sent\nreceived: %v %v", route, upstream)
+	}
+}
+
+func TestDebugTokenRequiresDebugHeaders(t *testing.T) {
+	config := buildConfiguration()
+	config.DebugToken = "s3cret"
+	expectedError := "invalid configuration: debug token set without debug headers"
+	if _, err := New(config); err == nil || err.Error() != expectedError {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
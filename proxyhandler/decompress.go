@@ -0,0 +1,94 @@
+package proxyhandler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gzipReadCloser closes both the gzip stream and the upstream body under it.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (reader *gzipReadCloser) Close() error {
+	reader.Reader.Close()
+	return reader.body.Close()
+}
+
+// decompressForClient replaces a gzip encoded upstream body with a stream of
+// its decoded contents when the client did not advertise gzip support. Partial
+// content is left alone, as its byte ranges refer to the encoded form. Whether
+// decoded or passed through, a gzip response depends on the Accept-Encoding
+// of the request, which Vary tells caches.
+func decompressForClient(response *http.Response, clientRequest *http.Request) error {
+	if isPartialContent(response) {
+		return nil
+	}
+	if !strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	addVary(response.Header, "Accept-Encoding")
+	if acceptsGzip(clientRequest) {
+		return nil
+	}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+
+	reader, err := gzip.NewReader(response.Body)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("decoding upstream gzip response: %s", err.Error())
+	}
+	response.Body = &gzipReadCloser{Reader: reader, body: response.Body}
+	response.Uncompressed = true
+	return nil
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding admits gzip,
+// either by name or through a "*" when gzip is not named.
+func acceptsGzip(request *http.Request) bool {
+	named, wildcard := -1.0, -1.0
+	for _, value := range request.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			coding, quality := parseMediaRange(coding)
+			switch coding {
+			case "gzip", "x-gzip":
+				named = quality
+			case "*":
+				wildcard = quality
+			}
+		}
+	}
+	if named >= 0 {
+		return named > 0
+	}
+	return wildcard > 0
+}
+
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// isPartialContent reports whether response carries a byte range rather than
+// a whole representation, in which case its body and framing must be relayed
+// exactly as received. A ranged request may still be answered in full, so
+// only the response decides.
+func isPartialContent(response *http.Response) bool {
+	return response.StatusCode == http.StatusPartialContent ||
+		response.Header.Get("Content-Range") != ""
+}
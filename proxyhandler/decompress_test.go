@@ -0,0 +1,124 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGzipIsDecompressedOnlyForClientsWithoutSupport(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	expectedBody := "hello from a gzipping upstream"
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(expectedBody))
+	writer.Close()
+
+	// the upstream compresses regardless of what the request accepts
+	httpmock.RegisterResponder("GET", "http://default.endpoint/", func(r *http.Request) (*http.Response, error) {
+		response := httpmock.NewBytesResponse(200, compressed.Bytes())
+		response.Header.Set("Content-Encoding", "gzip")
+		response.Header.Set("Content-Length", strconv.Itoa(compressed.Len()))
+		response.Header.Set("Vary", "Origin")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.DecompressForClients = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Body.String() != expectedBody {
+		t.Errorf("expected decompressed body\nexpected: %v\nreceived: %q", expectedBody, recorder.Body.String())
+	}
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected Content-Encoding to be removed\nreceived: %v", encoding)
+	}
+	if length := recorder.Header().Get("Content-Length"); length != "" {
+		t.Errorf("expected Content-Length to be removed\nreceived: %v", length)
+	}
+	if vary := recorder.Header().Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("expected Vary to include Accept-Encoding\nreceived: %v", vary)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	h.ServeHTTP(recorder, request)
+	if !bytes.Equal(recorder.Body.Bytes(), compressed.Bytes()) {
+		t.Errorf("expected compressed bytes to pass through\nexpected: %v\nreceived: %v", compressed.Bytes(), recorder.Body.Bytes())
+	}
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("expected Content-Encoding to be kept\nexpected: %v\nreceived: %v", "gzip", encoding)
+	}
+	if vary := recorder.Header().Values("Vary"); len(vary) != 2 || vary[1] != "Accept-Encoding" {
+		t.Errorf("expected Vary to include Accept-Encoding\nreceived: %v", vary)
+	}
+}
+
+func TestRangedRequestAnsweredInFullIsDecompressed(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	expectedBody := "the whole representation"
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(expectedBody))
+	writer.Close()
+
+	// the upstream ignores the Range header and answers with the whole body
+	httpmock.RegisterResponder("GET", "http://default.endpoint/", func(r *http.Request) (*http.Response, error) {
+		response := httpmock.NewBytesResponse(200, compressed.Bytes())
+		response.Header.Set("Content-Encoding", "gzip")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.DecompressForClients = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Range", "bytes=0-3")
+	h.ServeHTTP(recorder, request)
+	if recorder.Body.String() != expectedBody {
+		t.Errorf("expected decompressed body\nexpected: %v\nreceived: %q", expectedBody, recorder.Body.String())
+	}
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected Content-Encoding to be removed\nreceived: %v", encoding)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                false,
+		"identity":        false,
+		"gzip":            true,
+		"GZIP":            true,
+		"deflate, x-gzip": true,
+		"gzip;q=0":        false,
+		"*":               true,
+		"br, gzip;q=0.1":  true,
+		"*, gzip;q=0":     false,
+	}
+	for acceptEncoding, expected := range cases {
+		request := httptest.NewRequest("GET", "/", nil)
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if acceptsGzip(request) != expected {
+			t.Errorf("unexpected result for %q\nexpected: %v\nreceived: %v", acceptEncoding, expected, !expected)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errOverrideDenied = errors.New("override target is not allowed")
+
+// validateDevOverrides checks the developer override header and parses the
+// targets it may select.
+func (config *Configuration) validateDevOverrides() ([]*url.URL, error) {
+	if config.DevOverrideHeader == "" {
+		if len(config.DevOverrideTargets) > 0 {
+			return nil, fmt.Errorf("dev override targets set without a header")
+		}
+		return nil, nil
+	}
+	if !validToken(config.DevOverrideHeader) {
+		return nil, fmt.Errorf("invalid dev override header %q", config.DevOverrideHeader)
+	}
+	targets := make([]*url.URL, len(config.DevOverrideTargets))
+	for index, target := range config.DevOverrideTargets {
+		targetURL, err := parseEndpoint(target)
+		if err != nil {
+			return nil, fmt.Errorf("dev override target %d: %s", index, err.Error())
+		}
+		targets[index] = targetURL
+	}
+	return targets, nil
+}
+
+// devOverride returns the upstream a request asks to be sent to through the
+// developer override header, or nil when it makes no such request. A target
+// outside the allowed list is an error.
+func (handler *ProxyHandler) devOverride(request *http.Request) (*url.URL, error) {
+	if handler.configuration.DevOverrideHeader == "" {
+		return nil, nil
+	}
+	target := request.Header.Get(handler.configuration.DevOverrideHeader)
+	if target == "" {
+		return nil, nil
+	}
+	targetURL, err := parseEndpoint(target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errOverrideDenied, target)
+	}
+	for _, allowed := range handler.devOverrideTargets {
+		if targetURL.Scheme == allowed.Scheme && strings.EqualFold(targetURL.Host, allowed.Host) {
+			return allowed, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errOverrideDenied, target)
+}
@@ -0,0 +1,104 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildDevOverrideHandler(t *testing.T, enabled bool) *ProxyHandler {
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host+" "+r.Header.Get("X-Proxy-Target")), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default"
+	if enabled {
+		config.DevOverrideHeader = "X-Proxy-Target"
+		config.DevOverrideTargets = []string{"http://localhost:3000"}
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+func serveWithTarget(h *ProxyHandler, target string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Proxy-Target", target)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDevOverrideRedirectsAllowedTargets(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildDevOverrideHandler(t, true)
+	recorder := serveWithTarget(h, "http://LOCALHOST:3000")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "localhost:3000 " {
+		t.Errorf("expected request to reach the override without the header\nexpected: %v\nreceived: %v %q", "200 localhost:3000", recorder.Code, recorder.Body.String())
+	}
+	if variant := recorder.Header().Get("X-Upstream-Variant"); variant != "override" {
+		t.Errorf("unexpected variant\nexpected: %v\nreceived: %v", "override", variant)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Body.String() != "default " {
+		t.Errorf("expected requests without the header to use their route\nreceived: %v", recorder.Body.String())
+	}
+}
+
+func TestDevOverrideDeniesOtherTargets(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildDevOverrideHandler(t, true)
+	for _, target := range []string{"http://localhost:4000", "https://localhost:3000", "http://evil.example", "not a url"} {
+		recorder := serveWithTarget(h, target)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("unexpected status for target %q\nexpected: %v\nreceived: %v", target, http.StatusForbidden, recorder.Code)
+		}
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 0 {
+		t.Errorf("expected denied requests not to be forwarded\nreceived: %v calls", calls)
+	}
+}
+
+func TestDevOverrideIsInertWhenDisabled(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildDevOverrideHandler(t, false)
+	recorder := serveWithTarget(h, "http://localhost:3000")
+	expected := "default http://localhost:3000"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("expected the header to be ignored\nexpected: %v\nreceived: %v %v", expected, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDevOverridesAreValidated(t *testing.T) {
+	testCases := map[string]func(*Configuration){
+		"dev override targets set without a header": func(config *Configuration) {
+			config.DevOverrideTargets = []string{"http://localhost:3000"}
+		},
+		"invalid dev override header": func(config *Configuration) {
+			config.DevOverrideHeader = "X Proxy Target"
+		},
+		"dev override target 0": func(config *Configuration) {
+			config.DevOverrideHeader = "X-Proxy-Target"
+			config.DevOverrideTargets = []string{"gopher://localhost"}
+		},
+	}
+	for expectedError, configure := range testCases {
+		config := buildConfiguration()
+		configure(config)
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
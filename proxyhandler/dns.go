@@ -0,0 +1,325 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// negativeDNSCacheTTL bounds how long a failed lookup is remembered so that a
+// briefly unavailable resolver does not fail requests for a whole TTL.
+const negativeDNSCacheTTL = time.Second
+
+// dnsLookupTimeout bounds a lookup shared by the requests waiting for it.
+const dnsLookupTimeout = 10 * time.Second
+
+// Resolver looks up the addresses of upstream hosts. *net.Resolver satisfies
+// this interface.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsCache remembers the addresses of upstream hosts for a fixed TTL so each
+// new connection does not pay for a lookup. Concurrent lookups for the same
+// host share a single query.
+type dnsCache struct {
+	resolver Resolver
+	ttl      time.Duration
+	now      func() time.Time
+	// start runs a resolution in the background, reporting whether it was
+	// started, and lifetime bounds it; New directs them to the handler's
+	// goBackground and lifetime so that Close waits for and cancels them
+	start    func(task func()) bool
+	lifetime context.Context
+
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ready   chan struct{}
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+func newDNSCache(resolver Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		start: func(task func()) bool {
+			go task()
+			return true
+		},
+		lifetime: context.Background(),
+		entries:  make(map[string]*dnsCacheEntry),
+	}
+}
+
+// lookup returns the addresses of host, from the cache while its entry is
+// fresh. Otherwise a single resolution is started for all callers, which each
+// wait for it only as long as their own ctx allows.
+func (cache *dnsCache) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[host]
+	if ok {
+		select {
+		case <-entry.ready:
+			ok = cache.now().Before(entry.expires)
+		default:
+		}
+	}
+	if !ok {
+		entry = &dnsCacheEntry{ready: make(chan struct{})}
+		cache.entries[host] = entry
+		if !cache.start(func() { cache.resolve(host, entry) }) {
+			delete(cache.entries, host)
+			cache.mutex.Unlock()
+			return nil, errClosed
+		}
+	}
+	cache.mutex.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve looks host up for entry. The lookup is shared, so it runs on a
+// context of its own, bounded by dnsLookupTimeout and the cache's lifetime,
+// rather than on that of whichever request started it.
+func (cache *dnsCache) resolve(host string, entry *dnsCacheEntry) {
+	ctx, cancel := context.WithTimeout(cache.lifetime, dnsLookupTimeout)
+	defer cancel()
+	entry.addrs, entry.err = cache.resolver.LookupIPAddr(ctx, host)
+	ttl := cache.ttl
+	if entry.err != nil && ttl > negativeDNSCacheTTL {
+		ttl = negativeDNSCacheTTL
+	}
+	entry.expires = cache.now().Add(ttl)
+	close(entry.ready)
+}
+
+// lookupFunc resolves a hostname to its addresses.
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// defaultFallbackDelay is how long a host's IPv6 addresses are tried before
+// racing its IPv4 ones against them when FallbackDelay is not set, as
+// net.Dialer does.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// resolvingDialContext wraps dial so hostnames are resolved through lookup and
+// the resulting addresses are dialed directly, in the order chosen by balancer
+// when one is given. The original hostname remains on the request, so the Host
+// header and TLS server name are unaffected. When a host has addresses of both
+// families, those of the family it lists first are raced against the others
+// after fallbackDelay, unless it is negative.
+func resolvingDialContext(lookup lookupFunc, balancer *addressBalancer, fallbackDelay time.Duration, dial DialContextFunc) DialContextFunc {
+	if fallbackDelay == 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if balancer != nil {
+			addrs = balancer.order(host, addrs)
+		}
+		var primaries, fallbacks []net.IPAddr
+		for _, ip := range addrs {
+			switch {
+			case !networkAccepts(network, ip.IP):
+			case len(primaries) == 0 || isIPv4(primaries[0].IP) == isIPv4(ip.IP):
+				primaries = append(primaries, ip)
+			default:
+				fallbacks = append(fallbacks, ip)
+			}
+		}
+		if len(primaries) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", host)
+		}
+		serial := func(ctx context.Context, addrs []net.IPAddr) (net.Conn, error) {
+			return dialSerial(ctx, network, port, addrs, balancer, dial)
+		}
+		if len(fallbacks) == 0 || fallbackDelay < 0 {
+			return serial(ctx, append(primaries, fallbacks...))
+		}
+		return dialParallel(ctx, primaries, fallbacks, fallbackDelay, serial)
+	}
+}
+
+// dialSerial dials addrs one after another, returning the first connection
+// made, and gives up once ctx is done. Addresses which fail are reported to
+// balancer, unless the dial was canceled or timed out, as when it loses a
+// race or the client goes away, since that says nothing of the address.
+func dialSerial(ctx context.Context, network, port string, addrs []net.IPAddr, balancer *addressBalancer, dial DialContextFunc) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range addrs {
+		conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if balancer != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			balancer.markFailed(ip.String())
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialParallel dials primaries and, once fallbackDelay has passed or they
+// have failed, fallbacks alongside them, returning the first connection made
+// and canceling the other dial. When both fail, the error of the primaries is
+// returned.
+func dialParallel(ctx context.Context, primaries, fallbacks []net.IPAddr, fallbackDelay time.Duration, serial func(context.Context, []net.IPAddr) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	primary, fallback := make(chan dialResult, 1), make(chan dialResult, 1)
+	race := func(addrs []net.IPAddr, results chan<- dialResult) {
+		go func() {
+			conn, err := serial(ctx, addrs)
+			results <- dialResult{conn, err}
+		}()
+	}
+	race(primaries, primary)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var primaryErr, fallbackErr error
+	pending, fallbackStarted := 1, false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			race(fallbacks, fallback)
+		}
+	}
+	for pending > 0 {
+		var result dialResult
+		select {
+		case <-timer.C:
+			startFallback()
+			continue
+		case result = <-primary:
+			primaryErr = result.err
+			startFallback()
+		case result = <-fallback:
+			fallbackErr = result.err
+		}
+		pending--
+		if result.err == nil {
+			if pending > 0 {
+				// the losing dial is canceled, but may connect regardless
+				go func() {
+					select {
+					case lost := <-primary:
+						closeConn(lost.conn)
+					case lost := <-fallback:
+						closeConn(lost.conn)
+					}
+				}()
+			}
+			return result.conn, nil
+		}
+	}
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
+
+func closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// failedAddressBackoff is how long an address which refused a connection is
+// tried only after every other address of its host.
+const failedAddressBackoff = 30 * time.Second
+
+// addressBalancer rotates the starting address for each new connection to a
+// host so connections are spread across all of its records.
+type addressBalancer struct {
+	now func() time.Time
+
+	mutex  sync.Mutex
+	next   map[string]int
+	failed map[string]time.Time
+}
+
+func newAddressBalancer() *addressBalancer {
+	return &addressBalancer{
+		now:    time.Now,
+		next:   make(map[string]int),
+		failed: make(map[string]time.Time),
+	}
+}
+
+// order returns addrs rotated by one position per call for host, with
+// recently failed addresses moved to the end.
+func (balancer *addressBalancer) order(host string, addrs []net.IPAddr) []net.IPAddr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	start := balancer.next[host] % len(addrs)
+	balancer.next[host] = start + 1
+
+	now := balancer.now()
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	var failed []net.IPAddr
+	for index := range addrs {
+		addr := addrs[(start+index)%len(addrs)]
+		if until, ok := balancer.failed[addr.String()]; ok {
+			if now.Before(until) {
+				failed = append(failed, addr)
+				continue
+			}
+			delete(balancer.failed, addr.String())
+		}
+		ordered = append(ordered, addr)
+	}
+	return append(ordered, failed...)
+}
+
+func (balancer *addressBalancer) markFailed(addr string) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	balancer.failed[addr] = balancer.now().Add(failedAddressBackoff)
+}
+
+func networkAccepts(network string, ip net.IP) bool {
+	switch network {
+	case "tcp4", "udp4":
+		return ip.To4() != nil
+	case "tcp6", "udp6":
+		return ip.To4() == nil
+	}
+	return true
+}
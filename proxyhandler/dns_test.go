@@ -0,0 +1,384 @@
+package proxyhandler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	mutex   sync.Mutex
+	hosts   map[string][]string
+	lookups map[string]int
+}
+
+func newFakeResolver(hosts map[string][]string) *fakeResolver {
+	return &fakeResolver{hosts: hosts, lookups: make(map[string]int)}
+}
+
+func (resolver *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	resolver.lookups[host]++
+	ips, ok := resolver.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for index, ip := range ips {
+		addrs[index] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (resolver *fakeResolver) lookupCount(host string) int {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	return resolver.lookups[host]
+}
+
+func TestDNSCacheAvoidsRepeatedLookups(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var receivedHosts []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHosts = append(receivedHosts, r.Host)
+		// force a fresh dial for every request
+		w.Header().Set("Connection", "close")
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	upstreamHost := net.JoinHostPort("cached.upstream", port)
+
+	resolver := newFakeResolver(map[string][]string{"cached.upstream": []string{"127.0.0.1"}})
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = "http://" + upstreamHost
+	config.DNSCacheTTL = time.Minute
+	config.Resolver = resolver
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	for i := 0; i < 10; i++ {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		if recorder.Code != 200 {
+			t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", 200, recorder.Code)
+		}
+	}
+
+	if lookups := resolver.lookupCount("cached.upstream"); lookups != 1 {
+		t.Errorf("unexpected number of lookups\nexpected: %v\nreceived: %v", 1, lookups)
+	}
+	for _, host := range receivedHosts {
+		if host != upstreamHost {
+			t.Fatalf("expected original hostname in Host header\nexpected: %v\nreceived: %v", upstreamHost, host)
+		}
+	}
+}
+
+func TestDNSCacheExpiresEntries(t *testing.T) {
+	resolver := newFakeResolver(map[string][]string{"known": []string{"10.0.0.1"}})
+	cache := newDNSCache(resolver, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for _, host := range []string{"known", "known", "unknown", "unknown"} {
+		cache.lookup(context.Background(), host)
+	}
+	if resolver.lookupCount("known") != 1 || resolver.lookupCount("unknown") != 1 {
+		t.Fatalf("expected results to be cached\nreceived: %v", resolver.lookups)
+	}
+
+	now = now.Add(2 * negativeDNSCacheTTL)
+	cache.lookup(context.Background(), "known")
+	cache.lookup(context.Background(), "unknown")
+	if resolver.lookupCount("known") != 1 {
+		t.Errorf("expected positive entry to outlive the negative ttl\nreceived: %v lookups", resolver.lookupCount("known"))
+	}
+	if resolver.lookupCount("unknown") != 2 {
+		t.Errorf("expected negative entry to expire\nreceived: %v lookups", resolver.lookupCount("unknown"))
+	}
+
+	now = now.Add(time.Minute)
+	cache.lookup(context.Background(), "known")
+	if resolver.lookupCount("known") != 2 {
+		t.Errorf("expected positive entry to expire\nreceived: %v lookups", resolver.lookupCount("known"))
+	}
+}
+
+// blockingResolver answers each lookup once release is closed, recording
+// whether the lookup's context was done by then.
+type blockingResolver struct {
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan bool
+}
+
+func (resolver *blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	close(resolver.started)
+	<-resolver.release
+	resolver.canceled <- ctx.Err() != nil
+	return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+}
+
+func TestDNSCacheLookupOutlivesCanceledCaller(t *testing.T) {
+	resolver := &blockingResolver{make(chan struct{}), make(chan struct{}), make(chan bool, 1)}
+	cache := newDNSCache(resolver, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := cache.lookup(ctx, "shared")
+		first <- err
+	}()
+	<-resolver.started
+	type result struct {
+		addrs []net.IPAddr
+		err   error
+	}
+	second := make(chan result)
+	go func() {
+		addrs, err := cache.lookup(context.Background(), "shared")
+		second <- result{addrs, err}
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected the canceled caller to give up\nexpected: %v\nreceived: %v", context.Canceled, err)
+	}
+	close(resolver.release)
+	if received := <-second; received.err != nil || len(received.addrs) != 1 {
+		t.Errorf("expected the other caller to receive the shared lookup's result\nreceived: %v", received)
+	}
+	if <-resolver.canceled {
+		t.Error("expected the shared lookup not to be canceled with its first caller")
+	}
+}
+
+// stallingResolver answers lookups only once they are canceled.
+type stallingResolver struct {
+	started  chan struct{}
+	finished chan struct{}
+}
+
+func (resolver *stallingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	close(resolver.started)
+	<-ctx.Done()
+	close(resolver.finished)
+	return nil, ctx.Err()
+}
+
+func TestDNSCacheLookupsEndWithTheHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	resolver := &stallingResolver{make(chan struct{}), make(chan struct{})}
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = "http://stalled.upstream"
+	config.DNSCacheTTL = time.Minute
+	config.Resolver = resolver
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	served := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		served <- recorder.Code
+	}()
+	<-resolver.started
+	h.Close()
+	select {
+	case <-resolver.finished:
+	default:
+		t.Error("expected Close to cancel and wait for the lookup")
+	}
+	if status := <-served; status != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, status)
+	}
+}
+
+func TestDNSCacheDialReportsLookupFailure(t *testing.T) {
+	cache := newDNSCache(newFakeResolver(nil), time.Minute)
+	dial := resolvingDialContext(cache.lookup, nil, 0, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, fmt.Errorf("unexpected dial to %s", addr)
+	})
+	_, err := dial(context.Background(), "tcp", "missing.host:80")
+	if err == nil || !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("expected lookup failure to be returned\nreceived: %v", err)
+	}
+}
+
+func TestDNSRoundRobinSpreadsConnections(t *testing.T) {
+	resolver := newFakeResolver(map[string][]string{"service": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}})
+	cache := newDNSCache(resolver, time.Minute)
+	dialed := make(map[string]int)
+	dial := resolvingDialContext(cache.lookup, newAddressBalancer(), 0, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed[addr]++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	for i := 0; i < 30; i++ {
+		if _, err := dial(context.Background(), "tcp", "service:80"); err != nil {
+			t.Fatalf("unexpected dial error: %s", err.Error())
+		}
+	}
+	for _, addr := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"} {
+		if dialed[addr] != 10 {
+			t.Errorf("expected connections to be spread evenly\nexpected: %v\nreceived: %v", 10, dialed)
+			break
+		}
+	}
+	if resolver.lookupCount("service") != 1 {
+		t.Errorf("expected round robin to compose with the dns cache\nreceived: %v lookups", resolver.lookupCount("service"))
+	}
+}
+
+func TestDNSRoundRobinDeprioritizesFailedAddresses(t *testing.T) {
+	resolver := newFakeResolver(map[string][]string{"service": []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}})
+	balancer := newAddressBalancer()
+	now := time.Now()
+	balancer.now = func() time.Time { return now }
+	var dialed []string
+	dial := resolvingDialContext(resolver.LookupIPAddr, balancer, 0, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.1:80" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	for i := 0; i < 4; i++ {
+		dial(context.Background(), "tcp", "service:80")
+	}
+	expected := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.2:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("unexpected dial order\nexpected: %v\nreceived: %v", expected, dialed)
+	}
+
+	dialed = nil
+	now = now.Add(failedAddressBackoff)
+	for i := 0; i < 3; i++ {
+		dial(context.Background(), "tcp", "service:80")
+	}
+	if dialed[2] != "10.0.0.1:80" {
+		t.Errorf("expected failed address to be retried after backoff\nreceived: %v", dialed)
+	}
+}
+
+func TestResolvingDialRacesAddressFamilies(t *testing.T) {
+	resolver := newFakeResolver(map[string][]string{"dual": []string{"2001:db8::1", "10.0.0.1"}})
+	var mutex sync.Mutex
+	var dialed []string
+	canceled := make(chan string, 1)
+	base := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mutex.Lock()
+		dialed = append(dialed, addr)
+		mutex.Unlock()
+		if strings.HasPrefix(addr, "[2001:db8::1]") {
+			// the IPv6 address never answers
+			<-ctx.Done()
+			canceled <- addr
+			return nil, ctx.Err()
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+
+	dial := resolvingDialContext(resolver.LookupIPAddr, nil, 10*time.Millisecond, base)
+	conn, err := dial(context.Background(), "tcp", "dual:80")
+	if err != nil {
+		t.Fatalf("expected the IPv4 address to win the race: %s", err.Error())
+	}
+	conn.Close()
+	select {
+	case addr := <-canceled:
+		if addr != "[2001:db8::1]:80" {
+			t.Errorf("unexpected canceled dial\nexpected: %v\nreceived: %v", "[2001:db8::1]:80", addr)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the losing dial to be canceled")
+	}
+
+	// a negative delay tries the addresses in turn
+	dialed = nil
+	dial = resolvingDialContext(resolver.LookupIPAddr, nil, -1, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if strings.HasPrefix(addr, "[2001:db8::1]") {
+			return nil, fmt.Errorf("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	conn, err = dial(context.Background(), "tcp", "dual:80")
+	if err != nil {
+		t.Fatalf("expected the IPv4 address to be tried after the IPv6 one: %s", err.Error())
+	}
+	conn.Close()
+	expected := []string{"[2001:db8::1]:80", "10.0.0.1:80"}
+	if !reflect.DeepEqual(dialed, expected) {
+		t.Errorf("unexpected dial order\nexpected: %v\nreceived: %v", expected, dialed)
+	}
+}
+
+func TestDialSerialDoesNotBlameCanceledDials(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}}
+	balancer := newAddressBalancer()
+	var dialed []string
+
+	// the client goes away while the first address is dialed
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := dialSerial(ctx, "tcp", "80", addrs, balancer, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		cancel()
+		return nil, ctx.Err()
+	})
+	if err == nil || len(dialed) != 1 {
+		t.Errorf("expected dialing to stop once canceled\nreceived: %v %v", err, dialed)
+	}
+
+	// a dial which times out on its own is not held against the address
+	dialed = nil
+	conn, err := dialSerial(context.Background(), "tcp", "80", addrs, balancer, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.1:80" {
+			return nil, context.DeadlineExceeded
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	if err != nil {
+		t.Fatalf("expected the second address to be dialed: %s", err.Error())
+	}
+	conn.Close()
+	if len(dialed) != 2 {
+		t.Errorf("unexpected dials\nexpected: %v\nreceived: %v", 2, dialed)
+	}
+	if len(balancer.failed) != 0 {
+		t.Errorf("expected no address to be marked failed\nreceived: %v", balancer.failed)
+	}
+}
@@ -0,0 +1,78 @@
+package proxyhandler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// endpointHosts lists the upstream hosts, as scheme://host, which the table's
+// routes send requests to.
+func (table *routeTable) endpointHosts() map[string]bool {
+	hosts := map[string]bool{}
+	add := func(route *validRouteRule) {
+		for _, endpointURL := range append(route.EndpointURLs, route.EndpointURL, route.SplitEndpointURL, route.CanaryEndpointURL) {
+			if endpointURL != nil {
+				hosts[endpointURL.Scheme+"://"+endpointURL.Host] = true
+			}
+		}
+	}
+	add(table.defaultRoute)
+	for _, route := range table.routes {
+		add(route)
+	}
+	return hosts
+}
+
+// drainRemovedHosts closes the idle upstream connections left behind once a
+// change to the routing stops referring to a host, after the DrainDelay has
+// given requests still in flight to it time to finish. The standard transport
+// can only close every idle connection at once, so those to hosts still in use
+// are closed too and reopened when next needed.
+func (handler *ProxyHandler) drainRemovedHosts(previous, current *routeTable) {
+	delay := handler.configuration.DrainDelay
+	if delay <= 0 {
+		return
+	}
+	currentHosts := current.endpointHosts()
+	var removed []string
+	for host := range previous.endpointHosts() {
+		if !currentHosts[host] {
+			removed = append(removed, host)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	// routes with their own client take its connections with them
+	kept := map[*validRouteRule]bool{}
+	for _, route := range current.routes {
+		kept[route] = true
+	}
+	clients := []*http.Client{handler.client}
+	for _, route := range previous.routes {
+		if kept[route] {
+			continue
+		}
+		if route.client != nil {
+			clients = append(clients, route.client)
+		} else if client := route.transport.built(); client != nil {
+			clients = append(clients, client)
+		}
+	}
+	log.Printf("proxy: draining connections to %s in %s", strings.Join(removed, ", "), delay)
+	handler.goBackground(func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-handler.lifetime.Done():
+			// Close closes every idle connection itself
+			return
+		}
+		for _, client := range clients {
+			client.CloseIdleConnections()
+		}
+	})
+}
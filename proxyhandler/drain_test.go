@@ -0,0 +1,87 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"testing"
+	"time"
+)
+
+// newReuseRecordingHandler builds a handler against real upstreams which
+// records whether each upstream request reused a pooled connection.
+func newReuseRecordingHandler(t *testing.T, routes []*RouteRule, reused *[]bool) *ProxyHandler {
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = routes
+	config.DrainDelay = 10 * time.Millisecond
+	config.ClientTrace = func(*http.Request) *httptrace.ClientTrace {
+		return &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+			*reused = append(*reused, info.Reused)
+		}}
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+func TestRemovedHostsAreDrained(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer second.Close()
+	var reused []bool
+	h := newReuseRecordingHandler(t, []*RouteRule{&RouteRule{Path: "/app", Endpoint: first.URL}}, &reused)
+
+	dispatchBodies(h, []string{"/app", "/app"})
+	if err := h.SetEndpoint("/app", second.URL); err != nil {
+		t.Fatalf("unable to set endpoint: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := h.SetEndpoint("/app", first.URL); err != nil {
+		t.Fatalf("unable to set endpoint: %s", err.Error())
+	}
+	dispatchBodies(h, []string{"/app", "/app"})
+
+	expected := []bool{false, true, false, true}
+	if len(reused) != len(expected) {
+		t.Fatalf("unexpected connections\nexpected: %v\nreceived: %v", expected, reused)
+	}
+	for index := range expected {
+		if reused[index] != expected[index] {
+			t.Fatalf("unexpected connection reuse\nexpected: %v\nreceived: %v", expected, reused)
+		}
+	}
+}
+
+func TestHostsStillInUseAreNotDrained(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	var reused []bool
+	h := newReuseRecordingHandler(t, []*RouteRule{
+		&RouteRule{Path: "/a", Endpoint: upstream.URL},
+		&RouteRule{Path: "/b", Endpoint: upstream.URL},
+	}, &reused)
+
+	dispatchBodies(h, []string{"/a"})
+	if err := h.RemoveRoute("/a"); err != nil {
+		t.Fatalf("unable to remove route: %s", err.Error())
+	}
+	time.Sleep(100 * time.Millisecond)
+	dispatchBodies(h, []string{"/b"})
+
+	if len(reused) != 2 || !reused[1] {
+		t.Errorf("expected the connection to be reused after removing a route to a host still in use\nreceived: %v", reused)
+	}
+}
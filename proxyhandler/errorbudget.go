@@ -0,0 +1,209 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorBudgetAlert watches the share of each route's requests answered with a
+// 5xx status, whether by the upstream or by the proxy itself, over the last
+// Window, rounded up to whole seconds.
+//
+// Alert is called with the route's Path, empty for the default route, and the
+// error rate once a completed request takes the rate above Threshold, between
+// 0 and 1, and again once a later request finds it back at or below the
+// Threshold, or once the route's requests have all left the window without
+// one. The rate is only judged once the window holds MinRequests requests.
+// Having alerted for a route, Alert is not called for it again until a Window
+// has passed, so a rate hovering around the Threshold does not raise an alert
+// with every request. Alert is called from the goroutine which served the
+// request, or from a background one for a route found idle, so it should
+// return quickly.
+//
+// Routes sharing a Path but matching different requests are watched apart,
+// and a route's window is dropped when the route is removed.
+type ErrorBudgetAlert struct {
+	Threshold   float64
+	Window      time.Duration
+	MinRequests int
+	Alert       func(route string, rate float64)
+}
+
+func (config *ErrorBudgetAlert) validate() error {
+	if config.Threshold <= 0 || config.Threshold > 1 {
+		return fmt.Errorf("error budget threshold %v is not between 0 and 1", config.Threshold)
+	}
+	if config.Window < time.Second {
+		return fmt.Errorf("error budget window must be at least a second")
+	}
+	if config.MinRequests < 0 {
+		return fmt.Errorf("error budget min requests is negative")
+	}
+	if config.Alert == nil {
+		return fmt.Errorf("error budget alert requires an Alert function")
+	}
+	return nil
+}
+
+// errorBucket counts the requests completed and the errors among them in one
+// second.
+type errorBucket struct {
+	second   int64
+	requests int
+	errors   int
+}
+
+// errorWindow holds a route's recent requests in a ring of one bucket per
+// second of the window, and whether the route is alerting.
+type errorWindow struct {
+	mutex     sync.Mutex
+	buckets   []errorBucket
+	alerting  bool
+	alertedAt time.Time
+	watched   bool
+	removed   bool
+}
+
+// errorBudget keeps an errorWindow for each route which has served a request,
+// keyed by the route's matchKey.
+type errorBudget struct {
+	config  *ErrorBudgetAlert
+	windows sync.Map
+}
+
+func newErrorBudget(config *ErrorBudgetAlert) *errorBudget {
+	if config == nil {
+		return nil
+	}
+	return &errorBudget{config: config}
+}
+
+// recordErrorBudget counts observation in the window of route and alerts if
+// the route's error rate has crossed the threshold. Once a route is alerting,
+// its recovery is also watched for in the background, in case no further
+// request arrives to find it.
+func (handler *ProxyHandler) recordErrorBudget(route *validRouteRule, observation *Observation) {
+	budget := handler.errorBudget
+	if budget == nil {
+		return
+	}
+	key := route.matchKey()
+	value, ok := budget.windows.Load(key)
+	if !ok {
+		seconds := int((budget.config.Window + time.Second - 1) / time.Second)
+		value, _ = budget.windows.LoadOrStore(key, &errorWindow{buckets: make([]errorBucket, seconds)})
+	}
+	window := value.(*errorWindow)
+	rate, alert, watch := window.record(budget.config, observation.StatusCode >= 500, handler.now())
+	if alert {
+		budget.config.Alert(route.Path, rate)
+	}
+	if watch {
+		handler.goBackground(func() { handler.awaitRecovery(route.Path, window) })
+	}
+}
+
+// awaitRecovery checks window once every Window until it stops alerting,
+// alerting for path if it recovers without a request arriving to find it.
+func (handler *ProxyHandler) awaitRecovery(path string, window *errorWindow) {
+	config := handler.errorBudget.config
+	for {
+		select {
+		case <-handler.after(config.Window):
+		case <-handler.lifetime.Done():
+			return
+		}
+		recovered, done := window.checkIdle(config, handler.now())
+		if recovered {
+			config.Alert(path, 0)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// forget drops the windows of the routes of previous which current no longer
+// has.
+func (budget *errorBudget) forget(previous, current *routeTable) {
+	if budget == nil {
+		return
+	}
+	kept := make(map[string]bool, len(current.routes))
+	for _, route := range current.routes {
+		kept[route.matchKey()] = true
+	}
+	for _, route := range previous.routes {
+		key := route.matchKey()
+		if kept[key] {
+			continue
+		}
+		if value, ok := budget.windows.LoadAndDelete(key); ok {
+			window := value.(*errorWindow)
+			window.mutex.Lock()
+			window.removed = true
+			window.mutex.Unlock()
+		}
+	}
+}
+
+// record counts a request completed at now, and returns the window's error
+// rate, whether it should be alerted and whether the window has begun
+// alerting without its recovery being watched already.
+func (window *errorWindow) record(config *ErrorBudgetAlert, failed bool, now time.Time) (float64, bool, bool) {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	second := now.Unix()
+	bucket := &window.buckets[int(second%int64(len(window.buckets)))]
+	if bucket.second != second {
+		*bucket = errorBucket{second: second}
+	}
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+
+	requests, errors := window.count(second)
+	if requests < config.MinRequests {
+		return 0, false, false
+	}
+	rate := float64(errors) / float64(requests)
+	if (rate > config.Threshold) == window.alerting || now.Sub(window.alertedAt) < config.Window {
+		return rate, false, false
+	}
+	window.alerting, window.alertedAt = !window.alerting, now
+	watch := window.alerting && !window.watched
+	if watch {
+		window.watched = true
+	}
+	return rate, true, watch
+}
+
+// checkIdle ends the alert of a window whose requests have all left it by now,
+// reporting whether it did and whether the window no longer needs watching.
+func (window *errorWindow) checkIdle(config *ErrorBudgetAlert, now time.Time) (bool, bool) {
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+	if window.removed || !window.alerting {
+		window.watched = false
+		return false, true
+	}
+	if requests, _ := window.count(now.Unix()); requests > 0 || now.Sub(window.alertedAt) < config.Window {
+		return false, false
+	}
+	window.alerting, window.alertedAt, window.watched = false, now, false
+	return true, true
+}
+
+// count returns the requests and errors within the window ending at second.
+func (window *errorWindow) count(second int64) (int, int) {
+	requests, errors := 0, 0
+	for _, bucket := range window.buckets {
+		if second-bucket.second < int64(len(window.buckets)) {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	return requests, errors
+}
@@ -0,0 +1,173 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrorBudgetAlertsOnCrossingAndRecovery(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	status := http.StatusOK
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(status, "body"), nil
+	})
+	var alerts []string
+	config := buildConfiguration()
+	config.ErrorBudgetAlert = &ErrorBudgetAlert{
+		Threshold:   0.05,
+		Window:      time.Minute,
+		MinRequests: 10,
+		Alert: func(route string, rate float64) {
+			alerts = append(alerts, fmt.Sprintf("%s %.3f", route, rate))
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+	serve := func(count, code int) {
+		status = code
+		for index := 0; index < count; index++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/route1", nil))
+		}
+	}
+
+	serve(18, http.StatusOK)
+	clock = clock.Add(time.Second)
+	// the first failure takes the rate to 1/19, and later ones are not alerted
+	serve(5, http.StatusBadGateway)
+	clock = clock.Add(30 * time.Second)
+	serve(5, http.StatusBadGateway)
+	// the failures leave the window, and the tenth success is judged
+	clock = clock.Add(61 * time.Second)
+	serve(20, http.StatusOK)
+	// a burst within a window of the recovery is not alerted
+	clock = clock.Add(time.Second)
+	serve(5, http.StatusBadGateway)
+
+	expected := []string{"/route1 0.053", "/route1 0.000"}
+	if !reflect.DeepEqual(alerts, expected) {
+		t.Errorf("unexpected alerts\nexpected: %v\nreceived: %v", expected, alerts)
+	}
+}
+
+func TestErrorBudgetRecoversWhileIdle(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", httpmock.NewStringResponder(http.StatusBadGateway, "body"))
+	alerts := make(chan string, 2)
+	config := buildConfiguration()
+	config.ErrorBudgetAlert = &ErrorBudgetAlert{
+		Threshold: 0.5,
+		Window:    time.Minute,
+		Alert: func(route string, rate float64) {
+			alerts <- fmt.Sprintf("%s %.3f", route, rate)
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	var mutex sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return clock
+	}
+	ticks := make(chan time.Time)
+	h.after = func(time.Duration) <-chan time.Time { return ticks }
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/route1", nil))
+	if alert := <-alerts; alert != "/route1 1.000" {
+		t.Errorf("unexpected alert\nexpected: %v\nreceived: %v", "/route1 1.000", alert)
+	}
+	// no request arrives to find the failure gone from the window
+	mutex.Lock()
+	clock = clock.Add(61 * time.Second)
+	mutex.Unlock()
+	ticks <- clock
+	if alert := <-alerts; alert != "/route1 0.000" {
+		t.Errorf("unexpected alert\nexpected: %v\nreceived: %v", "/route1 0.000", alert)
+	}
+}
+
+func TestErrorBudgetWatchesRoutesApart(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://reader/items", httpmock.NewStringResponder(http.StatusBadGateway, "body"))
+	httpmock.RegisterResponder("POST", "http://writer/items", httpmock.NewStringResponder(http.StatusOK, "body"))
+	var alerts []string
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/items", Endpoint: "http://reader", Methods: []string{"GET"}},
+		&RouteRule{Path: "/items", Endpoint: "http://writer", Methods: []string{"POST"}},
+	}
+	config.ErrorBudgetAlert = &ErrorBudgetAlert{
+		Threshold:   0.5,
+		Window:      time.Minute,
+		MinRequests: 2,
+		Alert: func(route string, rate float64) {
+			alerts = append(alerts, fmt.Sprintf("%s %.3f", route, rate))
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+
+	// the writes would hide the reads' failures in a window shared by path
+	for _, method := range []string{"POST", "POST", "GET", "GET"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items", nil))
+	}
+	expected := []string{"/items 1.000"}
+	if !reflect.DeepEqual(alerts, expected) {
+		t.Errorf("unexpected alerts\nexpected: %v\nreceived: %v", expected, alerts)
+	}
+
+	if err := h.RemoveRouteRule(RouteRule{Path: "/items", Methods: []string{"GET"}}); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	windows := 0
+	h.errorBudget.windows.Range(func(key, value interface{}) bool {
+		windows++
+		return true
+	})
+	if windows != 1 {
+		t.Errorf("expected the removed route's window to be dropped\nexpected: %v\nreceived: %v", 1, windows)
+	}
+}
+
+func TestErrorBudgetAlertValidation(t *testing.T) {
+	alert := func(string, float64) {}
+	examples := map[string]ErrorBudgetAlert{
+		"is not between 0 and 1":   {Threshold: 1.5, Window: time.Minute, Alert: alert},
+		"at least a second":        {Threshold: 0.05, Window: time.Millisecond, Alert: alert},
+		"min requests is negative": {Threshold: 0.05, Window: time.Minute, MinRequests: -1, Alert: alert},
+		"requires an Alert":        {Threshold: 0.05, Window: time.Minute},
+	}
+	for expectedError, budget := range examples {
+		budget := budget
+		config := buildConfiguration()
+		config.ErrorBudgetAlert = &budget
+		if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
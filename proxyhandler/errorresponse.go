@@ -0,0 +1,204 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProxyError is an error generated by the proxy itself rather than relayed
+// from an upstream. Status is the status the proxy responds with.
+type ProxyError struct {
+	Status int
+	Err    error
+}
+
+func (proxyErr *ProxyError) Error() string {
+	return proxyErr.Err.Error()
+}
+
+func (proxyErr *ProxyError) Unwrap() error {
+	return proxyErr.Err
+}
+
+// ErrorTemplate renders the body of an error response from an ErrorData.
+// Templates from both text/template and html/template satisfy it.
+type ErrorTemplate interface {
+	Execute(writer io.Writer, data interface{}) error
+}
+
+// ErrorData is the data an ErrorTemplate is executed with.
+type ErrorData struct {
+	Status     int
+	StatusText string
+	Error      string
+}
+
+// JSONErrorTemplate renders errors as {"error": "...", "code": 502}.
+var JSONErrorTemplate ErrorTemplate = jsonErrorTemplate{}
+
+// HTMLErrorTemplate renders errors as a minimal HTML page.
+var HTMLErrorTemplate ErrorTemplate = template.Must(template.New("error").Parse(
+	`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Error}}</p>
+</body>
+</html>
+`))
+
+type jsonErrorTemplate struct{}
+
+func (jsonErrorTemplate) Execute(writer io.Writer, data interface{}) error {
+	errorData, ok := data.(ErrorData)
+	if !ok {
+		return fmt.Errorf("unexpected error data %T", data)
+	}
+	return json.NewEncoder(writer).Encode(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{errorData.Error, errorData.Status})
+}
+
+func (handler *ProxyHandler) handleUnexpectedError(err error, writer http.ResponseWriter, request *http.Request) {
+	log.Printf("proxy: http request error: %s", err.Error())
+	handler.writeError(writer, request, &ProxyError{Status: http.StatusInternalServerError, Err: err},
+		fmt.Sprintf("unexpected error encountered: %s", err.Error()))
+}
+
+// handleUpstreamError answers a request whose upstream could not be reached
+// or did not respond, using progress to tell a timeout's stage apart. It
+// returns the status written and the error with its timeout stage wrapped.
+func (handler *ProxyHandler) handleUpstreamError(err error, progress *upstreamProgress, writer http.ResponseWriter, request *http.Request) (int, error) {
+	status, err := progress.classify(err)
+	log.Printf("proxy: upstream request error: %s", err.Error())
+	handler.writeError(writer, request, &ProxyError{Status: status, Err: err}, err.Error())
+	return status, err
+}
+
+// handleMethodNotAllowed answers 405 listing each of the allowed methods once,
+// in sorted order.
+func (handler *ProxyHandler) handleMethodNotAllowed(allowed []string, writer http.ResponseWriter, request *http.Request) {
+	sort.Strings(allowed)
+	unique := allowed[:0]
+	for index, method := range allowed {
+		if index == 0 || method != allowed[index-1] {
+			unique = append(unique, method)
+		}
+	}
+	writer.Header().Set("Allow", strings.Join(unique, ", "))
+	handler.handleError(fmt.Errorf("method %s not allowed for %s", request.Method, request.URL.Path), http.StatusMethodNotAllowed, writer, request)
+}
+
+func (handler *ProxyHandler) handleError(err error, status int, writer http.ResponseWriter, request *http.Request) {
+	log.Printf("proxy: %s", err.Error())
+	handler.writeError(writer, request, &ProxyError{Status: status, Err: err}, err.Error())
+}
+
+// writeError hands proxyErr to the configured ErrorHandler, or otherwise
+// writes it with the ErrorFormats template best matching the request's Accept
+// header. Requests accepting none of the formats get a plain text body.
+func (handler *ProxyHandler) writeError(writer http.ResponseWriter, request *http.Request, proxyErr *ProxyError, summary string) {
+	if handler.configuration.ErrorHandler != nil {
+		handler.configuration.ErrorHandler(writer, request, proxyErr)
+		return
+	}
+	writer.Header().Add("X-Error", summary)
+
+	contentType, format := negotiateErrorFormat(request.Header.Get("Accept"), handler.configuration.ErrorFormats)
+	if format != nil {
+		var body bytes.Buffer
+		data := ErrorData{Status: proxyErr.Status, StatusText: http.StatusText(proxyErr.Status), Error: proxyErr.Error()}
+		err := format.Execute(&body, data)
+		if err == nil {
+			writer.Header().Set("Content-Type", contentType)
+			writer.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+			writer.WriteHeader(proxyErr.Status)
+			writer.Write(body.Bytes())
+			return
+		}
+		log.Printf("proxy: rendering %s error response: %s", contentType, err.Error())
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.WriteHeader(proxyErr.Status)
+	writer.Write([]byte("error: " + proxyErr.Error()))
+}
+
+// negotiateErrorFormat picks the format whose media type the Accept header
+// ranks highest. Earlier entries win ties and a bare */* selects nothing, so
+// clients without a preference get the plain text default.
+func negotiateErrorFormat(accept string, formats map[string]ErrorTemplate) (string, ErrorTemplate) {
+	if len(formats) == 0 || accept == "" {
+		return "", nil
+	}
+	mediaTypes := make([]string, 0, len(formats))
+	for mediaType := range formats {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+
+	bestType, bestQuality := "", 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaRange, quality := parseMediaRange(mediaRange)
+		if quality <= bestQuality || mediaRange == "*/*" {
+			continue
+		}
+		for _, mediaType := range mediaTypes {
+			if mediaRangeMatches(mediaRange, mediaType) {
+				bestType, bestQuality = mediaType, quality
+				break
+			}
+		}
+	}
+	if bestType == "" {
+		return "", nil
+	}
+	return bestType, formats[bestType]
+}
+
+func parseMediaRange(mediaRange string) (string, float64) {
+	parameters := strings.Split(mediaRange, ";")
+	quality := 1.0
+	for _, parameter := range parameters[1:] {
+		name, value, found := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return "", 0
+		}
+		quality = parsed
+	}
+	return strings.ToLower(strings.TrimSpace(parameters[0])), quality
+}
+
+func mediaRangeMatches(mediaRange, mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	if strings.HasSuffix(mediaRange, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+	}
+	return mediaRange == mediaType
+}
+
+func validateErrorFormats(formats map[string]ErrorTemplate) error {
+	for mediaType, format := range formats {
+		typeName, subtype, found := strings.Cut(mediaType, "/")
+		if !found || typeName == "" || subtype == "" || strings.Contains(mediaType, "*") {
+			return fmt.Errorf("error format media type %q must be of the form type/subtype", mediaType)
+		}
+		if format == nil {
+			return fmt.Errorf("error format for %s is nil", mediaType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package proxyhandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildFailingUpstreamHandler(t *testing.T, err error, configure func(*Configuration)) *ProxyHandler {
+	httpmock.RegisterNoResponder(httpmock.NewErrorResponder(err))
+	config := buildConfiguration()
+	config.ErrorFormats = map[string]ErrorTemplate{
+		"application/json": JSONErrorTemplate,
+		"text/html":        HTMLErrorTemplate,
+	}
+	if configure != nil {
+		configure(config)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+func TestErrorResponseFormatFollowsAccept(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildFailingUpstreamHandler(t, fmt.Errorf("connection refused"), nil)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/json")
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("unexpected content type\nexpected: %v\nreceived: %v", "application/json", contentType)
+	}
+	var body struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected JSON body, received %q: %s", recorder.Body.String(), err.Error())
+	}
+	if body.Code != http.StatusBadGateway || !strings.Contains(body.Error, "connection refused") {
+		t.Errorf("unexpected JSON error body\nreceived: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	h.ServeHTTP(recorder, request)
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/html" {
+		t.Errorf("unexpected content type\nexpected: %v\nreceived: %v", "text/html", contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), "<h1>502 Bad Gateway</h1>") {
+		t.Errorf("expected HTML error page\nreceived: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "*/*")
+	h.ServeHTTP(recorder, request)
+	if !strings.HasPrefix(recorder.Body.String(), "error: ") {
+		t.Errorf("expected plain text fallback\nreceived: %s", recorder.Body.String())
+	}
+}
+
+func TestNegotiateErrorFormat(t *testing.T) {
+	formats := map[string]ErrorTemplate{
+		"application/json": JSONErrorTemplate,
+		"text/html":        HTMLErrorTemplate,
+	}
+	cases := map[string]string{
+		"":                                      "",
+		"*/*":                                   "",
+		"image/png":                             "",
+		"application/json":                      "application/json",
+		"Application/JSON; charset=utf-8":       "application/json",
+		"text/*":                                "text/html",
+		"text/html;q=0.5, application/json":     "application/json",
+		"application/json;q=0, text/html;q=0.1": "text/html",
+		"text/html, application/json":           "text/html",
+		"application/json;q=nonsense":           "",
+	}
+	for accept, expected := range cases {
+		if received, _ := negotiateErrorFormat(accept, formats); received != expected {
+			t.Errorf("unexpected format for Accept %q\nexpected: %v\nreceived: %v", accept, expected, received)
+		}
+	}
+}
+
+func TestUpstreamTimeoutIsGatewayTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildFailingUpstreamHandler(t, context.DeadlineExceeded, nil)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusGatewayTimeout, recorder.Code)
+	}
+}
+
+func TestErrorHandlerOverridesErrorFormats(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var handled *ProxyError
+	h := buildFailingUpstreamHandler(t, fmt.Errorf("connection refused"), func(config *Configuration) {
+		config.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			handled, _ = err.(*ProxyError)
+			w.WriteHeader(http.StatusTeapot)
+		}
+	})
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Accept", "application/json")
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTeapot {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusTeapot, recorder.Code)
+	}
+	if handled == nil || handled.Status != http.StatusBadGateway {
+		t.Errorf("expected ErrorHandler to receive the proxy error\nexpected: %v\nreceived: %v", http.StatusBadGateway, handled)
+	}
+}
+
+func TestErrorFormatsAreValidated(t *testing.T) {
+	config := buildConfiguration()
+	config.ErrorFormats = map[string]ErrorTemplate{"json": JSONErrorTemplate}
+	expectedError := "must be of the form type/subtype"
+	if _, err := config.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,64 @@
+package proxyhandler
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvarMutex serializes the lookup and registration of published maps so
+// that handlers created concurrently with the same ExpvarPrefix share one.
+var expvarMutex sync.Mutex
+
+// expvarMap returns the map a handler built from config publishes its
+// counters in: ExpvarMap when set, otherwise the map registered under
+// ExpvarPrefix, which is registered when absent and reused when a previous
+// handler registered it.
+func expvarMap(config *Configuration) (*expvar.Map, error) {
+	if config.ExpvarMap != nil || config.ExpvarPrefix == "" {
+		return config.ExpvarMap, nil
+	}
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	existing := expvar.Get(config.ExpvarPrefix)
+	if existing == nil {
+		return expvar.NewMap(config.ExpvarPrefix), nil
+	}
+	vars, ok := existing.(*expvar.Map)
+	if !ok {
+		return nil, fmt.Errorf("expvar %q is already published and is not a map", config.ExpvarPrefix)
+	}
+	return vars, nil
+}
+
+// publishExpvar sets the handler's counters in vars. The values are read
+// from the counters backing Stats whenever vars is read, replacing those of
+// any handler which previously published in vars.
+func (handler *ProxyHandler) publishExpvar(vars *expvar.Map) {
+	total := func(count func(RouteStats) uint64) expvar.Func {
+		return func() interface{} {
+			var sum uint64
+			for _, stats := range handler.Stats() {
+				sum += count(stats)
+			}
+			return sum
+		}
+	}
+	vars.Set("requests", total(func(stats RouteStats) uint64 { return stats.Requests }))
+	vars.Set("errors", total(func(stats RouteStats) uint64 { return stats.Errors }))
+	vars.Set("retries", total(func(stats RouteStats) uint64 { return stats.Retries }))
+	vars.Set("bytes_in", total(func(stats RouteStats) uint64 { return stats.BytesIn }))
+	vars.Set("bytes_out", total(func(stats RouteStats) uint64 { return stats.BytesOut }))
+	vars.Set("in_flight", expvar.Func(func() interface{} { return handler.active.Load() }))
+	vars.Set("queued", expvar.Func(func() interface{} {
+		_, queued := handler.InFlight()
+		return queued
+	}))
+	vars.Set("shed", expvar.Func(func() interface{} {
+		if handler.admission == nil {
+			return uint64(0)
+		}
+		return handler.admission.shed.Load()
+	}))
+	vars.Set("routes", expvar.Func(func() interface{} { return handler.Stats() }))
+}
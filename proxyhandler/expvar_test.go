@@ -0,0 +1,106 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"expvar"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpvarPublishesCounters(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://default.endpoint/slow", func(r *http.Request) (*http.Response, error) {
+		<-release
+		return httpmock.NewStringResponse(200, "slow"), nil
+	})
+	httpmock.RegisterResponder("GET", "http://default.endpoint/", httpmock.NewStringResponder(200, "default"))
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", httpmock.NewStringResponder(200, "one"))
+	httpmock.RegisterResponder("POST", "http://endpoint.one/route1", httpmock.NewStringResponder(502, "down"))
+	vars := new(expvar.Map)
+	config := buildConfiguration()
+	config.ExpvarMap = vars
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	dispatchBodies(h, []string{"/", "/route1", "/route1"})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/route1", strings.NewReader("body")))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dispatchBodies(h, []string{"/slow"})
+	}()
+	for vars.Get("in_flight").String() != "1" {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+
+	var bytesIn, bytesOut uint64
+	for _, stats := range h.Stats() {
+		bytesIn += stats.BytesIn
+		bytesOut += stats.BytesOut
+	}
+	expected := map[string]string{
+		"requests":  "5",
+		"errors":    "1",
+		"retries":   "0",
+		"bytes_in":  strconv.FormatUint(bytesIn, 10),
+		"bytes_out": strconv.FormatUint(bytesOut, 10),
+		"in_flight": "0",
+	}
+	for name, value := range expected {
+		if received := vars.Get(name).String(); received != value {
+			t.Errorf("unexpected value of %s\nexpected: %v\nreceived: %v", name, value, received)
+		}
+	}
+	var routes map[string]RouteStats
+	if err := json.Unmarshal([]byte(vars.Get("routes").String()), &routes); err != nil {
+		t.Fatalf("unable to decode routes: %s", err.Error())
+	}
+	if routes[""].Requests != 2 || routes["/route1"].Requests != 3 || routes["/route1"].Errors != 1 {
+		t.Errorf("unexpected per-route counters\nreceived: %+v", routes)
+	}
+}
+
+func TestExpvarPrefixIsReused(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, ""))
+	config := buildConfiguration()
+	config.ExpvarPrefix = "proxyhandler_test_reused"
+	first, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	dispatchBodies(first, []string{"/"})
+	second, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create a second proxyhandler with the same prefix: %s", err.Error())
+	}
+	dispatchBodies(second, []string{"/", "/"})
+
+	vars := expvar.Get("proxyhandler_test_reused").(*expvar.Map)
+	if received := vars.Get("requests").String(); received != "2" {
+		t.Errorf("expected the latest handler's counters to be published\nexpected: %v\nreceived: %v", "2", received)
+	}
+
+	if expvar.Get("proxyhandler_test_taken") == nil {
+		expvar.NewInt("proxyhandler_test_taken")
+	}
+	config.ExpvarPrefix = "proxyhandler_test_taken"
+	if _, err := New(config); err == nil {
+		t.Error("expected an error when the prefix names a variable which is not a map")
+	}
+}
@@ -0,0 +1,22 @@
+package proxyhandler
+
+import (
+	"net"
+	"net/url"
+)
+
+// upgradeToHTTPS returns endpointURL with its scheme changed from http to
+// https. Port 80, being the default for http, becomes 443, while other
+// explicit ports are kept. Endpoints with any other scheme are returned as
+// they are.
+func upgradeToHTTPS(endpointURL *url.URL) *url.URL {
+	if endpointURL == nil || endpointURL.Scheme != "http" {
+		return endpointURL
+	}
+	upgraded := *endpointURL
+	upgraded.Scheme = "https"
+	if upgraded.Port() == "80" {
+		upgraded.Host = net.JoinHostPort(upgraded.Hostname(), "443")
+	}
+	return &upgraded
+}
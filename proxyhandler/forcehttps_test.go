@@ -0,0 +1,80 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeToHTTPS(t *testing.T) {
+	examples := map[string]string{
+		"http://backend":            "https://backend",
+		"http://backend:80":         "https://backend:443",
+		"http://backend:8080":       "https://backend:8080",
+		"http://[::1]:80":           "https://[::1]:443",
+		"https://backend":           "https://backend",
+		"https://backend:80":        "https://backend:80",
+		"ws://backend":              "ws://backend",
+		"http://backend:80/prefix/": "https://backend:443/prefix/",
+	}
+	for endpoint, expected := range examples {
+		endpointURL, err := url.Parse(endpoint)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", endpoint, err.Error())
+		}
+		if received := upgradeToHTTPS(endpointURL).String(); received != expected {
+			t.Errorf("unexpected upgrade of %s\nexpected: %v\nreceived: %v", endpoint, expected, received)
+		}
+	}
+}
+
+func TestForceHTTPS(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Scheme+"://"+r.URL.Host), nil
+	})
+	routes := func() []*RouteRule {
+		return []*RouteRule{
+			&RouteRule{Path: "/forced", Endpoint: "http://forced:80", ForceHTTPS: true},
+			&RouteRule{Path: "/custom", Endpoint: "http://custom:8080", ForceHTTPS: true},
+			&RouteRule{Path: "/template", EndpointTemplate: "http://{value}.backend", TemplateValue: TemplateFromHeader("X-Tenant"), ForceHTTPS: true},
+			&RouteRule{Path: "/plain", Endpoint: "http://plain"},
+		}
+	}
+	config := buildConfiguration()
+	config.Routes = routes()
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	dispatch := func() string {
+		request := httptest.NewRequest("GET", "/template", nil)
+		request.Header.Set("X-Tenant", "acme")
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		return strings.Join(append(dispatchBodies(h, []string{"/forced", "/custom", "/plain", "/"}), recorder.Body.String()), " ")
+	}
+	expected := "https://forced:443 https://custom:8080 http://plain http://default.endpoint https://acme.backend"
+	if received := dispatch(); received != expected {
+		t.Errorf("unexpected upstreams\nexpected: %v\nreceived: %v", expected, received)
+	}
+
+	config = buildConfiguration()
+	config.Routes = routes()
+	config.ForceHTTPS = true
+	if h, err = New(config); err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	expected = "https://forced:443 https://custom:8080 https://plain https://default.endpoint https://acme.backend"
+	if received := dispatch(); received != expected {
+		t.Errorf("unexpected upstreams with ForceHTTPS set for the handler\nexpected: %v\nreceived: %v", expected, received)
+	}
+	if snapshot := h.Snapshot(); snapshot.Routes[3].ForceHTTPS || snapshot.Routes[3].Endpoint != "http://plain" {
+		t.Errorf("expected the handler's ForceHTTPS to leave the route as configured\nreceived: %+v", snapshot.Routes[3])
+	}
+}
@@ -0,0 +1,46 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// checkMessageFraming rejects requests whose body length is ambiguous, which
+// an upstream might read differently from the proxy: Transfer-Encoding
+// together with Content-Length, differing Content-Length values, and any
+// Transfer-Encoding other than a single "chunked".
+func checkMessageFraming(request *http.Request) error {
+	transferEncodings := append([]string{}, request.TransferEncoding...)
+	transferEncodings = append(transferEncodings, headerListValues(request.Header, "Transfer-Encoding")...)
+	contentLengths := headerListValues(request.Header, "Content-Length")
+
+	if len(transferEncodings) > 0 && len(contentLengths) > 0 {
+		return fmt.Errorf("request has both Transfer-Encoding and Content-Length")
+	}
+	for _, contentLength := range contentLengths {
+		if contentLength != contentLengths[0] {
+			return fmt.Errorf("request has conflicting Content-Length values")
+		}
+	}
+	if len(transferEncodings) > 1 {
+		return fmt.Errorf("request has multiple Transfer-Encoding values")
+	}
+	if len(transferEncodings) == 1 && !strings.EqualFold(transferEncodings[0], "chunked") {
+		return fmt.Errorf("unsupported Transfer-Encoding %q", transferEncodings[0])
+	}
+	return nil
+}
+
+// headerListValues returns the comma separated elements of every value of the
+// named header, trimmed of surrounding whitespace.
+func headerListValues(header http.Header, name string) []string {
+	var values []string
+	for _, value := range header[textproto.CanonicalMIMEHeaderKey(name)] {
+		for _, element := range strings.Split(value, ",") {
+			values = append(values, strings.TrimSpace(element))
+		}
+	}
+	return values
+}
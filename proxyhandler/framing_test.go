@@ -0,0 +1,78 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAmbiguousFramingIsRejected(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	upstreamCalls := 0
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		upstreamCalls++
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	cases := map[string]http.Header{
+		"te and cl":           http.Header{"Transfer-Encoding": {"chunked"}, "Content-Length": {"5"}},
+		"differing cl":        http.Header{"Content-Length": {"5", "6"}},
+		"differing cl list":   http.Header{"Content-Length": {"5, 6"}},
+		"obfuscated te":       http.Header{"Transfer-Encoding": {"chunked, identity"}},
+		"repeated te":         http.Header{"Transfer-Encoding": {"chunked", "chunked"}},
+		"unknown te":          http.Header{"Transfer-Encoding": {"xchunked"}},
+		"te with padded cl":   http.Header{"Transfer-Encoding": {" chunked"}, "Content-Length": {"0"}},
+		"identity te with cl": http.Header{"Transfer-Encoding": {"identity"}, "Content-Length": {"5"}},
+	}
+	for name, header := range cases {
+		request := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected\nexpected: %v\nreceived: %v", name, http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if upstreamCalls != 0 {
+		t.Errorf("expected no upstream calls for rejected requests\nexpected: %v\nreceived: %v", 0, upstreamCalls)
+	}
+}
+
+func TestUnambiguousFramingIsForwarded(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, ""))
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	cases := map[string]http.Header{
+		"cl":          http.Header{"Content-Length": {"5"}},
+		"repeated cl": http.Header{"Content-Length": {"5", "5"}},
+		"te":          http.Header{"Transfer-Encoding": {"chunked"}},
+		"neither":     http.Header{},
+	}
+	for name, header := range cases {
+		request := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("expected %s to be forwarded\nexpected: %v\nreceived: %v", name, http.StatusOK, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// trickyPaths are request paths which have confused URL handling before.
+var trickyPaths = []string{
+	"/",
+	"/api/a%2Fb",
+	"/api/../admin",
+	"/api/./v1/",
+	"//evil.example/path",
+	"/api//double",
+	"/bücher/ü",
+	"/%E2%82%AC?q=%2F&x=1",
+	"/api?",
+	"/a%252Fb",
+	"/api;param=1",
+	"/%",
+	"*",
+}
+
+func FuzzUpstreamURL(f *testing.F) {
+	for _, path := range trickyPaths {
+		f.Add("http://upstream:8080", path, "", "")
+		f.Add("http://[::1]:9000/ignored", path, "/api", "/v2")
+		f.Add(":8000", path, "/", "/prefix/")
+	}
+	f.Add("https://bücher.example", "/x", "/x", "")
+	f.Add("ws://socket", "/ws?token=a%20b", "", "")
+
+	config := buildConfiguration()
+	f.Fuzz(func(t *testing.T, endpoint, requestURI, rewriteFrom, rewriteTo string) {
+		route, err := config.validateRoute(RouteRule{Path: "/", Endpoint: endpoint, RewriteFrom: rewriteFrom, RewriteTo: rewriteTo}, config.Transport)
+		if err != nil {
+			return
+		}
+		requestURL, err := url.ParseRequestURI(requestURI)
+		if err != nil {
+			return
+		}
+		upstreamURL := route.rewritePath(buildDownstreamRequestURL(requestURL, route.EndpointURL))
+		if requestURL.Path == "*" && requestURL.RawQuery == "" {
+			if upstreamURL.RequestURI() != "*" || upstreamURL.Host != route.EndpointURL.Host {
+				t.Errorf("asterisk-form request is not preserved\nexpected: %v\nreceived: %v %v", "*", upstreamURL.Host, upstreamURL.RequestURI())
+			}
+			return
+		}
+
+		reparsed, err := url.Parse(upstreamURL.String())
+		if err != nil {
+			t.Fatalf("upstream URL %q does not parse: %s", upstreamURL.String(), err.Error())
+		}
+		if reparsed.Scheme != route.EndpointURL.Scheme || reparsed.Host != route.EndpointURL.Host {
+			t.Errorf("upstream URL %q leaves the endpoint\nexpected: %v\nreceived: %v", upstreamURL.String(), route.EndpointURL.Scheme+"://"+route.EndpointURL.Host, reparsed.Scheme+"://"+reparsed.Host)
+		}
+		if reparsed.EscapedPath() != upstreamURL.EscapedPath() {
+			t.Errorf("upstream path changes when reparsed\nexpected: %v\nreceived: %v", upstreamURL.EscapedPath(), reparsed.EscapedPath())
+		}
+		if reparsed.RawQuery != requestURL.RawQuery {
+			t.Errorf("upstream query changes\nexpected: %v\nreceived: %v", requestURL.RawQuery, reparsed.RawQuery)
+		}
+	})
+}
+
+func FuzzRouteMatchingIsStable(f *testing.F) {
+	for _, path := range trickyPaths {
+		f.Add(path, "/other")
+		f.Add(path, "/api/v")
+	}
+	f.Add("/api/v1", "/api/v2")
+	f.Add("/static/app.js", "/stat")
+
+	f.Fuzz(func(t *testing.T, path, unrelated string) {
+		matchPath, ok := normalizePath(path)
+		if !ok || strings.HasPrefix(matchPath, unrelated) {
+			return
+		}
+		httpmock.Activate()
+		defer httpmock.DeactivateAndReset()
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+		httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+			return httpmock.NewStringResponse(200, r.URL.Host), nil
+		})
+
+		config := buildConfiguration()
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/api/v1", Endpoint: "http://v1"},
+			&RouteRule{Path: "/api", Endpoint: "http://api"},
+			&RouteRule{Path: "/static/", Endpoint: "http://static"},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		dispatch := func() string {
+			request := httptest.NewRequest("GET", "/", nil)
+			request.URL.Path = path
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, request)
+			return recorder.Body.String()
+		}
+
+		before := dispatch()
+		if err := h.AddRoute(RouteRule{Path: unrelated, Endpoint: "http://unrelated"}); err != nil {
+			return
+		}
+		if after := dispatch(); after != before {
+			t.Errorf("adding route %q changed where %q is sent\nexpected: %v\nreceived: %v", unrelated, path, before, after)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package proxyhandler
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// defaultHashReplicas is the number of points each endpoint is given on a
+// route's hash ring when HashReplicas is unset.
+const defaultHashReplicas = 100
+
+// hashRing places several points for each of a route's endpoints on a ring
+// of 64-bit hashes. A key belongs to the endpoint of the first point at or
+// after its own hash, so removing an endpoint only moves the keys which
+// belonged to it. Points are derived from the endpoint's URL rather than its
+// position, so the same endpoint keeps its points across route changes.
+type hashRing struct {
+	hashes  []uint64
+	indexes []int
+}
+
+// hashString hashes value with FNV-1a, whose output for values differing in
+// their last bytes is too alike to spread them around a ring, so it is mixed
+// with the finalizer of MurmurHash3.
+func hashString(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	sum := hash.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return sum
+}
+
+func newHashRing(endpoints []*url.URL, replicas int) *hashRing {
+	if replicas == 0 {
+		replicas = defaultHashReplicas
+	}
+	type point struct {
+		hash  uint64
+		index int
+	}
+	points := make([]point, 0, len(endpoints)*replicas)
+	for index, endpoint := range endpoints {
+		for replica := 0; replica < replicas; replica++ {
+			points = append(points, point{hashString(endpoint.String() + "#" + strconv.Itoa(replica)), index})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	ring := &hashRing{hashes: make([]uint64, len(points)), indexes: make([]int, len(points))}
+	for position, point := range points {
+		ring.hashes[position], ring.indexes[position] = point.hash, point.index
+	}
+	return ring
+}
+
+// choose returns the index of the endpoint key belongs to, continuing around
+// the ring past endpoints for which skip reports true unless every endpoint
+// is skipped.
+func (ring *hashRing) choose(key string, skip func(int) bool) int {
+	hash := hashString(key)
+	start := sort.Search(len(ring.hashes), func(position int) bool { return ring.hashes[position] >= hash })
+	for offset := 0; offset < len(ring.hashes); offset++ {
+		if index := ring.indexes[(start+offset)%len(ring.hashes)]; !skip(index) {
+			return index
+		}
+	}
+	return ring.indexes[start%len(ring.hashes)]
+}
+
+// HashKeyFromPath returns a HashKey which sends requests for the same path to
+// the same endpoint.
+func HashKeyFromPath() func(*http.Request) string {
+	return func(request *http.Request) string {
+		return request.URL.Path
+	}
+}
+
+// HashKeyFromHeader returns a HashKey which reads the header name. Requests
+// without the header are sent to the endpoints in rotation.
+func HashKeyFromHeader(name string) func(*http.Request) string {
+	return func(request *http.Request) string {
+		return request.Header.Get(name)
+	}
+}
+
+// HashKeyFromQuery returns a HashKey which reads the query parameter name.
+// Requests without the parameter are sent to the endpoints in rotation.
+func HashKeyFromQuery(name string) func(*http.Request) string {
+	return func(request *http.Request) string {
+		return request.URL.Query().Get(name)
+	}
+}
@@ -0,0 +1,103 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConsistentHashingKeepsKeysOnRemainingEndpoints(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	hashedRoute := func(endpoints ...string) []*RouteRule {
+		return []*RouteRule{
+			&RouteRule{Path: "/cache", Endpoints: endpoints, HashKey: HashKeyFromQuery("key")},
+		}
+	}
+	config := buildConfiguration()
+	config.Routes = hashedRoute("http://one", "http://two", "http://three", "http://four")
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	paths := make([]string, 1000)
+	for index := range paths {
+		paths[index] = fmt.Sprintf("/cache?key=resource-%d", index)
+	}
+	before := dispatchBodies(h, paths)
+	if again := dispatchBodies(h, paths); !reflect.DeepEqual(before, again) {
+		t.Fatalf("expected keys to map to the same endpoint on every request")
+	}
+	shares := make(map[string]int)
+	for _, host := range before {
+		shares[host]++
+	}
+	for _, host := range []string{"one", "two", "three", "four"} {
+		if shares[host] < 150 || shares[host] > 350 {
+			t.Errorf("unbalanced share of keys for %s\nreceived: %v", host, shares)
+		}
+	}
+
+	err = h.Reload(&Configuration{
+		DefaultRoute: "http://default.endpoint",
+		Routes:       hashedRoute("http://one", "http://two", "http://four"),
+	})
+	if err != nil {
+		t.Fatalf("unable to reload: %s", err.Error())
+	}
+	after := dispatchBodies(h, paths)
+	for index := range paths {
+		if before[index] != "three" && after[index] != before[index] {
+			t.Errorf("key %s moved from %s to %s", paths[index], before[index], after[index])
+		}
+		if after[index] == "three" {
+			t.Errorf("key %s still sent to removed endpoint", paths[index])
+		}
+	}
+}
+
+func TestConsistentHashingRotatesRequestsWithoutKey(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/cache", Endpoints: []string{"http://one", "http://two"}, HashKey: HashKeyFromHeader("X-Key")},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	expected := "one two one"
+	if received := strings.Join(dispatchBodies(h, []string{"/cache", "/cache", "/cache"}), " "); received != expected {
+		t.Errorf("unexpected endpoints\nexpected: %v\nreceived: %v", expected, received)
+	}
+}
+
+func TestConsistentHashingValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"requires several endpoints": RouteRule{Path: "/", Endpoint: "http://one", HashKey: HashKeyFromPath()},
+		"cannot be combined with slow start": RouteRule{Path: "/", Endpoints: []string{"http://one", "http://two"},
+			HashKey: HashKeyFromPath(), SlowStart: 1},
+		"cannot be combined with hedging": RouteRule{Path: "/", Endpoints: []string{"http://one", "http://two"},
+			HashKey: HashKeyFromPath(), HedgeDelay: 1},
+		"hash replicas is negative": RouteRule{Path: "/", Endpoints: []string{"http://one", "http://two"},
+			HashKey: HashKeyFromPath(), HashReplicas: -1},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
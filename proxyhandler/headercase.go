@@ -0,0 +1,66 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// setHeaderCase moves the values of each header named in names from its
+// canonical key to a key spelled exactly as the name is, so that it is
+// written to the wire in that casing. It must be the last change made to
+// header, since Get and Set no longer find the headers it moved.
+func setHeaderCase(header http.Header, names []string) {
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == name {
+			continue
+		}
+		if values, ok := header[canonical]; ok {
+			delete(header, canonical)
+			header[name] = values
+		}
+	}
+}
+
+// validateHeaderCase checks that the names listed for their casing are
+// header names.
+func validateHeaderCase(names []string) error {
+	for _, name := range names {
+		if !validToken(name) {
+			return fmt.Errorf("invalid header name %q in header casing", name)
+		}
+	}
+	return nil
+}
+
+// headerCaseTransport sets the casing of the route's RequestHeaderCase on
+// requests once the rest of the handler, including any Signer, is done with
+// them, for the handler's StdlibProxy.
+type headerCaseTransport struct {
+	transport http.RoundTripper
+	names     []string
+}
+
+func (transport *headerCaseTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	setHeaderCase(request.Header, transport.names)
+	return transport.transport.RoundTrip(request)
+}
+
+// headerCaseWriter sets the casing of the route's ResponseHeaderCase as the
+// response is started, for the handler's StdlibProxy, which copies the
+// upstream's headers to the client's response in canonical form.
+type headerCaseWriter struct {
+	http.ResponseWriter
+	names []string
+}
+
+func (writer *headerCaseWriter) WriteHeader(status int) {
+	setHeaderCase(writer.Header(), writer.names)
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (writer *headerCaseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
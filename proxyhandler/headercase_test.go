@@ -0,0 +1,106 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// rawUpstream answers each connection with response, sending the request head
+// it read on received.
+func rawUpstream(t *testing.T, response string) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			var head strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				head.WriteString(line)
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			received <- head.String()
+			io.WriteString(conn, response)
+			conn.Close()
+		}
+	}()
+	return listener, received
+}
+
+func TestHeaderCaseIsPreservedOnTheWire(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			upstream, received := rawUpstream(t, "HTTP/1.1 200 OK\r\nX-Soap-Result: done\r\nX-Other-Id: 7\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			defer upstream.Close()
+			config := buildConfiguration()
+			config.Transport = nil
+			config.StdlibProxy = mode.stdlib
+			config.Routes = []*RouteRule{
+				&RouteRule{
+					Path:               "/soap",
+					Endpoint:           "http://" + upstream.Addr().String(),
+					RequestHeaderCase:  []string{"SOAPAction"},
+					ResponseHeaderCase: []string{"X-SOAP-Result"},
+				},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			proxy := httptest.NewServer(h)
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+			if err != nil {
+				t.Fatalf("unable to connect to the proxy: %s", err.Error())
+			}
+			defer conn.Close()
+			io.WriteString(conn, "GET /soap HTTP/1.1\r\nHost: proxy\r\nSoapaction: urn:lookup\r\nX-Other-Action: keep\r\nConnection: close\r\n\r\n")
+			response, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("unable to read the response: %s", err.Error())
+			}
+
+			request := <-received
+			if !strings.Contains(request, "\r\nSOAPAction: urn:lookup\r\n") {
+				t.Errorf("expected the listed request header in its casing\nreceived: %q", request)
+			}
+			if !strings.Contains(request, "\r\nX-Other-Action: keep\r\n") {
+				t.Errorf("expected other request headers in canonical form\nreceived: %q", request)
+			}
+			if !strings.Contains(string(response), "\r\nX-SOAP-Result: done\r\n") {
+				t.Errorf("expected the listed response header in its casing\nreceived: %q", response)
+			}
+			if !strings.Contains(string(response), "\r\nX-Other-Id: 7\r\n") || !strings.HasSuffix(string(response), "\r\n\r\nok") {
+				t.Errorf("expected the rest of the response unchanged\nreceived: %q", response)
+			}
+		})
+	}
+}
+
+func TestHeaderCaseIsValidated(t *testing.T) {
+	route := RouteRule{Path: "/", Endpoint: "http://one", RequestHeaderCase: []string{"SOAP Action"}}
+	expectedError := `invalid header name "SOAP Action" in header casing`
+	if _, err := route.validate(); err == nil || err.Error() != expectedError {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,102 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/http/httpguts"
+	"net/http"
+	"slices"
+)
+
+// ErrInvalidUpstreamHeaders is wrapped by the error reported when the headers
+// of a request about to be sent upstream are invalid or too large. Such a
+// request is answered with 500 Internal Server Error, as the headers at fault
+// are the work of the route's rules rather than the client.
+var ErrInvalidUpstreamHeaders = errors.New("invalid upstream request headers")
+
+// headerRuleError marks a request forwarded by an httputil.ReverseProxy whose
+// headers failed checkHeaderRules, or whose Director panicked, so that it is
+// answered with a 500 rather than treated as an upstream failure.
+type headerRuleError struct {
+	err error
+}
+
+func (err *headerRuleError) Error() string { return err.err.Error() }
+func (err *headerRuleError) Unwrap() error { return err.err }
+
+// headerGuardTransport refuses to send a request forwarded by an
+// httputil.ReverseProxy once its Rewrite has found the headers invalid or the
+// Director has panicked, as Rewrite cannot fail the request itself.
+type headerGuardTransport struct {
+	transport http.RoundTripper
+	err       error
+}
+
+func (transport *headerGuardTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.err != nil {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, &headerRuleError{transport.err}
+	}
+	next := transport.transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(request)
+}
+
+// headerRule names the rule of route which sets the header name.
+func (route *validRouteRule) headerRule(name string) string {
+	for index, contextHeader := range route.ContextHeaders {
+		if http.CanonicalHeaderKey(contextHeader.Header) == name {
+			return fmt.Sprintf("ContextHeaders[%d]", index)
+		}
+	}
+	if http.CanonicalHeaderKey(route.SubdomainHeader) == name {
+		return "SubdomainHeader"
+	}
+	return "Director"
+}
+
+// checkHeaderRules checks the headers of request which the route's rules
+// added or changed from those in before. Their names and values must be
+// valid, and each header must fit within the handler's
+// MaxUpstreamHeaderValueBytes. The whole of the headers, including those
+// passed through from the client unchanged, must fit within
+// MaxUpstreamHeaderBytes.
+func (handler *ProxyHandler) checkHeaderRules(route *validRouteRule, before http.Header, request *http.Request) error {
+	total := 0
+	for name, values := range request.Header {
+		size := 0
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+		total += size
+		if slices.Equal(before[name], values) {
+			continue
+		}
+		rule := route.headerRule(name)
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("%w: route %s: %s set the invalid header name %q", ErrInvalidUpstreamHeaders, route.Path, rule, name)
+		}
+		for _, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("%w: route %s: %s set header %s to a value with control characters", ErrInvalidUpstreamHeaders, route.Path, rule, name)
+			}
+		}
+		if limit := handler.configuration.MaxUpstreamHeaderValueBytes; limit > 0 && size > limit {
+			return fmt.Errorf("%w: route %s: %s set header %s of %d bytes, over the limit of %d", ErrInvalidUpstreamHeaders, route.Path, rule, name, size, limit)
+		}
+	}
+	if limit := handler.configuration.MaxUpstreamHeaderBytes; limit > 0 && total > limit {
+		return fmt.Errorf("%w: route %s: headers of %d bytes, over the limit of %d", ErrInvalidUpstreamHeaders, route.Path, total, limit)
+	}
+	return nil
+}
+
+// guardsHeaders reports whether the headers of the route's upstream requests
+// are checked before they are sent.
+func (handler *ProxyHandler) guardsHeaders(route *validRouteRule) bool {
+	return len(route.ContextHeaders) > 0 || route.SubdomainHeader != "" || route.Director != nil || handler.configuration.MaxUpstreamHeaderBytes > 0
+}
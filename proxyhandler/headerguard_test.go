@@ -0,0 +1,79 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRulesAreChecked(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	examples := []struct {
+		path     string
+		expected string
+	}{
+		{"/ok", ""},
+		{"/name", `Director set the invalid header name "X Bad"`},
+		{"/value", "ContextHeaders[0] set header X-Tenant to a value with control characters"},
+		{"/large", "Director set header X-Large of"},
+		{"/total", "headers of"},
+	}
+	for _, mode := range proxyModes {
+		var observed error
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.MaxUpstreamHeaderValueBytes = 1024
+		config.MaxUpstreamHeaderBytes = 4096
+		config.Observer = func(observation *Observation) {
+			observed = observation.Err
+		}
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/ok", Endpoint: upstream.URL, ContextHeaders: []ContextHeader{{Header: "X-Tenant", Key: contextKey("tenant")}}},
+			&RouteRule{Path: "/name", Endpoint: upstream.URL, Director: func(r *http.Request) { r.Header["X Bad"] = []string{"1"} }},
+			&RouteRule{Path: "/value", Endpoint: upstream.URL, ContextHeaders: []ContextHeader{{Header: "X-Tenant", Key: contextKey("tenant"), Format: func(interface{}) string { return "acme\r\nX-Admin: 1" }}}},
+			&RouteRule{Path: "/large", Endpoint: upstream.URL, Director: func(r *http.Request) { r.Header.Set("X-Large", strings.Repeat("x", 2048)) }},
+			&RouteRule{Path: "/total", Endpoint: upstream.URL},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+
+		for _, example := range examples {
+			observed = nil
+			request := httptest.NewRequest("GET", example.path, nil)
+			request = request.WithContext(context.WithValue(request.Context(), contextKey("tenant"), "acme"))
+			// a large header from the client passes unless the total is exceeded
+			request.Header.Set("X-Client", strings.Repeat("c", 2048))
+			if example.path == "/total" {
+				request.Header.Set("X-More", strings.Repeat("m", 2048))
+			}
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, request)
+			if example.expected == "" {
+				if recorder.Code != http.StatusOK {
+					t.Errorf("%s %s: unexpected status\nexpected: %v\nreceived: %v", mode.name, example.path, http.StatusOK, recorder.Code)
+				}
+				continue
+			}
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("%s %s: unexpected status\nexpected: %v\nreceived: %v", mode.name, example.path, http.StatusInternalServerError, recorder.Code)
+			}
+			if !errors.Is(observed, ErrInvalidUpstreamHeaders) || !strings.Contains(observed.Error(), example.expected) {
+				t.Errorf("%s %s: unexpected error\nexpected: %v\nreceived: %v", mode.name, example.path, example.expected, observed)
+			}
+		}
+	}
+}
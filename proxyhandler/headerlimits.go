@@ -0,0 +1,46 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrResponseHeadersTooLarge is wrapped by the error reported when an
+// upstream's response headers exceed MaxResponseHeaderBytes or
+// MaxResponseHeaders.
+var ErrResponseHeadersTooLarge = errors.New("upstream response headers too large")
+
+// isResponseHeaderSizeError reports whether err is http.Transport refusing
+// response headers larger than its MaxResponseHeaderBytes, for which it has no
+// error value of its own.
+func isResponseHeaderSizeError(err error) bool {
+	return strings.Contains(err.Error(), "server response headers exceeded")
+}
+
+// maxResponseHeaders returns the number of header fields route accepts in an
+// upstream response, or zero for no limit.
+func (handler *ProxyHandler) maxResponseHeaders(route *validRouteRule) int {
+	if route.MaxResponseHeaders > 0 {
+		return route.MaxResponseHeaders
+	}
+	return handler.configuration.MaxResponseHeaders
+}
+
+// checkResponseHeaders fails when response carries more header fields than
+// route accepts, counting each value of a repeated field.
+func (handler *ProxyHandler) checkResponseHeaders(route *validRouteRule, response *http.Response) error {
+	limit := handler.maxResponseHeaders(route)
+	if limit == 0 {
+		return nil
+	}
+	count := 0
+	for _, values := range response.Header {
+		count += len(values)
+	}
+	if count > limit {
+		return fmt.Errorf("%w: %d fields exceed the limit of %d", ErrResponseHeadersTooLarge, count, limit)
+	}
+	return nil
+}
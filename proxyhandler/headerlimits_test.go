@@ -0,0 +1,96 @@
+package proxyhandler
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResponseHeaderLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "leaked")
+		if strings.HasSuffix(r.URL.Path, "/big") {
+			w.Header().Set("Set-Cookie", "session="+strings.Repeat("x", 64<<10))
+		}
+		if strings.HasSuffix(r.URL.Path, "/many") {
+			for i := 0; i < 50; i++ {
+				w.Header().Add("X-Many", strconv.Itoa(i))
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	examples := []struct {
+		path     string
+		expected int
+	}{
+		{"/strict/big", http.StatusBadGateway},
+		{"/strict/many", http.StatusBadGateway},
+		{"/strict/small", http.StatusOK},
+		{"/lenient/big", http.StatusOK},
+		{"/lenient/many", http.StatusOK},
+	}
+	for _, mode := range proxyModes {
+		var observed error
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.DefaultRoute = upstream.URL
+		config.MaxResponseHeaderBytes = 16 << 10
+		config.MaxResponseHeaders = 20
+		config.Observer = func(observation *Observation) {
+			observed = observation.Err
+		}
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/strict", Endpoint: upstream.URL},
+			&RouteRule{Path: "/lenient", Endpoint: upstream.URL, MaxResponseHeaderBytes: 1 << 20, MaxResponseHeaders: 100},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+
+		for _, example := range examples {
+			observed = nil
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", example.path, nil))
+			if recorder.Code != example.expected {
+				t.Errorf("%s %s: unexpected status\nexpected: %v\nreceived: %v", mode.name, example.path, example.expected, recorder.Code)
+			}
+			if example.expected != http.StatusBadGateway {
+				continue
+			}
+			if !errors.Is(observed, ErrResponseHeadersTooLarge) {
+				t.Errorf("%s %s: unexpected error\nexpected: %v\nreceived: %v", mode.name, example.path, ErrResponseHeadersTooLarge, observed)
+			}
+			for _, name := range []string{"X-Upstream", "Set-Cookie", "X-Many"} {
+				if value := recorder.Header().Get(name); value != "" {
+					t.Errorf("%s %s: upstream header %s leaked to the client", mode.name, example.path, name)
+				}
+			}
+		}
+	}
+}
+
+func TestResponseHeaderLimitValidation(t *testing.T) {
+	config := buildConfiguration()
+	config.MaxResponseHeaders = -1
+	expectedError := "response header limits must not be negative"
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+	route := RouteRule{Path: "/", Endpoint: "http://endpoint.one", MaxResponseHeaderBytes: -1}
+	if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,169 @@
+package proxyhandler
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// hedgeResult is the outcome of one of the requests raced by a hedge.
+type hedgeResult struct {
+	response *http.Response
+	err      error
+	progress *upstreamProgress
+	upstream *url.URL
+	hedge    bool
+	index    int
+}
+
+// cancelOnClose releases a winning request's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (route *validRouteRule) hedges(observation *Observation, request *http.Request, body *bufferedBody) bool {
+	return route.HedgeDelay > 0 && len(route.EndpointURLs) > 1 && observation.Variant == "" &&
+		isIdempotent(request.Method) && body.replayable()
+}
+
+// roundTrip sends downstreamRequest, hedging it with a copy sent to another
+// endpoint when the route calls for it. The upstream of the response relayed
+// is recorded in observation.
+func (handler *ProxyHandler) roundTrip(route *validRouteRule, observation *Observation, upstreamRequest *http.Request, body *bufferedBody, downstreamRequest *http.Request) (*http.Response, *upstreamProgress, error) {
+	if !route.hedges(observation, upstreamRequest, body) {
+		progress := &upstreamProgress{}
+		downstreamRequest = downstreamRequest.WithContext(progress.trace(downstreamRequest.Context()))
+		response, err := handler.clientFor(route).Do(downstreamRequest)
+		return response, progress, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func(request *http.Request, upstream *url.URL, hedge bool) {
+		ctx, cancel := context.WithCancel(request.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		progress := &upstreamProgress{}
+		request = request.WithContext(progress.trace(ctx))
+		go func() {
+			response, err := handler.clientFor(route).Do(request)
+			results <- hedgeResult{response, err, progress, upstream, hedge, index}
+		}()
+	}
+
+	launch(downstreamRequest, observation.Upstream, false)
+	pending := 1
+	hedgeTimer := handler.after(route.HedgeDelay)
+	for {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if hedgeRequest, upstream := handler.buildHedgeRequest(route, observation, upstreamRequest, body); hedgeRequest != nil {
+				observation.Hedged = true
+				launch(hedgeRequest, upstream, true)
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err != nil && pending > 0 {
+				continue
+			}
+			if result.err != nil {
+				for _, cancel := range cancels {
+					cancel()
+				}
+				return nil, result.progress, result.err
+			}
+			handler.abandonHedges(results, pending, cancels, result.index)
+			result.response.Body = &cancelOnClose{ReadCloser: result.response.Body, cancel: cancels[result.index]}
+			observation.Upstream = result.upstream
+			observation.HedgeWon = result.hedge
+			return result.response, result.progress, nil
+		}
+	}
+}
+
+// hedgeEndpoint returns the endpoint of route which hedges a request sent to
+// primary: the next in rotation other than primary, passing over those
+// ejected by outlier detection, or nil when no other endpoint is available.
+func (handler *ProxyHandler) hedgeEndpoint(route *validRouteRule, primary *url.URL) *url.URL {
+	var index int
+	available := true
+	choose := func(ejected func(int) bool) int {
+		skip := func(index int) bool {
+			return route.EndpointURLs[index] == primary || ejected(index)
+		}
+		index = route.rotate(skip)
+		available = !skip(index)
+		return index
+	}
+	if route.outliers == nil {
+		choose(func(int) bool { return false })
+	} else {
+		now := handler.now()
+		_, changes := route.outliers.pick(choose, now)
+		handler.reportOutliers(route, changes, now)
+	}
+	if !available {
+		return nil
+	}
+	return route.EndpointURLs[index]
+}
+
+// buildHedgeRequest prepares a copy of upstreamRequest for an endpoint other
+// than the one already tried, or returns nil if none can be prepared.
+func (handler *ProxyHandler) buildHedgeRequest(route *validRouteRule, observation *Observation, upstreamRequest *http.Request, body *bufferedBody) (*http.Request, *url.URL) {
+	upstream := handler.hedgeEndpoint(route, observation.Upstream)
+	if upstream == nil {
+		log.Printf("proxy: no endpoint left to hedge %s", upstreamRequest.URL.String())
+		return nil, nil
+	}
+	hedgeObservation := *observation
+	hedgeObservation.Upstream = upstream
+	request, err := handler.buildUpstreamRequest(route, &hedgeObservation, upstreamRequest, body)
+	if err != nil {
+		log.Printf("proxy: unable to hedge %s: %s", upstreamRequest.URL.String(), err.Error())
+		return nil, nil
+	}
+	log.Printf("proxy: hedging %s with %s", upstreamRequest.URL.String(), upstream.String())
+	return request, upstream
+}
+
+// abandonHedges cancels every raced request except the winner's and closes
+// the responses of those still pending once they return.
+func (handler *ProxyHandler) abandonHedges(results chan hedgeResult, pending int, cancels []context.CancelFunc, winner int) {
+	for index, cancel := range cancels {
+		if index != winner {
+			cancel()
+		}
+	}
+	if pending == 0 {
+		return
+	}
+	handler.background.Add(1)
+	go func() {
+		defer handler.background.Done()
+		for ; pending > 0; pending-- {
+			if result := <-results; result.response != nil {
+				result.response.Body.Close()
+			}
+		}
+	}()
+}
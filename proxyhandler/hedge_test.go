@@ -0,0 +1,160 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSlowServer answers after a second unless the request is canceled first,
+// in which case canceled receives a value.
+func newSlowServer(canceled chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+}
+
+func TestHedgedRequestUsesFastestEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	canceled := make(chan struct{}, 1)
+	slow := newSlowServer(canceled)
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	var observation *Observation
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{slow.URL, fast.URL}, HedgeDelay: 20 * time.Millisecond},
+	}
+	config.Observer = func(o *Observation) {
+		observation = o
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/api", nil))
+	if recorder.Body.String() != "fast" {
+		t.Errorf("expected fast endpoint's response\nexpected: %v\nreceived: %v", "fast", recorder.Body.String())
+	}
+	if observation == nil || !observation.Hedged || !observation.HedgeWon || observation.Upstream.String() != fast.URL {
+		t.Errorf("expected observation to record the winning hedge\nreceived: %+v", observation)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("expected slow endpoint to see its request canceled")
+	}
+}
+
+func TestHedgingSkipsNonIdempotentRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	canceled := make(chan struct{}, 1)
+	slow := newSlowServer(canceled)
+	defer slow.Close()
+	var fastHits atomic.Int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+	}))
+	defer fast.Close()
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{slow.URL, fast.URL}, HedgeDelay: 20 * time.Millisecond},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/api", strings.NewReader("order")))
+	if recorder.Body.String() != "slow" || fastHits.Load() != 0 {
+		t.Errorf("expected POST to be sent once\nexpected: %v\nreceived: %v with %d hedges", "slow", recorder.Body.String(), fastHits.Load())
+	}
+}
+
+func TestEndpointsRotate(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two", "http://three"}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	route := h.routes.Load().routes[0]
+	expected := []string{"http://one", "http://two", "http://three", "http://one"}
+	for _, endpoint := range expected {
+		if received := route.nextEndpoint().String(); received != endpoint {
+			t.Errorf("unexpected endpoint in rotation\nexpected: %v\nreceived: %v", endpoint, received)
+		}
+	}
+
+	route2 := RouteRule{Path: "/api", Endpoint: "http://one", Endpoints: []string{"http://two"}}
+	expectedError := "mutually exclusive"
+	if _, err := route2.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+func TestHedgeEndpointDiffersFromPrimary(t *testing.T) {
+	route, err := (&RouteRule{
+		Path:       "/api",
+		Endpoints:  []string{"http://one", "http://two", "http://three"},
+		HedgeDelay: time.Millisecond,
+		OutlierDetection: &OutlierDetection{
+			Window:             5,
+			MaxErrorRate:       0.5,
+			MaxEjectionPercent: 100,
+			BaseEjectionTime:   time.Minute,
+		},
+	}).validate()
+	if err != nil {
+		t.Fatalf("unable to validate route: %s", err.Error())
+	}
+	h := &ProxyHandler{now: time.Now}
+
+	for offset := 0; offset < 3; offset++ {
+		for _, primary := range route.EndpointURLs {
+			route.rotation.Store(uint64(offset))
+			if hedge := h.hedgeEndpoint(route, primary); hedge == nil || hedge == primary {
+				t.Errorf("unexpected hedge endpoint for %s at offset %d\nreceived: %v", primary, offset, hedge)
+			}
+		}
+	}
+
+	// with every other endpoint ejected, the request is not hedged
+	route.outliers.health[1].ejectedUntil = time.Now().Add(time.Minute)
+	route.outliers.health[2].ejectedUntil = time.Now().Add(time.Minute)
+	for offset := 0; offset < 3; offset++ {
+		route.rotation.Store(uint64(offset))
+		if hedge := h.hedgeEndpoint(route, route.EndpointURLs[0]); hedge != nil {
+			t.Errorf("expected no hedge endpoint at offset %d\nreceived: %v", offset, hedge)
+		}
+	}
+}
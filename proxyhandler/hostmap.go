@@ -0,0 +1,81 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// MapHost presents requests which arrive for the host from to the upstream as
+// the host to, independent of which route they match. Both the Host header
+// and the host dialed are replaced; when to has no port, the port of the
+// route's endpoint is kept. Incoming hosts are matched without regard to case
+// or port. Requests for hosts which are not mapped are sent to the endpoint's
+// host as before. Mapping a host again replaces its previous mapping.
+func (handler *ProxyHandler) MapHost(from, to string) error {
+	fromURL, err := parseHostname(from)
+	if err != nil {
+		return fmt.Errorf("invalid host %q: %s", from, err.Error())
+	}
+	if fromURL.Port() != "" {
+		return fmt.Errorf("invalid host %q: incoming hosts are matched without a port", from)
+	}
+	toURL, err := parseHostname(to)
+	if err != nil {
+		return fmt.Errorf("invalid host %q: %s", to, err.Error())
+	}
+
+	handler.hostsMutex.Lock()
+	defer handler.hostsMutex.Unlock()
+	hosts := make(map[string]string)
+	if current := handler.hosts.Load(); current != nil {
+		for key, value := range *current {
+			hosts[key] = value
+		}
+	}
+	hosts[fromURL.Hostname()] = toURL.Host
+	handler.hosts.Store(&hosts)
+	log.Printf("proxy: host %s -> %s", fromURL.Hostname(), toURL.Host)
+	return nil
+}
+
+// parseHostname validates a host name with an optional port, returning it in
+// lower-case ASCII form as the Host of a URL.
+func parseHostname(host string) (*url.URL, error) {
+	if len(host) == 0 {
+		return nil, fmt.Errorf("host is empty")
+	}
+	hostURL, err := parseEndpoint("http://" + host)
+	if err != nil {
+		return nil, err
+	}
+	if hostURL.User != nil || hostURL.Path != "" || hostURL.RawQuery != "" || hostURL.ForceQuery || hostURL.Fragment != "" {
+		return nil, fmt.Errorf("not a host name")
+	}
+	hostURL.Host = strings.ToLower(hostURL.Host)
+	return hostURL, nil
+}
+
+// mapHost replaces the host of upstreamURL according to the host mapping for
+// requestHost, reporting whether a mapping applied.
+func (handler *ProxyHandler) mapHost(upstreamURL *url.URL, requestHost string) bool {
+	hosts := handler.hosts.Load()
+	if hosts == nil {
+		return false
+	}
+	hostname := requestHost
+	if host, _, err := net.SplitHostPort(requestHost); err == nil {
+		hostname = host
+	}
+	mapped, ok := (*hosts)[strings.ToLower(hostname)]
+	if !ok {
+		return false
+	}
+	if _, _, err := net.SplitHostPort(mapped); err != nil && upstreamURL.Port() != "" {
+		mapped = net.JoinHostPort(strings.Trim(mapped, "[]"), upstreamURL.Port())
+	}
+	upstreamURL.Host = mapped
+	return true
+}
@@ -0,0 +1,76 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMapHostRewritesUpstreamHost(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.Host+" "+r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default:8080"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if err := h.MapHost("api.acme.com", "acme.internal"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := h.MapHost("api.globex.com", "globex.internal:9000"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expectations := map[string]string{
+		"api.acme.com":     "acme.internal:8080 acme.internal:8080",
+		"API.Acme.com:443": "acme.internal:8080 acme.internal:8080",
+		"api.globex.com":   "globex.internal:9000 globex.internal:9000",
+		"www.initech.com":  "default:8080 default:8080",
+	}
+	for host, expected := range expectations {
+		request := httptest.NewRequest("GET", "/anything", nil)
+		request.Host = host
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Body.String() != expected {
+			t.Errorf("unexpected upstream host for %s\nexpected: %v\nreceived: %v", host, expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestMapHostValidatesNames(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	invalid := [][2]string{
+		{"", "acme.internal"},
+		{"api.acme.com", ""},
+		{"api.acme.com:443", "acme.internal"},
+		{"api.acme.com/path", "acme.internal"},
+		{"api.acme.com", "user@acme.internal"},
+		{"api.acme.com", "acme.internal:99999"},
+		{"api acme.com", "acme.internal"},
+	}
+	for _, names := range invalid {
+		if err := h.MapHost(names[0], names[1]); err == nil {
+			t.Errorf("expected mapping %q -> %q to be rejected", names[0], names[1])
+		}
+	}
+	if h.hosts.Load() != nil {
+		t.Errorf("expected rejected mappings to leave the table empty\nreceived: %v", *h.hosts.Load())
+	}
+
+	expectedError := "invalid host"
+	err = h.MapHost("api.acme.com", "acme internal")
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,108 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// subdomainPlaceholder is the placeholder of an endpoint passed to
+// HandleHostPattern which is filled with the matched subdomain.
+const subdomainPlaceholder = "{subdomain}"
+
+// validateHostPattern checks the Host of a route: a hostname, without a port,
+// whose leftmost label may be a "*" wildcard.
+func validateHostPattern(pattern string) error {
+	labels := strings.Split(pattern, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("host pattern %q needs at least two labels", pattern)
+	}
+	for index, label := range labels {
+		if label == "*" && index == 0 {
+			continue
+		}
+		if strings.Contains(label, "*") {
+			return fmt.Errorf("invalid host pattern %q: wildcards may only form the leftmost label", pattern)
+		}
+		if label == "" || strings.ContainsAny(label, ":/[]") {
+			return fmt.Errorf("invalid host pattern %q: expected a hostname without a port", pattern)
+		}
+	}
+	return nil
+}
+
+// requestHostname returns the Host of request in lower case, without its port
+// or a trailing dot.
+func requestHostname(request *http.Request) string {
+	hostname := request.Host
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+// matchHost reports whether hostname matches pattern and returns the label
+// which filled its wildcard, if any. A wildcard fills exactly one label, so
+// neither the apex of the pattern nor deeper subdomains match it.
+func matchHost(pattern, hostname string) (string, bool) {
+	suffix, wildcard := strings.CutPrefix(pattern, "*.")
+	if !wildcard {
+		return "", hostname == pattern
+	}
+	label, found := strings.CutSuffix(hostname, "."+suffix)
+	if !found || label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// allowsHost reports whether the route serves requests for the host of
+// request.
+func (route *validRouteRule) allowsHost(request *http.Request) bool {
+	if route.Host == "" {
+		return true
+	}
+	_, ok := matchHost(route.Host, requestHostname(request))
+	return ok
+}
+
+// setSubdomainHeader sets the route's SubdomainHeader on request to the
+// subdomain which clientRequest's host matched, replacing any value the
+// client sent.
+func (route *validRouteRule) setSubdomainHeader(request *http.Request, clientRequest *http.Request) {
+	if route.SubdomainHeader == "" {
+		return
+	}
+	request.Header.Del(route.SubdomainHeader)
+	if label, ok := matchHost(route.Host, requestHostname(clientRequest)); ok && label != "" {
+		request.Header.Set(route.SubdomainHeader, label)
+	}
+}
+
+// TemplateFromSubdomain returns a TemplateValue which reads the leftmost label
+// of the request's host, the subdomain matched by a route whose Host begins
+// with a wildcard.
+func TemplateFromSubdomain() func(*http.Request) (string, error) {
+	return func(request *http.Request) (string, error) {
+		label, _, found := strings.Cut(requestHostname(request), ".")
+		if !found {
+			return "", fmt.Errorf("host has no subdomain")
+		}
+		return label, nil
+	}
+}
+
+// HandleHostPattern adds a route sending every request whose host matches
+// pattern to endpoint, whatever its path. A pattern whose leftmost label is
+// "*" matches one label in its place, such as each subdomain of
+// "*.preview.example.com", and a {subdomain} placeholder in endpoint is
+// filled with that label. Routes added this way have the Path "/" and are
+// matched after the existing routes.
+func (handler *ProxyHandler) HandleHostPattern(pattern, endpoint string) error {
+	route := RouteRule{Path: "/", Host: pattern, Endpoint: endpoint}
+	if strings.Contains(endpoint, subdomainPlaceholder) {
+		route.Endpoint, route.EndpointTemplate, route.TemplateValue = "", endpoint, TemplateFromSubdomain()
+	}
+	return handler.AddRoute(route)
+}
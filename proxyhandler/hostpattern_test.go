@@ -0,0 +1,72 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostPatternRouting(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var branch string
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		branch = r.Header.Get("X-Preview-Branch")
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/", Host: "*.preview.example.com", Endpoint: "http://preview-router.internal", SubdomainHeader: "X-Preview-Branch"},
+		&RouteRule{Path: "/", Host: "API.example.com", Endpoint: "http://api.internal"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if err := h.HandleHostPattern("*.review.example.com", "http://{subdomain}.review.internal"); err != nil {
+		t.Fatalf("unable to add host pattern: %s", err.Error())
+	}
+
+	examples := []struct {
+		host, upstream, branch string
+	}{
+		{"feature-x.preview.example.com", "preview-router.internal", "feature-x"},
+		{"Feature-Y.Preview.Example.com:8443", "preview-router.internal", "feature-y"},
+		{"a.b.preview.example.com", "default.endpoint", ""},
+		{"preview.example.com", "default.endpoint", ""},
+		{"notpreview.example.com", "default.endpoint", ""},
+		{"api.example.com:80", "api.internal", ""},
+		{"fix-123.review.example.com", "fix-123.review.internal", ""},
+	}
+	for _, example := range examples {
+		branch = ""
+		request := httptest.NewRequest("GET", "/pages/index.html", nil)
+		request.Host = example.host
+		request.Header.Set("X-Preview-Branch", "spoofed")
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if received := recorder.Body.String(); received != example.upstream {
+			t.Errorf("%s: unexpected upstream\nexpected: %v\nreceived: %v", example.host, example.upstream, received)
+		}
+		if example.upstream == "preview-router.internal" && branch != example.branch {
+			t.Errorf("%s: unexpected branch header\nexpected: %v\nreceived: %v", example.host, example.branch, branch)
+		}
+	}
+}
+
+func TestHostPatternValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"wildcards may only form the leftmost label": RouteRule{Path: "/", Endpoint: "http://one", Host: "preview.*.example.com"},
+		"needs at least two labels":                  RouteRule{Path: "/", Endpoint: "http://one", Host: "*"},
+		"only form the leftmost label":               RouteRule{Path: "/", Endpoint: "http://one", Host: "feature-*.example.com"},
+		"requires a wildcard host":                   RouteRule{Path: "/", Endpoint: "http://one", Host: "example.com", SubdomainHeader: "X-Branch"},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
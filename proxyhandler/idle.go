@@ -0,0 +1,115 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStreamIdle = errors.New("stream idle")
+
+// idleTimer calls onIdle once touch has not been called for timeout since it
+// was started. Rather than resetting a timer for every read or write, its
+// single goroutine checks the time of the last activity whenever the timeout
+// would have lapsed, so activity costs no more than an atomic store. The
+// methods of a nil idleTimer do nothing.
+type idleTimer struct {
+	timeout    time.Duration
+	onIdle     func()
+	lastActive atomic.Int64
+	fired      atomic.Bool
+	mutex      sync.Mutex
+	started    bool
+	stopped    bool
+	done       chan struct{}
+	finished   chan struct{}
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	return &idleTimer{timeout: timeout, onIdle: onIdle, done: make(chan struct{}), finished: make(chan struct{})}
+}
+
+// start begins timing. Later calls, and calls after stop, do nothing.
+func (idle *idleTimer) start() {
+	if idle == nil {
+		return
+	}
+	idle.mutex.Lock()
+	defer idle.mutex.Unlock()
+	if idle.started || idle.stopped {
+		return
+	}
+	idle.started = true
+	idle.touch()
+	go idle.run()
+}
+
+func (idle *idleTimer) run() {
+	defer close(idle.finished)
+	timer := time.NewTimer(idle.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-idle.done:
+			return
+		case <-timer.C:
+			elapsed := time.Since(time.Unix(0, idle.lastActive.Load()))
+			if elapsed >= idle.timeout {
+				idle.fired.Store(true)
+				idle.onIdle()
+				return
+			}
+			timer.Reset(idle.timeout - elapsed)
+		}
+	}
+}
+
+// touch records activity, postponing the timeout.
+func (idle *idleTimer) touch() {
+	if idle != nil {
+		idle.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+// stop ends the timer, waiting for a call to onIdle in progress to return.
+func (idle *idleTimer) stop() {
+	if idle == nil {
+		return
+	}
+	idle.mutex.Lock()
+	started := idle.started && !idle.stopped
+	idle.stopped = true
+	idle.mutex.Unlock()
+	if started {
+		close(idle.done)
+		<-idle.finished
+	}
+}
+
+// reaped reports whether the timeout lapsed.
+func (idle *idleTimer) reaped() bool {
+	return idle != nil && idle.fired.Load()
+}
+
+// watchIdle returns a copy of request which is canceled once, after the
+// response written to writer has begun, neither the response nor the request
+// body carries any bytes for the route's IdleTimeout. The wait for the
+// response to begin is left to the ResponseHeaderTimeout.
+func (handler *ProxyHandler) watchIdle(route *validRouteRule, writer http.ResponseWriter, request *http.Request, body *countingBody) (*http.Request, *idleTimer) {
+	ctx, cancel := context.WithCancel(request.Context())
+	idle := newIdleTimer(route.IdleTimeout, func() {
+		log.Printf("proxy: closing stream for %s idle for %s", request.URL.String(), route.IdleTimeout)
+		cancel()
+	})
+	if body != nil {
+		body.idle = idle
+	}
+	if tracked, ok := writer.(unwrappingWriter); ok {
+		tracked.tracked().idle = idle
+	}
+	return request.WithContext(ctx), idle
+}
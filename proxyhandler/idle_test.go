@@ -0,0 +1,96 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutClosesSilentStream(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		events := 0
+		if r.URL.Path == "/active" {
+			events = 6
+		}
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		for i := 0; i < events; i++ {
+			time.Sleep(40 * time.Millisecond)
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		if r.URL.Path == "/silent" {
+			<-r.Context().Done()
+		}
+	}))
+	defer upstream.Close()
+
+	for _, mode := range proxyModes {
+		var observed []error
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.Observer = func(observation *Observation) {
+			observed = append(observed, observation.Err)
+		}
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/", Endpoint: upstream.URL, IdleTimeout: 100 * time.Millisecond},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		proxy := httptest.NewServer(h)
+
+		response, err := http.Get(proxy.URL + "/active")
+		if err != nil {
+			t.Fatalf("%s: unable to open stream: %s", mode.name, err.Error())
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || strings.Count(string(body), "data:") != 7 {
+			t.Errorf("%s: expected an active stream to outlive the timeout\nreceived: %q %v", mode.name, body, err)
+		}
+
+		started := time.Now()
+		// the stream is aborted before or after its header reaches the client,
+		// depending on whether the first event was flushed
+		response, err = http.Get(proxy.URL + "/silent")
+		if err == nil {
+			_, err = ioutil.ReadAll(response.Body)
+			response.Body.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: expected a silent stream to be aborted", mode.name)
+		}
+		if elapsed := time.Since(started); elapsed > 2*time.Second {
+			t.Errorf("%s: silent stream closed too late\nreceived: %s", mode.name, elapsed)
+		}
+		proxy.Close()
+
+		// httputil.ReverseProxy aborts the response itself, before the
+		// observation is made, and the client may retry a request aborted
+		// before its response began
+		if !mode.stdlib && (len(observed) < 2 || observed[0] != nil || observed[len(observed)-1] != errStreamIdle) {
+			t.Errorf("%s: unexpected errors observed\nexpected: %v\nreceived: %v", mode.name, []error{nil, errStreamIdle}, observed)
+		}
+	}
+}
+
+func TestIdleTimeoutValidation(t *testing.T) {
+	route := RouteRule{Path: "/", Endpoint: "http://endpoint.one", IdleTimeout: -time.Second}
+	expectedError := "idle timeout is negative"
+	if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -0,0 +1,116 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// informationalRelay forwards the 1xx informational responses an upstream
+// sends before its final response, such as 103 Early Hints, to the client.
+// It relays only while open, which it is while an attempt awaits its
+// response, so that neither hedged attempts still running nor late arrivals
+// write to the client once the handler is answering it.
+type informationalRelay struct {
+	mutex  sync.Mutex
+	writer http.ResponseWriter
+	open   bool
+}
+
+// trace returns a ClientTrace relaying the informational responses of the
+// requests sent with it.
+func (relay *informationalRelay) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{Got1xxResponse: relay.relay}
+}
+
+// setOpen starts or stops relaying. It does nothing on a nil relay, as when
+// the route does not forward informational responses.
+func (relay *informationalRelay) setOpen(open bool) {
+	if relay == nil {
+		return
+	}
+	relay.mutex.Lock()
+	relay.open = open
+	relay.mutex.Unlock()
+}
+
+// relay writes an informational response with its own headers only, keeping
+// those the handler has already set for the final response. 100 Continue is
+// not relayed, since the client's server answers its expectation itself.
+func (relay *informationalRelay) relay(code int, header textproto.MIMEHeader) error {
+	if code == http.StatusContinue {
+		return nil
+	}
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if !relay.open {
+		return nil
+	}
+	responseHeader := relay.writer.Header()
+	kept := responseHeader.Clone()
+	clear(responseHeader)
+	copyHeaders(responseHeader, http.Header(header))
+	relay.writer.WriteHeader(code)
+	clear(responseHeader)
+	copyHeaders(responseHeader, kept)
+	return nil
+}
+
+// informationalFilter stands between an httputil.ReverseProxy and the
+// client's response for the handler's StdlibProxy. ReverseProxy writes every
+// 1xx response it receives and then clears the response's headers, so until
+// the final response is settled the filter collects headers apart from those
+// the handler has set, and hands each 1xx response to relay, which is nil
+// when the route does not forward them.
+type informationalFilter struct {
+	http.ResponseWriter
+	relay   *informationalRelay
+	pending http.Header
+}
+
+func newInformationalFilter(writer http.ResponseWriter, forward bool) *informationalFilter {
+	filter := &informationalFilter{ResponseWriter: writer, pending: make(http.Header)}
+	if forward {
+		filter.relay = &informationalRelay{writer: writer, open: true}
+	}
+	return filter
+}
+
+func (filter *informationalFilter) Header() http.Header {
+	if filter.pending != nil {
+		return filter.pending
+	}
+	return filter.ResponseWriter.Header()
+}
+
+// settle ends the collection of informational responses, once the upstream's
+// final response or failure is known, adding any headers set since.
+func (filter *informationalFilter) settle() {
+	if filter.pending == nil {
+		return
+	}
+	copyHeaders(filter.ResponseWriter.Header(), filter.pending)
+	filter.pending = nil
+}
+
+func (filter *informationalFilter) WriteHeader(status int) {
+	if filter.pending != nil && status < http.StatusOK {
+		if filter.relay != nil {
+			filter.relay.relay(status, textproto.MIMEHeader(filter.pending))
+		}
+		return
+	}
+	filter.settle()
+	filter.ResponseWriter.WriteHeader(status)
+}
+
+func (filter *informationalFilter) Write(data []byte) (int, error) {
+	filter.settle()
+	return filter.ResponseWriter.Write(data)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (filter *informationalFilter) Unwrap() http.ResponseWriter {
+	return filter.ResponseWriter
+}
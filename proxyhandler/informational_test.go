@@ -0,0 +1,84 @@
+package proxyhandler
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"testing"
+)
+
+func TestInformationalResponsesAreForwarded(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstream.URL
+	config.AttemptHeaders = true
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/hints", Endpoint: upstream.URL, ForwardInformational: true},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	get := func(path string) (*http.Response, []int, []textproto.MIMEHeader) {
+		var codes []int
+		var headers []textproto.MIMEHeader
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				headers = append(headers, header)
+				return nil
+			},
+		}
+		request, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		response, err := http.DefaultClient.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("unexpected final response\nexpected: %v ok\nreceived: %v %s", http.StatusOK, response.StatusCode, body)
+		}
+		return response, codes, headers
+	}
+
+	response, codes, headers := get("/hints")
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints {
+		t.Fatalf("expected early hints before the final response\nreceived: %v", codes)
+	}
+	if link := headers[0].Get("Link"); link != "</style.css>; rel=preload; as=style" {
+		t.Errorf("unexpected Link header of the early hints\nexpected: %v\nreceived: %v", "</style.css>; rel=preload; as=style", link)
+	}
+	if attempts := headers[0].Get("X-Proxy-Attempts"); attempts != "" {
+		t.Errorf("expected the early hints to carry only their own headers\nreceived: X-Proxy-Attempts %v", attempts)
+	}
+	if attempts := response.Header.Get("X-Proxy-Attempts"); attempts != "1" {
+		t.Errorf("expected the final response to keep the handler's headers\nexpected: %v\nreceived: %v", "1", attempts)
+	}
+	if link := response.Header.Get("Link"); link != "" {
+		t.Errorf("expected the final response not to carry the early hints' headers\nreceived: %v", link)
+	}
+
+	if _, codes, _ := get("/other"); len(codes) != 0 {
+		t.Errorf("expected informational responses to be dropped by default\nreceived: %v", codes)
+	}
+}
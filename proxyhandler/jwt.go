@@ -0,0 +1,294 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid bearer token")
+
+// JWTConfig describes how a route verifies the JSON Web Token in the
+// Authorization header of its requests before they are proxied. Requests
+// without a token, or whose token fails verification, are answered with
+// 401 Unauthorized and never reach the upstream.
+//
+// KeyFunc returns the key which verifies a token signed with algorithm by
+// the key identified by keyID, the token's "alg" and "kid" header
+// parameters; it may fetch keys from a JWKS endpoint. HS256, HS384 and HS512
+// tokens are verified with a []byte secret, RS256 to RS512 and PS256 to PS512
+// with an *rsa.PublicKey, ES256, ES384 and ES512 with an *ecdsa.PublicKey and
+// EdDSA with an ed25519.PublicKey. Algorithms, when set, restricts the
+// algorithms accepted.
+//
+// The token's "exp" and "nbf" claims are checked, with ClockSkew of leeway,
+// whenever they are present. Audience, when set, must be one of the token's
+// "aud" claims, and Issuer, when set, its "iss" claim.
+//
+// ClaimHeaders copies claims into request headers for the upstream, mapping
+// a claim name such as "sub" to a header name such as "X-User-ID". These
+// headers are removed from every request, so that a client cannot supply
+// them itself; claims which are absent are not sent. String claims are sent
+// as they are and other claims encoded as JSON.
+type JWTConfig struct {
+	KeyFunc    func(algorithm, keyID string) (interface{}, error)
+	Algorithms []string
+
+	Audience  string
+	Issuer    string
+	ClockSkew time.Duration
+
+	ClaimHeaders map[string]string
+}
+
+// jwtAlgorithms maps the supported signature algorithms to their hashes.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// jwtCurveBits gives the size of the curve each ECDSA algorithm signs with.
+var jwtCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func (config *JWTConfig) validate() error {
+	if config.KeyFunc == nil {
+		return fmt.Errorf("jwt validation requires a key func")
+	}
+	for _, algorithm := range config.Algorithms {
+		if _, ok := jwtAlgorithms[algorithm]; !ok {
+			return fmt.Errorf("unsupported jwt algorithm %q", algorithm)
+		}
+	}
+	if config.ClockSkew < 0 {
+		return fmt.Errorf("jwt clock skew is negative")
+	}
+	for claim, name := range config.ClaimHeaders {
+		if !validToken(name) {
+			return fmt.Errorf("invalid header name %q for claim %s", name, claim)
+		}
+	}
+	return nil
+}
+
+func (config *JWTConfig) allowsAlgorithm(algorithm string) bool {
+	if _, ok := jwtAlgorithms[algorithm]; !ok {
+		return false
+	}
+	if len(config.Algorithms) == 0 {
+		return true
+	}
+	for _, allowed := range config.Algorithms {
+		if allowed == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate verifies the bearer token of request against config at now
+// and copies the configured claims into its headers.
+func (config *JWTConfig) authenticate(request *http.Request, now time.Time) error {
+	for _, name := range config.ClaimHeaders {
+		request.Header.Del(name)
+	}
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return fmt.Errorf("%w: no bearer token", errInvalidToken)
+	}
+	claims, err := config.verify(strings.TrimSpace(token))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidToken, err.Error())
+	}
+	if err := config.checkClaims(claims, now); err != nil {
+		return fmt.Errorf("%w: %s", errInvalidToken, err.Error())
+	}
+	for claim, name := range config.ClaimHeaders {
+		value, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		if text, ok := value.(string); ok {
+			request.Header.Set(name, text)
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		request.Header.Set(name, string(encoded))
+	}
+	return nil
+}
+
+// verify checks the signature of a compact serialized token and returns its
+// claims.
+func (config *JWTConfig) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %s", err.Error())
+	}
+	if !config.allowsAlgorithm(header.Algorithm) {
+		return nil, fmt.Errorf("algorithm %q is not accepted", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %s", err.Error())
+	}
+	key, err := config.KeyFunc(header.Algorithm, header.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("key: %s", err.Error())
+	}
+	if err := verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %s", err.Error())
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(decoded))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// verifySignature checks signature over signed with key, which must be of the
+// type algorithm calls for.
+func verifySignature(algorithm string, key interface{}, signed string, signature []byte) error {
+	hash := jwtAlgorithms[algorithm]
+	var digest []byte
+	if hash != 0 {
+		hasher := hash.New()
+		hasher.Write([]byte(signed))
+		digest = hasher.Sum(nil)
+	}
+	valid := false
+	switch algorithm[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("%s requires a []byte key", algorithm)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		valid = hmac.Equal(mac.Sum(nil), signature)
+	case "RS", "PS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an *rsa.PublicKey", algorithm)
+		}
+		if algorithm[0] == 'R' {
+			valid = rsa.VerifyPKCS1v15(publicKey, hash, digest, signature) == nil
+		} else {
+			valid = rsa.VerifyPSS(publicKey, hash, digest, signature, nil) == nil
+		}
+	case "ES":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an *ecdsa.PublicKey", algorithm)
+		}
+		bits := publicKey.Curve.Params().BitSize
+		if bits != jwtCurveBits[algorithm] {
+			return fmt.Errorf("%s does not match the key's curve", algorithm)
+		}
+		size := (bits + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			valid = ecdsa.Verify(publicKey, digest, r, s)
+		}
+	case "Ed":
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s requires an ed25519.PublicKey", algorithm)
+		}
+		valid = ed25519.Verify(publicKey, []byte(signed), signature)
+	}
+	if !valid {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// checkClaims checks the registered claims of a verified token.
+func (config *JWTConfig) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if expiry, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok && !now.Add(-config.ClockSkew).Before(expiry) {
+		return fmt.Errorf("token has expired")
+	}
+	if notBefore, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(config.ClockSkew).Before(notBefore) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if len(config.Issuer) > 0 && claims["iss"] != config.Issuer {
+		return fmt.Errorf("unexpected issuer")
+	}
+	if len(config.Audience) > 0 && !hasAudience(claims["aud"], config.Audience) {
+		return fmt.Errorf("unexpected audience")
+	}
+	return nil
+}
+
+// numericDate reads the time of the claim name, reporting whether the token
+// has it.
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil || math.IsInf(seconds, 0) {
+		return time.Time{}, false, fmt.Errorf("claim %s is not a number", name)
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)), true, nil
+}
+
+// hasAudience reports whether the "aud" claim, a string or an array of
+// strings, contains audience.
+func hasAudience(claim interface{}, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []interface{}:
+		for _, value := range claim {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
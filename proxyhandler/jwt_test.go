@@ -0,0 +1,207 @@
+package proxyhandler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testJWTSecret = []byte("test secret")
+
+// signTestToken builds a compact token with claims signed by sign under
+// algorithm.
+func signTestToken(t *testing.T, algorithm string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT", "kid": "test"})
+	if err != nil {
+		t.Fatalf("unable to encode header: %s", err.Error())
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("unable to encode claims: %s", err.Error())
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func signHS256(signed []byte) []byte {
+	mac := hmac.New(sha256.New, testJWTSecret)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+func TestJWTValidationGatesRoute(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var received []http.Header
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		received = append(received, r.Header)
+		return httpmock.NewStringResponse(200, "upstream"), nil
+	})
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err.Error())
+	}
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/secure", Endpoint: "http://secure", JWT: &JWTConfig{
+			KeyFunc: func(algorithm, keyID string) (interface{}, error) {
+				if keyID != "test" {
+					return nil, fmt.Errorf("unknown key %q", keyID)
+				}
+				if algorithm == "ES256" {
+					return &ecdsaKey.PublicKey, nil
+				}
+				return testJWTSecret, nil
+			},
+			Audience:     "orders",
+			ClockSkew:    30 * time.Second,
+			ClaimHeaders: map[string]string{"sub": "X-User-ID", "roles": "X-User-Roles"},
+		}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	now := time.Unix(1700000000, 0)
+	h.now = func() time.Time { return now }
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub":   "user-42",
+			"aud":   []string{"billing", "orders"},
+			"exp":   now.Add(time.Minute).Unix(),
+			"nbf":   now.Add(-time.Minute).Unix(),
+			"roles": []string{"admin"},
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		return claims
+	}
+	signES256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, digest[:])
+		if err != nil {
+			t.Fatalf("unable to sign: %s", err.Error())
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"valid", "Bearer " + signTestToken(t, "HS256", claims(nil), signHS256), 200},
+		{"valid ecdsa", "Bearer " + signTestToken(t, "ES256", claims(nil), signES256), 200},
+		{"single audience", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"aud": "orders"}), signHS256), 200},
+		{"expired within skew", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()}), signHS256), 200},
+		{"expired", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}), signHS256), 401},
+		{"not yet valid", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}), signHS256), 401},
+		{"wrong audience", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"aud": "billing"}), signHS256), 401},
+		{"missing audience", "Bearer " + signTestToken(t, "HS256", claims(map[string]interface{}{"aud": nil}), signHS256), 401},
+		{"wrong secret", "Bearer " + signTestToken(t, "HS256", claims(nil), func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte("other secret"))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}), 401},
+		{"unsigned", "Bearer " + signTestToken(t, "none", claims(nil), func([]byte) []byte { return nil }), 401},
+		{"algorithm confusion", "Bearer " + signTestToken(t, "ES256", claims(nil), signHS256), 401},
+		{"malformed", "Bearer not.a-token", 401},
+		{"basic credentials", "Basic dXNlcjpwYXNz", 401},
+		{"missing token", "", 401},
+	}
+	for _, test := range tests {
+		received = nil
+		request := httptest.NewRequest("GET", "/secure/orders", nil)
+		request.Header.Set("X-User-ID", "spoofed")
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("unexpected status for %s token\nexpected: %v\nreceived: %v", test.name, test.status, recorder.Code)
+			continue
+		}
+		if test.status == 401 {
+			if len(received) > 0 {
+				t.Errorf("expected %s token to be rejected before contacting the upstream", test.name)
+			}
+			if recorder.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected %s token to be challenged", test.name)
+			}
+			continue
+		}
+		if len(received) != 1 || received[0].Get("X-User-ID") != "user-42" || received[0].Get("X-User-Roles") != `["admin"]` {
+			t.Errorf("unexpected claim headers for %s token\nreceived: %v", test.name, received)
+		}
+	}
+}
+
+func TestJWTClaimHeadersAreStrippedWhenAbsent(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var received http.Header
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		received = r.Header
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	config := buildConfiguration()
+	config.Routes[0].JWT = &JWTConfig{
+		KeyFunc:      func(string, string) (interface{}, error) { return testJWTSecret, nil },
+		Algorithms:   []string{"HS256"},
+		ClaimHeaders: map[string]string{"sub": "X-User-ID"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	request := httptest.NewRequest("GET", "/route1", nil)
+	request.Header.Set("X-User-ID", "spoofed")
+	request.Header.Set("Authorization", "Bearer "+signTestToken(t, "HS256", map[string]interface{}{}, signHS256))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", 200, recorder.Code)
+	}
+	if value, ok := received["X-User-Id"]; ok {
+		t.Errorf("expected the client's claim header to be removed\nreceived: %v", value)
+	}
+}
+
+func TestJWTConfigIsValidated(t *testing.T) {
+	keyFunc := func(string, string) (interface{}, error) { return testJWTSecret, nil }
+	tests := []*JWTConfig{
+		&JWTConfig{},
+		&JWTConfig{KeyFunc: keyFunc, Algorithms: []string{"none"}},
+		&JWTConfig{KeyFunc: keyFunc, ClockSkew: -time.Second},
+		&JWTConfig{KeyFunc: keyFunc, ClaimHeaders: map[string]string{"sub": "X User"}},
+	}
+	for _, jwtConfig := range tests {
+		config := buildConfiguration()
+		config.Routes[0].JWT = jwtConfig
+		if _, err := config.validate(); err == nil {
+			t.Errorf("expected jwt config %+v to be rejected", jwtConfig)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package proxyhandler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type routeLabelsKey struct{}
+
+// RouteLabels returns the Labels of the route serving the request whose
+// context is ctx, or nil when the route has none. The context of a request is
+// given them once it has been routed, so they are available to a route's
+// Director and ModifyResponse, its upstream requests' transport and
+// ClientTrace, and the ErrorHandler. The map must not be modified.
+func RouteLabels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(routeLabelsKey{}).(map[string]string)
+	return labels
+}
+
+// validateLabels checks that the names of labels are tokens and their values
+// are free of control characters, so that they can be written to the log as
+// they are.
+func validateLabels(labels map[string]string) error {
+	for name, value := range labels {
+		if !validToken(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return fmt.Errorf("label %s has a control character in its value", name)
+		}
+	}
+	return nil
+}
+
+// formatLabels lists labels as name=value pairs ordered by name, for the
+// access log.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,87 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/jarcoal/httpmock"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouteLabelsArePropagated(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			var output bytes.Buffer
+			log.SetOutput(&output)
+			defer log.SetOutput(os.Stderr)
+
+			httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, "ok"))
+			labels := map[string]string{"team": "payments", "tier": "gold"}
+			expected := map[string]string{"team": "payments", "tier": "gold"}
+			var directorLabels, observedLabels map[string]string
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.Routes[0].Labels = labels
+			config.Routes[0].Director = func(request *http.Request) {
+				directorLabels = RouteLabels(request.Context())
+			}
+			config.Observer = func(observation *Observation) {
+				observedLabels = observation.Labels
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			// labels cannot be changed once registered
+			labels["team"] = "search"
+			delete(labels, "tier")
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/route1", nil))
+			if !strings.Contains(output.String(), "proxy: response 200 for /route1 ") ||
+				!strings.Contains(output.String(), "[team=payments tier=gold]") {
+				t.Errorf("expected the access log to carry the route's labels\nreceived: %s", output.String())
+			}
+			if !reflect.DeepEqual(observedLabels, expected) {
+				t.Errorf("unexpected observed labels\nexpected: %v\nreceived: %v", expected, observedLabels)
+			}
+			if !reflect.DeepEqual(directorLabels, expected) {
+				t.Errorf("unexpected labels in the request context\nexpected: %v\nreceived: %v", expected, directorLabels)
+			}
+
+			routes := h.Routes()
+			if !reflect.DeepEqual(routes[0].Labels, expected) {
+				t.Errorf("unexpected labels in routes\nexpected: %v\nreceived: %v", expected, routes[0].Labels)
+			}
+			routes[0].Labels["team"] = "search"
+			if received := h.Routes()[0].Labels; !reflect.DeepEqual(received, expected) {
+				t.Errorf("expected labels returned by Routes to be a copy\nexpected: %v\nreceived: %v", expected, received)
+			}
+
+			// a route without labels logs as before
+			output.Reset()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+			if strings.Contains(output.String(), "[") || observedLabels != nil {
+				t.Errorf("expected no labels for the default route\nreceived: %s %v", output.String(), observedLabels)
+			}
+		})
+	}
+}
+
+func TestRouteLabelsAreValidated(t *testing.T) {
+	routes := map[string]RouteRule{
+		`invalid label name "bad name"`:                   RouteRule{Path: "/foo", Endpoint: "http://foo.endpoint", Labels: map[string]string{"bad name": "x"}},
+		"label team has a control character in its value": RouteRule{Path: "/foo", Endpoint: "http://foo.endpoint", Labels: map[string]string{"team": "a\nb"}},
+	}
+	for expected, route := range routes {
+		_, err := route.validate()
+		if err == nil || err.Error() != expected {
+			t.Errorf("unexpected validation error\nexpected: %v\nreceived: %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errOverloaded = errors.New("proxy is overloaded")
+
+// admission limits the requests a ProxyHandler serves at once, holding a
+// bounded number of further requests in a queue until a slot frees up.
+type admission struct {
+	slots     chan struct{}
+	maxQueued int64
+	timeout   time.Duration
+	queued    atomic.Int64
+	shed      atomic.Uint64
+}
+
+// newAdmission returns the admission control configured by config, or nil
+// when the number of requests in flight is unlimited.
+func newAdmission(config *Configuration) *admission {
+	if config.MaxInFlight == 0 {
+		return nil
+	}
+	return &admission{
+		slots:     make(chan struct{}, config.MaxInFlight),
+		maxQueued: int64(config.MaxQueued),
+		timeout:   config.QueueTimeout,
+	}
+}
+
+// acquire takes a slot for a request, waiting in the queue when every slot
+// is taken and the queue has room. It returns the time the request joined the
+// queue, which is zero when a slot was free at once, and reports false when
+// the request must be shed. A nil admission admits every request.
+func (admission *admission) acquire(ctx context.Context) (enqueued time.Time, ok bool) {
+	if admission == nil {
+		return time.Time{}, true
+	}
+	select {
+	case admission.slots <- struct{}{}:
+		return time.Time{}, true
+	default:
+	}
+	if admission.queued.Add(1) > admission.maxQueued {
+		admission.queued.Add(-1)
+		admission.shed.Add(1)
+		return time.Time{}, false
+	}
+	defer admission.queued.Add(-1)
+	enqueued = time.Now()
+	var expired <-chan time.Time
+	if admission.timeout > 0 {
+		timer := time.NewTimer(admission.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case admission.slots <- struct{}{}:
+		return enqueued, true
+	case <-expired:
+	case <-ctx.Done():
+	}
+	admission.shed.Add(1)
+	return enqueued, false
+}
+
+func (admission *admission) release() {
+	if admission != nil {
+		<-admission.slots
+	}
+}
+
+type admissionSlotKey struct{}
+
+// admissionSlot is the slot a request holds under MaxInFlight, which is given
+// back once, whether when the request finishes or earlier.
+type admissionSlot struct {
+	once      sync.Once
+	admission *admission
+}
+
+// hold returns request carrying the slot it has acquired, so that it can be
+// released before the request finishes. A nil admission returns a nil slot.
+func (admission *admission) hold(request *http.Request) (*http.Request, *admissionSlot) {
+	if admission == nil {
+		return request, nil
+	}
+	slot := &admissionSlot{admission: admission}
+	return request.WithContext(context.WithValue(request.Context(), admissionSlotKey{}, slot)), slot
+}
+
+func (slot *admissionSlot) release() {
+	if slot != nil {
+		slot.once.Do(slot.admission.release)
+	}
+}
+
+// releaseSlot gives back the slot request holds under MaxInFlight, if any,
+// ahead of the request finishing.
+func releaseSlot(request *http.Request) {
+	slot, _ := request.Context().Value(admissionSlotKey{}).(*admissionSlot)
+	slot.release()
+}
+
+type queueWaitKey struct{}
+
+// queueWait holds the times a request delayed under MaxInFlight joined and
+// left the queue.
+type queueWait struct {
+	enqueued time.Time
+	dequeued time.Time
+}
+
+// withQueueWait returns request with the times it was queued recorded in its
+// context. Only requests which waited are given one, so the rest carry no
+// extra allocation.
+func withQueueWait(request *http.Request, enqueued, dequeued time.Time) *http.Request {
+	wait := &queueWait{enqueued: enqueued, dequeued: dequeued}
+	return request.WithContext(context.WithValue(request.Context(), queueWaitKey{}, wait))
+}
+
+// queueDuration returns the time request waited for a slot under
+// MaxInFlight, which is zero if it did not wait.
+func queueDuration(request *http.Request) time.Duration {
+	if wait, ok := request.Context().Value(queueWaitKey{}).(*queueWait); ok {
+		return wait.dequeued.Sub(wait.enqueued)
+	}
+	return 0
+}
+
+// setQueueDurationHeader tells the upstream how long request waited for a
+// slot under MaxInFlight, in whole milliseconds, when QueueDurationHeader is
+// set.
+func (handler *ProxyHandler) setQueueDurationHeader(header http.Header, request *http.Request) {
+	if handler.configuration.QueueDurationHeader {
+		header.Set("X-Queue-Duration-Ms", strconv.FormatInt(queueDuration(request).Milliseconds(), 10))
+	}
+}
+
+// InFlight returns the number of requests being served and the number
+// waiting for a slot under MaxInFlight.
+func (handler *ProxyHandler) InFlight() (active, queued int64) {
+	active = handler.active.Load()
+	if handler.admission != nil {
+		queued = handler.admission.queued.Load()
+	}
+	return active, queued
+}
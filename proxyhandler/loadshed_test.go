@@ -0,0 +1,230 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForInFlight waits until h reports active and queued requests.
+func waitForInFlight(t *testing.T, h *ProxyHandler, active, queued int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		currentActive, currentQueued := h.InFlight()
+		if currentActive == active && currentQueued == queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected requests in flight\nexpected: %d active, %d queued\nreceived: %d active, %d queued", active, queued, currentActive, currentQueued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxInFlightShedsLoad(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://default.endpoint/blocked", func(r *http.Request) (*http.Response, error) {
+		<-release
+		return httpmock.NewStringResponse(200, "released"), nil
+	})
+	httpmock.RegisterResponder("GET", "http://default.endpoint/fast", httpmock.NewStringResponder(200, "fast"))
+	config := buildConfiguration()
+	config.MaxInFlight = 2
+	config.MaxQueued = 1
+	config.QueueTimeout = 50 * time.Millisecond
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+	statuses := make(chan int, 3)
+	for request := 0; request < 2; request++ {
+		go func() { statuses <- serve("/blocked").Code }()
+	}
+	waitForInFlight(t, h, 2, 0)
+
+	// a queued request gives up once the queue timeout passes
+	started := time.Now()
+	if recorder := serve("/fast"); recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected a timed out queued request to be shed\nreceived: %d %v", recorder.Code, recorder.Header())
+	}
+	if elapsed := time.Since(started); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the request to wait in the queue\nreceived: %s", elapsed)
+	}
+
+	// with the queue full, further requests are shed at once
+	go func() { statuses <- serve("/fast").Code }()
+	waitForInFlight(t, h, 2, 1)
+	started = time.Now()
+	if recorder := serve("/fast"); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status beyond the queue\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if elapsed := time.Since(started); elapsed >= 50*time.Millisecond {
+		t.Errorf("expected a request beyond the queue to be shed immediately\nreceived: %s", elapsed)
+	}
+
+	// a completing request lets the queued one through
+	release <- struct{}{}
+	for index := 0; index < 2; index++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, status)
+		}
+	}
+	waitForInFlight(t, h, 1, 0)
+	release <- struct{}{}
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, status)
+	}
+
+	// capacity recovers once requests complete
+	waitForInFlight(t, h, 0, 0)
+	for request := 0; request < 3; request++ {
+		if recorder := serve("/fast"); recorder.Code != http.StatusOK {
+			t.Errorf("unexpected status after recovery\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+		}
+	}
+	if shed := h.admission.shed.Load(); shed != 2 {
+		t.Errorf("unexpected count of shed requests\nexpected: %v\nreceived: %v", 2, shed)
+	}
+}
+
+func TestInFlightLimitsAreValidated(t *testing.T) {
+	config := buildConfiguration()
+	config.MaxQueued = 4
+	if _, err := config.validate(); err == nil {
+		t.Error("expected a queue without MaxInFlight to be rejected")
+	}
+}
+
+func TestQueueWaitIsReported(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			release := make(chan struct{})
+			headers := make(chan string, 2)
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Path == "/blocked" {
+					<-release
+				}
+				headers <- r.URL.Path + " " + r.Header.Get("X-Queue-Duration-Ms")
+				return httpmock.NewStringResponse(200, "ok"), nil
+			})
+			observations := make(chan *Observation, 2)
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.MaxInFlight = 1
+			config.MaxQueued = 1
+			config.QueueDurationHeader = true
+			config.Observer = func(observation *Observation) { observations <- observation }
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			serve := func(path string) {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+			go serve("/blocked")
+			waitForInFlight(t, h, 1, 0)
+			go serve("/queued")
+			waitForInFlight(t, h, 1, 1)
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+
+			waits := make(map[string]time.Duration)
+			received := make(map[string]bool)
+			for index := 0; index < 2; index++ {
+				observation := <-observations
+				waits[observation.Request.URL.Path] = observation.QueueWait
+				received[<-headers] = true
+			}
+			if wait := waits["/blocked"]; wait != 0 {
+				t.Errorf("expected a request given a slot at once not to wait\nreceived: %s", wait)
+			}
+			if wait := waits["/queued"]; wait < 20*time.Millisecond {
+				t.Errorf("expected the queued request to report its wait\nreceived: %s", wait)
+			}
+			if !received["/blocked 0"] {
+				t.Errorf("expected a zero queue duration upstream\nreceived: %v", received)
+			}
+			for header := range received {
+				if header != "/blocked 0" && (!strings.HasPrefix(header, "/queued ") || header == "/queued 0") {
+					t.Errorf("expected a positive queue duration upstream\nreceived: %v", received)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueDurationWithoutWaitDoesNotAllocate(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	allocations := testing.AllocsPerRun(100, func() {
+		if queueDuration(request) != 0 {
+			t.Fatal("expected no queue wait")
+		}
+	})
+	if allocations != 0 {
+		t.Errorf("unexpected allocations\nexpected: %v\nreceived: %v", 0, allocations)
+	}
+}
+
+func TestWebSocketTunnelsReleaseTheirSlot(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := newEchoWebSocketServer(t)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer plain.Close()
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = plain.URL
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Endpoint: strings.Replace(upstream.URL, "http://", "ws://", 1)},
+	}
+	config.MaxInFlight = 1
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	conn, reader, response := dialWebSocket(t, strings.TrimPrefix(proxy.URL, "http://"), http.Header{})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", http.StatusSwitchingProtocols, response.StatusCode)
+	}
+	// an echo shows the tunnel is open
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(reader, make([]byte, 4)); err != nil {
+		t.Fatalf("unable to read echo: %s", err.Error())
+	}
+
+	plainResponse, err := http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	plainResponse.Body.Close()
+	if plainResponse.StatusCode != http.StatusOK {
+		t.Errorf("expected a request beside the tunnel to be admitted\nexpected: %v\nreceived: %v", http.StatusOK, plainResponse.StatusCode)
+	}
+	if inFlight := h.Stats()["/ws"].InFlight; inFlight != 1 {
+		t.Errorf("expected the tunnel to be counted in flight\nexpected: %v\nreceived: %v", 1, inFlight)
+	}
+}
@@ -0,0 +1,80 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Matcher chooses the Route which serves a request. Match reports false for a
+// request which no Route serves, which is then sent to the DefaultRoute. A
+// Matcher is called concurrently by every request the handler serves.
+type Matcher interface {
+	Match(*http.Request) (*Route, bool)
+}
+
+// Route is a RouteRule validated for a ProxyHandler, for a Matcher to return.
+// Every setting of the RouteRule applies to the requests it serves, except
+// its Path, which is not matched but still names the route in Stats and
+// Observations, and its TTL.
+type Route struct {
+	route *validRouteRule
+}
+
+// NewRoute validates rule like those passed to New and returns it as a Route
+// for the handler's Matcher.
+func (handler *ProxyHandler) NewRoute(rule RouteRule) (*Route, error) {
+	route, err := handler.configuration.validateRoute(rule, handler.transport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RouteRule: %w", err)
+	}
+	return &Route{route: route}, nil
+}
+
+// Rule returns the RouteRule the Route was created from.
+func (route *Route) Rule() RouteRule {
+	return route.route.rule()
+}
+
+// pathMatcher is the Matcher of a handler without a Configuration.Matcher. It
+// matches a request to the first route of the handler's routing whose Path is
+// a prefix of the request's path and which allows its host, method, Accept and
+// Content-Type, removing routes whose TTL has passed along the way.
+type pathMatcher struct {
+	handler *ProxyHandler
+}
+
+func (matcher pathMatcher) Match(request *http.Request) (*Route, bool) {
+	matchPath, _ := normalizePath(request.URL.Path)
+	now := matcher.handler.now()
+	for _, route := range matcher.handler.routes.Load().routes {
+		if route.expired(now) {
+			matcher.handler.expireRoute(route)
+			continue
+		}
+		if route.matches(matchPath, request) && (route.allowsMethod(request.Method) || route.answersOptions(request)) {
+			return &Route{route: route}, true
+		}
+	}
+	return nil, false
+}
+
+// allowedMethods returns the methods of the routes matching request but for
+// its method, for a 405 Method Not Allowed response.
+func (matcher pathMatcher) allowedMethods(request *http.Request) []string {
+	matchPath, _ := normalizePath(request.URL.Path)
+	now := matcher.handler.now()
+	var allowed []string
+	for _, route := range matcher.handler.routes.Load().routes {
+		if !route.expired(now) && route.matches(matchPath, request) {
+			allowed = append(allowed, route.methods()...)
+		}
+	}
+	return allowed
+}
+
+// matches reports whether route serves requests for matchPath with the host,
+// Accept and Content-Type of request, whatever its method.
+func (route *validRouteRule) matches(matchPath string, request *http.Request) bool {
+	return strings.HasPrefix(matchPath, route.Path) && route.allowsHost(request) && route.allowsAccept(request) && route.allowsContentType(request)
+}
@@ -0,0 +1,91 @@
+package proxyhandler
+
+import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// regionMatcher routes requests on their X-Region header.
+type regionMatcher struct {
+	routes map[string]*Route
+}
+
+func (matcher *regionMatcher) Match(request *http.Request) (*Route, bool) {
+	route, ok := matcher.routes[request.Header.Get("X-Region")]
+	return route, ok
+}
+
+func TestCustomMatcherRoutesRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Host {
+		case "broken":
+			return nil, errors.New("connection refused")
+		case "eu.endpoint":
+			if r.URL.Path == "/fail" {
+				return httpmock.NewStringResponse(500, "eu"), nil
+			}
+		}
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	matcher := &regionMatcher{}
+	config := buildConfiguration()
+	config.Routes = nil
+	config.Matcher = matcher
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	rules := map[string]RouteRule{
+		"eu":     {Path: "/eu", Endpoint: "http://eu.endpoint", StatusMapping: map[int]int{500: 503}},
+		"us":     {Path: "/us", Endpoint: "http://us.endpoint"},
+		"broken": {Path: "/broken", Endpoint: "http://broken"},
+	}
+	matcher.routes = make(map[string]*Route)
+	for region, rule := range rules {
+		if matcher.routes[region], err = h.NewRoute(rule); err != nil {
+			t.Fatalf("unable to create route: %s", err.Error())
+		}
+	}
+	if _, err := h.NewRoute(RouteRule{Path: "/invalid", Endpoint: "gopher://nowhere"}); err == nil {
+		t.Errorf("expected an invalid route to be refused")
+	}
+
+	examples := []struct {
+		region, path, body string
+		status             int
+	}{
+		{"eu", "/anything", "eu.endpoint", http.StatusOK},
+		{"us", "/anything", "us.endpoint", http.StatusOK},
+		{"", "/anything", "default.endpoint", http.StatusOK},
+		{"eu", "/fail", "eu", http.StatusServiceUnavailable},
+		{"broken", "/anything", "", http.StatusBadGateway},
+	}
+	for _, example := range examples {
+		request := httptest.NewRequest("GET", example.path, nil)
+		request.Header.Set("X-Region", example.region)
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != example.status {
+			t.Errorf("%s %s: unexpected status\nexpected: %v\nreceived: %v", example.region, example.path, example.status, recorder.Code)
+		}
+		if example.body != "" && recorder.Body.String() != example.body {
+			t.Errorf("%s %s: unexpected body\nexpected: %v\nreceived: %v", example.region, example.path, example.body, recorder.Body.String())
+		}
+	}
+
+	requests := make(map[string]uint64)
+	for path, stats := range h.Stats() {
+		requests[path] = stats.Requests
+	}
+	expected := map[string]uint64{"/eu": 2, "/us": 1, "/broken": 1, "": 1}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("unexpected request counts\nexpected: %v\nreceived: %v", expected, requests)
+	}
+}
@@ -0,0 +1,110 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// bodilessUpstream answers with the status named in the request's query,
+// sending a body even where none is allowed, as a misbehaving upstream might.
+func bodilessUpstream(r *http.Request) (*http.Response, error) {
+	status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+	header := http.Header{}
+	body := "hello"
+	switch status {
+	case http.StatusOK:
+		header.Set("Content-Type", "text/plain")
+		header.Set("Content-Length", "5")
+		header.Set("ETag", `"v1"`)
+	case http.StatusNoContent:
+		header.Set("Content-Length", "0")
+		header.Set("X-Deleted", "yes")
+	case http.StatusNotModified:
+		header.Set("ETag", `"v1"`)
+		header.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		header.Set("Content-Length", "5")
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}, nil
+}
+
+func TestResponsesWithoutBodies(t *testing.T) {
+	full := http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"5"}, "Etag": {`"v1"`}}
+	noContent := http.Header{"X-Deleted": {"yes"}}
+	notModified := http.Header{"Etag": {`"v1"`}, "Last-Modified": {"Wed, 21 Oct 2015 07:28:00 GMT"}, "Content-Length": {"5"}}
+	tests := []struct {
+		method string
+		route  string
+		status int
+		header http.Header
+		body   string
+	}{
+		{"GET", "/plain", 200, full, "hello"},
+		{"GET", "/modified", 200, http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}}, "hello"},
+		{"HEAD", "/plain", 200, full, ""},
+		{"HEAD", "/modified", 200, full, ""},
+		{"HEAD", "/wrapped", 200, full, ""},
+		{"GET", "/plain", 204, noContent, ""},
+		{"GET", "/modified", 204, noContent, ""},
+		{"GET", "/wrapped", 204, noContent, ""},
+		{"GET", "/plain", 304, notModified, ""},
+		{"GET", "/modified", 304, notModified, ""},
+		{"GET", "/wrapped", 304, notModified, ""},
+		{"GET", "/mapped", 304, notModified, ""},
+	}
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			httpmock.RegisterNoResponder(bodilessUpstream)
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/plain", Endpoint: "http://upstream"},
+				&RouteRule{Path: "/modified", Endpoint: "http://upstream", ModifyResponse: func(response *http.Response) error {
+					response.Body = io.NopCloser(response.Body)
+					return nil
+				}},
+				&RouteRule{Path: "/wrapped", Endpoint: "http://upstream", WrapResponseBody: func(body io.Reader, _ *http.Response) io.Reader {
+					return body
+				}},
+				&RouteRule{Path: "/mapped", Endpoint: "http://upstream", StatusBodies: map[int]string{304: "not modified"}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			for _, test := range tests {
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest(test.method, test.route+"?status="+strconv.Itoa(test.status), nil))
+				name := test.method + " " + test.route + " " + strconv.Itoa(test.status)
+				if recorder.Code != test.status {
+					t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", name, test.status, recorder.Code)
+				}
+				if !reflect.DeepEqual(recorder.Header(), test.header) {
+					t.Errorf("unexpected headers for %s\nexpected: %v\nreceived: %v", name, test.header, recorder.Header())
+				}
+				if recorder.Body.String() != test.body {
+					t.Errorf("unexpected body for %s\nexpected: %q\nreceived: %q", name, test.body, recorder.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package proxyhandler
+
+import (
+	"errors"
+	"strings"
+)
+
+var errPathEscapesRoot = errors.New("request path escapes the root")
+
+// normalizePath resolves "." and ".." segments and collapses duplicate slashes
+// in an unescaped request path, keeping any trailing slash. It reports false
+// when a ".." segment would climb above the root.
+func normalizePath(path string) (string, bool) {
+	segments := strings.Split(path, "/")
+	normalized := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(normalized) == 0 {
+				return "", false
+			}
+			normalized = normalized[:len(normalized)-1]
+		default:
+			normalized = append(normalized, segment)
+		}
+	}
+	result := "/" + strings.Join(normalized, "/")
+	last := segments[len(segments)-1]
+	if len(normalized) > 0 && (last == "" || last == "." || last == "..") {
+		result += "/"
+	}
+	return result, true
+}
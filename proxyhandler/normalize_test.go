@@ -0,0 +1,90 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"/", "/", true},
+		{"", "/", true},
+		{"/admin", "/admin", true},
+		{"//admin", "/admin", true},
+		{"/foo//bar///", "/foo/bar/", true},
+		{"/foo/../admin", "/admin", true},
+		{"/foo/./bar", "/foo/bar", true},
+		{"/foo/bar/..", "/foo/", true},
+		{"/foo/.", "/foo/", true},
+		{"/..", "", false},
+		{"/foo/../../admin", "", false},
+		{"//../admin", "", false},
+		{"/foo/..bar/...", "/foo/..bar/...", true},
+	}
+	for _, c := range cases {
+		normalized, ok := normalizePath(c.path)
+		if normalized != c.expected || ok != c.ok {
+			t.Errorf("unexpected normalization of %q\nexpected: %v %v\nreceived: %v %v", c.path, c.expected, c.ok, normalized, ok)
+		}
+	}
+}
+
+func TestRoutesMatchNormalizedPath(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var receivedPath string
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		receivedPath = r.URL.Host + r.URL.EscapedPath()
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/admin", Endpoint: "http://admin"},
+	}
+
+	cases := []struct {
+		requested string
+		forward   bool
+		status    int
+		expected  string
+	}{
+		{"/foo/../admin/users", false, 200, "admin/foo/../admin/users"},
+		{"/foo/%2e%2e/admin/users", false, 200, "admin/foo/%2e%2e/admin/users"},
+		{"//admin", false, 200, "admin//admin"},
+		{"/foo/../admin/users", true, 200, "admin/admin/users"},
+		{"/foo/%2E%2E/admin", true, 200, "admin/admin"},
+		{"//admin//users", true, 200, "admin/admin/users"},
+		{"/public/./page", true, 200, "default.endpoint/public/page"},
+		{"/../admin", false, http.StatusBadRequest, ""},
+		{"/foo/%2e%2e/%2e%2e/etc/passwd", true, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		config.ForwardNormalizedPath = c.forward
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		receivedPath = ""
+		recorder := httptest.NewRecorder()
+		// parsed as the server would, since url.Parse reads "//admin" as a host
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RequestURI = c.requested
+		request.URL, _ = url.ParseRequestURI(c.requested)
+		h.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.status {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", c.requested, c.status, recorder.Code)
+		}
+		if receivedPath != c.expected {
+			t.Errorf("unexpected upstream for %s\nexpected: %v\nreceived: %v", c.requested, c.expected, receivedPath)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Observation describes a proxied HTTP request once its response has been
+// relayed. ClientIP is the address of the client, resolved through any trusted
+// proxies. Route is the Path of the matched RouteRule and is empty for the
+// default route. Variant names the traffic split the request was assigned to,
+// if any. StatusCode is the status written to the client and Err is the error
+// which prevented the upstream response from being relayed, if any. Attempts
+// counts the requests sent upstream, including retries. RetryStopped is the
+// reason a failed attempt, or one answered with a status asking for a retry,
+// was not retried: "max retries" once the route's MaxRetries are used up,
+// "body" when the request body cannot be sent again, "idempotency key" when the
+// route requires one for the request's method, "not idempotent" when a request
+// whose method is not idempotent may have reached the upstream before failing,
+// "canceled" when the client's request is done, "retry after" when the upstream
+// asks for a longer wait than the route's MaxRetryDelay, and "budget" when too
+// little time is left before its deadline. It is empty when the last attempt
+// needed no retry. Hedged records that a hedged copy of the request was sent
+// and HedgeWon that its response was the one relayed, in which case Upstream is
+// the hedge's endpoint. ConnWait is the time the attempts spent waiting for
+// upstream connections, including dialing them and queueing behind
+// MaxConnsPerUpstream. Ejected records that the request's outcome ejected its
+// upstream from rotation under the route's OutlierDetection. QueueWait is the
+// time the request waited for a slot under MaxInFlight before it was forwarded,
+// and is zero if it did not wait. Labels are the Labels of the route, which
+// must not be modified. BytesIn and BytesOut count the request and response
+// body bytes actually read from and written to the client, plus an estimate of
+// the size of their headers. Endpoint and StatusClass attribute the response as
+// Stats does.
+type Observation struct {
+	Request      *http.Request
+	ClientIP     string
+	Route        string
+	Upstream     *url.URL
+	Variant      string
+	StatusCode   int
+	Duration     time.Duration
+	BytesIn      int64
+	BytesOut     int64
+	Attempts     int
+	RetryStopped string
+	Hedged       bool
+	HedgeWon     bool
+	ConnWait     time.Duration
+	QueueWait    time.Duration
+	Labels       map[string]string
+	Ejected      bool
+	Err          error
+}
+
+func (handler *ProxyHandler) observe(route *validRouteRule, observation *Observation) {
+	handler.stats.record(observation)
+	handler.recordErrorBudget(route, observation)
+	if handler.observer != nil {
+		handler.observer(observation)
+	}
+}
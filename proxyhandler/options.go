@@ -0,0 +1,226 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionsPolicy determines how a route serves OPTIONS requests.
+type OptionsPolicy string
+
+// OptionsProxy forwards OPTIONS requests upstream like any other. It is the
+// default. OptionsAnswerLocally answers every OPTIONS request with 204 No
+// Content and an Allow header, without contacting the upstream.
+// OptionsCORSPreflight answers CORS preflight requests in the same way,
+// according to the route's CORS policy, and forwards other OPTIONS requests.
+const (
+	OptionsProxy         OptionsPolicy = "proxy"
+	OptionsAnswerLocally OptionsPolicy = "answer-locally"
+	OptionsCORSPreflight OptionsPolicy = "cors-preflight"
+)
+
+// CORSPolicy lets browsers call a route from the origins in AllowOrigins,
+// which may include "*" to allow any origin. Responses to requests from an
+// allowed origin carry an Access-Control-Allow-Origin header, and
+// Access-Control-Allow-Credentials when AllowCredentials is set, which
+// cannot be combined with "*". Under OptionsCORSPreflight, preflight requests
+// are answered with the methods in AllowMethods, or the route's Methods when
+// it is empty, the headers in AllowHeaders and a MaxAge, when set, for which
+// browsers may cache the answer. A preflight from an origin which is not
+// allowed, or for a method which is not, is answered without them, so that
+// the browser refuses the request.
+type CORSPolicy struct {
+	AllowOrigins     []string
+	AllowMethods     []string      `json:",omitempty"`
+	AllowHeaders     []string      `json:",omitempty"`
+	AllowCredentials bool          `json:",omitempty"`
+	MaxAge           time.Duration `json:",omitempty"`
+}
+
+// validate checks the policy and returns its origins normalized as
+// parseOrigin does, keeping "*" as it is.
+func (policy *CORSPolicy) validate() ([]string, error) {
+	if len(policy.AllowOrigins) == 0 {
+		return nil, fmt.Errorf("cors policy allows no origins")
+	}
+	origins := make([]string, len(policy.AllowOrigins))
+	for index, origin := range policy.AllowOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return nil, fmt.Errorf("cors policy cannot allow credentials from any origin")
+			}
+			origins[index] = origin
+			continue
+		}
+		normalized, err := parseOrigin(origin)
+		if err != nil {
+			return nil, fmt.Errorf("cors origin %q: %s", origin, err.Error())
+		}
+		origins[index] = normalized
+	}
+	for _, method := range policy.AllowMethods {
+		if !validToken(method) {
+			return nil, fmt.Errorf("invalid cors method %q", method)
+		}
+	}
+	for _, header := range policy.AllowHeaders {
+		if !validToken(header) {
+			return nil, fmt.Errorf("invalid cors header %q", header)
+		}
+	}
+	if policy.MaxAge < 0 {
+		return nil, fmt.Errorf("cors max age is negative")
+	}
+	return origins, nil
+}
+
+// validateOptions checks the route's OptionsPolicy and the settings it
+// depends on.
+func (route RouteRule) validateOptions() error {
+	for _, method := range route.OptionsAllow {
+		if !validToken(method) {
+			return fmt.Errorf("invalid allowed method %q", method)
+		}
+	}
+	switch route.Options {
+	case "", OptionsProxy:
+		if len(route.OptionsAllow) > 0 {
+			return fmt.Errorf("options allow is set but OPTIONS requests are proxied")
+		}
+		return nil
+	case OptionsAnswerLocally:
+		if len(route.OptionsAllow) == 0 && len(route.Methods) == 0 {
+			return fmt.Errorf("answering OPTIONS locally requires OptionsAllow or Methods")
+		}
+		return nil
+	case OptionsCORSPreflight:
+		if route.CORS == nil {
+			return fmt.Errorf("cors preflight requires a CORS policy")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown options policy %q", route.Options)
+}
+
+// isPreflight reports whether request is a CORS preflight request.
+func isPreflight(request *http.Request) bool {
+	return request.Method == http.MethodOptions && request.Header.Get("Origin") != "" &&
+		request.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answersOptions reports whether the route answers request itself under its
+// OptionsPolicy rather than forwarding it.
+func (route *validRouteRule) answersOptions(request *http.Request) bool {
+	switch route.Options {
+	case OptionsAnswerLocally:
+		return request.Method == http.MethodOptions
+	case OptionsCORSPreflight:
+		return isPreflight(request)
+	}
+	return false
+}
+
+// answerOptions answers an OPTIONS request for route with 204 No Content.
+func (route *validRouteRule) answerOptions(writer http.ResponseWriter, request *http.Request) {
+	if route.Options == OptionsCORSPreflight {
+		route.answerPreflight(writer.Header(), request)
+	} else {
+		allowed := route.OptionsAllow
+		if len(allowed) == 0 {
+			allowed = route.methods()
+			if !route.allowsMethod(http.MethodOptions) {
+				allowed = append(allowed, http.MethodOptions)
+			}
+		}
+		writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// serveOptions answers an OPTIONS request for route itself, recording it as
+// handleHTTPRequest records the requests it forwards.
+func (handler *ProxyHandler) serveOptions(route *validRouteRule, writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+	requestBody := countRequestBody(request)
+	route.answerOptions(writer, request)
+	observation := &Observation{
+		Request:    request,
+		Route:      route.Path,
+		StatusCode: http.StatusNoContent,
+		ClientIP:   handler.clientIP(request),
+		QueueWait:  queueDuration(request),
+		Labels:     route.Labels,
+	}
+	handler.recordRequest(route, observation, writer, requestBody, start)
+}
+
+// answerPreflight sets the headers of the answer to a CORS preflight request.
+func (route *validRouteRule) answerPreflight(header http.Header, request *http.Request) {
+	header.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	methods := route.CORS.AllowMethods
+	if len(methods) == 0 {
+		methods = route.Methods
+	}
+	requested := request.Header.Get("Access-Control-Request-Method")
+	if len(methods) > 0 && !slices.Contains(methods, requested) {
+		return
+	}
+	if !route.setAllowOrigin(header, request) {
+		return
+	}
+	if len(methods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	} else {
+		header.Set("Access-Control-Allow-Methods", requested)
+	}
+	if len(route.CORS.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(route.CORS.AllowHeaders, ", "))
+	}
+	if route.CORS.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(route.CORS.MaxAge/time.Second)))
+	}
+}
+
+// setCORSHeaders marks a response relayed for request as readable by the
+// request's origin when the route's CORS policy allows it, in place of any
+// such marking by the upstream.
+func (route *validRouteRule) setCORSHeaders(header http.Header, request *http.Request) {
+	if route.CORS == nil {
+		return
+	}
+	// the policy decides which origins may read the response, whatever the
+	// upstream allowed
+	header.Del("Access-Control-Allow-Origin")
+	header.Del("Access-Control-Allow-Credentials")
+	if request.Header.Get("Origin") == "" {
+		return
+	}
+	header.Add("Vary", "Origin")
+	route.setAllowOrigin(header, request)
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin header, and
+// Access-Control-Allow-Credentials, when the Origin of request is allowed by
+// the route's CORS policy, reporting whether it is.
+func (route *validRouteRule) setAllowOrigin(header http.Header, request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	normalized, err := parseOrigin(origin)
+	for _, allowed := range route.corsOrigins {
+		if allowed == "*" {
+			header.Set("Access-Control-Allow-Origin", "*")
+			return true
+		}
+		if err == nil && allowed == normalized {
+			header.Set("Access-Control-Allow-Origin", origin)
+			if route.CORS.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/jarcoal/httpmock"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsPolicies(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	upstreamRequests := make(map[string]int)
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		upstreamRequests[r.Method+" "+r.URL.Host]++
+		response := httpmock.NewStringResponse(200, "")
+		response.Header.Set("Allow", "UPSTREAM")
+		response.Header.Set("Access-Control-Allow-Origin", "*")
+		response.Header.Set("Access-Control-Allow-Credentials", "true")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/proxied", Endpoint: "http://proxied", Options: OptionsProxy},
+		&RouteRule{Path: "/local", Endpoint: "http://local", Options: OptionsAnswerLocally, OptionsAllow: []string{"GET", "HEAD", "OPTIONS"}},
+		&RouteRule{Path: "/restricted", Endpoint: "http://restricted", Methods: []string{"GET", "POST"}, Options: OptionsAnswerLocally},
+		&RouteRule{
+			Path:     "/cors",
+			Endpoint: "http://cors",
+			Options:  OptionsCORSPreflight,
+			CORS: &CORSPolicy{
+				AllowOrigins:     []string{"https://app.example"},
+				AllowMethods:     []string{"GET", "PUT"},
+				AllowHeaders:     []string{"Authorization"},
+				AllowCredentials: true,
+				MaxAge:           10 * time.Minute,
+			},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		return recorder
+	}
+	preflight := func(origin, method string) http.Header {
+		return http.Header{"Origin": {origin}, "Access-Control-Request-Method": {method}}
+	}
+
+	if recorder := serve("OPTIONS", "/proxied", nil); recorder.Code != http.StatusOK || recorder.Header().Get("Allow") != "UPSTREAM" {
+		t.Errorf("expected OPTIONS to be proxied\nreceived: %d %v", recorder.Code, recorder.Header())
+	}
+	for path, allow := range map[string]string{"/local": "GET, HEAD, OPTIONS", "/restricted": "GET, POST, HEAD, OPTIONS"} {
+		recorder := serve("OPTIONS", path, nil)
+		if recorder.Code != http.StatusNoContent || recorder.Header().Get("Allow") != allow {
+			t.Errorf("unexpected local answer for %s\nexpected: 204 %v\nreceived: %d %v", path, allow, recorder.Code, recorder.Header().Get("Allow"))
+		}
+	}
+
+	recorder := serve("OPTIONS", "/cors", preflight("https://app.example", "PUT"))
+	expected := http.Header{
+		"Access-Control-Allow-Origin":      {"https://app.example"},
+		"Access-Control-Allow-Credentials": {"true"},
+		"Access-Control-Allow-Methods":     {"GET, PUT"},
+		"Access-Control-Allow-Headers":     {"Authorization"},
+		"Access-Control-Max-Age":           {"600"},
+	}
+	for name, values := range expected {
+		if received := recorder.Header().Get(name); recorder.Code != http.StatusNoContent || received != values[0] {
+			t.Errorf("unexpected preflight answer for %s\nexpected: 204 %v\nreceived: %d %v", name, values[0], recorder.Code, received)
+		}
+	}
+	for _, header := range []http.Header{preflight("https://evil.example", "PUT"), preflight("https://app.example", "DELETE")} {
+		recorder := serve("OPTIONS", "/cors", header)
+		if recorder.Code != http.StatusNoContent || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("expected a refused preflight to be answered without CORS headers\nreceived: %d %v", recorder.Code, recorder.Header())
+		}
+	}
+	if recorder := serve("OPTIONS", "/cors", nil); recorder.Header().Get("Allow") != "UPSTREAM" {
+		t.Errorf("expected an OPTIONS request which is not a preflight to be proxied\nreceived: %d %v", recorder.Code, recorder.Header())
+	}
+	recorder = serve("GET", "/cors", http.Header{"Origin": {"https://app.example"}})
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "https://app.example" || recorder.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected the response to be readable by the allowed origin\nreceived: %v", recorder.Header())
+	}
+	// the upstream's own CORS headers give way to the route's policy
+	recorder = serve("GET", "/cors", http.Header{"Origin": {"https://evil.example"}})
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "" || recorder.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected the response not to be readable by a disallowed origin\nreceived: %v", recorder.Header())
+	}
+
+	expectedRequests := map[string]int{"OPTIONS proxied": 1, "OPTIONS cors": 1, "GET cors": 2}
+	for key, count := range expectedRequests {
+		if upstreamRequests[key] != count {
+			t.Errorf("unexpected upstream requests for %s\nexpected: %v\nreceived: %v", key, count, upstreamRequests)
+		}
+	}
+	if len(upstreamRequests) != len(expectedRequests) {
+		t.Errorf("expected local answers not to contact the upstream\nreceived: %v", upstreamRequests)
+	}
+}
+
+func TestLocalOptionsAnswersAreObserved(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var observations []*Observation
+	config := buildConfiguration()
+	config.Observer = func(observation *Observation) {
+		observations = append(observations, observation)
+	}
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/local", Endpoint: "http://local", Options: OptionsAnswerLocally, OptionsAllow: []string{"GET", "OPTIONS"}, Labels: map[string]string{"team": "web"}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/local", nil))
+
+	if len(observations) != 1 {
+		t.Fatalf("unexpected observations\nexpected: %v\nreceived: %v", 1, len(observations))
+	}
+	observation := observations[0]
+	if observation.Route != "/local" || observation.StatusCode != http.StatusNoContent || observation.Endpoint() != ProxyEndpoint {
+		t.Errorf("unexpected observation\nexpected: %v %v %v\nreceived: %v %v %v", "/local", http.StatusNoContent, ProxyEndpoint, observation.Route, observation.StatusCode, observation.Endpoint())
+	}
+	if !strings.Contains(logged.String(), "response 204 for /local") {
+		t.Errorf("expected the answer to be written to the access log\nreceived: %v", logged.String())
+	}
+	if count := h.Stats()["/local"]; count.Requests != 1 {
+		t.Errorf("unexpected route requests in stats\nexpected: %v\nreceived: %v", 1, count.Requests)
+	}
+}
+
+func TestOptionsPolicyValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"unknown options policy":            RouteRule{Path: "/", Endpoint: "http://one", Options: "ignore"},
+		"requires OptionsAllow or Methods":  RouteRule{Path: "/", Endpoint: "http://one", Options: OptionsAnswerLocally},
+		"OPTIONS requests are proxied":      RouteRule{Path: "/", Endpoint: "http://one", OptionsAllow: []string{"GET"}},
+		"cors preflight requires a CORS":    RouteRule{Path: "/", Endpoint: "http://one", Options: OptionsCORSPreflight},
+		"cors policy allows no origins":     RouteRule{Path: "/", Endpoint: "http://one", CORS: &CORSPolicy{}},
+		"cannot allow credentials from any": RouteRule{Path: "/", Endpoint: "http://one", CORS: &CORSPolicy{AllowOrigins: []string{"*"}, AllowCredentials: true}},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outlierLabel is the label of the route changes reported when outlier
+// detection ejects an endpoint from rotation or readmits it.
+const outlierLabel = "outlier"
+
+// defaultMaxEjectionPercent is the share of a route's endpoints which may be
+// ejected at once when OutlierDetection leaves MaxEjectionPercent unset.
+const defaultMaxEjectionPercent = 50
+
+// OutlierDetection ejects an endpoint of a route with several Endpoints from
+// rotation once its recent requests fail too often or take too long.
+//
+// Window is the number of requests to each endpoint over which it is judged;
+// an endpoint is only judged once it has served a full window. MaxErrorRate
+// is the share of those requests, between 0 and 1, which may fail to reach
+// the endpoint or be answered with a 5xx status. MaxLatency is the longest
+// their mean time to a response may be. At least one of the two must be set.
+//
+// An ejected endpoint returns to rotation after BaseEjectionTime multiplied
+// by the number of times it has been ejected, up to MaxEjectionTime when that
+// is set, and is judged afresh from then on. MaxEjectionPercent caps the
+// share of endpoints which are ejected at once, defaulting to 50; at least one
+// endpoint always stays in rotation.
+type OutlierDetection struct {
+	Window             int
+	MaxErrorRate       float64       `json:",omitempty"`
+	MaxLatency         time.Duration `json:",omitempty"`
+	MaxEjectionPercent int           `json:",omitempty"`
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration `json:",omitempty"`
+}
+
+func (config *OutlierDetection) validate() error {
+	if config.Window <= 0 {
+		return fmt.Errorf("outlier detection window must be positive")
+	}
+	if config.MaxErrorRate < 0 || config.MaxErrorRate > 1 {
+		return fmt.Errorf("outlier detection error rate %v is not between 0 and 1", config.MaxErrorRate)
+	}
+	if config.MaxLatency < 0 {
+		return fmt.Errorf("outlier detection latency is negative")
+	}
+	if config.MaxErrorRate == 0 && config.MaxLatency == 0 {
+		return fmt.Errorf("outlier detection requires an error rate or latency threshold")
+	}
+	if config.MaxEjectionPercent < 0 || config.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier detection ejection percentage %d is not between 0 and 100", config.MaxEjectionPercent)
+	}
+	if config.BaseEjectionTime <= 0 {
+		return fmt.Errorf("outlier detection base ejection time must be positive")
+	}
+	if config.MaxEjectionTime < 0 {
+		return fmt.Errorf("outlier detection max ejection time is negative")
+	}
+	return nil
+}
+
+// endpointHealth holds the recent outcomes of requests to one endpoint in a
+// ring of Window entries.
+type endpointHealth struct {
+	failures     []bool
+	latencies    []time.Duration
+	next         int
+	count        int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// outlierDetector tracks the health of each of a route's endpoints, in the
+// order of its EndpointURLs.
+// readmitted, when set, is called with the index of each endpoint returned
+// to rotation.
+type outlierDetector struct {
+	config     OutlierDetection
+	endpoints  []string
+	readmitted func(index int, now time.Time)
+	mutex      sync.Mutex
+	health     []endpointHealth
+}
+
+func newOutlierDetector(config OutlierDetection, endpoints []string) *outlierDetector {
+	detector := &outlierDetector{config: config, endpoints: endpoints, health: make([]endpointHealth, len(endpoints))}
+	for index := range detector.health {
+		detector.health[index].failures = make([]bool, config.Window)
+		detector.health[index].latencies = make([]time.Duration, config.Window)
+	}
+	return detector
+}
+
+func (health *endpointHealth) ejected(now time.Time) bool {
+	return !health.ejectedUntil.IsZero() && now.Before(health.ejectedUntil)
+}
+
+// inRotation lists the endpoints which have not been ejected, as RouteChange
+// reports them. It must be called with mutex held.
+func (detector *outlierDetector) inRotation() string {
+	var endpoints []string
+	for index := range detector.health {
+		if detector.health[index].ejectedUntil.IsZero() {
+			endpoints = append(endpoints, detector.endpoints[index])
+		}
+	}
+	return strings.Join(endpoints, ", ")
+}
+
+// canEject reports whether one more endpoint may be ejected. It must be called
+// with mutex held, after readmit.
+func (detector *outlierDetector) canEject() bool {
+	percent := detector.config.MaxEjectionPercent
+	if percent == 0 {
+		percent = defaultMaxEjectionPercent
+	}
+	allowed := len(detector.health) * percent / 100
+	if allowed >= len(detector.health) {
+		allowed = len(detector.health) - 1
+	}
+	ejected := 0
+	for index := range detector.health {
+		if !detector.health[index].ejectedUntil.IsZero() {
+			ejected++
+		}
+	}
+	return ejected < allowed
+}
+
+// readmit returns endpoints whose ejection has lapsed to rotation, returning
+// the RouteChanges which describe it. It must be called with mutex held.
+func (detector *outlierDetector) readmit(now time.Time) []RouteChange {
+	var changes []RouteChange
+	for index := range detector.health {
+		health := &detector.health[index]
+		if health.ejectedUntil.IsZero() || health.ejected(now) {
+			continue
+		}
+		before := detector.inRotation()
+		health.ejectedUntil = time.Time{}
+		changes = append(changes, RouteChange{OldEndpoint: before, NewEndpoint: detector.inRotation()})
+		log.Printf("proxy: readmitted %s to rotation", detector.endpoints[index])
+		if detector.readmitted != nil {
+			detector.readmitted(index, now)
+		}
+	}
+	return changes
+}
+
+// pick returns the index of the endpoint chosen by choose, which is told to
+// pass over those which are ejected, readmitting any whose ejection has
+// lapsed first.
+func (detector *outlierDetector) pick(choose func(skip func(int) bool) int, now time.Time) (int, []RouteChange) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	changes := detector.readmit(now)
+	index := choose(func(index int) bool {
+		return detector.health[index].ejected(now)
+	})
+	return index, changes
+}
+
+// record adds the outcome of a request to the endpoint at index, ejecting
+// the endpoint when its window breaches a threshold. It returns the
+// RouteChanges made, the last of which is the ejection when ejected is set.
+func (detector *outlierDetector) record(index int, failed bool, latency time.Duration, now time.Time) (changes []RouteChange, ejected bool) {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	changes = detector.readmit(now)
+	health := &detector.health[index]
+	if health.ejected(now) {
+		return changes, false
+	}
+	health.failures[health.next] = failed
+	health.latencies[health.next] = latency
+	health.next = (health.next + 1) % detector.config.Window
+	if health.count < detector.config.Window {
+		health.count++
+	}
+	if health.count < detector.config.Window {
+		return changes, false
+	}
+
+	failures := 0
+	var total time.Duration
+	for slot := range health.failures {
+		if health.failures[slot] {
+			failures++
+		}
+		total += health.latencies[slot]
+	}
+	errorRate := float64(failures) / float64(detector.config.Window)
+	meanLatency := total / time.Duration(detector.config.Window)
+	var reason string
+	switch {
+	case detector.config.MaxErrorRate > 0 && errorRate > detector.config.MaxErrorRate:
+		reason = fmt.Sprintf("error rate %.2f", errorRate)
+	case detector.config.MaxLatency > 0 && meanLatency > detector.config.MaxLatency:
+		reason = fmt.Sprintf("mean latency %s", meanLatency)
+	default:
+		return changes, false
+	}
+	if !detector.canEject() {
+		return changes, false
+	}
+
+	before := detector.inRotation()
+	health.ejections++
+	duration := detector.config.BaseEjectionTime * time.Duration(health.ejections)
+	if detector.config.MaxEjectionTime > 0 && duration > detector.config.MaxEjectionTime {
+		duration = detector.config.MaxEjectionTime
+	}
+	health.ejectedUntil = now.Add(duration)
+	health.next, health.count = 0, 0
+	log.Printf("proxy: ejected %s from rotation for %s after %s", detector.endpoints[index], duration, reason)
+	return append(changes, RouteChange{OldEndpoint: before, NewEndpoint: detector.inRotation()}), true
+}
+
+// pickEndpoint returns the endpoint of route which serves request: the next in
+// rotation, weighted by the route's SlowStart, or that of the request's
+// HashKey, passing over those ejected by outlier detection.
+func (handler *ProxyHandler) pickEndpoint(route *validRouteRule, request *http.Request) *url.URL {
+	if route.outliers == nil && route.slowStart == nil && route.hashRing == nil {
+		return route.nextEndpoint()
+	}
+	now := handler.now()
+	choose := route.rotate
+	if route.slowStart != nil {
+		choose = func(skip func(int) bool) int {
+			return route.slowStart.choose(now, skip)
+		}
+	}
+	if route.hashRing != nil {
+		if key := route.HashKey(request); key != "" {
+			choose = func(skip func(int) bool) int {
+				return route.hashRing.choose(key, skip)
+			}
+		}
+	}
+	if route.outliers == nil {
+		return route.EndpointURLs[choose(func(int) bool { return false })]
+	}
+	index, changes := route.outliers.pick(choose, now)
+	handler.reportOutliers(route, changes, now)
+	return route.EndpointURLs[index]
+}
+
+// rotate returns the index of the route's next endpoint in rotation, passing
+// over those for which skip reports true unless every endpoint is skipped.
+func (route *validRouteRule) rotate(skip func(int) bool) int {
+	count := uint64(len(route.EndpointURLs))
+	index := int((route.rotation.Add(1) - 1) % count)
+	for attempts := uint64(1); attempts < count && skip(index); attempts++ {
+		index = int((route.rotation.Add(1) - 1) % count)
+	}
+	return index
+}
+
+// recordAttempt feeds the outcome of a request sent to the upstream chosen in
+// observation to the route's outlier detection, reporting whether it ejected
+// the endpoint. Requests abandoned by the client are not counted.
+func (handler *ProxyHandler) recordAttempt(route *validRouteRule, observation *Observation, response *http.Response, err error, latency time.Duration) bool {
+	if route.outliers == nil || observation.Request.Context().Err() != nil {
+		return false
+	}
+	for index, endpointURL := range route.EndpointURLs {
+		if endpointURL != observation.Upstream {
+			continue
+		}
+		now := handler.now()
+		failed := err != nil || response.StatusCode >= 500
+		changes, ejected := route.outliers.record(index, failed, latency, now)
+		handler.reportOutliers(route, changes, now)
+		return ejected
+	}
+	return false
+}
+
+// reportOutliers passes ejections and readmissions to the RouteChangeHook.
+// They are reported while holding routesMutex so that the hook is never
+// called concurrently.
+func (handler *ProxyHandler) reportOutliers(route *validRouteRule, changes []RouteChange, now time.Time) {
+	if len(changes) == 0 || handler.configuration.RouteChangeHook == nil {
+		return
+	}
+	handler.routesMutex.Lock()
+	defer handler.routesMutex.Unlock()
+	for _, change := range changes {
+		change.Label, change.Time, change.Path = outlierLabel, now, route.Path
+		handler.configuration.RouteChangeHook(change)
+	}
+}
@@ -0,0 +1,202 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetectionEjectsAndReadmitsFailingEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://one/api", httpmock.NewStringResponder(200, "one"))
+	httpmock.RegisterResponder("GET", "http://two/api", httpmock.NewStringResponder(500, "two"))
+	httpmock.RegisterResponder("GET", "http://three/api", httpmock.NewStringResponder(200, "three"))
+
+	var changes []RouteChange
+	var ejections []string
+	config := buildConfiguration()
+	config.RouteChangeHook = func(change RouteChange) {
+		changes = append(changes, change)
+	}
+	config.Observer = func(observation *Observation) {
+		if observation.Ejected {
+			ejections = append(ejections, observation.Upstream.String())
+		}
+	}
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:      "/api",
+			Endpoints: []string{"http://one", "http://two", "http://three"},
+			OutlierDetection: &OutlierDetection{
+				Window:           2,
+				MaxErrorRate:     0.5,
+				BaseEjectionTime: 10 * time.Second,
+			},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+	serve := func(count int) string {
+		var bodies []string
+		for i := 0; i < count; i++ {
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/api", nil))
+			bodies = append(bodies, recorder.Body.String())
+		}
+		return strings.Join(bodies, " ")
+	}
+
+	steps := []struct {
+		advance  time.Duration
+		requests int
+		expected string
+	}{
+		// the second failure fills two's window and ejects it
+		{0, 6, "one two three one two three"},
+		{0, 4, "one three one three"},
+		// readmitted after the base ejection time
+		{10 * time.Second, 3, "one two three"},
+		// ejected again, now for twice as long
+		{0, 3, "one two three"},
+		{15 * time.Second, 3, "one three one"},
+		{5 * time.Second, 3, "two three one"},
+	}
+	for index, step := range steps {
+		clock = clock.Add(step.advance)
+		if received := serve(step.requests); received != step.expected {
+			t.Errorf("unexpected endpoints at step %d\nexpected: %v\nreceived: %v", index, step.expected, received)
+		}
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	all, remaining := "http://one, http://two, http://three", "http://one, http://three"
+	expectedChanges := []RouteChange{
+		{Label: "outlier", Time: start, Path: "/api", OldEndpoint: all, NewEndpoint: remaining},
+		{Label: "outlier", Time: start.Add(10 * time.Second), Path: "/api", OldEndpoint: remaining, NewEndpoint: all},
+		{Label: "outlier", Time: start.Add(10 * time.Second), Path: "/api", OldEndpoint: all, NewEndpoint: remaining},
+		{Label: "outlier", Time: start.Add(30 * time.Second), Path: "/api", OldEndpoint: remaining, NewEndpoint: all},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("unexpected route changes\nexpected: %v\nreceived: %v", expectedChanges, changes)
+	}
+	expectedEjections := []string{"http://two", "http://two"}
+	if !reflect.DeepEqual(ejections, expectedEjections) {
+		t.Errorf("unexpected ejections observed\nexpected: %v\nreceived: %v", expectedEjections, ejections)
+	}
+}
+
+func TestOutlierDetectionEjectsSlowEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	httpmock.RegisterResponder("GET", "http://fast/api", httpmock.NewStringResponder(200, "fast"))
+	httpmock.RegisterResponder("GET", "http://slow/api", func(request *http.Request) (*http.Response, error) {
+		clock = clock.Add(2 * time.Second)
+		return httpmock.NewStringResponse(200, "slow"), nil
+	})
+
+	for _, mode := range proxyModes {
+		config := buildConfiguration()
+		config.StdlibProxy = mode.stdlib
+		config.Routes = []*RouteRule{
+			&RouteRule{
+				Path:      "/api",
+				Endpoints: []string{"http://fast", "http://slow"},
+				OutlierDetection: &OutlierDetection{
+					Window:           1,
+					MaxLatency:       time.Second,
+					BaseEjectionTime: time.Minute,
+				},
+			},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		h.now = func() time.Time { return clock }
+
+		var bodies []string
+		for i := 0; i < 4; i++ {
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/api", nil))
+			bodies = append(bodies, recorder.Body.String())
+		}
+		expected := "fast slow fast fast"
+		if received := strings.Join(bodies, " "); received != expected {
+			t.Errorf("%s: unexpected endpoints\nexpected: %v\nreceived: %v", mode.name, expected, received)
+		}
+	}
+}
+
+func TestOutlierDetectionKeepsEndpointsInRotation(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://one/api", httpmock.NewStringResponder(502, "one"))
+	httpmock.RegisterResponder("GET", "http://two/api", httpmock.NewStringResponder(502, "two"))
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:      "/api",
+			Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: &OutlierDetection{
+				Window:             1,
+				MaxErrorRate:       0.5,
+				MaxEjectionPercent: 100,
+				BaseEjectionTime:   time.Minute,
+			},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/api", nil))
+		bodies = append(bodies, recorder.Body.String())
+	}
+	expected := "one two two two"
+	if received := strings.Join(bodies, " "); received != expected {
+		t.Errorf("unexpected endpoints\nexpected: %v\nreceived: %v", expected, received)
+	}
+}
+
+func TestOutlierDetectionValidation(t *testing.T) {
+	detection := func(modify func(*OutlierDetection)) *OutlierDetection {
+		config := &OutlierDetection{Window: 10, MaxErrorRate: 0.5, BaseEjectionTime: time.Second}
+		modify(config)
+		return config
+	}
+	examples := map[string]RouteRule{
+		"several endpoints": RouteRule{Path: "/api", Endpoint: "http://one", OutlierDetection: detection(func(*OutlierDetection) {})},
+		"window must be positive": RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: detection(func(config *OutlierDetection) { config.Window = 0 })},
+		"requires an error rate or latency": RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: detection(func(config *OutlierDetection) { config.MaxErrorRate = 0 })},
+		"error rate 1.5": RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: detection(func(config *OutlierDetection) { config.MaxErrorRate = 1.5 })},
+		"ejection percentage 101": RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: detection(func(config *OutlierDetection) { config.MaxEjectionPercent = 101 })},
+		"base ejection time must be positive": RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"},
+			OutlierDetection: detection(func(config *OutlierDetection) { config.BaseEjectionTime = 0 })},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
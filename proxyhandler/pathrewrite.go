@@ -0,0 +1,102 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewritePath replaces the route's RewriteFrom prefix with RewriteTo in the
+// path of upstreamURL. The escaped form of the path is rewritten so that
+// escaped characters in the remainder reach the upstream as they were sent.
+func (route *validRouteRule) rewritePath(upstreamURL *url.URL) *url.URL {
+	if len(route.RewriteFrom) == 0 {
+		return upstreamURL
+	}
+	rewritten, ok := replacePathPrefix(upstreamURL.EscapedPath(), route.RewriteFrom, route.RewriteTo)
+	if !ok {
+		return upstreamURL
+	}
+	path, err := url.PathUnescape(rewritten)
+	if err != nil {
+		return upstreamURL
+	}
+	upstreamURL.Path = path
+	upstreamURL.RawPath = ""
+	if rewritten != upstreamURL.EscapedPath() {
+		upstreamURL.RawPath = rewritten
+	}
+	return upstreamURL
+}
+
+// unrewriteResponse maps paths in headers which point back at the upstream
+// from RewriteTo to RewriteFrom, so clients are sent to paths they can reach.
+// Absolute Location URLs naming the upstream host are made to name the host
+// the client requested instead.
+func (route *validRouteRule) unrewriteResponse(response *http.Response, clientRequest *http.Request) {
+	if len(route.RewriteFrom) == 0 {
+		return
+	}
+	if location := response.Header.Get("Location"); location != "" {
+		response.Header.Set("Location", route.unrewriteLocation(location, response.Request, clientRequest))
+	}
+	cookies := response.Header["Set-Cookie"]
+	for index, cookie := range cookies {
+		cookies[index] = route.unrewriteCookiePath(cookie)
+	}
+}
+
+func (route *validRouteRule) unrewriteLocation(location string, upstreamRequest, clientRequest *http.Request) string {
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if locationURL.Host != "" {
+		if upstreamRequest == nil || locationURL.Host != upstreamRequest.URL.Host {
+			return location
+		}
+		locationURL.Host = clientRequest.Host
+		locationURL.Scheme = "http"
+		if clientRequest.TLS != nil {
+			locationURL.Scheme = "https"
+		}
+	}
+	if path, ok := replacePathPrefix(locationURL.EscapedPath(), route.RewriteTo, route.RewriteFrom); ok {
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			locationURL.Path, locationURL.RawPath = unescaped, path
+		}
+	}
+	return locationURL.String()
+}
+
+func (route *validRouteRule) unrewriteCookiePath(cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	for index, attribute := range attributes {
+		trimmed := strings.TrimSpace(attribute)
+		if len(trimmed) < 5 || !strings.EqualFold(trimmed[:5], "path=") {
+			continue
+		}
+		if path, ok := replacePathPrefix(trimmed[5:], route.RewriteTo, route.RewriteFrom); ok {
+			attributes[index] = " " + trimmed[:5] + path
+		}
+	}
+	return strings.Join(attributes, ";")
+}
+
+// replacePathPrefix swaps prefix for replacement at the start of path. The
+// prefix only matches whole segments, so /api does not match /apis.
+func replacePathPrefix(path, prefix, replacement string) (string, bool) {
+	trimmedPrefix := strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(path, trimmedPrefix) {
+		return path, false
+	}
+	remainder := path[len(trimmedPrefix):]
+	if remainder != "" && remainder[0] != '/' {
+		return path, false
+	}
+	rewritten := strings.TrimSuffix(replacement, "/") + remainder
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten, true
+}
@@ -0,0 +1,102 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func buildRewriteHandler(t *testing.T, upstream http.Handler) (*ProxyHandler, *httptest.Server) {
+	server := httptest.NewServer(upstream)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:        "/v1/billing",
+			Endpoint:    server.URL,
+			RewriteFrom: "/v1/billing",
+			RewriteTo:   "/internal/billing/v2",
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		server.Close()
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h, server
+}
+
+func TestPathRewriteMapsPrefixUpstream(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var receivedPath string
+	h, server := buildRewriteHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.EscapedPath()
+	}))
+	defer server.Close()
+
+	cases := map[string]string{
+		"/v1/billing":                       "/internal/billing/v2",
+		"/v1/billing/":                      "/internal/billing/v2/",
+		"/v1/billing/invoices/42/lines":     "/internal/billing/v2/invoices/42/lines",
+		"/v1/billing/files/a%2Fb%20c":       "/internal/billing/v2/files/a%2Fb%20c",
+		"/v1/billingaccounts/not/rewritten": "/v1/billingaccounts/not/rewritten",
+	}
+	for requested, expectedPath := range cases {
+		receivedPath = ""
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", requested, nil))
+		if receivedPath != expectedPath {
+			t.Errorf("unexpected upstream path for %s\nexpected: %v\nreceived: %v", requested, expectedPath, receivedPath)
+		}
+	}
+}
+
+func TestPathRewriteReversesRedirectLocation(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var upstreamURL string
+	h, server := buildRewriteHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("to") {
+		case "absolute":
+			w.Header().Set("Location", upstreamURL+"/internal/billing/v2/invoices/43")
+		default:
+			w.Header().Set("Location", "/internal/billing/v2/invoices/43")
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/internal/billing/v2/"})
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+	upstreamURL = server.URL
+
+	cases := map[string]string{
+		"/v1/billing/invoices/42":             "/v1/billing/invoices/43",
+		"/v1/billing/invoices/42?to=absolute": "http://proxy.example/v1/billing/invoices/43",
+	}
+	for requested, expectedLocation := range cases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", requested, nil)
+		request.Host = "proxy.example"
+		h.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusFound {
+			t.Errorf("expected redirect to be relayed\nexpected: %v\nreceived: %v", http.StatusFound, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != expectedLocation {
+			t.Errorf("unexpected Location for %s\nexpected: %v\nreceived: %v", requested, expectedLocation, location)
+		}
+		if cookie := recorder.Header().Get("Set-Cookie"); !strings.Contains(cookie, "Path=/v1/billing/") {
+			t.Errorf("expected cookie path to be reversed\nexpected: %v\nreceived: %v", "Path=/v1/billing/", cookie)
+		}
+	}
+}
+
+func TestPathRewriteRequiresPrefix(t *testing.T) {
+	route := RouteRule{Path: "/v1", Endpoint: "http://upstream", RewriteTo: "/internal"}
+	expectedError := "without a prefix"
+	if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
@@ -3,20 +3,63 @@
 package proxyhandler
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/koding/websocketproxy"
-	"io"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
-	"strings"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyHandler implements http.Handler and will override portions of the request URI
 // prior to completing the request.
 type ProxyHandler struct {
-	defaultHostURL *url.URL
-	routes         []*validRouteRule
+	configuration      Configuration
+	transport          http.RoundTripper
+	client             *http.Client
+	transports         *transportRegistry
+	buffers            *bufferPool
+	observer           func(*Observation)
+	trustedProxies     []*net.IPNet
+	devOverrideTargets []*url.URL
+	webSocketOrigins   []string
+	stats              routeStats
+	errorBudget        *errorBudget
+	random             func() float64
+	now                func() time.Time
+	after              func(time.Duration) <-chan time.Time
+
+	routes      atomic.Pointer[routeTable]
+	routesMutex sync.Mutex
+
+	hosts      atomic.Pointer[map[string]string]
+	hostsMutex sync.Mutex
+
+	lifecycleMutex sync.Mutex
+	shuttingDown   bool
+	servers        []*http.Server
+	certificates   []*certificateReloader
+	inFlight       sync.WaitGroup
+	active         atomic.Int64
+	admission      *admission
+	background     sync.WaitGroup
+
+	closed      bool
+	lifetime    context.Context
+	endLifetime context.CancelFunc
+	tasks       sync.WaitGroup
+	watches     []func()
+	closeOnce   sync.Once
+	closeErr    error
+	dumps       sync.Map
 }
 
 // New creates a valid ProxyHandler and returns its pointer. It will
@@ -24,40 +67,177 @@ type ProxyHandler struct {
 func New(config *Configuration) (*ProxyHandler, error) {
 	validConfig, err := config.validate()
 	if err != nil {
-		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	vars, err := expvarMap(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	handler := &ProxyHandler{
+		configuration:      *config,
+		transport:          validConfig.Transport,
+		client:             newClient(validConfig.Transport),
+		transports:         newTransportRegistry(validConfig.Transport),
+		buffers:            newBufferPool(config.CopyBufferSize),
+		observer:           config.Observer,
+		trustedProxies:     validConfig.TrustedProxies,
+		devOverrideTargets: validConfig.DevOverrideTargets,
+		webSocketOrigins:   validConfig.WebSocketOrigins,
+		random:             config.Random,
+		admission:          newAdmission(config),
+		errorBudget:        newErrorBudget(config.ErrorBudgetAlert),
+	}
+	if handler.random == nil {
+		handler.random = rand.Float64
 	}
-	handler := ProxyHandler{
-		defaultHostURL: validConfig.DefaultRoute,
-		routes:         validConfig.Routes,
+	handler.now = time.Now
+	handler.after = time.After
+	handler.lifetime, handler.endLifetime = context.WithCancel(context.Background())
+	if cache := validConfig.DNSCache; cache != nil {
+		cache.start, cache.lifetime = handler.goBackground, handler.lifetime
+	}
+	handler.startExpiry(validConfig.Routes)
+	handler.routes.Store(&routeTable{
+		defaultRoute: &validRouteRule{
+			RouteRule:   RouteRule{Endpoint: config.DefaultRoute},
+			EndpointURL: validConfig.DefaultRoute,
+		},
+		routes: validConfig.Routes,
+	})
+	handler.warmUp(nil, handler.routes.Load())
+	if vars != nil {
+		handler.publishExpvar(vars)
 	}
 	handler.announceSetup()
-	return &handler, nil
+	return handler, nil
 }
 
 func (handler *ProxyHandler) announceSetup() {
+	table := handler.routes.Load()
 	log.Println("New proxy created")
-	log.Printf("Default proxy backend %s", handler.defaultHostURL.String())
-	for _, route := range handler.routes {
-		log.Printf("\tRoute %s -> %s", route.Path, route.Endpoint)
+	log.Printf("Default proxy backend %s", table.defaultRoute.EndpointURL.String())
+	for _, route := range table.routes {
+		log.Printf("\tRoute %s -> %s", route.Path, route.target())
 	}
 }
 
 func (handler *ProxyHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	for _, route := range handler.routes {
-		if strings.HasPrefix(request.URL.Path, route.Path) {
-			switch route.EndpointURL.Scheme {
-			case "ws":
-				handler.handleWebsocketRequest(route.EndpointURL, writer, request)
-			case "http":
-				handler.handleHTTPRequest(route.EndpointURL, writer, request)
+	if err := handler.beginRequest(); err != nil {
+		handler.handleError(err, http.StatusServiceUnavailable, writer, request)
+		return
+	}
+	defer handler.inFlight.Done()
+	enqueued, ok := handler.admission.acquire(request.Context())
+	if !ok {
+		writer.Header().Set("Retry-After", "1")
+		handler.handleError(errOverloaded, http.StatusServiceUnavailable, writer, request)
+		return
+	}
+	request, slot := handler.admission.hold(request)
+	defer slot.release()
+	if !enqueued.IsZero() {
+		request = withQueueWait(request, enqueued, time.Now())
+	}
+	handler.active.Add(1)
+	defer handler.active.Add(-1)
+	if !handler.checkRequestLimits(writer, request) {
+		return
+	}
+	if err := checkMessageFraming(request); err != nil {
+		handler.handleError(err, http.StatusBadRequest, writer, request)
+		return
+	}
+	handler.setStrictTransportSecurity(writer.Header(), request)
+	trackedWriter := &responseWriter{ResponseWriter: writer}
+	defer handler.recoverPanic(trackedWriter, request)
+	handler.routeRequest(trackedWriter.wrap(), request)
+}
+
+// recoverPanic logs a panic raised while serving request and answers with a
+// 500 when nothing has been written to the client yet. http.ErrAbortHandler
+// is re-panicked so net/http can abort the response as intended.
+func (handler *ProxyHandler) recoverPanic(writer *responseWriter, request *http.Request) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	log.Printf("proxy: panic serving %s: %v\n%s", request.URL.String(), recovered, debug.Stack())
+	if !writer.wroteHeader && !writer.hijacked {
+		handler.handleUnexpectedError(fmt.Errorf("internal proxy error"), writer, request)
+	}
+}
+
+func (handler *ProxyHandler) routeRequest(writer http.ResponseWriter, request *http.Request) {
+	matchPath, ok := normalizePath(request.URL.Path)
+	if !ok {
+		handler.handleError(errPathEscapesRoot, http.StatusBadRequest, writer, request)
+		return
+	}
+	if handler.configuration.ForwardNormalizedPath && matchPath != request.URL.Path {
+		request.URL.Path = matchPath
+		request.URL.RawPath = ""
+	}
+	matcher := handler.configuration.Matcher
+	if matcher == nil {
+		matcher = pathMatcher{handler}
+	}
+	matched, ok := matcher.Match(request)
+	if !ok {
+		if paths, ok := matcher.(pathMatcher); ok && handler.configuration.MethodNotAllowed {
+			if allowed := paths.allowedMethods(request); len(allowed) > 0 {
+				handler.handleMethodNotAllowed(allowed, writer, request)
+				return
 			}
+		}
+		defaultRoute := handler.routes.Load().defaultRoute
+		if allowed, refused := handler.refusesMethod(defaultRoute, request.Method); refused {
+			handler.handleMethodNotAllowed(allowed, writer, request)
+			return
+		}
+		handler.handleHTTPRequest(defaultRoute, writer, request)
+		return
+	}
+	route := matched.route
+	if route.answersOptions(request) {
+		handler.serveOptions(route, writer, request)
+		return
+	}
+	if allowed, refused := handler.refusesMethod(route, request.Method); refused {
+		handler.handleMethodNotAllowed(allowed, writer, request)
+		return
+	}
+	if route.JWT != nil {
+		if err := route.JWT.authenticate(request, handler.now()); err != nil {
+			writer.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			handler.handleError(err, http.StatusUnauthorized, writer, request)
 			return
 		}
 	}
-	handler.handleHTTPRequest(handler.defaultHostURL, writer, request)
+	if len(route.EndpointTemplate) > 0 {
+		resolved, err := route.resolveTemplate(request)
+		if err != nil {
+			handler.handleError(err, http.StatusBadRequest, writer, request)
+			return
+		}
+		route = resolved
+	}
+	switch route.EndpointURL.Scheme {
+	case "ws":
+		handler.handleWebsocketRequest(route, writer, request)
+	case "http", "https":
+		handler.handleHTTPRequest(route, writer, request)
+	}
 }
 
 func buildDownstreamRequestURL(upstreamRequestURL, routeRuleURL *url.URL) *url.URL {
+	if upstreamRequestURL.Path == "*" && upstreamRequestURL.RawQuery == "" {
+		// an asterisk-form request, such as OPTIONS *, addresses the upstream
+		// server itself rather than the path "/*"
+		return &url.URL{Scheme: routeRuleURL.Scheme, Host: routeRuleURL.Host, Opaque: "*"}
+	}
 	return &url.URL{
 		Scheme:     routeRuleURL.Scheme,
 		Host:       routeRuleURL.Host,
@@ -68,57 +248,320 @@ func buildDownstreamRequestURL(upstreamRequestURL, routeRuleURL *url.URL) *url.U
 	}
 }
 
-func (handler *ProxyHandler) handleWebsocketRequest(routeEndpointURL *url.URL, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
-	websocketRequestBackend := func(r *http.Request) *url.URL {
-		return buildDownstreamRequestURL(r.URL, routeEndpointURL)
+func (handler *ProxyHandler) handleHTTPRequest(route *validRouteRule, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
+	start := time.Now()
+	defer handler.stats.begin(route.Path)()
+	requestBody := countRequestBody(upstreamRequest)
+	var idle *idleTimer
+	if route.IdleTimeout > 0 {
+		upstreamRequest, idle = handler.watchIdle(route, upstreamWriter, upstreamRequest, requestBody)
+		defer idle.stop()
+	}
+	if route.Labels != nil {
+		upstreamRequest = upstreamRequest.WithContext(context.WithValue(upstreamRequest.Context(), routeLabelsKey{}, route.Labels))
+	}
+	upstreamURL, variant, selectErr := handler.selectUpstream(route, upstreamRequest)
+	observation := &Observation{
+		Request:   upstreamRequest,
+		Route:     route.Path,
+		Upstream:  upstreamURL,
+		Variant:   variant,
+		ClientIP:  handler.clientIP(upstreamRequest),
+		QueueWait: queueDuration(upstreamRequest),
+		Labels:    route.Labels,
+	}
+	if selectErr != nil {
+		handler.handleError(selectErr, http.StatusServiceUnavailable, upstreamWriter, upstreamRequest)
+		observation.StatusCode, observation.Err = http.StatusServiceUnavailable, selectErr
+	} else if err := handler.checkCallbacks(route); err != nil {
+		handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+		observation.StatusCode, observation.Err = http.StatusInternalServerError, err
+	} else if override, err := handler.devOverride(upstreamRequest); err != nil {
+		handler.handleError(err, http.StatusForbidden, upstreamWriter, upstreamRequest)
+		observation.StatusCode, observation.Err = http.StatusForbidden, err
+	} else if status, err := route.transformRequestBody(upstreamRequest); err != nil {
+		handler.handleError(err, status, upstreamWriter, upstreamRequest)
+		observation.StatusCode, observation.Err = status, err
+	} else {
+		if route.compressRequestBody(upstreamRequest) {
+			defer upstreamRequest.Body.Close()
+		}
+		if override != nil {
+			observation.Upstream, observation.Variant = override, "override"
+		}
+		handler.setDebugHeaders(upstreamWriter.Header(), upstreamRequest, observation)
+		forward := handler.forwardHTTPRequest
+		if handler.configuration.StdlibProxy {
+			forward = handler.forwardWithReverseProxy
+		}
+		observation.StatusCode, observation.Err = forward(route, observation, upstreamWriter, upstreamRequest)
 	}
-	websocketProxy := websocketproxy.WebsocketProxy{
-		Backend:  websocketRequestBackend,
-		Upgrader: websocketproxy.DefaultUpgrader,
+	if idle.reaped() {
+		observation.Err = errStreamIdle
+	}
+	handler.recordRequest(route, observation, upstreamWriter, requestBody, start)
+	if idle.reaped() || errors.Is(observation.Err, errResponseAborted) {
+		// the response was cut short and must not appear complete
+		panic(http.ErrAbortHandler)
 	}
-	// disable CORS same-origin verification within proxy
-	websocketProxy.Upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	websocketProxy.ServeHTTP(upstreamWriter, upstreamRequest)
 }
 
-func (handler *ProxyHandler) handleHTTPRequest(routeEndpointURL *url.URL, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
-	downstreamRequest, err := buildProxyRequest(upstreamRequest, routeEndpointURL)
-	if err != nil {
-		handleUnexpectedError(err, upstreamWriter)
-		return
+// recordRequest completes the observation of a request served for route
+// since start, whose body was counted by requestBody, writing it to the
+// access log and passing it to observe.
+func (handler *ProxyHandler) recordRequest(route *validRouteRule, observation *Observation, upstreamWriter http.ResponseWriter, requestBody *countingBody, start time.Time) {
+	request := observation.Request
+	observation.Duration = time.Since(start)
+	observation.BytesIn = requestHeaderBytes(request) + requestBody.bytes()
+	if writer, ok := upstreamWriter.(unwrappingWriter); ok {
+		observation.BytesOut = writer.tracked().headerBytes + writer.tracked().bodyBytes
+	}
+	if route.labelText != "" {
+		log.Printf("proxy: response %d for %s (%d bytes in, %d bytes out, queued %s) [%s]", observation.StatusCode, request.URL.String(), observation.BytesIn, observation.BytesOut, observation.QueueWait, route.labelText)
+	} else {
+		log.Printf("proxy: response %d for %s (%d bytes in, %d bytes out, queued %s)", observation.StatusCode, request.URL.String(), observation.BytesIn, observation.BytesOut, observation.QueueWait)
 	}
+	handler.observe(route, observation)
+}
 
-	log.Printf("proxy: request %s -> %s %s", upstreamRequest.URL.String(), downstreamRequest.Method, downstreamRequest.URL.String())
-	downstreamResponse, err := http.DefaultClient.Do(downstreamRequest)
+// forwardHTTPRequest sends the request to the upstream chosen in observation
+// and copies the response to the client. It returns the status written to the
+// client and any error which prevented the upstream response being relayed.
+func (handler *ProxyHandler) forwardHTTPRequest(route *validRouteRule, observation *Observation, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) (int, error) {
+	start := time.Now()
+	if observation.Variant != "" {
+		upstreamWriter.Header().Set("X-Upstream-Variant", observation.Variant)
+	}
+	body, err := handler.bufferBody(route, upstreamRequest)
+	defer body.cleanup()
 	if err != nil {
-		handleUnexpectedError(err, upstreamWriter)
-		return
+		handler.handleError(err, http.StatusBadRequest, upstreamWriter, upstreamRequest)
+		return http.StatusBadRequest, err
+	}
+
+	dump := handler.newDump(upstreamRequest)
+	defer handler.finishDump(dump)
+
+	if handler.configuration.AttemptHeaders && upstreamRequest.Header.Get("X-Request-ID") == "" {
+		upstreamRequest.Header.Set("X-Request-ID", newRequestID())
+	}
+	var informational *informationalRelay
+	if route.ForwardInformational {
+		informational = &informationalRelay{writer: upstreamWriter}
+		upstreamRequest = upstreamRequest.WithContext(httptrace.WithClientTrace(upstreamRequest.Context(), informational.trace()))
+	}
+
+	var downstreamResponse *http.Response
+	var upstreamLatency time.Duration
+	for attempt := 1; ; attempt++ {
+		observation.Attempts = attempt
+		if handler.configuration.AttemptHeaders {
+			upstreamWriter.Header().Set("X-Proxy-Attempts", strconv.Itoa(attempt))
+		}
+		downstreamRequest, err := handler.buildUpstreamRequest(route, observation, upstreamRequest, body)
+		if err != nil {
+			if errors.Is(err, errBodyTooLargeToSign) {
+				handler.handleError(err, http.StatusRequestEntityTooLarge, upstreamWriter, upstreamRequest)
+				return http.StatusRequestEntityTooLarge, err
+			}
+			handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+			return http.StatusInternalServerError, err
+		}
+		dump.captureRequest(downstreamRequest, handler.debugDumpBodyBytes())
+		var progress *upstreamProgress
+		downstreamRequest, cancelAttempt := handler.limitAttempt(route, downstreamRequest)
+		attemptStart, sentAt := time.Now(), handler.now()
+		informational.setOpen(true)
+		downstreamResponse, progress, err = handler.roundTrip(route, observation, upstreamRequest, body, downstreamRequest)
+		informational.setOpen(false)
+		upstreamLatency = time.Since(attemptStart)
+		if handler.recordAttempt(route, observation, downstreamResponse, err, handler.now().Sub(sentAt)) {
+			observation.Ejected = true
+		}
+		observation.ConnWait += progress.waited()
+		if err == nil {
+			downstreamResponse.Body = &cancelOnClose{ReadCloser: downstreamResponse.Body, cancel: cancelAttempt}
+			route.keepJarCookies(downstreamResponse)
+			if err = handler.checkResponseHeaders(route, downstreamResponse); err != nil {
+				discardResponse(downstreamResponse)
+			}
+		} else {
+			cancelAttempt()
+		}
+		if err != nil {
+			delay := handler.backoff(route, attempt)
+			observation.RetryStopped = handler.failureRetryStopped(route, attempt, body, upstreamRequest, progress, delay)
+			if observation.RetryStopped != "" {
+				return handler.handleUpstreamError(err, progress, upstreamWriter, upstreamRequest)
+			}
+			log.Printf("proxy: retrying %s in %s after attempt %d failed: %s", upstreamRequest.URL.String(), delay, attempt, err.Error())
+			if err := handler.wait(upstreamRequest.Context(), delay); err != nil {
+				return handler.handleUpstreamError(err, progress, upstreamWriter, upstreamRequest)
+			}
+			continue
+		}
+		delay, retry := handler.retryDelay(downstreamResponse)
+		if !retry {
+			break
+		}
+		observation.RetryStopped = handler.retryStopped(route, attempt, body, upstreamRequest, delay)
+		if observation.RetryStopped != "" {
+			break
+		}
+		log.Printf("proxy: retrying %s in %s after attempt %d returned %d", upstreamRequest.URL.String(), delay, attempt, downstreamResponse.StatusCode)
+		discardResponse(downstreamResponse)
+		if err := handler.wait(upstreamRequest.Context(), delay); err != nil {
+			return handler.handleUpstreamError(err, progress, upstreamWriter, upstreamRequest)
+		}
 	}
 
 	defer downstreamResponse.Body.Close()
+	dump.captureResponse(downstreamResponse, handler.debugDumpBodyBytes())
+	originalBody, originalLength := downstreamResponse.Body, downstreamResponse.ContentLength
+	route.unrewriteResponse(downstreamResponse, upstreamRequest)
+	if handler.configuration.DecompressForClients {
+		if err := decompressForClient(downstreamResponse, upstreamRequest); err != nil {
+			handler.handleError(err, http.StatusBadGateway, upstreamWriter, upstreamRequest)
+			return http.StatusBadGateway, err
+		}
+	}
+	buffered, err := route.bufferResponse(downstreamResponse)
+	if err != nil {
+		handler.handleError(err, http.StatusBadGateway, upstreamWriter, upstreamRequest)
+		return http.StatusBadGateway, err
+	}
+	if route.ModifyResponse != nil {
+		if err := handler.modifyResponse(route, downstreamResponse, buffered); err != nil {
+			handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+			return http.StatusInternalServerError, err
+		}
+	}
+	route.wrapResponseBody(downstreamResponse)
+	route.mapStatus(downstreamResponse)
+	syncResponseLength(downstreamResponse, originalBody, originalLength)
+	dropBody(downstreamResponse)
 	copyHeaders(upstreamWriter.Header(), downstreamResponse.Header)
+	handler.setStrictTransportSecurity(upstreamWriter.Header(), upstreamRequest)
+	handler.configuration.SecurityHeaders.apply(upstreamWriter.Header())
+	route.setCORSHeaders(upstreamWriter.Header(), upstreamRequest)
+	if handler.configuration.TimingHeaders {
+		setTimingHeaders(upstreamWriter.Header(), upstreamLatency, time.Since(start))
+	}
+	handler.setDebugHeaders(upstreamWriter.Header(), upstreamRequest, observation)
+	setHeaderCase(upstreamWriter.Header(), route.ResponseHeaderCase)
 	upstreamWriter.WriteHeader(downstreamResponse.StatusCode)
-	io.Copy(upstreamWriter, downstreamResponse.Body)
+	if route.WrapResponseBody != nil {
+		if err := handler.copyWrappedBody(upstreamWriter, downstreamResponse.Body, upstreamRequest); err != nil {
+			return downstreamResponse.StatusCode, err
+		}
+	} else {
+		handler.buffers.copy(upstreamWriter, downstreamResponse.Body)
+	}
+	return downstreamResponse.StatusCode, nil
+}
+
+// buildUpstreamRequest prepares one attempt at sending upstreamRequest to the
+// upstream chosen in observation.
+func (handler *ProxyHandler) buildUpstreamRequest(route *validRouteRule, observation *Observation, upstreamRequest *http.Request, body *bufferedBody) (*http.Request, error) {
+	downstreamRequest, err := buildProxyRequest(upstreamRequest, route, observation.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	handler.forwardClient(downstreamRequest.Header, upstreamRequest)
+	handler.setUserAgent(downstreamRequest.Header, upstreamRequest)
+	if handler.configuration.DevOverrideHeader != "" {
+		downstreamRequest.Header.Del(handler.configuration.DevOverrideHeader)
+	}
+	if handler.configuration.DebugToken != "" {
+		downstreamRequest.Header.Del(debugRequestHeader)
+	}
+	if handler.mapHost(downstreamRequest.URL, upstreamRequest.Host) {
+		downstreamRequest.Host = downstreamRequest.URL.Host
+	}
+	if handler.configuration.AttemptHeaders {
+		downstreamRequest.Header.Set("X-Retry-Attempt", strconv.Itoa(observation.Attempts))
+	}
+	handler.setQueueDurationHeader(downstreamRequest.Header, upstreamRequest)
+	if route.ProxyProtocol != 0 {
+		downstreamRequest = downstreamRequest.WithContext(withProxyProtocolAddresses(downstreamRequest.Context(), upstreamRequest))
+	}
+	route.addJarCookies(downstreamRequest)
+	var before http.Header
+	if handler.guardsHeaders(route) {
+		before = downstreamRequest.Header.Clone()
+	}
+	route.setContextHeaders(downstreamRequest, upstreamRequest)
+	route.setSubdomainHeader(downstreamRequest, upstreamRequest)
+	body.attach(downstreamRequest, upstreamRequest.ContentLength)
+	if route.Director != nil {
+		originalBody, originalLength := downstreamRequest.Body, downstreamRequest.ContentLength
+		if err := handler.callDirector(route, downstreamRequest); err != nil {
+			return nil, err
+		}
+		syncRequestLength(downstreamRequest, originalBody, originalLength)
+	}
+	if before != nil {
+		if err := handler.checkHeaderRules(route, before, downstreamRequest); err != nil {
+			return nil, err
+		}
+	}
+	if route.Signer != nil {
+		if err := signRequest(downstreamRequest, route.Signer, handler.configuration.BufferBodyBytes); err != nil {
+			return nil, err
+		}
+	}
+	setHeaderCase(downstreamRequest.Header, route.RequestHeaderCase)
+	if handler.configuration.ClientTrace != nil {
+		if trace := handler.configuration.ClientTrace(downstreamRequest); trace != nil {
+			downstreamRequest = downstreamRequest.WithContext(httptrace.WithClientTrace(downstreamRequest.Context(), trace))
+		}
+	}
+
+	if observation.Variant != "" {
+		log.Printf("proxy: request %s -> %s %s (variant %s)", upstreamRequest.URL.String(), downstreamRequest.Method, downstreamRequest.URL.String(), observation.Variant)
+	} else {
+		log.Printf("proxy: request %s -> %s %s", upstreamRequest.URL.String(), downstreamRequest.Method, downstreamRequest.URL.String())
+	}
+	handler.buffers.wrapBody(downstreamRequest)
+	return downstreamRequest, nil
+}
+
+func (handler *ProxyHandler) clientFor(route *validRouteRule) *http.Client {
+	if route.client != nil {
+		return route.client
+	}
+	if route.transport != nil {
+		return handler.transports.client(route)
+	}
+	return handler.client
 }
 
-func buildProxyRequest(upstreamRequest *http.Request, routeOverrideURL *url.URL) (*http.Request, error) {
-	proxiedRequestURL := buildDownstreamRequestURL(upstreamRequest.URL, routeOverrideURL)
+func buildProxyRequest(upstreamRequest *http.Request, route *validRouteRule, routeOverrideURL *url.URL) (*http.Request, error) {
+	proxiedRequestURL := route.rewritePath(buildDownstreamRequestURL(upstreamRequest.URL, routeOverrideURL))
 	// Unsure how this might return an error as parts for proxiedRequestURL should be valid.
-	proxyRequest, err := http.NewRequest(upstreamRequest.Method, proxiedRequestURL.String(), upstreamRequest.Body)
+	proxyRequest, err := http.NewRequestWithContext(upstreamRequest.Context(), upstreamRequest.Method, proxiedRequestURL.String(), upstreamRequest.Body)
 	if err != nil {
 		return nil, err
 	}
+	// the URL's string form cannot carry the host of an asterisk-form request
+	proxyRequest.URL, proxyRequest.Host = proxiedRequestURL, proxiedRequestURL.Host
+	proxyRequest.ContentLength = upstreamRequest.ContentLength
 	copyHeaders(proxyRequest.Header, upstreamRequest.Header)
 	return proxyRequest, nil
 }
 
-func handleUnexpectedError(err error, writer http.ResponseWriter) {
-	// No test coverage here, beware regressions within
-	log.Printf("proxy: http request error: %s", err.Error())
-	header := writer.Header()
-	header.Add("X-Error", fmt.Sprintf("unexpected error encountered: %s", err.Error()))
-	writer.WriteHeader(500)
-	writer.Write([]byte("error: " + err.Error()))
+// appendForwardedFor adds the client's address to X-Forwarded-For. RemoteAddr
+// is split with net.SplitHostPort so bracketed IPv6 addresses are recorded
+// without their brackets or port.
+func appendForwardedFor(header http.Header, remoteAddr string) {
+	clientIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return
+	}
+	if prior := header.Get("X-Forwarded-For"); prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	header.Set("X-Forwarded-For", clientIP)
 }
 
 func copyHeaders(destination, source http.Header) {
@@ -2,11 +2,13 @@ package proxyhandler
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"github.com/jarcoal/httpmock"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -26,6 +28,16 @@ func afterTest() {
 	httpmock.DeactivateAndReset()
 }
 
+// proxyModes are the ways a ProxyHandler can forward requests, which tests
+// run against to check that they behave alike.
+var proxyModes = []struct {
+	name   string
+	stdlib bool
+}{
+	{"handler", false},
+	{"stdlib", true},
+}
+
 func TestNewReturnsValidProxyHandler(t *testing.T) {
 	config := buildConfiguration()
 	_, err := New(config)
@@ -50,78 +62,93 @@ func TestNewReturnsErrorWithInvalidConfiguration(t *testing.T) {
 }
 
 func TestResponseStatus(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	expectedStatus := 999
-	httpmock.RegisterResponder("GET", "http://defaulthost/", httpmock.NewBytesResponder(expectedStatus, nil))
-	recorder := httptest.NewRecorder()
-	req := httptest.NewRequest("GET", "/", nil)
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("Failed creating handler: %v", err.Error())
-	}
-	h.ServeHTTP(recorder, req)
-
-	if recorder.Code != expectedStatus {
-		t.Fatalf("Expected status code not found\n\tExpected: %v\n\tActual: %v", expectedStatus, recorder.Code)
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			expectedStatus := 999
+			httpmock.RegisterResponder("GET", "http://defaulthost/", httpmock.NewBytesResponder(expectedStatus, nil))
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://defaulthost"
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("Failed creating handler: %v", err.Error())
+			}
+			h.ServeHTTP(recorder, req)
+
+			if recorder.Code != expectedStatus {
+				t.Fatalf("Expected status code not found\n\tExpected: %v\n\tActual: %v", expectedStatus, recorder.Code)
+			}
+		})
 	}
 }
 
 func TestRequestBodyTransfer(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	expectedBody := []byte("This is the expected body")
-	httpmock.RegisterResponder("POST", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
-		actualBody, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			t.Fatalf("Request body unreadable: %v", err.Error())
-		}
-
-		if string(expectedBody) != string(actualBody) {
-			t.Fatalf("Expected body not found\n\tExpected: %v\n\tActual: %v", expectedBody, actualBody)
-		}
-		return httpmock.NewStringResponse(200, ""), nil
-	})
-
-	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(expectedBody))
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			expectedBody := []byte("This is the expected body")
+			httpmock.RegisterResponder("POST", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
+				actualBody, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatalf("Request body unreadable: %v", err.Error())
+				}
+
+				if string(expectedBody) != string(actualBody) {
+					t.Fatalf("Expected body not found\n\tExpected: %v\n\tActual: %v", expectedBody, actualBody)
+				}
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+
+			req := httptest.NewRequest("POST", "/", bytes.NewBuffer(expectedBody))
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://defaulthost"
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		})
 	}
-	h.ServeHTTP(httptest.NewRecorder(), req)
 }
 
 func TestResponseBodyTransfer(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	expectedBody := []byte("This is the expected body")
-	httpmock.RegisterResponder("GET", "http://defaulthost/", httpmock.NewBytesResponder(200, expectedBody))
-	req := httptest.NewRequest("GET", "/", nil)
-	recorder := httptest.NewRecorder()
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("unable to create proxyhandler: %s", err.Error())
-	}
-	h.ServeHTTP(recorder, req)
-	actualBody, err := ioutil.ReadAll(recorder.Body)
-	if err != nil {
-		t.Fatalf("Response body unreadable: %v", err.Error())
-	}
-
-	if string(expectedBody) != string(actualBody) {
-		t.Fatalf("Expected body not found\n\tExpected: %v\n\tActual: %v", expectedBody, actualBody)
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			expectedBody := []byte("This is the expected body")
+			httpmock.RegisterResponder("GET", "http://defaulthost/", httpmock.NewBytesResponder(200, expectedBody))
+			req := httptest.NewRequest("GET", "/", nil)
+			recorder := httptest.NewRecorder()
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://defaulthost"
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			h.ServeHTTP(recorder, req)
+			actualBody, err := ioutil.ReadAll(recorder.Body)
+			if err != nil {
+				t.Fatalf("Response body unreadable: %v", err.Error())
+			}
+
+			if string(expectedBody) != string(actualBody) {
+				t.Fatalf("Expected body not found\n\tExpected: %v\n\tActual: %v", expectedBody, actualBody)
+			}
+		})
 	}
 }
 
@@ -129,10 +156,17 @@ func TestRequestHeaderTransfer(t *testing.T) {
 	beforeTest()
 	defer afterTest()
 
-	expectedHeader := http.Header{
+	requestHeader := http.Header{
 		"X-Foo": []string{"IMPORTANT"},
 		"X-Bar": []string{"here; are_some; headers"},
 	}
+	expectedHeader := http.Header{
+		"X-Foo":           []string{"IMPORTANT"},
+		"X-Bar":           []string{"here; are_some; headers"},
+		"X-Forwarded-For": []string{"192.0.2.1"},
+		// present but empty, so the transport sends no User-Agent of its own
+		"User-Agent": []string{""},
+	}
 	httpmock.RegisterResponder("GET", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
 		if !reflect.DeepEqual(r.Header, expectedHeader) {
 			t.Fatalf("Unexpected headers\n\tExpected: %v\n\tActual: %v", expectedHeader, r.Header)
@@ -140,7 +174,7 @@ func TestRequestHeaderTransfer(t *testing.T) {
 		return httpmock.NewStringResponse(200, ""), nil
 	})
 	req := httptest.NewRequest("GET", "/", nil)
-	req.Header = expectedHeader
+	req.Header = requestHeader
 
 	config := buildConfiguration()
 	config.DefaultRoute = "http://defaulthost"
@@ -152,111 +186,160 @@ func TestRequestHeaderTransfer(t *testing.T) {
 }
 
 func TestResponseHeaderTransfer(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	expectedHeader := http.Header{
-		"Accept-Ranges":  []string{"bytes"},
-		"Content-Length": []string{"6"},
-		"Content-Type":   []string{"text/plain; charset=utf-8"},
-		"Content-Range":  []string{"bytes 0-5/1862"},
-	}
-	mockResponder := httpmock.ResponderFromResponse(&http.Response{
-		Header: expectedHeader,
-		Body:   httpmock.NewRespBodyFromString(""),
-	})
-	httpmock.RegisterResponder("GET", "http://defaulthost/", mockResponder)
-	recorder := httptest.NewRecorder()
-	req := httptest.NewRequest("GET", "/", nil)
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("unable to create proxyhandler: %s", err.Error())
-	}
-	h.ServeHTTP(recorder, req)
-
-	if !reflect.DeepEqual(recorder.Header(), expectedHeader) {
-		t.Fatalf("Unexpected headers\n\tExpected: %v\n\tActual: %v", expectedHeader, recorder.Header())
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			// A gzip encoded representation, so a partial response is only intact if
+			// its bytes are passed through untouched.
+			var representation bytes.Buffer
+			gzipWriter := gzip.NewWriter(&representation)
+			gzipWriter.Write([]byte(strings.Repeat("partial content ", 100)))
+			gzipWriter.Close()
+			expectedBody := representation.Bytes()[3:9]
+
+			expectedHeader := http.Header{
+				"Accept-Ranges":    []string{"bytes"},
+				"Content-Encoding": []string{"gzip"},
+				"Content-Length":   []string{"6"},
+				"Content-Type":     []string{"text/plain; charset=utf-8"},
+				"Content-Range":    []string{fmt.Sprintf("bytes 3-8/%d", representation.Len())},
+			}
+			var receivedRange string
+			httpmock.RegisterResponder("GET", "http://defaulthost/video", func(r *http.Request) (*http.Response, error) {
+				receivedRange = r.Header.Get("Range")
+				header := http.Header{}
+				copyHeaders(header, expectedHeader)
+				return &http.Response{
+					StatusCode: http.StatusPartialContent,
+					Header:     header,
+					Body:       ioutil.NopCloser(bytes.NewReader(expectedBody)),
+				}, nil
+			})
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/video", nil)
+			req.Header.Set("Range", "bytes=3-8")
+
+			// body touching features must leave partial content alone
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DecompressForClients = true
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/video", Endpoint: "http://defaulthost", StatusMapping: map[int]int{206: 200}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			h.ServeHTTP(recorder, req)
+
+			if receivedRange != "bytes=3-8" {
+				t.Errorf("expected Range to be forwarded\nexpected: %v\nreceived: %v", "bytes=3-8", receivedRange)
+			}
+			if recorder.Code != http.StatusPartialContent {
+				t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusPartialContent, recorder.Code)
+			}
+			if !reflect.DeepEqual(recorder.Header(), expectedHeader) {
+				t.Fatalf("Unexpected headers\n\tExpected: %v\n\tActual: %v", expectedHeader, recorder.Header())
+			}
+			if !bytes.Equal(recorder.Body.Bytes(), expectedBody) {
+				t.Errorf("unexpected partial body\nexpected: %v\nreceived: %v", expectedBody, recorder.Body.Bytes())
+			}
+		})
 	}
 }
 
 func TestPostMethod(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	expectedPostBody := `{"some":"json"}`
-	success := false
-	httpmock.RegisterResponder("POST", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
-		success = true
-		actualBody, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			t.Fatalf("Response body unreadable: %v", err.Error())
-		}
-		if expectedPostBody != string(actualBody) {
-			t.Fatalf("Body did not match\n\tExpected: %v\n\tActual: %v", expectedPostBody, string(actualBody))
-		}
-		return httpmock.NewStringResponse(200, ""), nil
-	})
-	req := httptest.NewRequest("POST", "/", strings.NewReader(expectedPostBody))
-	recorder := httptest.NewRecorder()
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("unable to create proxyhandler: %s", err.Error())
-	}
-	h.ServeHTTP(recorder, req)
-	if !success {
-		t.Error("Expected POST responder to be executed")
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			expectedPostBody := `{"some":"json"}`
+			success := false
+			httpmock.RegisterResponder("POST", "http://defaulthost/", func(r *http.Request) (*http.Response, error) {
+				success = true
+				actualBody, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					t.Fatalf("Response body unreadable: %v", err.Error())
+				}
+				if expectedPostBody != string(actualBody) {
+					t.Fatalf("Body did not match\n\tExpected: %v\n\tActual: %v", expectedPostBody, string(actualBody))
+				}
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+			req := httptest.NewRequest("POST", "/", strings.NewReader(expectedPostBody))
+			recorder := httptest.NewRecorder()
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://defaulthost"
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			h.ServeHTTP(recorder, req)
+			if !success {
+				t.Error("Expected POST responder to be executed")
+			}
+		})
 	}
 }
 
 func TestProxyHandlesSpecificEndpoint(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-
-	success := false
-	httpmock.RegisterResponder("GET", "http://anotherhost/foo", func(r *http.Request) (*http.Response, error) {
-		success = true
-		return httpmock.NewStringResponse(200, ""), nil
-	})
-	req := httptest.NewRequest("GET", "/foo", nil)
-	recorder := httptest.NewRecorder()
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://defaulthost"
-	config.Routes = []*RouteRule{
-		&RouteRule{Path: "/foo", Endpoint: "http://anotherhost"},
-	}
-	h, err := New(config)
-	if err != nil {
-		t.Fatalf("unable to create proxyhandler: %s", err.Error())
-	}
-	h.ServeHTTP(recorder, req)
-	if !success {
-		t.Error("Expected handler to direct request to //anotherhost")
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			success := false
+			httpmock.RegisterResponder("GET", "http://anotherhost/foo", func(r *http.Request) (*http.Response, error) {
+				success = true
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+			req := httptest.NewRequest("GET", "/foo", nil)
+			recorder := httptest.NewRecorder()
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://defaulthost"
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/foo", Endpoint: "http://anotherhost"},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			h.ServeHTTP(recorder, req)
+			if !success {
+				t.Error("Expected handler to direct request to //anotherhost")
+			}
+		})
 	}
 }
 
 func TestDefaultHostIsUsedWhenMatchingRouteMissing(t *testing.T) {
-	beforeTest()
-	defer afterTest()
-	success := false
-
-	httpmock.RegisterResponder("GET", "http://notgoogle/", func(r *http.Request) (*http.Response, error) {
-		success = true
-		return httpmock.NewStringResponse(200, ""), nil
-	})
-
-	config := buildConfiguration()
-	config.DefaultRoute = "http://notgoogle"
-	h, _ := New(config)
-	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
-	if !success {
-		t.Error("Expected default host to be requested")
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			success := false
+
+			httpmock.RegisterResponder("GET", "http://notgoogle/", func(r *http.Request) (*http.Response, error) {
+				success = true
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://notgoogle"
+			h, _ := New(config)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if !success {
+				t.Error("Expected default host to be requested")
+			}
+		})
 	}
 }
 
@@ -301,3 +384,177 @@ func BenchmarkRouteHandling(b *testing.B) {
 	}
 	fmt.Println(string(result))
 }
+
+func TestPanickingDirectorReturnsInternalServerError(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			var logOutput bytes.Buffer
+			log.SetOutput(&logOutput)
+
+			httpmock.RegisterResponder("GET", "http://anotherhost/foo", httpmock.NewStringResponder(200, ""))
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.Routes = []*RouteRule{
+				&RouteRule{
+					Path:     "/foo",
+					Endpoint: "http://anotherhost",
+					Director: func(r *http.Request) {
+						var nilHeader *http.Header
+						nilHeader.Set("X-Boom", "true")
+					},
+				},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/foo", nil))
+
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusInternalServerError, recorder.Code)
+			}
+			if !strings.Contains(logOutput.String(), "panic in Director of route /foo") || !strings.Contains(logOutput.String(), "goroutine") {
+				t.Errorf("expected panic and stack trace to be logged\nreceived: %v", logOutput.String())
+			}
+		})
+	}
+}
+
+func TestAbortHandlerPanicIsPropagated(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:     "/foo",
+			Endpoint: "http://anotherhost",
+			Director: func(r *http.Request) { panic(http.ErrAbortHandler) },
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("expected ErrAbortHandler to be re-panicked\nexpected: %v\nreceived: %v", http.ErrAbortHandler, recovered)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+}
+
+func TestProxyToIPv6Upstream(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %s", err.Error())
+	}
+	var receivedHost, receivedForwardedFor string
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHost = r.Host
+		receivedForwardedFor = r.Header.Get("X-Forwarded-For")
+		w.Write([]byte("v6"))
+	}))
+	upstream.Listener.Close()
+	upstream.Listener = listener
+	upstream.Start()
+	defer upstream.Close()
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/v6", Endpoint: upstream.URL},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	req := httptest.NewRequest("GET", "/v6", nil)
+	req.RemoteAddr = "[2001:db8::1]:4321"
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 || recorder.Body.String() != "v6" {
+		t.Fatalf("expected successful round trip\nreceived: %v %v", recorder.Code, recorder.Body.String())
+	}
+	expectedHost := strings.TrimPrefix(upstream.URL, "http://")
+	if receivedHost != expectedHost {
+		t.Errorf("unexpected Host header\nexpected: %v\nreceived: %v", expectedHost, receivedHost)
+	}
+	if receivedForwardedFor != "2001:db8::1" {
+		t.Errorf("unexpected X-Forwarded-For\nexpected: %v\nreceived: %v", "2001:db8::1", receivedForwardedFor)
+	}
+}
+
+func buildMethodRoutingHandler(t *testing.T, methodNotAllowed bool) *ProxyHandler {
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.MethodNotAllowed = methodNotAllowed
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/users", Methods: []string{"POST"}, Endpoint: "http://writer"},
+		&RouteRule{Path: "/users", Methods: []string{"GET", "POST"}, Endpoint: "http://reader"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+func TestRoutesMatchMethods(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildMethodRoutingHandler(t, false)
+	cases := map[string]string{
+		"POST":   "writer",
+		"GET":    "reader",
+		"HEAD":   "reader",
+		"DELETE": "default.endpoint",
+	}
+	for method, expectedHost := range cases {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(method, "/users", nil))
+		if recorder.Body.String() != expectedHost {
+			t.Errorf("unexpected upstream for %s\nexpected: %v\nreceived: %v", method, expectedHost, recorder.Body.String())
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h := buildMethodRoutingHandler(t, true)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/users", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusMethodNotAllowed, recorder.Code)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+		t.Errorf("unexpected Allow header\nexpected: %v\nreceived: %v", "GET, HEAD, POST", allow)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/other", nil))
+	if recorder.Body.String() != "default.endpoint" {
+		t.Errorf("expected unmatched paths to use the default route\nreceived: %v", recorder.Body.String())
+	}
+}
+
+func TestRouteMethodsAreValidated(t *testing.T) {
+	route := RouteRule{Path: "/", Methods: []string{"GET, POST"}, Endpoint: "http://upstream"}
+	expectedError := "invalid method"
+	if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
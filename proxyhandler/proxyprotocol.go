@@ -0,0 +1,122 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// proxyProtocolSignature begins every PROXY protocol version 2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyProtocolKey struct{}
+
+// proxyProtocolAddresses are the client's source address and the address on
+// which the proxy accepted its connection. Either may be nil when unknown.
+type proxyProtocolAddresses struct {
+	source      *net.TCPAddr
+	destination *net.TCPAddr
+}
+
+// withProxyProtocolAddresses records the addresses of the connection which
+// clientRequest arrived on in ctx, for use by a proxyProtocolDialContext.
+func withProxyProtocolAddresses(ctx context.Context, clientRequest *http.Request) context.Context {
+	addresses := &proxyProtocolAddresses{}
+	if host, port, err := net.SplitHostPort(clientRequest.RemoteAddr); err == nil {
+		ip := net.ParseIP(host)
+		number, err := strconv.Atoi(port)
+		if ip != nil && err == nil {
+			addresses.source = &net.TCPAddr{IP: ip, Port: number}
+		}
+	}
+	if local, ok := clientRequest.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		addresses.destination = local
+	}
+	return context.WithValue(ctx, proxyProtocolKey{}, addresses)
+}
+
+// proxyProtocolDialContext wraps dial so that every connection it makes
+// begins with a PROXY protocol header of the given version describing the
+// client connection recorded in the dial's context.
+func proxyProtocolDialContext(dial DialContextFunc, version int) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addresses, _ := ctx.Value(proxyProtocolKey{}).(*proxyProtocolAddresses)
+		if addresses == nil {
+			addresses = &proxyProtocolAddresses{}
+		}
+		header := addresses.headerV1()
+		if version == 2 {
+			header = addresses.headerV2()
+		}
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("writing proxy protocol header: %s", err.Error())
+		}
+		return conn, nil
+	}
+}
+
+// known reports whether both addresses are known, and if so whether either is
+// an IPv6 address.
+func (addresses *proxyProtocolAddresses) known() (bool, bool) {
+	if addresses.source == nil || addresses.destination == nil {
+		return false, false
+	}
+	ipv6 := addresses.source.IP.To4() == nil || addresses.destination.IP.To4() == nil
+	return true, ipv6
+}
+
+// headerV1 encodes the addresses as a PROXY protocol version 1 header.
+func (addresses *proxyProtocolAddresses) headerV1() []byte {
+	known, ipv6 := addresses.known()
+	if !known {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, source, destination := "TCP4", addresses.source.IP.To4(), addresses.destination.IP.To4()
+	if ipv6 {
+		family, source, destination = "TCP6", addresses.source.IP.To16(), addresses.destination.IP.To16()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, ipString(source, ipv6), ipString(destination, ipv6),
+		addresses.source.Port, addresses.destination.Port))
+}
+
+// ipString formats ip, writing IPv4 addresses in their IPv4-mapped form when
+// the header describes IPv6 addresses.
+func ipString(ip net.IP, ipv6 bool) string {
+	if ipv6 && ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
+
+// headerV2 encodes the addresses as a PROXY protocol version 2 header. When
+// the addresses are unknown the header uses the LOCAL command, which tells the
+// upstream to use the connection's own addresses.
+func (addresses *proxyProtocolAddresses) headerV2() []byte {
+	var header bytes.Buffer
+	header.Write(proxyProtocolSignature)
+	known, ipv6 := addresses.known()
+	if !known {
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+	family, source, destination := byte(0x11), addresses.source.IP.To4(), addresses.destination.IP.To4()
+	if ipv6 {
+		family, source, destination = 0x21, addresses.source.IP.To16(), addresses.destination.IP.To16()
+	}
+	header.Write([]byte{0x21, family})
+	binary.Write(&header, binary.BigEndian, uint16(2*len(source)+4))
+	header.Write(source)
+	header.Write(destination)
+	binary.Write(&header, binary.BigEndian, uint16(addresses.source.Port))
+	binary.Write(&header, binary.BigEndian, uint16(addresses.destination.Port))
+	return header.Bytes()
+}
@@ -0,0 +1,165 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readProxyProtocolHeader parses a PROXY protocol header of either version,
+// describing it in the form of a version 1 header without the "PROXY" prefix.
+func readProxyProtocolHeader(reader *bufio.Reader) (string, error) {
+	prefix, err := reader.Peek(len(proxyProtocolSignature))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(prefix, proxyProtocolSignature) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(line, "PROXY ") || !strings.HasSuffix(line, "\r\n") {
+			return "", fmt.Errorf("malformed v1 header %q", line)
+		}
+		return "v1 " + strings.TrimSuffix(strings.TrimPrefix(line, "PROXY "), "\r\n"), nil
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", err
+	}
+	switch {
+	case header[12] == 0x20 && header[13] == 0x00:
+		return "v2 LOCAL", nil
+	case header[12] == 0x21 && header[13] == 0x11 && len(payload) == 12:
+		return fmt.Sprintf("v2 TCP4 %s %s %d %d", net.IP(payload[0:4]), net.IP(payload[4:8]),
+			binary.BigEndian.Uint16(payload[8:]), binary.BigEndian.Uint16(payload[10:])), nil
+	case header[12] == 0x21 && header[13] == 0x21 && len(payload) == 36:
+		return fmt.Sprintf("v2 TCP6 %s %s %d %d", net.IP(payload[0:16]), net.IP(payload[16:32]),
+			binary.BigEndian.Uint16(payload[32:]), binary.BigEndian.Uint16(payload[34:])), nil
+	}
+	return "", fmt.Errorf("unexpected v2 header %x", header[12:14])
+}
+
+// serveProxyProtocol accepts connections which begin with a PROXY protocol
+// header, reporting each header and answering the request which follows.
+func serveProxyProtocol(listener net.Listener, headers chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			header, err := readProxyProtocolHeader(reader)
+			if err != nil {
+				headers <- "error: " + err.Error()
+				return
+			}
+			headers <- header
+			if _, err := http.ReadRequest(reader); err != nil {
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		}()
+	}
+}
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	headers := make(chan string, 10)
+	go serveProxyProtocol(listener, headers)
+
+	testCases := []struct {
+		path        string
+		remoteAddr  string
+		localAddr   *net.TCPAddr
+		expectation string
+	}{
+		{"/v1", "203.0.113.7:5555", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, "v1 TCP4 203.0.113.7 198.51.100.1 5555 443"},
+		{"/v2", "203.0.113.7:5555", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, "v2 TCP4 203.0.113.7 198.51.100.1 5555 443"},
+		{"/v1", "[2001:db8::7]:5555", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "v1 TCP6 2001:db8::7 2001:db8::1 5555 443"},
+		{"/v2", "[2001:db8::7]:5555", &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, "v2 TCP6 2001:db8::7 198.51.100.1 5555 443"},
+		{"/v1", "203.0.113.7:5555", nil, "v1 UNKNOWN"},
+		{"/v2", "203.0.113.7:5555", nil, "v2 LOCAL"},
+	}
+	for _, mode := range proxyModes {
+		config := buildConfiguration()
+		config.Transport = nil
+		config.StdlibProxy = mode.stdlib
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/v1", Endpoint: "http://" + listener.Addr().String(), ProxyProtocol: 1},
+			&RouteRule{Path: "/v2", Endpoint: "http://" + listener.Addr().String(), ProxyProtocol: 2},
+		}
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+
+		for _, testCase := range testCases {
+			request := httptest.NewRequest("GET", testCase.path, nil)
+			request.RemoteAddr = testCase.remoteAddr
+			if testCase.localAddr != nil {
+				request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, testCase.localAddr))
+			}
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+				t.Errorf("%s: unexpected response for %s from %s\nexpected: %v\nreceived: %v %v", mode.name, testCase.path, testCase.remoteAddr, "200 ok", recorder.Code, recorder.Body.String())
+				continue
+			}
+			if header := <-headers; header != testCase.expectation {
+				t.Errorf("%s: unexpected proxy protocol header\nexpected: %v\nreceived: %v", mode.name, testCase.expectation, header)
+			}
+		}
+	}
+}
+
+func TestProxyProtocolIsValidated(t *testing.T) {
+	testCases := map[string]RouteRule{
+		"unsupported proxy protocol version 3":                 RouteRule{Path: "/", Endpoint: "http://backend", ProxyProtocol: 3},
+		"proxy protocol is not supported for websocket routes": RouteRule{Path: "/", Endpoint: "ws://backend", ProxyProtocol: 1},
+		"proxy protocol cannot be sent through an outbound proxy": RouteRule{Path: "/", Endpoint: "http://backend", ProxyProtocol: 2,
+			OutboundProxy: "http://proxy.internal:3128"},
+	}
+	for expectedError, route := range testCases {
+		config := buildConfiguration()
+		config.Transport = nil
+		config.Routes = []*RouteRule{&route}
+		_, err := New(config)
+		if err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.OutboundProxy = "http://proxy.internal:3128"
+	config.Routes = []*RouteRule{&RouteRule{Path: "/", Endpoint: "http://backend", ProxyProtocol: 1}}
+	expectedError := "proxy protocol cannot be sent through the handler's outbound proxy"
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
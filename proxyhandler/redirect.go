@@ -0,0 +1,80 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedirectHTTPHandler returns an http.Handler for a plain HTTP listener which
+// redirects every request to the same host, path and query over https on
+// httpsPort. The port is left out of the Location when it is 443. Redirects
+// use the Configuration's RedirectStatus, which defaults to 308 Permanent
+// Redirect so that clients repeat the method and body.
+func (handler *ProxyHandler) RedirectHTTPHandler(httpsPort int) http.Handler {
+	status := handler.configuration.RedirectStatus
+	if status == 0 {
+		status = http.StatusPermanentRedirect
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location, err := httpsLocation(r, httpsPort)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, location, status)
+	})
+}
+
+// httpsLocation builds the https URL to which request is redirected.
+func httpsLocation(request *http.Request, httpsPort int) (string, error) {
+	hostURL, err := parseHostname(request.Host)
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q: %s", request.Host, err.Error())
+	}
+	host := hostURL.Hostname()
+	if httpsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + request.URL.RequestURI(), nil
+}
+
+func validateRedirectStatus(status int) error {
+	switch status {
+	case 0, http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		return nil
+	}
+	return fmt.Errorf("redirect status must be %d or %d", http.StatusMovedPermanently, http.StatusPermanentRedirect)
+}
+
+// strictTransportSecurity returns the Strict-Transport-Security header
+// value configured for responses sent over TLS, or "" when HSTS is disabled.
+func (handler *ProxyHandler) strictTransportSecurity() string {
+	if handler.configuration.HSTSMaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.FormatInt(int64(handler.configuration.HSTSMaxAge/time.Second), 10)
+	if handler.configuration.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if handler.configuration.HSTSPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// setStrictTransportSecurity adds the configured HSTS header to the response
+// to request when it arrived over TLS, replacing any sent by the upstream.
+func (handler *ProxyHandler) setStrictTransportSecurity(header http.Header, request *http.Request) {
+	if request.TLS == nil {
+		return
+	}
+	if value := handler.strictTransportSecurity(); value != "" {
+		header.Set("Strict-Transport-Security", value)
+	}
+}
@@ -0,0 +1,128 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRedirectHTTPHandlerLocation(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	examples := []struct {
+		host      string
+		target    string
+		httpsPort int
+		expected  string
+	}{
+		{"example.com", "/", 443, "https://example.com/"},
+		{"example.com:80", "/a/b?c=d&e=f", 443, "https://example.com/a/b?c=d&e=f"},
+		{"example.com:8080", "/a%2Fb?q", 443, "https://example.com/a%2Fb?q"},
+		{"example.com", "/path", 8443, "https://example.com:8443/path"},
+		{"example.com:80", "/path?x=1", 8443, "https://example.com:8443/path?x=1"},
+		{"[::1]:80", "/", 443, "https://[::1]/"},
+		{"[::1]", "/", 8443, "https://[::1]:8443/"},
+	}
+	for _, example := range examples {
+		request := httptest.NewRequest("POST", example.target, nil)
+		request.Host = example.host
+		recorder := httptest.NewRecorder()
+		h.RedirectHTTPHandler(example.httpsPort).ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusPermanentRedirect {
+			t.Errorf("unexpected status for %s%s\nexpected: %v\nreceived: %v", example.host, example.target, http.StatusPermanentRedirect, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != example.expected {
+			t.Errorf("unexpected location for %s%s\nexpected: %v\nreceived: %v", example.host, example.target, example.expected, location)
+		}
+	}
+}
+
+func TestRedirectHTTPHandlerStatus(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	config := buildConfiguration()
+	config.RedirectStatus = http.StatusMovedPermanently
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.RedirectHTTPHandler(443).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusMovedPermanently {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusMovedPermanently, recorder.Code)
+	}
+
+	config.RedirectStatus = http.StatusFound
+	if _, err := New(config); err == nil {
+		t.Error("expected a temporary redirect status to be rejected")
+	}
+}
+
+func TestRedirectHTTPHandlerRejectsInvalidHost(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = ""
+	recorder := httptest.NewRecorder()
+	h.RedirectHTTPHandler(443).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestStrictTransportSecurityIsSetOverTLS(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		response := httpmock.NewStringResponse(200, "ok")
+		response.Header.Set("Strict-Transport-Security", "max-age=1")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.HSTSMaxAge = 365 * 24 * time.Hour
+	config.HSTSIncludeSubdomains = true
+	config.HSTSPreload = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expected := "max-age=31536000; includeSubDomains; preload"
+	request := httptest.NewRequest("GET", "/", nil)
+	request.TLS = &tls.ConnectionState{}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if values := recorder.Header().Values("Strict-Transport-Security"); len(values) != 1 || values[0] != expected {
+		t.Errorf("unexpected Strict-Transport-Security\nexpected: %v\nreceived: %v", expected, values)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if value := recorder.Header().Get("Strict-Transport-Security"); value != "max-age=1" {
+		t.Errorf("expected plain HTTP responses to be left alone\nreceived: %v", value)
+	}
+}
+
+func TestStrictTransportSecurityDirectivesRequireMaxAge(t *testing.T) {
+	config := buildConfiguration()
+	config.HSTSPreload = true
+	if _, err := New(config); err == nil {
+		t.Error("expected preload without a max age to be rejected")
+	}
+}
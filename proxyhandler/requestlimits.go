@@ -0,0 +1,60 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// maxLoggedURLBytes bounds how much of an oversized URL is logged.
+const maxLoggedURLBytes = 256
+
+// requestURI returns the request target as the client sent it, or as
+// reconstructed from its URL for requests built without one.
+func requestURI(request *http.Request) string {
+	if request.RequestURI != "" {
+		return request.RequestURI
+	}
+	return request.URL.RequestURI()
+}
+
+// requestFieldBytes estimates the size of request's header fields, including
+// Host and the blank line which ends them, as they would be sent in HTTP/1.1.
+func requestFieldBytes(request *http.Request) int64 {
+	size := len("Host: ") + len(request.Host) + len("\r\n")
+	return int64(size) + headerBytes(request.Header)
+}
+
+// truncateURL shortens uri to maxLoggedURLBytes for logging.
+func truncateURL(uri string) string {
+	if len(uri) <= maxLoggedURLBytes {
+		return uri
+	}
+	return uri[:maxLoggedURLBytes] + "..."
+}
+
+// checkRequestLimits answers a request whose URL is longer than MaxURLLength
+// with 414 URI Too Long, and one whose header fields exceed
+// MaxRequestHeaderBytes with 431 Request Header Fields Too Large, reporting
+// whether the request is within both. The violation is logged with the
+// client's address and the start of the URL, which is not echoed back.
+func (handler *ProxyHandler) checkRequestLimits(writer http.ResponseWriter, request *http.Request) bool {
+	uri := requestURI(request)
+	var err error
+	var status int
+	if limit := handler.configuration.MaxURLLength; limit > 0 && len(uri) > limit {
+		err = fmt.Errorf("request URL of %d bytes exceeds %d", len(uri), limit)
+		status = http.StatusRequestURITooLong
+	} else if limit := handler.configuration.MaxRequestHeaderBytes; limit > 0 {
+		if size := requestFieldBytes(request); size > int64(limit) {
+			err = fmt.Errorf("request headers of %d bytes exceed %d", size, limit)
+			status = http.StatusRequestHeaderFieldsTooLarge
+		}
+	}
+	if err == nil {
+		return true
+	}
+	log.Printf("proxy: %s from %s: %s %s", err.Error(), handler.clientIP(request), request.Method, truncateURL(uri))
+	handler.writeError(writer, request, &ProxyError{Status: status, Err: err}, err.Error())
+	return false
+}
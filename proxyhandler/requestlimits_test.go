@@ -0,0 +1,127 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"github.com/jarcoal/httpmock"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimits(t *testing.T) {
+	// httptest.NewRequest sets Host to example.com and no other header
+	fixedHeaderBytes := len("Host: example.com\r\n") + len("X-Pad: \r\n") + len("\r\n")
+	longURL := func(length int) string {
+		return "/route1?" + strings.Repeat("q", length-len("/route1?"))
+	}
+	paddedRequest := func(headerBytes int) *http.Request {
+		request := httptest.NewRequest("GET", "/route1", nil)
+		request.Header.Set("X-Pad", strings.Repeat("p", headerBytes-fixedHeaderBytes))
+		return request
+	}
+	tests := []struct {
+		name           string
+		maxURL         int
+		maxHeaderBytes int
+		request        *http.Request
+		status         int
+	}{
+		{"url under limit", 100, 0, httptest.NewRequest("GET", longURL(99), nil), http.StatusOK},
+		{"url at limit", 100, 0, httptest.NewRequest("GET", longURL(100), nil), http.StatusOK},
+		{"url over limit", 100, 0, httptest.NewRequest("GET", longURL(101), nil), http.StatusRequestURITooLong},
+		{"url limit disabled", 0, 0, httptest.NewRequest("GET", longURL(10000), nil), http.StatusOK},
+		{"headers under limit", 0, 200, paddedRequest(199), http.StatusOK},
+		{"headers at limit", 0, 200, paddedRequest(200), http.StatusOK},
+		{"headers over limit", 0, 200, paddedRequest(201), http.StatusRequestHeaderFieldsTooLarge},
+		{"header limit disabled", 0, 0, paddedRequest(10000), http.StatusOK},
+		{"url checked first", 100, 200, func() *http.Request {
+			request := paddedRequest(201)
+			request.RequestURI = longURL(101)
+			return request
+		}(), http.StatusRequestURITooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+
+			upstreamRequests := 0
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				upstreamRequests++
+				return httpmock.NewStringResponse(200, "ok"), nil
+			})
+			config := buildConfiguration()
+			config.MaxURLLength = test.maxURL
+			config.MaxRequestHeaderBytes = test.maxHeaderBytes
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			test.request.RemoteAddr = "192.0.2.7:4321"
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, test.request)
+
+			if recorder.Code != test.status {
+				t.Errorf("unexpected status\nexpected: %v\nreceived: %v", test.status, recorder.Code)
+			}
+			if test.status == http.StatusOK {
+				if upstreamRequests != 1 {
+					t.Errorf("unexpected upstream requests\nexpected: %v\nreceived: %v", 1, upstreamRequests)
+				}
+				return
+			}
+			if upstreamRequests != 0 {
+				t.Errorf("expected the upstream not to be contacted\nreceived: %v", upstreamRequests)
+			}
+			line := logged.String()
+			if !strings.Contains(line, "from 192.0.2.7") || !strings.Contains(line, "GET /route1") {
+				t.Errorf("expected the refusal to be logged with the client address and URL\nreceived: %v", line)
+			}
+		})
+	}
+}
+
+func TestRequestLimitsTruncateLoggedURL(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	config := buildConfiguration()
+	config.MaxURLLength = 100
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	url := "/route1?" + strings.Repeat("q", 2000)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+
+	if recorder.Code != http.StatusRequestURITooLong {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusRequestURITooLong, recorder.Code)
+	}
+	if !strings.Contains(logged.String(), url[:maxLoggedURLBytes]+"...") || strings.Contains(logged.String(), url[:maxLoggedURLBytes+1]) {
+		t.Errorf("expected the logged URL to be truncated\nreceived: %v", logged.String())
+	}
+	if strings.Contains(recorder.Body.String(), "qqqq") {
+		t.Errorf("expected the URL not to be echoed to the client\nreceived: %v", recorder.Body.String())
+	}
+}
+
+func TestNegativeRequestLimitsAreRejected(t *testing.T) {
+	for _, config := range []*Configuration{
+		{DefaultRoute: "http://default.endpoint", MaxURLLength: -1},
+		{DefaultRoute: "http://default.endpoint", MaxRequestHeaderBytes: -1},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("expected a negative request limit to be rejected")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// responseBuffer is the body of a response read in full under
+// BufferResponses. Its length is always known, so the response is sent with
+// an exact Content-Length.
+type responseBuffer struct {
+	*bytes.Reader
+}
+
+func (buffer *responseBuffer) Close() error { return nil }
+
+// hasBody reports whether response can carry a body, which responses to HEAD
+// requests and those with a 1xx, 204 or 304 status cannot, whatever their
+// Content-Length says.
+func hasBody(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+	status := response.StatusCode
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// dropBody empties a response which cannot carry a body, as RFC 7230 section
+// 3.3 requires, so that nothing the upstream sent with it is relayed. A 1xx or
+// 204 response loses its Content-Length and Transfer-Encoding, which it must
+// not have, while a 304 or a response to HEAD keeps the Content-Length the
+// upstream sent, along with validators such as ETag and Last-Modified.
+func dropBody(response *http.Response) {
+	if hasBody(response) {
+		return
+	}
+	if response.Body != nil && response.Body != http.NoBody {
+		response.Body.Close()
+	}
+	response.Body = http.NoBody
+	response.TransferEncoding = nil
+	response.Header.Del("Transfer-Encoding")
+	if response.StatusCode < 200 || response.StatusCode == http.StatusNoContent {
+		response.ContentLength = 0
+		response.Header.Del("Content-Length")
+	}
+}
+
+// bufferResponse reads the body of response in full when the route's
+// BufferResponses allows, reporting whether it did. A body declared longer
+// than BufferResponses is not read. One of unknown length is read until it
+// proves longer, in which case the bytes read are put back in front of the
+// rest and it is streamed as any other.
+func (route *validRouteRule) bufferResponse(response *http.Response) (bool, error) {
+	maxBytes := route.BufferResponses
+	if maxBytes == 0 || response.ContentLength > maxBytes || !hasBody(response) {
+		return false, nil
+	}
+	body := response.Body
+	data, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(data)) > maxBytes {
+		response.Body = &replacedBody{io.MultiReader(bytes.NewReader(data), body), body}
+		return false, nil
+	}
+	body.Close()
+	response.Body = &responseBuffer{bytes.NewReader(data)}
+	response.ContentLength = int64(len(data))
+	return true, nil
+}
+
+// modifyResponse calls the route's ModifyResponse. On a route with
+// BufferResponses, it sees the whole body of a response which was buffered,
+// and any body it substitutes is read in full as well, so that its length is
+// known. The body of a response which is streamed instead is withheld from it
+// and relayed as received.
+func (handler *ProxyHandler) modifyResponse(route *validRouteRule, response *http.Response, buffered bool) error {
+	if route.BufferResponses == 0 {
+		return handler.callModifyResponse(route, response)
+	}
+	if !buffered {
+		body := response.Body
+		response.Body = http.NoBody
+		defer func() { response.Body = body }()
+		return handler.callModifyResponse(route, response)
+	}
+	if err := handler.callModifyResponse(route, response); err != nil {
+		return err
+	}
+	if _, ok := response.Body.(*responseBuffer); ok || response.Body == nil {
+		return nil
+	}
+	body := response.Body
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	response.Body = &responseBuffer{bytes.NewReader(data)}
+	response.ContentLength = int64(len(data))
+	return nil
+}
@@ -0,0 +1,97 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBufferResponses(t *testing.T) {
+	small, large := "small body", strings.Repeat("large body ", 10)
+	examples := []struct {
+		path          string
+		body          string
+		knownLength   bool
+		expected      string
+		contentLength string
+	}{
+		{"/small", small, true, strings.ToUpper(small), strconv.Itoa(len(small))},
+		{"/unknown-small", small, false, strings.ToUpper(small), strconv.Itoa(len(small))},
+		{"/large", large, true, large, strconv.Itoa(len(large))},
+		{"/unknown-large", large, false, large, ""},
+	}
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			for _, example := range examples {
+				example := example
+				httpmock.RegisterResponder("GET", "http://endpoint.one"+example.path, func(r *http.Request) (*http.Response, error) {
+					response := &http.Response{
+						StatusCode:    200,
+						Header:        http.Header{},
+						Body:          ioutil.NopCloser(iotest.HalfReader(strings.NewReader(example.body))),
+						ContentLength: -1,
+						Request:       r,
+					}
+					if example.knownLength {
+						response.ContentLength = int64(len(example.body))
+						response.Header.Set("Content-Length", strconv.Itoa(len(example.body)))
+					}
+					return response, nil
+				})
+			}
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.Routes[0].Path = "/"
+			config.Routes[0].BufferResponses = 64
+			config.Routes[0].ModifyResponse = func(response *http.Response) error {
+				body, err := io.ReadAll(response.Body)
+				if err != nil {
+					return err
+				}
+				response.Body = ioutil.NopCloser(strings.NewReader(strings.ToUpper(string(body))))
+				response.Header.Set("X-Modified", "true")
+				return nil
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+
+			for _, example := range examples {
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest("GET", example.path, nil))
+				if received := recorder.Body.String(); received != example.expected {
+					t.Errorf("unexpected body for %s\nexpected: %v\nreceived: %v", example.path, example.expected, received)
+				}
+				if received := recorder.Header().Get("Content-Length"); received != example.contentLength {
+					t.Errorf("unexpected Content-Length for %s\nexpected: %v\nreceived: %v", example.path, example.contentLength, received)
+				}
+				if recorder.Header().Get("X-Modified") != "true" {
+					t.Errorf("expected ModifyResponse to alter the headers of %s", example.path)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferResponsesValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"response buffer size is negative": RouteRule{Path: "/", Endpoint: "http://one", BufferResponses: -1},
+		"cannot be combined with WrapResponseBody": RouteRule{Path: "/", Endpoint: "http://one", BufferResponses: 64,
+			WrapResponseBody: func(body io.Reader, _ *http.Response) io.Reader { return body }},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
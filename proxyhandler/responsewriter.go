@@ -0,0 +1,159 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseWriter records whether a response has been started so the handler
+// knows if it is still able to answer with an error of its own, counts the
+// bytes of the response and, when idle is set, starts it with the response
+// and records the bytes as activity. It is handed out through wrap so the
+// optional interfaces of the writer it wraps remain visible.
+type responseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	hijacked    bool
+	headerBytes int64
+	bodyBytes   int64
+	idle        *idleTimer
+}
+
+func (writer *responseWriter) WriteHeader(status int) {
+	writer.startResponse(status)
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *responseWriter) Write(body []byte) (int, error) {
+	writer.startResponse(http.StatusOK)
+	written, err := writer.ResponseWriter.Write(body)
+	writer.bodyBytes += int64(written)
+	writer.idle.touch()
+	return written, err
+}
+
+// startResponse marks the response as started, estimating the size of its
+// header the first time. Informational responses are not counted.
+func (writer *responseWriter) startResponse(status int) {
+	if writer.wroteHeader || status < 200 {
+		return
+	}
+	writer.wroteHeader = true
+	writer.headerBytes = responseHeaderBytes(status, writer.Header())
+	writer.idle.start()
+}
+
+// tracked gives the handler access to the responseWriter behind a wrapped
+// writer.
+func (writer *responseWriter) tracked() *responseWriter {
+	return writer
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (writer *responseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+func (writer *responseWriter) flush() {
+	writer.startResponse(http.StatusOK)
+	writer.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (writer *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	writer.hijacked = true
+	return writer.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (writer *responseWriter) readFrom(source io.Reader) (int64, error) {
+	writer.startResponse(http.StatusOK)
+	written, err := writer.ResponseWriter.(io.ReaderFrom).ReadFrom(activityReader{source, writer.idle})
+	writer.bodyBytes += written
+	return written, err
+}
+
+// activityReader records the reads made from it with idle.
+type activityReader struct {
+	io.Reader
+	idle *idleTimer
+}
+
+func (reader activityReader) Read(buffer []byte) (int, error) {
+	read, err := reader.Reader.Read(buffer)
+	if read > 0 {
+		reader.idle.touch()
+	}
+	return read, err
+}
+
+type flushFunc func()
+
+func (flush flushFunc) Flush() { flush() }
+
+type hijackFunc func() (net.Conn, *bufio.ReadWriter, error)
+
+func (hijack hijackFunc) Hijack() (net.Conn, *bufio.ReadWriter, error) { return hijack() }
+
+type readFromFunc func(io.Reader) (int64, error)
+
+func (readFrom readFromFunc) ReadFrom(source io.Reader) (int64, error) { return readFrom(source) }
+
+type unwrappingWriter interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+	tracked() *responseWriter
+}
+
+// wrap returns writer extended with exactly those of http.Flusher,
+// http.Hijacker and io.ReaderFrom which the underlying writer implements.
+func (writer *responseWriter) wrap() http.ResponseWriter {
+	_, canFlush := writer.ResponseWriter.(http.Flusher)
+	_, canHijack := writer.ResponseWriter.(http.Hijacker)
+	_, canReadFrom := writer.ResponseWriter.(io.ReaderFrom)
+	flusher, hijacker, readerFrom := flushFunc(writer.flush), hijackFunc(writer.hijack), readFromFunc(writer.readFrom)
+
+	switch {
+	case canFlush && canHijack && canReadFrom:
+		return struct {
+			unwrappingWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{writer, flusher, hijacker, readerFrom}
+	case canFlush && canHijack:
+		return struct {
+			unwrappingWriter
+			http.Flusher
+			http.Hijacker
+		}{writer, flusher, hijacker}
+	case canFlush && canReadFrom:
+		return struct {
+			unwrappingWriter
+			http.Flusher
+			io.ReaderFrom
+		}{writer, flusher, readerFrom}
+	case canHijack && canReadFrom:
+		return struct {
+			unwrappingWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{writer, hijacker, readerFrom}
+	case canFlush:
+		return struct {
+			unwrappingWriter
+			http.Flusher
+		}{writer, flusher}
+	case canHijack:
+		return struct {
+			unwrappingWriter
+			http.Hijacker
+		}{writer, hijacker}
+	case canReadFrom:
+		return struct {
+			unwrappingWriter
+			io.ReaderFrom
+		}{writer, readerFrom}
+	}
+	return struct{ unwrappingWriter }{writer}
+}
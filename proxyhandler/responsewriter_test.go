@@ -0,0 +1,149 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type stubFlusher struct{}
+
+func (stubFlusher) Flush() {}
+
+type stubHijacker struct{}
+
+func (stubHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, fmt.Errorf("not hijackable")
+}
+
+type stubReaderFrom struct{}
+
+func (stubReaderFrom) ReadFrom(io.Reader) (int64, error) { return 0, nil }
+
+// capabilities identifies a subset of the optional ResponseWriter interfaces.
+type capabilities struct {
+	flush, hijack, readFrom bool
+}
+
+func capabilitiesOf(writer http.ResponseWriter) capabilities {
+	_, flush := writer.(http.Flusher)
+	_, hijack := writer.(http.Hijacker)
+	_, readFrom := writer.(io.ReaderFrom)
+	return capabilities{flush, hijack, readFrom}
+}
+
+// buildWriter returns a ResponseWriter implementing exactly the optional
+// interfaces in want.
+func buildWriter(want capabilities) http.ResponseWriter {
+	base := struct{ http.ResponseWriter }{httptest.NewRecorder()}
+	switch want {
+	case capabilities{true, true, true}:
+		return struct {
+			http.ResponseWriter
+			stubFlusher
+			stubHijacker
+			stubReaderFrom
+		}{ResponseWriter: base}
+	case capabilities{true, true, false}:
+		return struct {
+			http.ResponseWriter
+			stubFlusher
+			stubHijacker
+		}{ResponseWriter: base}
+	case capabilities{true, false, true}:
+		return struct {
+			http.ResponseWriter
+			stubFlusher
+			stubReaderFrom
+		}{ResponseWriter: base}
+	case capabilities{false, true, true}:
+		return struct {
+			http.ResponseWriter
+			stubHijacker
+			stubReaderFrom
+		}{ResponseWriter: base}
+	case capabilities{true, false, false}:
+		return struct {
+			http.ResponseWriter
+			stubFlusher
+		}{ResponseWriter: base}
+	case capabilities{false, true, false}:
+		return struct {
+			http.ResponseWriter
+			stubHijacker
+		}{ResponseWriter: base}
+	case capabilities{false, false, true}:
+		return struct {
+			http.ResponseWriter
+			stubReaderFrom
+		}{ResponseWriter: base}
+	}
+	return base
+}
+
+func allCapabilities() []capabilities {
+	var all []capabilities
+	for _, flush := range []bool{false, true} {
+		for _, hijack := range []bool{false, true} {
+			for _, readFrom := range []bool{false, true} {
+				all = append(all, capabilities{flush, hijack, readFrom})
+			}
+		}
+	}
+	return all
+}
+
+func TestResponseWriterAdvertisesUnderlyingInterfaces(t *testing.T) {
+	for _, want := range allCapabilities() {
+		underlying := buildWriter(want)
+		if capabilitiesOf(underlying) != want {
+			t.Fatalf("test writer built incorrectly for %+v", want)
+		}
+		wrapped := (&responseWriter{ResponseWriter: underlying}).wrap()
+		if received := capabilitiesOf(wrapped); received != want {
+			t.Errorf("unexpected interfaces advertised\nexpected: %+v\nreceived: %+v", want, received)
+		}
+		if http.NewResponseController(wrapped).Flush() == http.ErrNotSupported && want.flush {
+			t.Errorf("expected ResponseController to reach the flusher for %+v", want)
+		}
+	}
+}
+
+func TestResponseWriterTracksOptionalWrites(t *testing.T) {
+	writer := &responseWriter{ResponseWriter: buildWriter(capabilities{true, true, true})}
+	wrapped := writer.wrap()
+	wrapped.(io.ReaderFrom).ReadFrom(nil)
+	if !writer.wroteHeader {
+		t.Error("expected ReadFrom to mark the response as started")
+	}
+	wrapped.(http.Hijacker).Hijack()
+	if !writer.hijacked {
+		t.Error("expected Hijack to mark the connection as hijacked")
+	}
+}
+
+func TestProxyPassesWriterInterfacesThrough(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	want := capabilities{flush: true, hijack: false, readFrom: true}
+	var received capabilities
+	config := buildConfiguration()
+	config.DefaultRoute = "http://127.0.0.1:1"
+	config.Transport = nil
+	config.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		received = capabilitiesOf(w)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(buildWriter(want), httptest.NewRequest("GET", "/", nil))
+	if received != want {
+		t.Errorf("unexpected interfaces advertised to the proxy\nexpected: %+v\nreceived: %+v", want, received)
+	}
+}
@@ -0,0 +1,158 @@
+package proxyhandler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDiscardedBodyBytes bounds how much of a response being retried is read
+// so its connection can be reused; longer bodies close the connection.
+const maxDiscardedBodyBytes = 4096
+
+// DefaultMaxRetryDelay is the longest Retry-After a route waits for before
+// retrying when its MaxRetryDelay is not set.
+const DefaultMaxRetryDelay = 30 * time.Second
+
+// DefaultRetryBackoff is the wait before the first retry of a failed attempt
+// when a route's RetryBackoff is not set.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// retryDelay reports whether response asks for the request to be retried and
+// how long to wait first.
+func (handler *ProxyHandler) retryDelay(response *http.Response) (time.Duration, bool) {
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(response.Header.Get("Retry-After"), handler.now()), true
+}
+
+// retryStopped returns the reason upstreamRequest, sent on route, is not sent
+// again after attempt, waiting delay first, or an empty string if it may be.
+// A retry is refused when the wait is longer than the route's MaxRetryDelay,
+// when it would leave less than the route's MinRetryBudget before the
+// request's deadline, or would end after it.
+func (handler *ProxyHandler) retryStopped(route *validRouteRule, attempt int, body *bufferedBody, upstreamRequest *http.Request, delay time.Duration) string {
+	ctx := upstreamRequest.Context()
+	switch {
+	case attempt > route.MaxRetries:
+		return "max retries"
+	case !body.replayable():
+		return "body"
+	case route.RequireIdempotencyKey && !isIdempotent(upstreamRequest.Method) && upstreamRequest.Header.Get("Idempotency-Key") == "":
+		return "idempotency key"
+	case ctx.Err() != nil:
+		return "canceled"
+	case delay > route.maxRetryDelay():
+		return "retry after"
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := deadline.Sub(handler.now().Add(delay))
+		if remaining <= 0 || remaining < route.MinRetryBudget {
+			return "budget"
+		}
+	}
+	return ""
+}
+
+// failureRetryStopped is retryStopped for an attempt which failed without a
+// response. A request whose method is not idempotent is only sent again when
+// the attempt failed before it had a connection, so that the upstream cannot
+// have received it, or when the client sent an Idempotency-Key.
+func (handler *ProxyHandler) failureRetryStopped(route *validRouteRule, attempt int, body *bufferedBody, upstreamRequest *http.Request, progress *upstreamProgress, delay time.Duration) string {
+	if stopped := handler.retryStopped(route, attempt, body, upstreamRequest, delay); stopped != "" {
+		return stopped
+	}
+	if !isIdempotent(upstreamRequest.Method) && upstreamRequest.Header.Get("Idempotency-Key") == "" && progress.connected() {
+		return "not idempotent"
+	}
+	return ""
+}
+
+// backoff returns the wait before retrying a failed attempt: the route's
+// RetryBackoff, doubled for every attempt before it up to its MaxRetryDelay,
+// less a random part of up to half, so that requests which failed together
+// are not retried together.
+func (handler *ProxyHandler) backoff(route *validRouteRule, attempt int) time.Duration {
+	delay, limit := route.RetryBackoff, route.maxRetryDelay()
+	if delay == 0 {
+		delay = DefaultRetryBackoff
+	}
+	for retried := 1; retried < attempt && delay < limit; retried++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay - time.Duration(handler.random()*float64(delay/2))
+}
+
+func (route *validRouteRule) maxRetryDelay() time.Duration {
+	if route.MaxRetryDelay == 0 {
+		return DefaultMaxRetryDelay
+	}
+	return route.MaxRetryDelay
+}
+
+// limitAttempt bounds downstreamRequest by the route's AttemptTimeout. Its
+// context keeps the deadline of the client's request, so an attempt is
+// shortened to the time left when that comes first. The returned function
+// releases the context.
+func (handler *ProxyHandler) limitAttempt(route *validRouteRule, downstreamRequest *http.Request) (*http.Request, context.CancelFunc) {
+	if route.AttemptTimeout == 0 {
+		return downstreamRequest, func() {}
+	}
+	ctx, cancel := context.WithDeadline(downstreamRequest.Context(), handler.now().Add(route.AttemptTimeout))
+	return downstreamRequest.WithContext(ctx), cancel
+}
+
+// parseRetryAfter reads a Retry-After value given either in seconds or as an
+// HTTP date. Missing, invalid and past values mean no delay.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
+
+// wait blocks for delay, returning early with ctx's error if it is done first.
+func (handler *ProxyHandler) wait(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-handler.after(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newRequestID returns a random identifier for a client request which did not
+// carry an X-Request-ID.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func discardResponse(response *http.Response) {
+	io.CopyN(io.Discard, response.Body, maxDiscardedBodyBytes)
+	response.Body.Close()
+}
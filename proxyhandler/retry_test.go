@@ -0,0 +1,397 @@
+package proxyhandler
+
+import (
+	"context"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// buildRetryingHandler returns a handler whose route retries once against an
+// upstream answering first with status and retryAfter, then with 200. Its
+// clock is faked and every wait is recorded in waited.
+func buildRetryingHandler(t *testing.T, status int, retryAfter func(now time.Time) string) (*ProxyHandler, *[]time.Duration, *[]*Observation) {
+	now := time.Now()
+	attempts := 0
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			response := httpmock.NewStringResponse(status, "busy")
+			response.Header.Set("Retry-After", retryAfter(now))
+			return response, nil
+		}
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+	var observations []*Observation
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 1
+	config.Observer = func(observation *Observation) {
+		observations = append(observations, observation)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	var waited []time.Duration
+	h.now = func() time.Time { return now }
+	h.after = func(delay time.Duration) <-chan time.Time {
+		waited = append(waited, delay)
+		now = now.Add(delay)
+		elapsed := make(chan time.Time, 1)
+		elapsed <- now
+		return elapsed
+	}
+	return h, &waited, &observations
+}
+
+func TestRetryAfterDelaysRetry(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	cases := map[string]struct {
+		status     int
+		retryAfter func(now time.Time) string
+	}{
+		"503 seconds": {http.StatusServiceUnavailable, func(time.Time) string { return "2" }},
+		"429 date": {http.StatusTooManyRequests, func(now time.Time) string {
+			return now.Add(2 * time.Second).UTC().Format(http.TimeFormat)
+		}},
+	}
+	for name, c := range cases {
+		h, waited, observations := buildRetryingHandler(t, c.status, c.retryAfter)
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected retry to succeed\nexpected: %v\nreceived: %v", name, http.StatusOK, recorder.Code)
+		}
+		// an HTTP date has second precision, so the wait may be just under 2s
+		if len(*waited) != 1 || (*waited)[0] <= time.Second || (*waited)[0] > 2*time.Second {
+			t.Errorf("%s: unexpected wait before retrying\nexpected: %v\nreceived: %v", name, 2*time.Second, *waited)
+		}
+		if len(*observations) != 1 || (*observations)[0].Attempts != 2 {
+			t.Errorf("%s: expected two attempts to be observed\nreceived: %v", name, *observations)
+		}
+	}
+}
+
+func TestRetryAfterBeyondDeadlineReturnsResponse(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, waited, observations := buildRetryingHandler(t, http.StatusServiceUnavailable, func(time.Time) string { return "2" })
+	ctx, cancel := context.WithDeadline(context.Background(), h.now().Add(time.Second))
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil).WithContext(ctx))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != "busy" {
+		t.Errorf("expected upstream response to be returned as-is\nexpected: %v busy\nreceived: %v %s", http.StatusServiceUnavailable, recorder.Code, recorder.Body.String())
+	}
+	if len(*waited) != 0 {
+		t.Errorf("expected no wait\nreceived: %v", *waited)
+	}
+	if len(*observations) != 1 || (*observations)[0].Attempts != 1 {
+		t.Errorf("expected a single attempt to be observed\nreceived: %v", *observations)
+	}
+}
+
+func TestRetryAfterBeyondMaxRetryDelayReturnsResponse(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	cases := map[string]struct {
+		maxRetryDelay time.Duration
+		retryAfter    string
+	}{
+		"default": {0, "86400"},
+		"route":   {time.Second, "2"},
+	}
+	for name, c := range cases {
+		h, waited, observations := buildRetryingHandler(t, http.StatusTooManyRequests, func(time.Time) string { return c.retryAfter })
+		config := buildConfiguration()
+		config.Routes[0].MaxRetries = 1
+		config.Routes[0].MaxRetryDelay = c.maxRetryDelay
+		if err := h.Reload(config); err != nil {
+			t.Fatalf("unable to reload: %s", err.Error())
+		}
+
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+		if recorder.Code != http.StatusTooManyRequests || recorder.Body.String() != "busy" {
+			t.Errorf("%s: expected upstream response to be returned as-is\nexpected: %v busy\nreceived: %v %s", name, http.StatusTooManyRequests, recorder.Code, recorder.Body.String())
+		}
+		if len(*waited) != 0 {
+			t.Errorf("%s: expected no wait\nreceived: %v", name, *waited)
+		}
+		if len(*observations) != 1 || (*observations)[0].RetryStopped != "retry after" {
+			t.Errorf("%s: expected the retry to be stopped by its delay\nreceived: %v", name, *observations)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"0":                             0,
+		"120":                           2 * time.Minute,
+		"-5":                            0,
+		"soon":                          0,
+		"Wed, 01 Jan 2020 12:00:30 GMT": 30 * time.Second,
+		"Wed, 01 Jan 2020 11:00:00 GMT": 0,
+	}
+	for value, expected := range cases {
+		if received := parseRetryAfter(value, now); received != expected {
+			t.Errorf("unexpected delay for %q\nexpected: %v\nreceived: %v", value, expected, received)
+		}
+	}
+}
+
+func TestRetryBudgetLimitsAttempts(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	// every attempt takes 100ms of the fake clock and is answered with 503
+	start := time.Now()
+	now := start
+	var deadlines []time.Time
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		deadline, _ := r.Context().Deadline()
+		deadlines = append(deadlines, deadline)
+		now = now.Add(100 * time.Millisecond)
+		return httpmock.NewStringResponse(http.StatusServiceUnavailable, "busy"), nil
+	})
+	var observations []*Observation
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 5
+	config.Routes[0].MinRetryBudget = 150 * time.Millisecond
+	config.Routes[0].AttemptTimeout = time.Second
+	config.Observer = func(observation *Observation) {
+		observations = append(observations, observation)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.now = func() time.Time { return now }
+
+	examples := []struct {
+		budget   time.Duration
+		attempts int
+		stopped  string
+	}{
+		// after the third attempt only 50ms of the budget is left
+		{350 * time.Millisecond, 3, "budget"},
+		{10 * time.Second, 6, "max retries"},
+	}
+	for _, example := range examples {
+		now, deadlines, observations = start, nil, nil
+		deadline := start.Add(example.budget)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil).WithContext(ctx))
+		cancel()
+
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected last response to be relayed with a budget of %s\nexpected: %v\nreceived: %v", example.budget, http.StatusServiceUnavailable, recorder.Code)
+		}
+		if len(observations) != 1 || observations[0].Attempts != example.attempts || observations[0].RetryStopped != example.stopped {
+			t.Errorf("unexpected attempts with a budget of %s\nexpected: %v %s\nreceived: %v", example.budget, example.attempts, example.stopped, observations)
+		}
+		// attempts are shortened to the time left before the deadline
+		for attempt, received := range deadlines {
+			expected := start.Add(time.Duration(attempt)*100*time.Millisecond + time.Second)
+			if expected.After(deadline) {
+				expected = deadline
+			}
+			if !received.Equal(expected) {
+				t.Errorf("unexpected deadline for attempt %d with a budget of %s\nexpected: %v\nreceived: %v", attempt+1, example.budget, expected, received)
+			}
+		}
+	}
+}
+
+func TestRetryBudgetValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"require max retries":  RouteRule{Path: "/", Endpoint: "http://one", MinRetryBudget: time.Second},
+		"must not be negative": RouteRule{Path: "/", Endpoint: "http://one", AttemptTimeout: -1},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestAttemptHeaders(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var upstreamHeaders []http.Header
+	httpmock.RegisterResponder("POST", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		upstreamHeaders = append(upstreamHeaders, r.Header)
+		if len(upstreamHeaders) == 1 {
+			return httpmock.NewStringResponse(http.StatusServiceUnavailable, "busy"), nil
+		}
+		return httpmock.NewStringResponse(http.StatusOK, "ok"), nil
+	})
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 1
+	config.Routes[0].RequireIdempotencyKey = true
+	config.BufferBodyBytes = 1024
+	config.AttemptHeaders = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	request := httptest.NewRequest("POST", "/route1", strings.NewReader("order"))
+	request.Header.Set("Idempotency-Key", "order-1")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-Proxy-Attempts") != "2" {
+		t.Errorf("expected retry to succeed after two attempts\nexpected: %v 2\nreceived: %v %s", http.StatusOK, recorder.Code, recorder.Header().Get("X-Proxy-Attempts"))
+	}
+	if len(upstreamHeaders) != 2 {
+		t.Fatalf("unexpected number of attempts\nexpected: %v\nreceived: %v", 2, len(upstreamHeaders))
+	}
+	for index, header := range upstreamHeaders {
+		if expected, received := strconv.Itoa(index+1), header.Get("X-Retry-Attempt"); received != expected {
+			t.Errorf("unexpected attempt header\nexpected: %v\nreceived: %v", expected, received)
+		}
+	}
+	id := upstreamHeaders[0].Get("X-Request-ID")
+	if id == "" || upstreamHeaders[1].Get("X-Request-ID") != id {
+		t.Errorf("expected attempts to share a generated request ID\nreceived: %v %v", id, upstreamHeaders[1].Get("X-Request-ID"))
+	}
+
+	// without an Idempotency-Key the POST is not retried
+	upstreamHeaders = nil
+	request = httptest.NewRequest("POST", "/route1", strings.NewReader("order"))
+	request.Header.Set("X-Request-ID", "client-id")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("X-Proxy-Attempts") != "1" {
+		t.Errorf("expected a single attempt\nexpected: %v 1\nreceived: %v %s", http.StatusServiceUnavailable, recorder.Code, recorder.Header().Get("X-Proxy-Attempts"))
+	}
+	if len(upstreamHeaders) != 1 || upstreamHeaders[0].Get("X-Request-ID") != "client-id" {
+		t.Errorf("expected the client's request ID to be forwarded\nexpected: %v\nreceived: %v", "client-id", upstreamHeaders)
+	}
+}
+
+func TestFailedAttemptsBackOff(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	attempts := 0
+	httpmock.RegisterResponder("GET", "http://endpoint.one/route1", func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts < 4 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+	config := buildConfiguration()
+	config.Routes[0].MaxRetries = 3
+	config.Routes[0].RetryBackoff = 100 * time.Millisecond
+	config.Routes[0].MaxRetryDelay = 300 * time.Millisecond
+	config.Random = func() float64 { return 0.5 }
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	var waited []time.Duration
+	h.after = func(delay time.Duration) <-chan time.Time {
+		waited = append(waited, delay)
+		elapsed := make(chan time.Time, 1)
+		elapsed <- time.Now()
+		return elapsed
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/route1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the retries to succeed\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+	// doubled from RetryBackoff up to MaxRetryDelay, less a quarter of jitter
+	expected := []time.Duration{75 * time.Millisecond, 150 * time.Millisecond, 225 * time.Millisecond}
+	if !reflect.DeepEqual(waited, expected) {
+		t.Errorf("unexpected waits between attempts\nexpected: %v\nreceived: %v", expected, waited)
+	}
+}
+
+func TestFailedPostIsRetriedOnlyBeforeReachingUpstream(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// the upstream reads each request and drops the connection unanswered
+	var attempts atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	examples := []struct {
+		name     string
+		method   string
+		endpoint string
+		key      string
+		attempts int32
+		stopped  string
+	}{
+		{"GET after reaching upstream", "GET", upstream.URL, "", 2, "max retries"},
+		{"POST after reaching upstream", "POST", upstream.URL, "", 1, "not idempotent"},
+		{"POST with idempotency key", "POST", upstream.URL, "order-1", 2, "max retries"},
+		{"POST before reaching upstream", "POST", closed.URL, "", 0, "max retries"},
+	}
+	for _, example := range examples {
+		attempts.Store(0)
+		var observation *Observation
+		config := buildConfiguration()
+		config.Transport = nil
+		config.BufferBodyBytes = 1024
+		config.Routes = []*RouteRule{
+			&RouteRule{Path: "/", Endpoint: example.endpoint, MaxRetries: 1, RetryBackoff: time.Millisecond},
+		}
+		config.Observer = func(received *Observation) { observation = received }
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		request := httptest.NewRequest(example.method, "/", strings.NewReader("order"))
+		if example.key != "" {
+			request.Header.Set("Idempotency-Key", example.key)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		h.Close()
+
+		if recorder.Code != http.StatusBadGateway {
+			t.Errorf("%s: unexpected status\nexpected: %v\nreceived: %v", example.name, http.StatusBadGateway, recorder.Code)
+		}
+		if received := attempts.Load(); received != example.attempts {
+			t.Errorf("%s: unexpected requests received upstream\nexpected: %v\nreceived: %v", example.name, example.attempts, received)
+		}
+		if observation == nil || observation.RetryStopped != example.stopped {
+			t.Errorf("%s: unexpected reason for stopping\nexpected: %v\nreceived: %v", example.name, example.stopped, observation)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package proxyhandler
+
+import (
+	"time"
+)
+
+// expiryLabel is the label of route removals made when a route's TTL lapses.
+const expiryLabel = "expiry"
+
+// RouteChange describes a single change to the routing of a ProxyHandler, as
+// reported to the Configuration's RouteChangeHook. Label is the label given
+// to As by the caller which made the change, "expiry" for routes removed when
+// their TTL lapsed, "outlier" for endpoints ejected or readmitted by outlier
+// detection, or empty. Path is the path of the changed route, or empty
+// for the default route. OldEndpoint is empty for an added route and
+// NewEndpoint for a removed one; routes with several endpoints list them
+// separated by commas.
+type RouteChange struct {
+	Label       string
+	Time        time.Time
+	Path        string
+	OldEndpoint string
+	NewEndpoint string
+}
+
+// diffRoutes lists the changes which turn previous into current: first those
+// to the default route, then those to routes which were changed or removed,
+// in their previous order, then those which were added, in their new order.
+func diffRoutes(previous, current *routeTable) []RouteChange {
+	var changes []RouteChange
+	if previous.defaultRoute.target() != current.defaultRoute.target() {
+		changes = append(changes, RouteChange{OldEndpoint: previous.defaultRoute.target(), NewEndpoint: current.defaultRoute.target()})
+	}
+	for _, route := range previous.routes {
+		change := RouteChange{Path: route.Path, OldEndpoint: route.target()}
+		if index := current.indexOf(route.Path); index >= 0 {
+			change.NewEndpoint = current.routes[index].target()
+		}
+		if change.NewEndpoint != change.OldEndpoint {
+			changes = append(changes, change)
+		}
+	}
+	for _, route := range current.routes {
+		if previous.indexOf(route.Path) < 0 {
+			changes = append(changes, RouteChange{Path: route.Path, NewEndpoint: route.target()})
+		}
+	}
+	return changes
+}
+
+// RouteEditor changes the routing of a ProxyHandler on behalf of a labeled
+// caller. Its methods behave as the ProxyHandler methods of the same names.
+type RouteEditor struct {
+	handler *ProxyHandler
+	label   string
+}
+
+// As returns a RouteEditor whose changes are reported to the
+// RouteChangeHook with label, for example naming the operator or system which
+// makes them.
+func (handler *ProxyHandler) As(label string) *RouteEditor {
+	return &RouteEditor{handler: handler, label: label}
+}
+
+// SetEndpoint directs the route registered for path to endpoint, as
+// ProxyHandler.SetEndpoint does, reporting the change with the editor's label.
+func (editor *RouteEditor) SetEndpoint(path, endpoint string) error {
+	return editor.handler.setEndpoint(editor.label, path, endpoint)
+}
+
+// AddRoute appends route to the route table, as ProxyHandler.AddRoute does,
+// reporting the change with the editor's label.
+func (editor *RouteEditor) AddRoute(route RouteRule) error {
+	return editor.handler.addRoute(editor.label, route)
+}
+
+// RemoveRoute removes the route registered for path, as
+// ProxyHandler.RemoveRoute does, reporting the change with the editor's label.
+func (editor *RouteEditor) RemoveRoute(path string) error {
+	return editor.handler.removeRoute(editor.label, path)
+}
+
+// RemoveRouteRule removes the route matching the same requests as route, as
+// ProxyHandler.RemoveRouteRule does, reporting the change with the editor's
+// label.
+func (editor *RouteEditor) RemoveRouteRule(route RouteRule) error {
+	return editor.handler.removeRouteRule(editor.label, route)
+}
+
+// SwapEndpoints exchanges the endpoints of the routes registered for pathA
+// and pathB, as ProxyHandler.SwapEndpoints does, reporting the changes with
+// the editor's label.
+func (editor *RouteEditor) SwapEndpoints(pathA, pathB string) error {
+	return editor.handler.swapEndpoints(editor.label, pathA, pathB)
+}
+
+// Reload replaces the default route and route table with those in config, as
+// ProxyHandler.Reload does, reporting the changes with the editor's label.
+func (editor *RouteEditor) Reload(config *Configuration) error {
+	return editor.handler.reload(editor.label, config)
+}
+
+// Restore returns the routing to that captured in snapshot, as
+// ProxyHandler.Restore does, reporting the changes with the editor's label.
+func (editor *RouteEditor) Restore(snapshot Snapshot) error {
+	return editor.handler.restore(editor.label, snapshot)
+}
@@ -0,0 +1,93 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRouteChangeHookReportsMutationsInOrder(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var changes []RouteChange
+	config := buildConfiguration()
+	config.RouteChangeHook = func(change RouteChange) {
+		changes = append(changes, change)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes from New\nreceived: %v", changes)
+	}
+
+	steps := []func() error{
+		func() error { return h.AddRoute(RouteRule{Path: "/route2", Endpoint: "http://endpoint.two"}) },
+		func() error { return h.SetEndpoint("/route1", "http://endpoint.three") },
+		func() error { return h.SwapEndpoints("/route1", "/route2") },
+		func() error { return h.As("operator").RemoveRoute("/route2") },
+		func() error {
+			return h.Reload(&Configuration{
+				DefaultRoute: "http://new.default",
+				Routes: []*RouteRule{
+					&RouteRule{Path: "/route3", Endpoints: []string{"http://endpoint.four", "http://endpoint.five"}},
+					&RouteRule{Path: "/route1", Endpoint: "http://endpoint.two"},
+				},
+			})
+		},
+		func() error { return h.SetEndpoint("/route1", "http://endpoint.two") },
+	}
+	for index, step := range steps {
+		clock = clock.Add(time.Minute)
+		if err := step(); err != nil {
+			t.Fatalf("step %d failed: %s", index, err.Error())
+		}
+	}
+
+	minute := func(n int) time.Time { return time.Date(2020, 1, 1, 0, n, 0, 0, time.UTC) }
+	expected := []RouteChange{
+		{Time: minute(1), Path: "/route2", NewEndpoint: "http://endpoint.two"},
+		{Time: minute(2), Path: "/route1", OldEndpoint: "http://endpoint.one", NewEndpoint: "http://endpoint.three"},
+		{Time: minute(3), Path: "/route1", OldEndpoint: "http://endpoint.three", NewEndpoint: "http://endpoint.two"},
+		{Time: minute(3), Path: "/route2", OldEndpoint: "http://endpoint.two", NewEndpoint: "http://endpoint.three"},
+		{Label: "operator", Time: minute(4), Path: "/route2", OldEndpoint: "http://endpoint.three"},
+		{Time: minute(5), OldEndpoint: "http://default.endpoint", NewEndpoint: "http://new.default"},
+		{Time: minute(5), Path: "/route3", NewEndpoint: "http://endpoint.four, http://endpoint.five"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected route changes\nexpected: %+v\nreceived: %+v", expected, changes)
+	}
+}
+
+func TestRouteChangeHookReportsExpiry(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, ""))
+	var changes []RouteChange
+	config := buildConfiguration()
+	config.RouteChangeHook = func(change RouteChange) {
+		changes = append(changes, change)
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	if err := h.AddRoute(RouteRule{Path: "/temporary", Endpoint: "http://endpoint.two", TTL: time.Minute}); err != nil {
+		t.Fatalf("unable to add route: %s", err.Error())
+	}
+
+	now = now.Add(2 * time.Minute)
+	dispatchBodies(h, []string{"/temporary"})
+	expected := RouteChange{Label: "expiry", Time: now, Path: "/temporary", OldEndpoint: "http://endpoint.two"}
+	if len(changes) != 2 || changes[1] != expected {
+		t.Errorf("unexpected expiry change\nexpected: %+v\nreceived: %+v", expected, changes)
+	}
+}
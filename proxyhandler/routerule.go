@@ -2,37 +2,839 @@ package proxyhandler
 
 import (
 	"fmt"
+	"golang.org/x/net/idna"
+	"io"
+	"maps"
+	"net"
+	"net/http"
 	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // RouteRule represents a route which the proxyHandler can use to direct requests to
-// appropriate backend system. Path is the requested path in the URL received by the
-// proxyHandler. Endpoint is the backend host to direct the traffic to.
+// appropriate backend system. Callbacks are omitted when a RouteRule is
+// encoded as JSON.
 type RouteRule struct {
-	Path     string
+	// Path is the requested path in the URL received by the proxyHandler.
+	Path string
+	// Methods, when set, restricts the route to requests using one of the
+	// listed methods; other requests continue to be matched against later
+	// routes. A route listing GET also serves HEAD requests, as HTTP expects
+	// of a resource which supports GET, and lists HEAD in Allow headers.
+	Methods []string `json:",omitempty"`
+	// AllowedMethods, by contrast with Methods, applies once a request has
+	// matched the route: requests using a method it does not list are
+	// answered with 405 Method Not Allowed, with the list in an Allow header,
+	// without contacting the upstream. OPTIONS requests the route answers
+	// itself under its Options policy are not refused.
+	AllowedMethods []string `json:",omitempty"`
+	// Accept, when set, restricts the route to requests whose Accept header
+	// prefers one of the listed media types. The media ranges with the highest
+	// quality value, ignoring */*, must all cover one of the route's types;
+	// requests without such a preference, including those without an Accept
+	// header and those with several equally preferred ranges the route does
+	// not all serve, continue to be matched against later routes. Routes
+	// negotiating the same path are configured together through New or
+	// Reload, since the methods which address a route by path act on the
+	// first one registered.
+	Accept []string `json:",omitempty"`
+	// ContentType, when set, restricts the route to requests whose
+	// Content-Type header names one of the listed media types; parameters such
+	// as charset and boundary are ignored and the body is not read. Requests
+	// without a Content-Type, or with one which cannot be parsed, continue to
+	// be matched against later routes.
+	ContentType []string `json:",omitempty"`
+	// Endpoint is the backend host to direct the traffic to.
 	Endpoint string
+	// Endpoints, used in place of Endpoint, lists several backend hosts which
+	// take turns serving the route's requests.
+	Endpoints []string `json:",omitempty"`
+
+	// EndpointTemplate, when set in place of Endpoint, is an endpoint URL with
+	// placeholders such as {tenant}, for example "http://{tenant}.internal.svc".
+	// Every placeholder is filled with the value TemplateValue returns for
+	// each request.
+	EndpointTemplate string `json:",omitempty"`
+	// TemplateValue returns the value filling the placeholders of
+	// EndpointTemplate; TemplateFromHeader and TemplateFromPathSegment build
+	// common functions. Requests for which it fails, or returns anything but
+	// letters, digits and hyphens, are answered with 400 Bad Request rather
+	// than being sent to a host of the client's choosing.
+	TemplateValue func(*http.Request) (string, error) `json:"-"`
+
+	// JWT, when set, requires the route's requests to carry a valid JSON Web
+	// Token as described by JWTConfig. The token is verified before any
+	// EndpointTemplate is filled, so TemplateValue may read the claim headers.
+	JWT *JWTConfig `json:"-"`
+
+	// Director, when set, may alter the outbound request before it is sent to
+	// the Endpoint. It may replace the body, which is sent with its
+	// ContentLength when that is updated along with it, and chunked otherwise.
+	Director func(*http.Request) `json:"-"`
+	// ModifyResponse, when set, may alter the upstream response before it is
+	// copied to the client; returning an error aborts the response with a
+	// 500. It may replace the body as Director may.
+	ModifyResponse func(*http.Response) error `json:"-"`
+	// WrapResponseBody, when set, is called after ModifyResponse with the
+	// response body and returns the reader the client's body is streamed from,
+	// allowing large bodies to be transformed as they arrive rather than
+	// buffered. Wrapped bodies are sent chunked and flushed as they are read.
+	// An error read from the wrapper is logged and aborts the response.
+	WrapResponseBody func(io.Reader, *http.Response) io.Reader `json:"-"`
+	// Signer, when set, is called with every request sent upstream, including
+	// retries and hedges, after the Director and with the SHA-256 hash of the
+	// body being sent, so that it can add headers authenticating the request.
+	// Signing requires the handler's BufferBodyBytes, which bounds the bodies
+	// the route accepts; longer bodies are refused with 413 Request Entity Too
+	// Large and a Signer error aborts the request with a 500 before it is
+	// sent. HMACSigner builds a Signer for HMAC-SHA256 signatures.
+	Signer func(*http.Request, []byte) error `json:"-"`
+
+	// BufferResponses, when set, reads responses of up to that many bytes in
+	// full before relaying them, while larger responses stream as usual. A
+	// response is buffered when its Content-Length is within the limit, or
+	// when it has none and its body turns out to be; one without a
+	// Content-Length which proves larger is streamed, beginning with the bytes
+	// already read. ModifyResponse sees the whole body of a buffered response,
+	// and the body it leaves, whether the original or a replacement, is sent
+	// with an exact Content-Length. For a streamed response, ModifyResponse
+	// sees only the status and headers, and the body is relayed as received.
+	// It cannot be combined with WrapResponseBody.
+	BufferResponses int64 `json:",omitempty"`
+
+	// TransformBody, when set, rewrites request bodies of up to
+	// TransformBodyBytes before they are sent upstream, for example to add a
+	// field to JSON bodies. It is called once per request with the request's
+	// Content-Type and body, and the body it returns is sent with its own
+	// Content-Length. A TransformBody error answers the request with 400 Bad
+	// Request without contacting the upstream.
+	TransformBody func(contentType string, body []byte) ([]byte, error) `json:"-"`
+	// TransformBodyBytes bounds the bodies TransformBody is given, and must be
+	// set along with it. Longer bodies are sent untransformed.
+	TransformBodyBytes int64 `json:",omitempty"`
+	// RejectOversizedBodies refuses bodies longer than TransformBodyBytes with
+	// 413 Request Entity Too Large rather than sending them untransformed.
+	RejectOversizedBodies bool `json:",omitempty"`
+
+	// CompressRequests, when set, gzips request bodies longer than that many
+	// bytes before they are sent upstream, for upstreams which accept gzip
+	// encoded requests. Only bodies of a textual Content-Type, such as JSON,
+	// XML or text/*, which the client has not already encoded are compressed,
+	// and bodies of unknown length always are. The body is compressed as it
+	// is sent, with a Content-Encoding of gzip and no Content-Length, after
+	// any TransformBody.
+	CompressRequests int64 `json:",omitempty"`
+
+	// DialContext, when set, replaces the handler's dialer for this route
+	// only.
+	DialContext DialContextFunc `json:"-"`
+	// DialNetwork, when "tcp4" or "tcp6", makes the route's connections over
+	// IPv4 or IPv6 only, for upstreams whose addresses of the other family are
+	// unreachable. The route then sends its requests through a transport of
+	// its own. It does not apply to websocket routes.
+	DialNetwork string `json:",omitempty"`
+	// Client, when set, sends the route's requests in place of the handler's
+	// client, for example to use a cookie jar or a client instrumented by
+	// another library. None of the handler's transport settings, such as
+	// MaxIdleConnsPerHost, MaxConnsPerUpstream, DialContext, DNSCacheTTL,
+	// OutboundProxy and the timeouts, apply to it, and it cannot be combined
+	// with the route's own transport settings. Its redirect policy is honored,
+	// so a client with the default policy follows redirects rather than
+	// relaying them to the caller. With StdlibProxy only its Transport is
+	// used.
+	Client *http.Client `json:"-"`
+
+	// SplitEndpoint, when set, receives SplitRatio of the HTTP traffic
+	// matching this route as the "experiment" variant, while the rest goes to
+	// Endpoint as the "stable" variant.
+	SplitEndpoint string `json:",omitempty"`
+	// SplitRatio, between 0 and 1, is the share of requests sent to
+	// SplitEndpoint.
+	SplitRatio float64 `json:",omitempty"`
+	// SplitKey, when set and returning a non-empty key, assigns requests
+	// sharing a key the same variant. Requests are otherwise assigned at
+	// random.
+	SplitKey func(*http.Request) string `json:"-"`
+
+	// CanaryEndpoint, when set, receives every request for which
+	// CanaryMatcher returns true as the "canary" variant. Requests are not
+	// retried against the stable endpoint if the canary fails.
+	CanaryEndpoint string `json:",omitempty"`
+	// CanaryMatcher chooses the requests sent to CanaryEndpoint, and is
+	// consulted before any split. HeaderEquals and CookiePresent build common
+	// matchers.
+	CanaryMatcher func(*http.Request) bool `json:"-"`
+
+	// WarmupPath, when set, is requested with HEAD from each of the route's
+	// endpoints, in the background, whenever the route is installed by New,
+	// AddRoute, SetEndpoint, Reload or Restore, so that the connections made
+	// are ready in the pool for the route's first requests. Each request is
+	// abandoned after five seconds, and failures are only logged. Warm-up
+	// does not apply to websocket routes or those with an EndpointTemplate.
+	WarmupPath string `json:",omitempty"`
+	// WarmupRequests is the number of warm-up requests sent to each endpoint
+	// at once, one by default, and so the number of connections opened.
+	WarmupRequests int `json:",omitempty"`
+
+	// TTL, when set, limits how long the route stays in effect after it is
+	// installed by New, Reload or Restore. An expired route stops matching and
+	// is removed from the table.
+	TTL time.Duration `json:",omitempty"`
+	// OnExpire, when set, is called with the route once TTL has removed it.
+	OnExpire func(RouteRule) `json:"-"`
+
+	// RewriteFrom, when set, is a path prefix which is replaced with RewriteTo
+	// in the path sent upstream; the rest of the path is appended unchanged.
+	// The mapping is reversed on the path of Location headers and Set-Cookie
+	// Path attributes in the response.
+	RewriteFrom string `json:",omitempty"`
+	// RewriteTo replaces RewriteFrom in the path sent upstream.
+	RewriteTo string `json:",omitempty"`
+
+	// StatusMapping replaces upstream response statuses, keyed by the status
+	// the upstream returned, with statuses between 200 and 599. Errors generated by the proxy itself and 206
+	// Partial Content responses are never mapped.
+	StatusMapping map[int]int `json:",omitempty"`
+	// StatusBodies holds bodies sent in place of the upstream's, keyed by the
+	// status the upstream returned, for responses which may carry one.
+	StatusBodies map[int]string `json:",omitempty"`
+
+	// ForwardInformational relays the 1xx informational responses, such as
+	// 103 Early Hints, which the route's upstream sends ahead of its final
+	// response, each with only its own headers. They are otherwise dropped,
+	// since some clients mishandle them. 100 Continue is never relayed. The
+	// same applies under the handler's StdlibProxy, although
+	// httputil.ReverseProxy would relay them all.
+	ForwardInformational bool `json:",omitempty"`
+
+	// RequestHeaderCase lists headers, such as SOAPAction, which the route's
+	// upstream requires in a casing other than Go's canonical one. Headers of
+	// upstream requests named in it are sent spelled exactly as listed, once
+	// the Director and any Signer have seen them in canonical form. Casing is
+	// only preserved over HTTP/1, since HTTP/2 sends every header name in
+	// lower case.
+	RequestHeaderCase []string `json:",omitempty"`
+	// ResponseHeaderCase does as RequestHeaderCase does for the headers of
+	// responses relayed to clients.
+	ResponseHeaderCase []string `json:",omitempty"`
+
+	// ResponseHeaderTimeout, when set, overrides the handler's
+	// ResponseHeaderTimeout for this route. Exceeding it is answered with 504
+	// Gateway Timeout.
+	ResponseHeaderTimeout time.Duration `json:",omitempty"`
+	// MaxResponseHeaderBytes, when set, overrides the handler's
+	// MaxResponseHeaderBytes for this route, which then sends its requests
+	// through a transport of its own.
+	MaxResponseHeaderBytes int64 `json:",omitempty"`
+	// MaxResponseHeaders, when set, overrides the handler's
+	// MaxResponseHeaders for this route.
+	MaxResponseHeaders int `json:",omitempty"`
+	// ForceHTTPS sends the route's requests to its http endpoints over https,
+	// as though they had been registered with the https scheme. An endpoint's
+	// port 80 becomes 443, while other explicit ports are kept. Endpoints
+	// already using https, and websocket endpoints, are unaffected. The
+	// handler's ForceHTTPS applies it to every route.
+	ForceHTTPS bool `json:",omitempty"`
+	// TLSServerName, when set on a route with https endpoints, is sent as the
+	// SNI server name in place of the endpoint's host, and the upstream
+	// certificate is verified against it. This allows dialing an endpoint by
+	// IP address.
+	TLSServerName string `json:",omitempty"`
+	// TLSPins, when set on a route with https endpoints, pins the upstream
+	// certificate: the handshake succeeds only when the leaf certificate the
+	// upstream presents has the public key of one of the pins, whether or not
+	// its chain is signed by a trusted authority or names the endpoint's host,
+	// and the request is otherwise answered with 502 Bad Gateway. Pins of
+	// intermediate or root certificates are not matched. Each pin is the
+	// base64 encoded SHA-256 hash of a SubjectPublicKeyInfo, as returned by
+	// SPKIPin, optionally prefixed with "sha256/"; listing both the current
+	// and the next key allows it to be rotated. The route sends its requests
+	// through a transport of its own.
+	TLSPins []string `json:",omitempty"`
+	// OutboundProxy, when set, replaces the handler's OutboundProxy for this
+	// route.
+	OutboundProxy string `json:",omitempty"`
+	// ProxyProtocol, when 1 or 2, begins each connection to the route's
+	// endpoints with a PROXY protocol header of that version carrying the
+	// client's address and the address it connected to. Since each connection
+	// then belongs to a single client, connections to these endpoints are not
+	// reused. It cannot be combined with an OutboundProxy, the route's or the
+	// handler's, and does not apply to websocket routes.
+	ProxyProtocol int `json:",omitempty"`
+	// MaxConnsPerUpstream, when set, overrides the handler's
+	// MaxConnsPerUpstream for this route, whose requests are then sent
+	// through a transport of its own and so count only against the route's
+	// limit.
+	//
+	// A route's own transport, whichever setting calls for it, is built from
+	// the handler's transport when the route first sends a request and shared
+	// by all of its requests. Its idle connections are closed when the route
+	// is removed or replaced, including by Reload.
+	MaxConnsPerUpstream int `json:",omitempty"`
+
+	// MaxRetries is the number of times a request is sent again after the
+	// upstream cannot be reached or answers 429 Too Many Requests or 503
+	// Service Unavailable. A request with a body is only retried when the
+	// whole body fits within the handler's BufferBodyBytes. Requests whose
+	// methods are not idempotent are only retried after a failed attempt
+	// when it failed before reaching the upstream or the client sent an
+	// Idempotency-Key.
+	MaxRetries int `json:",omitempty"`
+	// MinRetryBudget, when set, skips retries which would begin with less than
+	// that long left before the request context's deadline, as they would add
+	// load upstream with little chance of completing.
+	MinRetryBudget time.Duration `json:",omitempty"`
+	// MaxRetryDelay bounds the Retry-After a retry waits for after a 429 or
+	// 503, and defaults to DefaultMaxRetryDelay. The response is relayed as-is
+	// when the wait would be longer, or would outlast the request context's
+	// deadline.
+	MaxRetryDelay time.Duration `json:",omitempty"`
+	// RetryBackoff is the wait before retrying a failed attempt, doubled for
+	// each further attempt up to MaxRetryDelay and jittered, and defaults to
+	// DefaultRetryBackoff.
+	RetryBackoff time.Duration `json:",omitempty"`
+	// RequireIdempotencyKey, when set, only retries requests whose methods are
+	// not idempotent, such as POST, when the client sent an Idempotency-Key
+	// header, so that the upstream can recognize a request it has already
+	// processed.
+	RequireIdempotencyKey bool `json:",omitempty"`
+	// AttemptTimeout, when set, bounds each request sent upstream, including
+	// the transfer of its response. An attempt never outlasts the request
+	// context's deadline, so near the deadline it is shortened to the time
+	// left. An attempt which times out may be retried, and is answered with
+	// 504 Gateway Timeout when it is not.
+	AttemptTimeout time.Duration `json:",omitempty"`
+	// HedgeDelay, when set on a route with several Endpoints, sends a second
+	// copy of an idempotent request to the next endpoint in rotation if no
+	// response has arrived after the delay. Whichever response arrives first
+	// is relayed and the other request is canceled.
+	HedgeDelay time.Duration `json:",omitempty"`
+	// IdleTimeout, when set, closes a websocket through the route once no data
+	// has passed in either direction for that long, taking precedence over the
+	// handler's TunnelIdleTimeout. It likewise aborts a response, such as a
+	// stream of server-sent events, once neither its body nor the request's
+	// has carried data for that long after the response began; the wait for
+	// the response's headers is bounded by ResponseHeaderTimeout instead.
+	// Neither limits the total time of a transfer which keeps making
+	// progress. A response cut short is aborted, so the client does not
+	// mistake it for a complete one.
+	IdleTimeout time.Duration `json:",omitempty"`
+
+	// SlowStart, when set on a route with several Endpoints, warms up
+	// endpoints added to the route, or readmitted by its OutlierDetection,
+	// over the given duration: their share of requests starts at a tenth of
+	// that of the other endpoints and grows linearly to an equal share. The
+	// endpoints of a route passed to New are considered warm.
+	SlowStart time.Duration `json:",omitempty"`
+	// HashKey, when set on a route with several Endpoints, balances requests
+	// by consistent hashing in place of rotation: requests whose HashKey
+	// returns the same key are sent to the same endpoint, and adding or
+	// removing an endpoint only moves the keys which belong to it. Requests
+	// with an empty key are sent to the endpoints in rotation. It cannot be
+	// combined with SlowStart or HedgeDelay.
+	HashKey func(*http.Request) string `json:"-"`
+	// HashReplicas is the number of points each endpoint has on the hash ring
+	// of HashKey, 100 by default; more points spread keys more evenly.
+	HashReplicas int `json:",omitempty"`
+	// OutlierDetection, when set on a route with several Endpoints, passes
+	// over endpoints whose recent requests fail too often or respond too
+	// slowly.
+	OutlierDetection *OutlierDetection `json:",omitempty"`
+
+	// EndpointSelector, when set on a route with several Endpoints, chooses
+	// the endpoint of each request in place of rotation, for policies such as
+	// picking by a region header. It is given a copy of the endpoints and must
+	// return one of them. A request for which it fails, or returns any other
+	// URL, is answered with 503 Service Unavailable and the error reported
+	// wraps ErrEndpointSelection. It cannot be combined with HashKey,
+	// SlowStart, OutlierDetection or HedgeDelay.
+	EndpointSelector func(*http.Request, []*url.URL) (*url.URL, error) `json:"-"`
+
+	// CookieJar, when set, keeps the cookies the route's endpoints set, as a
+	// browser would, and sends them with later requests through the route to
+	// the host which set them until they expire. This lets clients which keep
+	// no state use an upstream which requires a session cookie. The jar is
+	// shared by every client of the route and is emptied when a change to the
+	// routing replaces the route. It does not apply to websocket routes.
+	CookieJar bool `json:",omitempty"`
+	// CookieJarPassthrough relays the cookies kept by CookieJar to clients,
+	// from whose responses they are otherwise removed.
+	CookieJarPassthrough bool `json:",omitempty"`
+
+	// ContextHeaders set headers of the route's upstream requests from values
+	// which middleware in front of the handler stored in the client request's
+	// context. They are set before the Director is called.
+	ContextHeaders []ContextHeader `json:"-"`
+
+	// Options sets how the route serves OPTIONS requests, which it otherwise
+	// forwards upstream. OPTIONS requests the route answers itself match it
+	// even when its Methods do not include OPTIONS, and are answered before
+	// any JWT is checked, since browsers send preflight requests without
+	// credentials.
+	Options OptionsPolicy `json:",omitempty"`
+	// OptionsAllow lists the methods in the Allow header of the answer under
+	// OptionsAnswerLocally, which otherwise lists the route's Methods and
+	// OPTIONS.
+	OptionsAllow []string `json:",omitempty"`
+	// CORS sets the route's CORSPolicy, which OptionsCORSPreflight requires.
+	CORS *CORSPolicy `json:",omitempty"`
+
+	// Host, when set, restricts the route to requests for that host, matched
+	// without regard to case or port. A Host whose leftmost label is "*", such
+	// as "*.preview.example.com", matches any single label in its place, but
+	// neither the domain itself nor deeper subdomains; a wildcard anywhere
+	// else is invalid. Routes with the same Path but different Hosts may
+	// coexist, though SetEndpoint and RemoveRoute address the first of them
+	// and RemoveRouteRule is needed to address the others.
+	Host string `json:",omitempty"`
+	// SubdomainHeader names a header which carries the label the wildcard of
+	// Host matched to the upstream, and TemplateFromSubdomain makes it
+	// available to an EndpointTemplate.
+	SubdomainHeader string `json:",omitempty"`
+
+	// Labels, such as the team owning the route, describe the route to those
+	// reading the access log, to the Observer, which finds them in
+	// Observation.Labels, and to code given the route's requests, through
+	// RouteLabels. Label names must be tokens and values must not contain
+	// control characters. The labels are copied when the route is registered,
+	// and Routes returns copies of them, so they cannot change afterwards.
+	Labels map[string]string `json:",omitempty"`
 }
 
 type validRouteRule struct {
 	RouteRule
-	EndpointURL *url.URL
+	EndpointURL       *url.URL
+	EndpointURLs      []*url.URL
+	SplitEndpointURL  *url.URL
+	CanaryEndpointURL *url.URL
+	expiresAt         time.Time
+
+	outboundProxyURL *url.URL
+	client           *http.Client
+	transport        *routeTransport
+	rotation         *atomic.Uint64
+	outliers         *outlierDetector
+	slowStart        *slowStart
+	hashRing         *hashRing
+	jar              http.CookieJar
+	tlsPins          [][]byte
+	acceptTypes      []string
+	contentTypes     []string
+	panics           *callbackPanics
+	corsOrigins      []string
+	labelText        string
 }
 
 var validSchemes = map[string]struct{}{
-	"ws":   struct{}{},
-	"http": struct{}{},
+	"ws":    struct{}{},
+	"http":  struct{}{},
+	"https": struct{}{},
 }
 
 func (route RouteRule) validate() (*validRouteRule, error) {
 	if len(route.Path) == 0 {
 		return nil, fmt.Errorf("path is empty")
 	}
-	endpointURL, err := url.Parse(route.Endpoint)
+	var endpointURLs []*url.URL
+	var err error
+	if len(route.EndpointTemplate) > 0 {
+		var endpointURL *url.URL
+		endpointURL, err = parseEndpointTemplate(route)
+		endpointURLs = []*url.URL{endpointURL}
+	} else {
+		endpointURLs, err = parseEndpoints(route.Endpoint, route.Endpoints)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("parsing endpoint: %s", err.Error())
+		return nil, err
+	}
+	if route.ForceHTTPS {
+		for index, endpointURL := range endpointURLs {
+			endpointURLs[index] = upgradeToHTTPS(endpointURL)
+		}
+	}
+	validRoute := validRouteRule{
+		RouteRule:    route,
+		EndpointURL:  endpointURLs[0],
+		EndpointURLs: endpointURLs,
+		panics:       &callbackPanics{},
+	}
+	if len(endpointURLs) > 1 {
+		validRoute.rotation = new(atomic.Uint64)
+	}
+	if len(route.SplitEndpoint) > 0 {
+		validRoute.SplitEndpointURL, err = parseEndpoint(route.SplitEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("split endpoint: %s", err.Error())
+		}
+		if route.ForceHTTPS {
+			validRoute.SplitEndpointURL = upgradeToHTTPS(validRoute.SplitEndpointURL)
+		}
+		if route.SplitRatio < 0 || route.SplitRatio > 1 {
+			return nil, fmt.Errorf("split ratio %v is not between 0 and 1", route.SplitRatio)
+		}
+	}
+	if len(route.RewriteTo) > 0 && len(route.RewriteFrom) == 0 {
+		return nil, fmt.Errorf("path rewrite target set without a prefix to rewrite")
+	}
+	if len(route.RewriteFrom) > 0 && route.RewriteFrom[0] != '/' {
+		return nil, fmt.Errorf("path rewrite prefix %q must begin with /", route.RewriteFrom)
+	}
+	for from, to := range route.StatusMapping {
+		if !validStatus(from) || !validMappedStatus(to) {
+			return nil, fmt.Errorf("invalid status mapping %d -> %d", from, to)
+		}
+	}
+	for _, method := range route.Methods {
+		if !validToken(method) {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+	}
+	for _, method := range route.AllowedMethods {
+		if !validToken(method) {
+			return nil, fmt.Errorf("invalid method %q in allowed methods", method)
+		}
+	}
+	validRoute.acceptTypes, err = parseMediaTypes(route.Accept)
+	if err != nil {
+		return nil, fmt.Errorf("accept: %s", err.Error())
+	}
+	validRoute.contentTypes, err = parseMediaTypes(route.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("content type: %s", err.Error())
+	}
+	if err := validateHeaderCase(route.RequestHeaderCase); err != nil {
+		return nil, err
+	}
+	if err := validateHeaderCase(route.ResponseHeaderCase); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(route.Labels); err != nil {
+		return nil, err
+	}
+	validRoute.Labels = maps.Clone(route.Labels)
+	validRoute.labelText = formatLabels(route.Labels)
+	if err := route.validateOptions(); err != nil {
+		return nil, err
+	}
+	if route.CORS != nil {
+		if validRoute.corsOrigins, err = route.CORS.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if route.BufferResponses < 0 {
+		return nil, fmt.Errorf("response buffer size is negative")
+	}
+	if route.BufferResponses > 0 && route.WrapResponseBody != nil {
+		return nil, fmt.Errorf("buffered responses cannot be combined with WrapResponseBody")
+	}
+	if route.TransformBody != nil && route.TransformBodyBytes <= 0 {
+		return nil, fmt.Errorf("body transform requires a positive TransformBodyBytes")
+	}
+	if route.CompressRequests < 0 {
+		return nil, fmt.Errorf("request compression threshold is negative")
+	}
+	if route.JWT != nil {
+		if err := route.JWT.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if route.HedgeDelay < 0 {
+		return nil, fmt.Errorf("hedge delay is negative")
+	}
+	if route.MaxRetries < 0 {
+		return nil, fmt.Errorf("max retries is negative")
+	}
+	if route.MinRetryBudget < 0 || route.MaxRetryDelay < 0 || route.RetryBackoff < 0 || route.AttemptTimeout < 0 {
+		return nil, fmt.Errorf("retry budget, delay, backoff and attempt timeout must not be negative")
+	}
+	if (route.MinRetryBudget > 0 || route.MaxRetryDelay > 0 || route.RetryBackoff > 0 || route.RequireIdempotencyKey) && route.MaxRetries == 0 {
+		return nil, fmt.Errorf("retry budget, delay, backoff and idempotency key require max retries")
+	}
+	if route.OutlierDetection != nil {
+		if len(route.Endpoints) < 2 {
+			return nil, fmt.Errorf("outlier detection requires several endpoints")
+		}
+		if err := route.OutlierDetection.validate(); err != nil {
+			return nil, err
+		}
+		validRoute.outliers = newOutlierDetector(*route.OutlierDetection, route.Endpoints)
+	}
+	if route.SlowStart < 0 {
+		return nil, fmt.Errorf("slow start is negative")
+	}
+	if route.SlowStart > 0 {
+		if len(route.Endpoints) < 2 {
+			return nil, fmt.Errorf("slow start requires several endpoints")
+		}
+		validRoute.slowStart = newSlowStart(route.SlowStart, len(route.Endpoints))
+		if validRoute.outliers != nil {
+			validRoute.outliers.readmitted = validRoute.slowStart.restart
+		}
+	}
+	if route.HashReplicas < 0 {
+		return nil, fmt.Errorf("hash replicas is negative")
+	}
+	if route.HashKey != nil {
+		switch {
+		case len(route.Endpoints) < 2:
+			return nil, fmt.Errorf("consistent hashing requires several endpoints")
+		case route.SlowStart > 0:
+			return nil, fmt.Errorf("consistent hashing cannot be combined with slow start")
+		case route.HedgeDelay > 0:
+			return nil, fmt.Errorf("consistent hashing cannot be combined with hedging")
+		}
+		validRoute.hashRing = newHashRing(validRoute.EndpointURLs, route.HashReplicas)
+	}
+	if route.EndpointSelector != nil {
+		switch {
+		case len(route.Endpoints) < 2:
+			return nil, fmt.Errorf("endpoint selector requires several endpoints")
+		case route.HashKey != nil || route.SlowStart > 0 || route.OutlierDetection != nil:
+			return nil, fmt.Errorf("endpoint selector cannot be combined with hashing, slow start or outlier detection")
+		case route.HedgeDelay > 0:
+			return nil, fmt.Errorf("endpoint selector cannot be combined with hedging")
+		}
+	}
+	if route.CookieJar && validRoute.EndpointURL.Scheme == "ws" {
+		return nil, fmt.Errorf("cookie jar is not supported for websocket routes")
+	}
+	if route.CookieJarPassthrough && !route.CookieJar {
+		return nil, fmt.Errorf("cookie jar passthrough requires a cookie jar")
+	}
+	validRoute.jar = newRouteCookieJar(&route)
+	if route.Host != "" {
+		route.Host = strings.TrimSuffix(strings.ToLower(route.Host), ".")
+		validRoute.Host = route.Host
+		if err := validateHostPattern(route.Host); err != nil {
+			return nil, err
+		}
+	}
+	if route.SubdomainHeader != "" && !strings.HasPrefix(route.Host, "*.") {
+		return nil, fmt.Errorf("subdomain header requires a wildcard host")
+	}
+	for index := range route.ContextHeaders {
+		if err := route.ContextHeaders[index].validate(); err != nil {
+			return nil, err
+		}
+	}
+	if route.MaxConnsPerUpstream < 0 {
+		return nil, fmt.Errorf("max connections per upstream is negative")
+	}
+	if route.IdleTimeout < 0 {
+		return nil, fmt.Errorf("idle timeout is negative")
+	}
+	if route.ResponseHeaderTimeout < 0 {
+		return nil, fmt.Errorf("response header timeout is negative")
+	}
+	if route.MaxResponseHeaderBytes < 0 || route.MaxResponseHeaders < 0 {
+		return nil, fmt.Errorf("response header limits must not be negative")
+	}
+	validRoute.outboundProxyURL, err = parseOutboundProxy(route.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	if route.DialNetwork != "" {
+		if _, ok := dialNetworks[route.DialNetwork]; !ok {
+			return nil, fmt.Errorf("unsupported dial network %q", route.DialNetwork)
+		}
+		if validRoute.EndpointURL.Scheme == "ws" {
+			return nil, fmt.Errorf("dial network is not supported for websocket routes")
+		}
+	}
+	if route.ProxyProtocol != 0 {
+		if route.ProxyProtocol != 1 && route.ProxyProtocol != 2 {
+			return nil, fmt.Errorf("unsupported proxy protocol version %d", route.ProxyProtocol)
+		}
+		if validRoute.EndpointURL.Scheme == "ws" {
+			return nil, fmt.Errorf("proxy protocol is not supported for websocket routes")
+		}
+		if validRoute.outboundProxyURL != nil {
+			return nil, fmt.Errorf("proxy protocol cannot be sent through an outbound proxy")
+		}
+	}
+	if len(route.TLSPins) > 0 {
+		if validRoute.EndpointURL.Scheme != "https" {
+			return nil, fmt.Errorf("tls pins require an https endpoint")
+		}
+		if validRoute.tlsPins, err = parseTLSPins(route.TLSPins); err != nil {
+			return nil, err
+		}
+	}
+	if len(route.TLSServerName) > 0 && validRoute.EndpointURL.Scheme != "https" {
+		return nil, fmt.Errorf("tls server name requires an https endpoint")
+	}
+	if err := validRoute.validateWarmup(); err != nil {
+		return nil, err
+	}
+	if route.TTL < 0 {
+		return nil, fmt.Errorf("ttl is negative")
+	}
+	if len(route.CanaryEndpoint) > 0 {
+		validRoute.CanaryEndpointURL, err = parseEndpoint(route.CanaryEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("canary endpoint: %s", err.Error())
+		}
+		if route.ForceHTTPS {
+			validRoute.CanaryEndpointURL = upgradeToHTTPS(validRoute.CanaryEndpointURL)
+		}
+		if route.CanaryMatcher == nil {
+			return nil, fmt.Errorf("canary endpoint requires a canary matcher")
+		}
+	}
+	return &validRoute, nil
+}
+
+// parseEndpoints parses a route's single endpoint or, when it has several, its
+// list of endpoints.
+func parseEndpoints(endpoint string, endpoints []string) ([]*url.URL, error) {
+	if len(endpoints) == 0 {
+		endpointURL, err := parseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return []*url.URL{endpointURL}, nil
+	}
+	if len(endpoint) > 0 {
+		return nil, fmt.Errorf("endpoint and endpoints are mutually exclusive")
+	}
+	endpointURLs := make([]*url.URL, len(endpoints))
+	for index, endpoint := range endpoints {
+		endpointURL, err := parseEndpoint(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %d: %s", index, err.Error())
+		}
+		if index > 0 && endpointURL.Scheme != endpointURLs[0].Scheme {
+			return nil, fmt.Errorf("endpoints must share a scheme")
+		}
+		endpointURLs[index] = endpointURL
+	}
+	return endpointURLs, nil
+}
+
+// allowsMethod reports whether the route serves requests using method.
+func (route *validRouteRule) allowsMethod(method string) bool {
+	return len(route.Methods) == 0 || slices.Contains(route.methods(), method)
+}
+
+// methods returns the route's Methods, with HEAD added when they list GET
+// but not HEAD.
+func (route *validRouteRule) methods() []string {
+	methods := slices.Clone(route.Methods)
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	return methods
+}
+
+// validToken reports whether value is a non-empty HTTP token, as methods and
+// header names must be.
+func validToken(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, char := range value {
+		if char <= ' ' || char >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", char) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchKey identifies the requests route matches: routes with the same key
+// match the same requests, so only the first of them is ever used. It is also
+// the identity by which AddRoute and RemoveRouteRule tell routes apart.
+func (route *RouteRule) matchKey() string {
+	sorted := func(values []string, normalize func(string) string) string {
+		normalized := make([]string, len(values))
+		for index, value := range values {
+			normalized[index] = normalize(value)
+		}
+		sort.Strings(normalized)
+		return strings.Join(normalized, ",")
+	}
+	same := func(value string) string { return value }
+	return strings.Join([]string{
+		strings.TrimSuffix(strings.ToLower(route.Host), ".") + route.Path,
+		sorted(route.Methods, same),
+		sorted(route.Accept, strings.ToLower),
+		sorted(route.ContentType, strings.ToLower),
+	}, " ")
+}
+
+// rule returns a copy of the RouteRule route was registered with, whose
+// slices, maps and settings are its own, so that changing it cannot affect
+// the route in effect.
+func (route *validRouteRule) rule() RouteRule {
+	rule := route.RouteRule
+	rule.Methods = slices.Clone(rule.Methods)
+	rule.AllowedMethods = slices.Clone(rule.AllowedMethods)
+	rule.Accept = slices.Clone(rule.Accept)
+	rule.ContentType = slices.Clone(rule.ContentType)
+	rule.Endpoints = slices.Clone(rule.Endpoints)
+	rule.StatusMapping = maps.Clone(rule.StatusMapping)
+	rule.StatusBodies = maps.Clone(rule.StatusBodies)
+	rule.RequestHeaderCase = slices.Clone(rule.RequestHeaderCase)
+	rule.ResponseHeaderCase = slices.Clone(rule.ResponseHeaderCase)
+	rule.TLSPins = slices.Clone(rule.TLSPins)
+	rule.ContextHeaders = slices.Clone(rule.ContextHeaders)
+	rule.OptionsAllow = slices.Clone(rule.OptionsAllow)
+	rule.Labels = maps.Clone(rule.Labels)
+	if rule.JWT != nil {
+		jwt := *rule.JWT
+		jwt.Algorithms = slices.Clone(jwt.Algorithms)
+		jwt.ClaimHeaders = maps.Clone(jwt.ClaimHeaders)
+		rule.JWT = &jwt
+	}
+	if rule.OutlierDetection != nil {
+		outlierDetection := *rule.OutlierDetection
+		rule.OutlierDetection = &outlierDetection
+	}
+	if rule.CORS != nil {
+		cors := *rule.CORS
+		cors.AllowOrigins = slices.Clone(cors.AllowOrigins)
+		cors.AllowMethods = slices.Clone(cors.AllowMethods)
+		cors.AllowHeaders = slices.Clone(cors.AllowHeaders)
+		rule.CORS = &cors
+	}
+	return rule
+}
+
+// nextEndpoint returns the route's endpoints in rotation.
+func (route *validRouteRule) nextEndpoint() *url.URL {
+	if route.rotation == nil {
+		return route.EndpointURL
+	}
+	index := route.rotation.Add(1) - 1
+	return route.EndpointURLs[index%uint64(len(route.EndpointURLs))]
+}
+
+// target describes the route's endpoints for logging.
+func (route *RouteRule) target() string {
+	if len(route.EndpointTemplate) > 0 {
+		return route.EndpointTemplate
+	}
+	if len(route.Endpoints) > 0 {
+		return strings.Join(route.Endpoints, ", ")
+	}
+	return route.Endpoint
+}
+
+// parseEndpoint parses and validates the URL of a backend host. The shorthand
+// forms ":3001" and "localhost:3001" are accepted for http://localhost:3001.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	endpointURL, err := url.Parse(expandEndpointShorthand(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
 	}
 	if len(endpointURL.Host) == 0 {
-		return nil, fmt.Errorf("host is empty")
+		return nil, fmt.Errorf("host is empty: %q parsed as scheme %q, opaque %q, path %q",
+			endpoint, endpointURL.Scheme, endpointURL.Opaque, endpointURL.Path)
 	}
 	if endpointURL.Scheme == "" {
 		return nil, fmt.Errorf("protocol scheme is empty")
@@ -40,12 +842,71 @@ func (route RouteRule) validate() (*validRouteRule, error) {
 	if _, ok := validSchemes[endpointURL.Scheme]; !ok {
 		return nil, fmt.Errorf("unsupported scheme: %s", endpointURL.Scheme)
 	}
-	validRoute := validRouteRule{
-		RouteRule: RouteRule{
-			Path:     route.Path,
-			Endpoint: route.Endpoint,
-		},
-		EndpointURL: endpointURL,
+	if strings.Contains(endpointURL.Hostname(), ":") && !strings.HasPrefix(endpointURL.Host, "[") {
+		return nil, fmt.Errorf("invalid host %q: IPv6 literals must be enclosed in brackets", endpointURL.Host)
 	}
-	return &validRoute, nil
+	if port := endpointURL.Port(); port != "" {
+		number, err := strconv.Atoi(port)
+		if err != nil || number < 1 || number > 65535 {
+			return nil, fmt.Errorf("invalid port %q in host %q", port, endpointURL.Host)
+		}
+	}
+	if err := toASCIIHost(endpointURL); err != nil {
+		return nil, err
+	}
+	return endpointURL, nil
+}
+
+// expandEndpointShorthand rewrites ":port" and "localhost:port" to a full
+// http URL on localhost. Any other value is returned unchanged.
+func expandEndpointShorthand(endpoint string) string {
+	for _, prefix := range []string{":", "localhost:"} {
+		port := strings.TrimPrefix(endpoint, prefix)
+		if port != endpoint && len(port) > 0 && isDigits(port) {
+			return "http://localhost:" + port
+		}
+	}
+	return endpoint
+}
+
+func isDigits(value string) bool {
+	for _, character := range value {
+		if character < '0' || character > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// toASCIIHost converts an internationalized hostname to its punycode form so
+// that the name which is dialed and sent in the Host header is plain ASCII, as
+// RFC 7230 requires.
+func toASCIIHost(endpointURL *url.URL) error {
+	hostname := endpointURL.Hostname()
+	if isASCII(hostname) {
+		return nil
+	}
+	asciiHostname, err := idna.Lookup.ToASCII(hostname)
+	if err != nil {
+		return fmt.Errorf("invalid internationalized hostname %q: %s", hostname, err.Error())
+	}
+	port := endpointURL.Port()
+	endpointURL.Host = asciiHostname
+	if port != "" {
+		endpointURL.Host = net.JoinHostPort(asciiHostname, port)
+	}
+	return nil
+}
+
+func isASCII(value string) bool {
+	for index := 0; index < len(value); index++ {
+		if value[index] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func (route *validRouteRule) expired(now time.Time) bool {
+	return !route.expiresAt.IsZero() && !now.Before(route.expiresAt)
 }
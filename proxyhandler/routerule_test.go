@@ -134,3 +134,86 @@ func TestValidateVerifiesEndpoint(t *testing.T) {
 		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
 	}
 }
+
+func TestValidateHandlesIPv6Literals(t *testing.T) {
+	validEndpoints := []string{"http://[::1]:8080", "http://[fd00::5]:9000", "ws://[::1]", "http://[fe80::1%25eth0]:80"}
+	for _, endpoint := range validEndpoints {
+		validRoute, err := RouteRule{Path: "/", Endpoint: endpoint}.validate()
+		if err != nil {
+			t.Errorf("expected %s to be valid\nreceived: %v", endpoint, err.Error())
+			continue
+		}
+		if validRoute.EndpointURL.Host[0] != '[' {
+			t.Errorf("expected brackets to be preserved\nreceived: %v", validRoute.EndpointURL.Host)
+		}
+	}
+
+	invalidEndpoints := map[string]string{
+		"http://fd00::5":        "enclosed in brackets",
+		"http://[fd00::zz]:80":  "parsing endpoint",
+		"http://[::1]:99999":    "invalid port",
+		"http://hostname:70000": "invalid port",
+	}
+	for endpoint, expectedError := range invalidEndpoints {
+		_, err := RouteRule{Path: "/", Endpoint: endpoint}.validate()
+		if err == nil {
+			t.Errorf("expected %s to be invalid", endpoint)
+			continue
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
+
+func TestValidateConvertsInternationalizedHostnames(t *testing.T) {
+	validRoute, err := RouteRule{Path: "/", Endpoint: "http://Bücher.example:8080"}.validate()
+	if err != nil {
+		t.Fatalf("expected internationalized hostname to be valid\nreceived: %v", err.Error())
+	}
+	expectedHost := "xn--bcher-kva.example:8080"
+	if validRoute.EndpointURL.Host != expectedHost {
+		t.Errorf("unexpected host\nexpected: %v\nreceived: %v", expectedHost, validRoute.EndpointURL.Host)
+	}
+
+	expectedError := "invalid internationalized hostname"
+	_, err = RouteRule{Path: "/", Endpoint: "http://bü_cher.example"}.validate()
+	if err == nil {
+		t.Fatal("expected hostname failing IDNA processing to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestValidateExpandsLocalhostShorthand(t *testing.T) {
+	for _, endpoint := range []string{":3001", "localhost:3001"} {
+		validRoute, err := RouteRule{Path: "/api", Endpoint: endpoint}.validate()
+		if err != nil {
+			t.Errorf("expected %s to be valid\nreceived: %v", endpoint, err.Error())
+			continue
+		}
+		if validRoute.EndpointURL.String() != "http://localhost:3001" {
+			t.Errorf("unexpected endpoint for %s\nexpected: %v\nreceived: %v", endpoint, "http://localhost:3001", validRoute.EndpointURL.String())
+		}
+		if validRoute.Endpoint != endpoint {
+			t.Errorf("expected configured endpoint to be preserved\nexpected: %v\nreceived: %v", endpoint, validRoute.Endpoint)
+		}
+	}
+
+	invalidEndpoints := map[string]string{
+		"::::":          "parsing endpoint",
+		"localhost:abc": "host is empty: \"localhost:abc\" parsed as scheme \"localhost\", opaque \"abc\"",
+		"example.com":   "host is empty: \"example.com\" parsed as scheme \"\", opaque \"\", path \"example.com\"",
+	}
+	for endpoint, expectedError := range invalidEndpoints {
+		_, err := RouteRule{Path: "/api", Endpoint: endpoint}.validate()
+		if err == nil {
+			t.Errorf("expected %s to be invalid", endpoint)
+			continue
+		}
+		if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+var (
+	errRouteNotFound = errors.New("route not found")
+	errRouteExists   = errors.New("route already exists")
+)
+
+// routeTable is an immutable set of routes. Changes to the routing of a
+// ProxyHandler are made by building a new routeTable and swapping it in, so
+// each request observes a single consistent table.
+type routeTable struct {
+	defaultRoute *validRouteRule
+	routes       []*validRouteRule
+}
+
+func (table *routeTable) indexOf(path string) int {
+	for index, route := range table.routes {
+		if route.Path == path {
+			return index
+		}
+	}
+	return -1
+}
+
+// indexOfRule returns the index of the route which matches the same requests
+// as rule, or -1 if there is none.
+func (table *routeTable) indexOfRule(rule *RouteRule) int {
+	key := rule.matchKey()
+	for index, route := range table.routes {
+		if route.matchKey() == key {
+			return index
+		}
+	}
+	return -1
+}
+
+// updateRoutes applies update to a copy of the current routes and installs the
+// routes it returns, reporting the changes made on behalf of label. Updates
+// are serialized so that none are lost to concurrent callers.
+func (handler *ProxyHandler) updateRoutes(label string, update func(routes []*validRouteRule) ([]*validRouteRule, error)) error {
+	handler.routesMutex.Lock()
+	defer handler.routesMutex.Unlock()
+	current := handler.routes.Load()
+	routes := make([]*validRouteRule, len(current.routes))
+	copy(routes, current.routes)
+	routes, err := update(routes)
+	if err != nil {
+		return err
+	}
+	handler.storeRoutes(label, &routeTable{defaultRoute: current.defaultRoute, routes: routes})
+	return nil
+}
+
+// storeRoutes installs table, warms up the endpoints it adds, drains
+// connections to the hosts it no longer refers to, forgets the error budgets
+// of the routes it removes and reports how it differs from the table it
+// replaces. It must be called with routesMutex held.
+func (handler *ProxyHandler) storeRoutes(label string, table *routeTable) {
+	handler.startSlowStart(handler.routes.Load(), table)
+	previous := handler.routes.Swap(table)
+	handler.transports.release(previous, table)
+	handler.warmUp(previous, table)
+	handler.drainRemovedHosts(previous, table)
+	handler.errorBudget.forget(previous, table)
+	if handler.configuration.RouteChangeHook == nil {
+		return
+	}
+	now := handler.now()
+	for _, change := range diffRoutes(previous, table) {
+		change.Label, change.Time = label, now
+		handler.configuration.RouteChangeHook(change)
+	}
+}
+
+// withEndpoint validates a copy of route directed to endpoint, or to
+// endpoints when there are several. The copy keeps the expiry of the original.
+func (handler *ProxyHandler) withEndpoint(route *validRouteRule, endpoint string, endpoints []string) (*validRouteRule, error) {
+	updated := route.RouteRule
+	updated.Endpoint = endpoint
+	updated.Endpoints = endpoints
+	validRoute, err := handler.configuration.validateRoute(updated, handler.transport)
+	if err != nil {
+		return nil, err
+	}
+	validRoute.expiresAt = route.expiresAt
+	return validRoute, nil
+}
+
+// startExpiry stamps routes with a TTL with the time they expire.
+func (handler *ProxyHandler) startExpiry(routes []*validRouteRule) {
+	now := handler.now()
+	for _, route := range routes {
+		if route.TTL > 0 {
+			route.expiresAt = now.Add(route.TTL)
+		}
+	}
+}
+
+// expireRoute removes route from the table and notifies its OnExpire
+// callback. Only the first caller to observe the expiry removes it.
+func (handler *ProxyHandler) expireRoute(route *validRouteRule) {
+	removed := false
+	handler.updateRoutes(expiryLabel, func(routes []*validRouteRule) ([]*validRouteRule, error) {
+		for index, candidate := range routes {
+			if candidate == route {
+				removed = true
+				return append(routes[:index], routes[index+1:]...), nil
+			}
+		}
+		return nil, errRouteNotFound
+	})
+	if !removed {
+		return
+	}
+	log.Printf("proxy: route %s expired", route.Path)
+	if route.OnExpire != nil {
+		route.OnExpire(route.rule())
+	}
+}
+
+// SetEndpoint directs the route registered for path to endpoint. The endpoint
+// is validated like those passed to New and the change is applied atomically:
+// requests which have already matched the route finish against the previous
+// endpoint while every later request uses the new one.
+func (handler *ProxyHandler) SetEndpoint(path, endpoint string) error {
+	return handler.setEndpoint("", path, endpoint)
+}
+
+func (handler *ProxyHandler) setEndpoint(label, path, endpoint string) error {
+	return handler.updateRoutes(label, func(routes []*validRouteRule) ([]*validRouteRule, error) {
+		index := (&routeTable{routes: routes}).indexOf(path)
+		if index < 0 {
+			return nil, fmt.Errorf("no route for path %s", path)
+		}
+		updated, err := handler.withEndpoint(routes[index], endpoint, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint for %s: %s", path, err.Error())
+		}
+		routes[index] = updated
+		log.Printf("proxy: route %s -> %s", path, updated.Endpoint)
+		return routes, nil
+	})
+}
+
+// AddRoute validates route like those passed to New and appends it to the
+// route table, where it is matched after the existing routes. It fails if a
+// route with the same Path, Host, Methods, Accept and ContentType, which
+// would match the same requests, is already registered.
+func (handler *ProxyHandler) AddRoute(route RouteRule) error {
+	return handler.addRoute("", route)
+}
+
+func (handler *ProxyHandler) addRoute(label string, route RouteRule) error {
+	validRoute, err := handler.configuration.expandRoute(route)
+	if err != nil {
+		return fmt.Errorf("invalid RouteRule: %w", err)
+	}
+	return handler.updateRoutes(label, func(routes []*validRouteRule) ([]*validRouteRule, error) {
+		if (&routeTable{routes: routes}).indexOfRule(&route) >= 0 {
+			return nil, fmt.Errorf("%w for path %s", errRouteExists, validRoute.Host+validRoute.Path)
+		}
+		if err := prepareRouteClient(validRoute, handler.transport); err != nil {
+			return nil, fmt.Errorf("invalid RouteRule: %w", err)
+		}
+		handler.startExpiry([]*validRouteRule{validRoute})
+		log.Printf("proxy: added route %s -> %s", route.Path, route.target())
+		return append(routes, validRoute), nil
+	})
+}
+
+// RemoveRoute removes the route registered for path from the route table.
+// Requests which have already matched the route are unaffected.
+func (handler *ProxyHandler) RemoveRoute(path string) error {
+	return handler.removeRoute("", path)
+}
+
+func (handler *ProxyHandler) removeRoute(label, path string) error {
+	return handler.removeAt(label, path, func(table *routeTable) int {
+		return table.indexOf(path)
+	})
+}
+
+// RemoveRouteRule removes the route with the same Path, Host, Methods, Accept
+// and ContentType as route, which tells apart routes sharing a path. Other
+// fields of route are ignored.
+func (handler *ProxyHandler) RemoveRouteRule(route RouteRule) error {
+	return handler.removeRouteRule("", route)
+}
+
+func (handler *ProxyHandler) removeRouteRule(label string, route RouteRule) error {
+	return handler.removeAt(label, route.Host+route.Path, func(table *routeTable) int {
+		return table.indexOfRule(&route)
+	})
+}
+
+// removeAt removes the route find locates, which is described by name in
+// errors and the log.
+func (handler *ProxyHandler) removeAt(label, name string, find func(table *routeTable) int) error {
+	return handler.updateRoutes(label, func(routes []*validRouteRule) ([]*validRouteRule, error) {
+		index := find(&routeTable{routes: routes})
+		if index < 0 {
+			return nil, fmt.Errorf("%w for path %s", errRouteNotFound, name)
+		}
+		log.Printf("proxy: removed route %s", name)
+		return append(routes[:index], routes[index+1:]...), nil
+	})
+}
+
+// SwapEndpoints atomically exchanges the endpoints of the routes registered
+// for pathA and pathB.
+func (handler *ProxyHandler) SwapEndpoints(pathA, pathB string) error {
+	return handler.swapEndpoints("", pathA, pathB)
+}
+
+func (handler *ProxyHandler) swapEndpoints(label, pathA, pathB string) error {
+	return handler.updateRoutes(label, func(routes []*validRouteRule) ([]*validRouteRule, error) {
+		table := &routeTable{routes: routes}
+		indexA, indexB := table.indexOf(pathA), table.indexOf(pathB)
+		if indexA < 0 {
+			return nil, fmt.Errorf("no route for path %s", pathA)
+		}
+		if indexB < 0 {
+			return nil, fmt.Errorf("no route for path %s", pathB)
+		}
+		routeA, err := handler.withEndpoint(routes[indexA], routes[indexB].Endpoint, routes[indexB].Endpoints)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint for %s: %s", pathA, err.Error())
+		}
+		routeB, err := handler.withEndpoint(routes[indexB], routes[indexA].Endpoint, routes[indexA].Endpoints)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint for %s: %s", pathB, err.Error())
+		}
+		routes[indexA], routes[indexB] = routeA, routeB
+		log.Printf("proxy: route %s -> %s", pathA, routeA.target())
+		log.Printf("proxy: route %s -> %s", pathB, routeB.target())
+		return routes, nil
+	})
+}
+
+// Routes returns a copy of the RouteRules currently in effect, in matching
+// order.
+func (handler *ProxyHandler) Routes() []RouteRule {
+	table := handler.routes.Load()
+	now := handler.now()
+	routes := make([]RouteRule, 0, len(table.routes))
+	for _, route := range table.routes {
+		if !route.expired(now) {
+			routes = append(routes, route.rule())
+		}
+	}
+	return routes
+}
+
+// Reload atomically replaces the default route and route table with those in
+// config. The new routes are validated in full before any are applied, and
+// on error the existing table is kept. Settings other than DefaultRoute and
+// Routes are fixed when the ProxyHandler is created and are ignored.
+func (handler *ProxyHandler) Reload(config *Configuration) error {
+	return handler.reload("", config)
+}
+
+func (handler *ProxyHandler) reload(label string, config *Configuration) error {
+	reloaded := handler.configuration
+	reloaded.DefaultRoute = config.DefaultRoute
+	reloaded.Routes = config.Routes
+	defaultRouteURL, routes, err := reloaded.validateRoutes(handler.transport)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	handler.startExpiry(routes)
+
+	handler.routesMutex.Lock()
+	defer handler.routesMutex.Unlock()
+	handler.storeRoutes(label, &routeTable{
+		defaultRoute: &validRouteRule{
+			RouteRule:   RouteRule{Endpoint: config.DefaultRoute},
+			EndpointURL: defaultRouteURL,
+		},
+		routes: routes,
+	})
+	log.Printf("proxy: reloaded %d routes", len(routes))
+	return nil
+}
+
+// Snapshot is a copy of a ProxyHandler's routing which can later be passed to
+// Restore. It may be encoded as JSON, although callbacks such as Director are
+// not included in the encoding.
+type Snapshot struct {
+	DefaultRoute string
+	Routes       []RouteRule
+}
+
+// Snapshot captures the default route and route table currently in effect.
+func (handler *ProxyHandler) Snapshot() Snapshot {
+	return Snapshot{
+		DefaultRoute: handler.routes.Load().defaultRoute.Endpoint,
+		Routes:       handler.Routes(),
+	}
+}
+
+// Restore atomically returns the ProxyHandler to the routing captured in
+// snapshot, as Reload does.
+func (handler *ProxyHandler) Restore(snapshot Snapshot) error {
+	return handler.restore("", snapshot)
+}
+
+func (handler *ProxyHandler) restore(label string, snapshot Snapshot) error {
+	routes := make([]*RouteRule, len(snapshot.Routes))
+	for index := range snapshot.Routes {
+		route := snapshot.Routes[index]
+		routes[index] = &route
+	}
+	return handler.reload(label, &Configuration{DefaultRoute: snapshot.DefaultRoute, Routes: routes})
+}
@@ -0,0 +1,294 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetEndpointSwitchesAtomically(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	// responders build a new response per call so concurrent requests don't share a body
+	httpmock.RegisterResponder("GET", "http://blue/app", func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, "blue"), nil
+	})
+	httpmock.RegisterResponder("GET", "http://green/app", func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, "green"), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/app", Endpoint: "http://blue"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	var switched atomic.Bool
+	var wait sync.WaitGroup
+	errors := make(chan string, 800)
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 100; i++ {
+				startedAfterSwitch := switched.Load()
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest("GET", "/app", nil))
+				body := recorder.Body.String()
+				if body != "blue" && body != "green" {
+					errors <- "unexpected response: " + body
+				}
+				if startedAfterSwitch && body != "green" {
+					errors <- "request started after the switch reached " + body
+				}
+			}
+		}()
+	}
+	if err := h.SetEndpoint("/app", "http://green"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	switched.Store(true)
+	wait.Wait()
+	close(errors)
+	for message := range errors {
+		t.Error(message)
+	}
+}
+
+func TestSetEndpointValidatesEndpoint(t *testing.T) {
+	config := buildConfiguration()
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expectedError := "unsupported scheme"
+	err = h.SetEndpoint("/route1", "gopher://nowhere")
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+	expectedError = "no route for path /missing"
+	err = h.SetEndpoint("/missing", "http://somewhere")
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+	if endpoint := h.routes.Load().routes[0].Endpoint; endpoint != "http://endpoint.one" {
+		t.Errorf("expected failed updates to leave the route untouched\nreceived: %v", endpoint)
+	}
+}
+
+func TestSwapEndpoints(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://blue/live", httpmock.NewStringResponder(200, "blue"))
+	httpmock.RegisterResponder("GET", "http://green/staging", httpmock.NewStringResponder(200, "green"))
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/live", Endpoint: "http://green"},
+		&RouteRule{Path: "/staging", Endpoint: "http://blue"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if err := h.SwapEndpoints("/live", "/staging"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	for path, expected := range map[string]string{"/live": "blue", "/staging": "green"} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Body.String() != expected {
+			t.Errorf("unexpected upstream for %s\nexpected: %v\nreceived: %v", path, expected, recorder.Body.String())
+		}
+	}
+}
+
+func dispatchBodies(h *ProxyHandler, paths []string) []string {
+	bodies := make([]string, len(paths))
+	for index, path := range paths {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		bodies[index] = recorder.Body.String()
+	}
+	return bodies
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host+r.URL.Path), nil
+	})
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/billing", Endpoint: "http://billing"},
+		&RouteRule{Path: "/users", Endpoint: "http://users", SplitEndpoint: "http://users-next", SplitRatio: 0},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	paths := []string{"/billing/invoice", "/users/1", "/other"}
+	expectedRoutes := h.Routes()
+	expectedBodies := dispatchBodies(h, paths)
+
+	snapshot := h.Snapshot()
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("unable to encode snapshot: %s", err.Error())
+	}
+
+	h.SetEndpoint("/billing", "http://billing-v2")
+	err = h.Reload(&Configuration{
+		DefaultRoute: "http://elsewhere",
+		Routes:       []*RouteRule{&RouteRule{Path: "/", Endpoint: "http://catchall"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected reload error: %s", err.Error())
+	}
+	if reflect.DeepEqual(dispatchBodies(h, paths), expectedBodies) {
+		t.Fatal("expected mutations to change routing")
+	}
+
+	if err := h.Restore(snapshot); err != nil {
+		t.Fatalf("unexpected restore error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(h.Routes(), expectedRoutes) {
+		t.Errorf("unexpected routes after restore\nexpected: %v\nreceived: %v", expectedRoutes, h.Routes())
+	}
+	if bodies := dispatchBodies(h, paths); !reflect.DeepEqual(bodies, expectedBodies) {
+		t.Errorf("unexpected dispatch after restore\nexpected: %v\nreceived: %v", expectedBodies, bodies)
+	}
+
+	h.SetEndpoint("/billing", "http://billing-v2")
+	var decoded Snapshot
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("unable to decode snapshot: %s", err.Error())
+	}
+	if err := h.Restore(decoded); err != nil {
+		t.Fatalf("unexpected restore error: %s", err.Error())
+	}
+	if bodies := dispatchBodies(h, paths); !reflect.DeepEqual(bodies, expectedBodies) {
+		t.Errorf("unexpected dispatch after restoring decoded snapshot\nexpected: %v\nreceived: %v", expectedBodies, bodies)
+	}
+}
+
+func TestReloadKeepsRoutesWhenInvalid(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	expectedRoutes := h.Routes()
+	err = h.Reload(&Configuration{
+		DefaultRoute: "http://default",
+		Routes: []*RouteRule{
+			&RouteRule{Path: "/good", Endpoint: "http://good"},
+			&RouteRule{Path: "", Endpoint: "http://bad"},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected invalid reload to fail")
+	}
+	if !reflect.DeepEqual(h.Routes(), expectedRoutes) {
+		t.Errorf("expected routes to be kept\nexpected: %v\nreceived: %v", expectedRoutes, h.Routes())
+	}
+}
+
+func TestRouteExpiresAfterTTL(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	var expired []RouteRule
+	config := buildConfiguration()
+	config.DefaultRoute = "http://default"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/preview", Endpoint: "http://preview", TTL: time.Minute, OnExpire: func(route RouteRule) {
+			expired = append(expired, route)
+		}},
+		&RouteRule{Path: "/stable", Endpoint: "http://stable"},
+	}
+	now := time.Now()
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.now = func() time.Time { return now }
+
+	if bodies := dispatchBodies(h, []string{"/preview"}); bodies[0] != "preview" {
+		t.Errorf("expected route to match before expiry\nreceived: %v", bodies[0])
+	}
+
+	now = now.Add(2 * time.Minute)
+	if len(h.Routes()) != 1 {
+		t.Errorf("expected expired route to be omitted from Routes\nreceived: %v", h.Routes())
+	}
+	bodies := dispatchBodies(h, []string{"/preview", "/preview", "/stable"})
+	expectedBodies := []string{"default", "default", "stable"}
+	if !reflect.DeepEqual(bodies, expectedBodies) {
+		t.Errorf("unexpected dispatch after expiry\nexpected: %v\nreceived: %v", expectedBodies, bodies)
+	}
+	if len(expired) != 1 || expired[0].Path != "/preview" {
+		t.Errorf("expected expiry callback to fire once for /preview\nreceived: %v", expired)
+	}
+	if len(h.routes.Load().routes) != 1 {
+		t.Errorf("expected expired route to be removed from the table\nreceived: %v", len(h.routes.Load().routes))
+	}
+}
+
+func TestRoutesDoNotShareStateWithTheRouteTable(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:             "/api",
+			Methods:          []string{"GET"},
+			Accept:           []string{"application/json"},
+			Endpoints:        []string{"http://one", "http://two"},
+			StatusMapping:    map[int]int{502: 503},
+			StatusBodies:     map[int]string{502: "unavailable"},
+			ContextHeaders:   []ContextHeader{{Header: "X-Tenant", Key: contextKey("tenant")}},
+			Options:          OptionsAnswerLocally,
+			OptionsAllow:     []string{"GET", "OPTIONS"},
+			CORS:             &CORSPolicy{AllowOrigins: []string{"https://app.example.com"}},
+			OutlierDetection: &OutlierDetection{Window: 5, MaxErrorRate: 0.5, BaseEjectionTime: time.Minute},
+			Labels:           map[string]string{"team": "payments"},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	expected := h.Routes()
+
+	for _, rule := range []RouteRule{h.Routes()[0], h.Snapshot().Routes[0]} {
+		rule.Methods[0] = "POST"
+		rule.Accept[0] = "text/html"
+		rule.Endpoints[0] = "http://elsewhere"
+		rule.StatusMapping[502] = 200
+		rule.StatusBodies[502] = "fine"
+		rule.ContextHeaders[0].Header = "X-Other"
+		rule.OptionsAllow[0] = "DELETE"
+		rule.CORS.AllowOrigins[0] = "*"
+		rule.OutlierDetection.Window = 1
+		rule.Labels["team"] = "other"
+	}
+	if routes := h.Routes(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("expected the routes in effect to be unchanged\nexpected: %+v\nreceived: %+v", expected, routes)
+	}
+}
@@ -0,0 +1,64 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// routeTransport holds the client of a route which needs a transport of its
+// own. It is created with the route and the transport is built the first time
+// the route sends a request, so a route registration has at most one however
+// many requests race to use it, and it is released along with the route.
+type routeTransport struct {
+	once   sync.Once
+	client atomic.Pointer[http.Client]
+}
+
+// built returns the route's client, or nil when it has not been needed yet.
+func (transport *routeTransport) built() *http.Client {
+	if transport == nil {
+		return nil
+	}
+	return transport.client.Load()
+}
+
+// transportRegistry builds the transports of routes which need their own from
+// the handler's transport, and closes their idle connections once the routes
+// are removed.
+type transportRegistry struct {
+	base *http.Transport
+	// newTransport builds a route's transport; tests replace it to count
+	// the transports built
+	newTransport func(route *validRouteRule, base *http.Transport) *http.Transport
+}
+
+func newTransportRegistry(base http.RoundTripper) *transportRegistry {
+	baseTransport, _ := base.(*http.Transport)
+	return &transportRegistry{base: baseTransport, newTransport: newRouteTransport}
+}
+
+// client returns the client of route, which must have a routeTransport,
+// building its transport on first use.
+func (registry *transportRegistry) client(route *validRouteRule) *http.Client {
+	route.transport.once.Do(func() {
+		route.transport.client.Store(newClient(registry.newTransport(route, registry.base)))
+	})
+	return route.transport.client.Load()
+}
+
+// release closes the idle connections of the transports of routes in previous
+// which are missing from current. Connections still in use by requests in
+// flight are closed by DrainDelay, if set, or once they have idled for the
+// transport's IdleConnTimeout.
+func (registry *transportRegistry) release(previous, current *routeTable) {
+	kept := map[*validRouteRule]bool{}
+	for _, route := range current.routes {
+		kept[route] = true
+	}
+	for _, route := range previous.routes {
+		if client := route.transport.built(); client != nil && !kept[route] {
+			client.CloseIdleConnections()
+		}
+	}
+}
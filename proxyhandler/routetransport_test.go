@@ -0,0 +1,96 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouteTransportIsBuiltOnce(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var open atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstream.URL
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	var built atomic.Int64
+	h.transports.newTransport = func(route *validRouteRule, base *http.Transport) *http.Transport {
+		built.Add(1)
+		return newRouteTransport(route, base)
+	}
+	route := RouteRule{Path: "/dedicated", Endpoint: upstream.URL, ResponseHeaderTimeout: time.Second}
+	if err := h.AddRoute(route); err != nil {
+		t.Fatalf("unable to add route: %s", err.Error())
+	}
+	if received := built.Load(); received != 0 {
+		t.Errorf("expected no transport before the route is used\nreceived: %d", received)
+	}
+
+	start := make(chan struct{})
+	var wait sync.WaitGroup
+	for client := 0; client < 64; client++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			<-start
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/dedicated", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+			}
+		}()
+	}
+	close(start)
+	wait.Wait()
+	if received := built.Load(); received != 1 {
+		t.Errorf("unexpected number of transports built\nexpected: %v\nreceived: %v", 1, received)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dedicated", nil))
+	if received := built.Load(); received != 1 {
+		t.Errorf("expected the transport to be reused\nexpected: %v\nreceived: %v", 1, received)
+	}
+
+	// removing the route closes its idle connections
+	if err := h.RemoveRoute("/dedicated"); err != nil {
+		t.Fatalf("unable to remove route: %s", err.Error())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for open.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received := open.Load(); received != 0 {
+		t.Errorf("expected the removed route's connections to be closed\nreceived: %d open", received)
+	}
+
+	// registering the route again builds a new transport
+	if err := h.AddRoute(route); err != nil {
+		t.Fatalf("unable to add route: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/dedicated", nil))
+	if received := built.Load(); received != 2 {
+		t.Errorf("unexpected number of transports built\nexpected: %v\nreceived: %v", 2, received)
+	}
+}
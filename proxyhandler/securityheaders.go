@@ -0,0 +1,73 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SecurityHeader is the value of a security header added to proxied
+// responses. The header is only added when the upstream response does not
+// already carry it, unless Override is set, in which case the upstream's value
+// is replaced.
+type SecurityHeader struct {
+	Value    string
+	Override bool
+}
+
+// SecurityHeaderConfig lists the security headers added to proxied responses.
+// ContentTypeOptions, FrameOptions and ReferrerPolicy default to nosniff,
+// SAMEORIGIN and strict-origin-when-cross-origin when their Value is empty.
+// ContentSecurityPolicy has no sensible default and is only added when its
+// Value is set.
+type SecurityHeaderConfig struct {
+	ContentTypeOptions    SecurityHeader
+	FrameOptions          SecurityHeader
+	ReferrerPolicy        SecurityHeader
+	ContentSecurityPolicy SecurityHeader
+}
+
+// securityHeaderDefaults are the values of the headers in a
+// SecurityHeaderConfig which are used when their Value is empty.
+var securityHeaderDefaults = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "SAMEORIGIN",
+	"Referrer-Policy":        "strict-origin-when-cross-origin",
+}
+
+// headers returns the configured headers by name.
+func (config *SecurityHeaderConfig) headers() map[string]SecurityHeader {
+	return map[string]SecurityHeader{
+		"X-Content-Type-Options":  config.ContentTypeOptions,
+		"X-Frame-Options":         config.FrameOptions,
+		"Referrer-Policy":         config.ReferrerPolicy,
+		"Content-Security-Policy": config.ContentSecurityPolicy,
+	}
+}
+
+func (config *SecurityHeaderConfig) validate() error {
+	for name, header := range config.headers() {
+		if strings.ContainsAny(header.Value, "\r\n") {
+			return fmt.Errorf("security header %s contains a line break", name)
+		}
+	}
+	return nil
+}
+
+// apply adds the configured security headers to header, the headers of a
+// proxied response.
+func (config *SecurityHeaderConfig) apply(header http.Header) {
+	if config == nil {
+		return
+	}
+	for name, securityHeader := range config.headers() {
+		value := securityHeader.Value
+		if value == "" {
+			value = securityHeaderDefaults[name]
+		}
+		if value == "" || (!securityHeader.Override && header.Get(name) != "") {
+			continue
+		}
+		header.Set(name, value)
+	}
+}
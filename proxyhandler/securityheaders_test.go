@@ -0,0 +1,91 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveWithSecurityHeaders(t *testing.T, securityHeaders *SecurityHeaderConfig, upstreamHeaders map[string]string) http.Header {
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		response := httpmock.NewStringResponse(200, "ok")
+		for name, value := range upstreamHeaders {
+			response.Header.Set(name, value)
+		}
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.SecurityHeaders = securityHeaders
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	return recorder.Header()
+}
+
+func TestSecurityHeadersDefaults(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	header := serveWithSecurityHeaders(t, &SecurityHeaderConfig{}, nil)
+	expectations := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "SAMEORIGIN",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+		"Content-Security-Policy": "",
+	}
+	for name, expected := range expectations {
+		if received := header.Get(name); received != expected {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", name, expected, received)
+		}
+	}
+}
+
+func TestSecurityHeadersOverrides(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	header := serveWithSecurityHeaders(t, &SecurityHeaderConfig{
+		FrameOptions:          SecurityHeader{Value: "DENY", Override: true},
+		ReferrerPolicy:        SecurityHeader{Value: "no-referrer"},
+		ContentSecurityPolicy: SecurityHeader{Value: "default-src 'self'"},
+	}, map[string]string{
+		"X-Frame-Options":         "ALLOW-FROM https://example.com",
+		"Referrer-Policy":         "origin",
+		"Content-Security-Policy": "default-src https:",
+	})
+	expectations := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "origin",
+		"Content-Security-Policy": "default-src https:",
+	}
+	for name, expected := range expectations {
+		if values := header.Values(name); len(values) != 1 || values[0] != expected {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", name, expected, values)
+		}
+	}
+}
+
+func TestSecurityHeadersAreNotAddedByDefault(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	header := serveWithSecurityHeaders(t, nil, nil)
+	if value := header.Get("X-Content-Type-Options"); value != "" {
+		t.Errorf("expected no security headers\nreceived: %v", value)
+	}
+}
+
+func TestSecurityHeadersRejectLineBreaks(t *testing.T) {
+	config := buildConfiguration()
+	config.SecurityHeaders = &SecurityHeaderConfig{
+		ContentSecurityPolicy: SecurityHeader{Value: "default-src 'self'\r\nSet-Cookie: a=b"},
+	}
+	if _, err := New(config); err == nil {
+		t.Error("expected a header value with a line break to be rejected")
+	}
+}
@@ -0,0 +1,38 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrEndpointSelection is wrapped by the error reported when a route's
+// EndpointSelector fails or selects a URL which is not one of the route's
+// endpoints. The request is answered with 503 Service Unavailable.
+var ErrEndpointSelection = errors.New("endpoint selection failed")
+
+// selectEndpoint returns the endpoint of route chosen for request by its
+// EndpointSelector. The selector is given copies of the endpoints, so that it
+// cannot alter those shared by every request, and must return one equal to
+// one of them.
+func (route *validRouteRule) selectEndpoint(request *http.Request) (*url.URL, error) {
+	candidates := make([]*url.URL, len(route.EndpointURLs))
+	for index, endpointURL := range route.EndpointURLs {
+		candidate := *endpointURL
+		candidates[index] = &candidate
+	}
+	selected, err := route.EndpointSelector(request, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEndpointSelection, err.Error())
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("%w: no endpoint selected", ErrEndpointSelection)
+	}
+	for _, endpointURL := range route.EndpointURLs {
+		if endpointURL.String() == selected.String() {
+			return endpointURL, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s is not an endpoint of the route", ErrEndpointSelection, selected.String())
+}
@@ -0,0 +1,108 @@
+package proxyhandler
+
+import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// selectByRegion is an EndpointSelector which picks the endpoint whose host
+// is named by the X-Region header. It tampers with the candidates it is given
+// to check that they are copies.
+func selectByRegion(request *http.Request, candidates []*url.URL) (*url.URL, error) {
+	region := request.Header.Get("X-Region")
+	var selected *url.URL
+	for _, candidate := range candidates {
+		if candidate.Host == region {
+			selected = candidate
+		}
+	}
+	for index, candidate := range candidates {
+		if candidate != selected {
+			candidate.Host = "tampered"
+			candidates[index] = nil
+		}
+	}
+	switch region {
+	case "":
+		return nil, errors.New("region is missing")
+	case "elsewhere":
+		return &url.URL{Scheme: "http", Host: "internal.admin"}, nil
+	}
+	return selected, nil
+}
+
+func TestEndpointSelector(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	received := make(map[string][]string)
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		received[r.URL.Host] = append(received[r.URL.Host], r.Header.Get("X-Region"))
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	var errs []error
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{"http://east", "http://west", "http://north"}, EndpointSelector: selectByRegion},
+	}
+	config.Observer = func(observation *Observation) { errs = append(errs, observation.Err) }
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	serve := func(region string) int {
+		request := httptest.NewRequest("GET", "/api", nil)
+		if region != "" {
+			request.Header.Set("X-Region", region)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	for _, region := range []string{"west", "east", "west", "north", "east", "west"} {
+		if status := serve(region); status != http.StatusOK {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", region, http.StatusOK, status)
+		}
+	}
+	for host, regions := range map[string]string{"east": "east east", "west": "west west west", "north": "north"} {
+		if strings.Join(received[host], " ") != regions {
+			t.Errorf("unexpected requests received by %s\nexpected: %v\nreceived: %v", host, regions, received[host])
+		}
+	}
+	if len(received) != 3 {
+		t.Errorf("expected only the route's endpoints to receive requests\nreceived: %v", received)
+	}
+
+	for _, region := range []string{"", "elsewhere"} {
+		if status := serve(region); status != http.StatusServiceUnavailable {
+			t.Errorf("unexpected status for a failed selection\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, status)
+		}
+		if err := errs[len(errs)-1]; !errors.Is(err, ErrEndpointSelection) {
+			t.Errorf("unexpected error for a failed selection\nexpected: %v\nreceived: %v", ErrEndpointSelection, err)
+		}
+	}
+	if _, ok := received["internal.admin"]; ok {
+		t.Errorf("expected a URL which is not an endpoint of the route to be refused")
+	}
+}
+
+func TestEndpointSelectorValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"requires several endpoints": RouteRule{Path: "/", Endpoint: "http://one", EndpointSelector: selectByRegion},
+		"cannot be combined with hashing": RouteRule{Path: "/", Endpoints: []string{"http://one", "http://two"},
+			EndpointSelector: selectByRegion, HashKey: HashKeyFromPath()},
+		"cannot be combined with hedging": RouteRule{Path: "/", Endpoints: []string{"http://one", "http://two"},
+			EndpointSelector: selectByRegion, HedgeDelay: 1},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proxyhandler
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultReadHeaderTimeout, DefaultIdleTimeout and DefaultMaxHeaderBytes
+// configure the servers started by Serve and ListenAndServe when the
+// Configuration leaves them unset.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultMaxHeaderBytes    = 1 << 20
+)
+
+// newServer builds an http.Server for the handler with the configured limits.
+func (handler *ProxyHandler) newServer() *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: handler.configuration.ReadHeaderTimeout,
+		IdleTimeout:       handler.configuration.IdleTimeout,
+		MaxHeaderBytes:    handler.configuration.MaxHeaderBytes,
+	}
+	if server.ReadHeaderTimeout == 0 {
+		server.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if server.IdleTimeout == 0 {
+		server.IdleTimeout = DefaultIdleTimeout
+	}
+	if server.MaxHeaderBytes == 0 {
+		server.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	return server
+}
+
+// Serve accepts connections on listener and serves them with the handler
+// until Shutdown is called, after which it returns http.ErrServerClosed. The
+// server applies the Configuration's ReadHeaderTimeout, IdleTimeout and
+// MaxHeaderBytes.
+func (handler *ProxyHandler) Serve(listener net.Listener) error {
+	server := handler.newServer()
+	if !handler.trackServer(server) {
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	return server.Serve(listener)
+}
+
+// trackServer registers server to be shut down with the handler. It returns
+// false when the handler is already shutting down.
+func (handler *ProxyHandler) trackServer(server *http.Server) bool {
+	handler.lifecycleMutex.Lock()
+	defer handler.lifecycleMutex.Unlock()
+	if handler.shuttingDown {
+		return false
+	}
+	handler.servers = append(handler.servers, server)
+	return true
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (handler *ProxyHandler) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return handler.Serve(listener)
+}
@@ -0,0 +1,233 @@
+package proxyhandler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeProxiesAndShutsDownGracefully(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(arrived)
+			<-release
+		}
+		w.Write([]byte("upstream " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	h := newRealUpstreamHandler(t, upstream.URL)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- h.Serve(listener)
+	}()
+	proxyURL := "http://" + listener.Addr().String()
+
+	response, err := http.Get(proxyURL + "/fast")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "upstream /fast" {
+		t.Errorf("unexpected body\nexpected: %v\nreceived: %v", "upstream /fast", string(body))
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		response, err := http.Get(proxyURL + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		slow <- string(body)
+	}()
+	<-arrived
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- h.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("unexpected Serve result\nexpected: %v\nreceived: %v", http.ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return once shutdown began")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("expected Shutdown to wait for the in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if body := <-slow; body != "upstream /slow" {
+		t.Errorf("expected the in-flight request to complete\nexpected: %v\nreceived: %v", "upstream /slow", body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected shutdown error: %s", err.Error())
+	}
+	if err := h.Serve(listener); err != http.ErrServerClosed {
+		t.Errorf("expected Serve after Shutdown to fail\nexpected: %v\nreceived: %v", http.ErrServerClosed, err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	server := h.newServer()
+	if server.ReadHeaderTimeout != DefaultReadHeaderTimeout || server.IdleTimeout != DefaultIdleTimeout || server.MaxHeaderBytes != DefaultMaxHeaderBytes {
+		t.Errorf("unexpected default limits\nreceived: %v %v %v", server.ReadHeaderTimeout, server.IdleTimeout, server.MaxHeaderBytes)
+	}
+
+	config := buildConfiguration()
+	config.ReadHeaderTimeout = time.Second
+	config.IdleTimeout = time.Minute
+	config.MaxHeaderBytes = 4096
+	h, err = New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	server = h.newServer()
+	if server.ReadHeaderTimeout != time.Second || server.IdleTimeout != time.Minute || server.MaxHeaderBytes != 4096 {
+		t.Errorf("unexpected configured limits\nreceived: %v %v %v", server.ReadHeaderTimeout, server.IdleTimeout, server.MaxHeaderBytes)
+	}
+}
+
+// writeCertificate writes a self-signed certificate for name to certFile and
+// keyFile, returning a pool which trusts it.
+func writeCertificate(t *testing.T, name string, serial int64, certFile, keyFile string) *x509.CertPool {
+	_, certPEM, keyPEM := newSelfSignedCertificate(t, name, serial)
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("unable to write certificate: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("unable to write key: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return pool
+}
+
+func TestServeTLSTerminatesAndReloads(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer upstream.Close()
+	h := newRealUpstreamHandler(t, upstream.URL)
+	defer h.Shutdown(context.Background())
+
+	directory := t.TempDir()
+	certFile, keyFile := filepath.Join(directory, "cert.pem"), filepath.Join(directory, "key.pem")
+	pool := writeCertificate(t, "proxy.test", 1, certFile, keyFile)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	go h.ServeTLS(listener, certFile, keyFile)
+
+	request := func(pool *x509.CertPool) (string, *big.Int, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "proxy.test"},
+		}}
+		response, err := client.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			return "", nil, err
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body), response.TLS.PeerCertificates[0].SerialNumber, nil
+	}
+
+	body, serial, err := request(pool)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if body != "https" {
+		t.Errorf("unexpected X-Forwarded-Proto\nexpected: %v\nreceived: %v", "https", body)
+	}
+	if serial.Int64() != 1 {
+		t.Errorf("unexpected certificate serial\nexpected: %v\nreceived: %v", 1, serial)
+	}
+
+	rotatedPool := writeCertificate(t, "proxy.test", 2, certFile, keyFile)
+	if err := h.ReloadCertificates(); err != nil {
+		t.Fatalf("unexpected reload error: %s", err.Error())
+	}
+	if _, _, err := request(pool); err == nil {
+		t.Error("expected the previous certificate to be replaced")
+	}
+	_, serial, err = request(rotatedPool)
+	if err != nil || serial.Int64() != 2 {
+		t.Errorf("expected the rotated certificate to be served\nreceived: %v %v", serial, err)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err := h.ReloadCertificates(); err == nil {
+		t.Error("expected reloading an invalid key to fail")
+	}
+	if _, serial, err = request(rotatedPool); err != nil || serial.Int64() != 2 {
+		t.Errorf("expected the last good certificate to be kept\nreceived: %v %v", serial, err)
+	}
+}
+
+func TestServeTLSAppliesServerConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	certificate, certPEM, _ := newSelfSignedCertificate(t, "proxy.test", 1)
+	config := buildConfiguration()
+	config.TLSServerConfig = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Shutdown(context.Background())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	go h.ServeTLS(listener, "", "")
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "proxy.test"},
+	}}
+	if _, err := client.Get("https://" + listener.Addr().String() + "/"); err == nil {
+		t.Error("expected a client without a certificate to be refused")
+	}
+}
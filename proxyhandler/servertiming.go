@@ -0,0 +1,22 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// setTimingHeaders reports how long the upstream took to begin its response
+// and how much of the total time was spent in the proxy itself.
+func setTimingHeaders(header http.Header, upstream, total time.Duration) {
+	overhead := total - upstream
+	if overhead < 0 {
+		overhead = 0
+	}
+	header.Set("X-Upstream-Latency", fmt.Sprintf("%dms", upstream.Milliseconds()))
+	header.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f, proxy;dur=%.1f", milliseconds(upstream), milliseconds(overhead)))
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
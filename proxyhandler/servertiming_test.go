@@ -0,0 +1,71 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTimingHeaders(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	delay := 50 * time.Millisecond
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		time.Sleep(delay)
+		response := httpmock.NewStringResponse(200, "slow")
+		response.Header.Set("Server-Timing", "db;dur=12")
+		return response, nil
+	})
+	config := buildConfiguration()
+	config.TimingHeaders = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	latency, err := time.ParseDuration(recorder.Header().Get("X-Upstream-Latency"))
+	if err != nil || latency < delay {
+		t.Errorf("unexpected X-Upstream-Latency\nexpected: at least %v\nreceived: %q", delay, recorder.Header().Get("X-Upstream-Latency"))
+	}
+	serverTiming := recorder.Header().Values("Server-Timing")
+	if len(serverTiming) != 2 || serverTiming[0] != "db;dur=12" {
+		t.Fatalf("expected the upstream's Server-Timing to be kept\nreceived: %v", serverTiming)
+	}
+	match := regexp.MustCompile(`^upstream;dur=(\d+\.\d), proxy;dur=(\d+\.\d)$`).FindStringSubmatch(serverTiming[1])
+	if match == nil {
+		t.Fatalf("unexpected Server-Timing\nreceived: %v", serverTiming[1])
+	}
+	upstream, _ := strconv.ParseFloat(match[1], 64)
+	proxy, _ := strconv.ParseFloat(match[2], 64)
+	if upstream < 50 || upstream > 5000 {
+		t.Errorf("implausible upstream duration\nexpected: at least 50\nreceived: %v", upstream)
+	}
+	if proxy < 0 || proxy > upstream {
+		t.Errorf("implausible proxy duration\nreceived: %v", proxy)
+	}
+}
+
+func TestTimingHeadersAreOptIn(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, "ok"))
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	for _, name := range []string{"X-Upstream-Latency", "Server-Timing"} {
+		if value := recorder.Header().Get(name); value != "" {
+			t.Errorf("unexpected %s header\nreceived: %v", name, value)
+		}
+	}
+}
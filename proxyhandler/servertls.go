@@ -0,0 +1,100 @@
+package proxyhandler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// certificateReloader serves a certificate loaded from files which can be
+// read again to pick up a rotated certificate without a restart.
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// load reads the certificate files, keeping the current certificate if they
+// cannot be loaded.
+func (reloader *certificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %s", reloader.certFile, err.Error())
+	}
+	reloader.mutex.Lock()
+	reloader.certificate = &certificate
+	reloader.mutex.Unlock()
+	return nil
+}
+
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.certificate, nil
+}
+
+// ServeTLS is like Serve but terminates TLS on the accepted connections using
+// the Configuration's TLSServerConfig. When certFile and keyFile are given,
+// the certificate is loaded from them and may later be replaced by calling
+// ReloadCertificates; otherwise TLSServerConfig must provide the certificate.
+// Requests received over TLS are forwarded with X-Forwarded-Proto set to
+// https.
+func (handler *ProxyHandler) ServeTLS(listener net.Listener, certFile, keyFile string) error {
+	server := handler.newServer()
+	server.TLSConfig = &tls.Config{}
+	if handler.configuration.TLSServerConfig != nil {
+		server.TLSConfig = handler.configuration.TLSServerConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		reloader, err := newCertificateReloader(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		server.TLSConfig.GetCertificate = reloader.getCertificate
+		handler.lifecycleMutex.Lock()
+		handler.certificates = append(handler.certificates, reloader)
+		handler.lifecycleMutex.Unlock()
+	}
+	if !handler.trackServer(server) {
+		listener.Close()
+		return http.ErrServerClosed
+	}
+	return server.ServeTLS(listener, "", "")
+}
+
+// ListenAndServeTLS listens on the TCP address addr and calls ServeTLS.
+func (handler *ProxyHandler) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return handler.ServeTLS(listener, certFile, keyFile)
+}
+
+// ReloadCertificates reads the certificate files passed to ServeTLS and
+// ListenAndServeTLS again, for example after they are rotated. New TLS
+// connections use the reloaded certificates while established connections
+// are unaffected. A certificate which fails to load is kept as it was.
+func (handler *ProxyHandler) ReloadCertificates() error {
+	handler.lifecycleMutex.Lock()
+	certificates := handler.certificates
+	handler.lifecycleMutex.Unlock()
+	for _, reloader := range certificates {
+		if err := reloader.load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	errShuttingDown = errors.New("proxy is shutting down")
+	errClosed       = errors.New("proxy is closed")
+)
+
+// Shutdown stops the ProxyHandler from accepting new requests and waits for
+// in-flight requests and background work, such as warm-ups, to complete.
+// Requests received after Shutdown is called are answered with 503 Service
+// Unavailable, and servers started with Serve or ListenAndServe stop
+// listening and close their idle connections. Once in-flight requests have
+// finished, connection drains still waiting out their DrainDelay are canceled
+// and the idle connections of the handler's transports are closed in their
+// place. If ctx expires before everything has finished, Shutdown returns the
+// context's error and in-flight requests are left to complete on their own.
+func (handler *ProxyHandler) Shutdown(ctx context.Context) error {
+	handler.lifecycleMutex.Lock()
+	handler.shuttingDown = true
+	servers := handler.servers
+	handler.lifecycleMutex.Unlock()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		handler.inFlight.Wait()
+		handler.background.Wait()
+		handler.endLifetime()
+		handler.tasks.Wait()
+		handler.closeIdleConnections()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginRequest registers a request as in-flight. It returns errClosed once
+// the handler is closed and errShuttingDown while it is shutting down, when
+// the request must be refused.
+func (handler *ProxyHandler) beginRequest() error {
+	handler.lifecycleMutex.Lock()
+	defer handler.lifecycleMutex.Unlock()
+	if handler.closed {
+		return errClosed
+	}
+	if handler.shuttingDown {
+		return errShuttingDown
+	}
+	handler.inFlight.Add(1)
+	return nil
+}
+
+func (handler *ProxyHandler) isShuttingDown() bool {
+	handler.lifecycleMutex.Lock()
+	defer handler.lifecycleMutex.Unlock()
+	return handler.shuttingDown
+}
+
+// Close releases the resources of the ProxyHandler at once, without waiting
+// for requests in flight. Requests received afterwards are answered with 503
+// Service Unavailable, as after Shutdown, reporting that the proxy is closed.
+// Servers started with Serve or ListenAndServe are closed along with their
+// connections, config file watches end, warm-up requests are canceled,
+// pending connection drains are abandoned and the idle connections of the
+// handler's transports, including those of routes with their own, are
+// closed. The debug dumps of exchanges still in flight are written to the log
+// as far as they have been captured. Close returns once the handler's
+// background goroutines have exited, with the first error from closing a
+// server. It may be called more than once, and concurrently, with later
+// calls returning the result of the first.
+func (handler *ProxyHandler) Close() error {
+	handler.closeOnce.Do(func() {
+		handler.lifecycleMutex.Lock()
+		handler.shuttingDown = true
+		handler.closed = true
+		servers, watches := handler.servers, handler.watches
+		handler.lifecycleMutex.Unlock()
+
+		handler.endLifetime()
+		for _, stop := range watches {
+			stop()
+		}
+		for _, server := range servers {
+			if err := server.Close(); err != nil && handler.closeErr == nil {
+				handler.closeErr = err
+			}
+		}
+		handler.tasks.Wait()
+		handler.background.Wait()
+
+		handler.closeIdleConnections()
+		handler.flushDumps()
+	})
+	return handler.closeErr
+}
+
+// closeIdleConnections closes the idle connections of the handler's
+// transports, including those of routes with their own.
+func (handler *ProxyHandler) closeIdleConnections() {
+	handler.client.CloseIdleConnections()
+	for _, route := range handler.routes.Load().routes {
+		if client := route.transport.built(); client != nil {
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+// goBackground runs task in a goroutine which Close waits for, reporting
+// whether it did. Once the handler is closed, task is not run.
+func (handler *ProxyHandler) goBackground(task func()) bool {
+	handler.lifecycleMutex.Lock()
+	defer handler.lifecycleMutex.Unlock()
+	if handler.closed {
+		return false
+	}
+	handler.tasks.Add(1)
+	go func() {
+		defer handler.tasks.Done()
+		task()
+	}()
+	return true
+}
@@ -0,0 +1,323 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"context"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://defaulthost/slow", func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return httpmock.NewStringResponse(200, "finished"), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	slowRecorder := httptest.NewRecorder()
+	slowDone := make(chan struct{})
+	go func() {
+		h.ServeHTTP(slowRecorder, httptest.NewRequest("GET", "/slow", nil))
+		close(slowDone)
+	}()
+	<-started
+
+	shutdownResult := make(chan error)
+	go func() {
+		shutdownResult <- h.Shutdown(context.Background())
+	}()
+	for !h.isShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+
+	refusedRecorder := httptest.NewRecorder()
+	h.ServeHTTP(refusedRecorder, httptest.NewRequest("GET", "/slow", nil))
+	if refusedRecorder.Code != http.StatusServiceUnavailable || !strings.Contains(refusedRecorder.Body.String(), errShuttingDown.Error()) {
+		t.Errorf("expected request during shutdown to be refused\nexpected: %v %v\nreceived: %v %v", http.StatusServiceUnavailable, errShuttingDown, refusedRecorder.Code, refusedRecorder.Body.String())
+	}
+
+	select {
+	case <-shutdownResult:
+		t.Fatal("expected shutdown to wait for in-flight request")
+	default:
+	}
+
+	close(release)
+	if err := <-shutdownResult; err != nil {
+		t.Fatalf("unexpected shutdown error: %s", err.Error())
+	}
+	<-slowDone
+	body, _ := ioutil.ReadAll(slowRecorder.Body)
+	if slowRecorder.Code != 200 || string(body) != "finished" {
+		t.Errorf("expected in-flight request to complete\nexpected: %v %v\nreceived: %v %v", 200, "finished", slowRecorder.Code, string(body))
+	}
+}
+
+func TestShutdownRespectsContextDeadline(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	httpmock.RegisterResponder("GET", "http://defaulthost/slow", func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to honor the context deadline\nexpected: %v\nreceived: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestShutdownWaitsForBackgroundTasks(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	h, err := New(buildConfiguration())
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	release := make(chan struct{})
+	h.goBackground(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to wait for the task\nexpected: %v\nreceived: %v", context.DeadlineExceeded, err)
+	}
+	close(release)
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected shutdown error: %s", err.Error())
+	}
+}
+
+func TestShutdownCancelsPendingDrains(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	config := buildConfiguration()
+	config.DrainDelay = time.Hour
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if err := h.SetEndpoint("/route1", "http://elsewhere"); err != nil {
+		t.Fatalf("unable to set endpoint: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Errorf("expected shutdown not to wait out the drain delay\nreceived: %v", err)
+	}
+}
+
+// goroutines returns the stacks of the running goroutines keyed by their
+// header line, which holds the goroutine's id.
+func goroutines() map[string]string {
+	buffer := make([]byte, 1<<20)
+	for {
+		size := runtime.Stack(buffer, true)
+		if size < len(buffer) {
+			buffer = buffer[:size]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+	stacks := map[string]string{}
+	for _, stack := range strings.Split(string(buffer), "\n\n") {
+		id, _, _ := strings.Cut(stack, " [")
+		stacks[id] = stack
+	}
+	return stacks
+}
+
+// leakedGoroutines waits for the goroutines started since before to exit and
+// returns the stacks of those which have not. The signal package's own
+// goroutine, started by the first watch of a config file, lives for the rest
+// of the process and is not counted.
+func leakedGoroutines(before map[string]string) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var leaked []string
+		for id, stack := range goroutines() {
+			if _, ok := before[id]; !ok && !strings.Contains(stack, "os/signal.loop") && !strings.Contains(stack, "leakedGoroutines") {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			return leaked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	before := goroutines()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstream.URL
+	config.DrainDelay = time.Hour
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/warm", Endpoint: upstream.URL, WarmupPath: "/health", WarmupRequests: 2},
+		&RouteRule{Path: "/own", Endpoint: upstream.URL, ResponseHeaderTimeout: time.Second, TTL: time.Hour},
+		&RouteRule{Path: "/compressed", Endpoint: upstream.URL, CompressRequests: 1, IdleTimeout: time.Second},
+		&RouteRule{Path: "/removed", Endpoint: "http://127.0.0.1:1", MaxConnsPerUpstream: 1},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	if _, err := h.WatchConfigFile(writeConfigFile(t, `{"DefaultRoute": "http://default.endpoint"}`)); err != nil {
+		t.Fatalf("unable to watch config file: %s", err.Error())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	served := make(chan error, 1)
+	go func() { served <- h.Serve(listener) }()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	for _, path := range []string{"/warm", "/own", "/compressed", "/other"} {
+		response, err := client.Post("http://"+listener.Addr().String()+path, "application/json", strings.NewReader(`{"blob":"data"}`))
+		if err != nil {
+			t.Fatalf("unable to send request to %s: %s", path, err.Error())
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", path, http.StatusOK, response.StatusCode)
+		}
+	}
+	// leaves a drain of the removed route's host pending for an hour
+	if err := h.RemoveRoute("/removed"); err != nil {
+		t.Fatalf("unable to remove route: %s", err.Error())
+	}
+
+	var closing sync.WaitGroup
+	for caller := 0; caller < 3; caller++ {
+		closing.Add(1)
+		go func() {
+			defer closing.Done()
+			if err := h.Close(); err != nil {
+				t.Errorf("unexpected error closing the handler: %s", err.Error())
+			}
+		}()
+	}
+	closing.Wait()
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("unexpected result of Serve\nexpected: %v\nreceived: %v", http.ErrServerClosed, err)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/own", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected requests after Close to be refused\nexpected: %v\nreceived: %v", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if _, err := h.WatchConfigFile(writeConfigFile(t, `{"DefaultRoute": "http://default.endpoint"}`)); err != errClosed {
+		t.Errorf("expected watching after Close to fail\nexpected: %v\nreceived: %v", errClosed, err)
+	}
+	client.CloseIdleConnections()
+	upstream.Close()
+
+	if leaked := leakedGoroutines(before); len(leaked) > 0 {
+		t.Errorf("expected no goroutines to outlive the handler\nreceived: %d\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
+
+func TestCloseDuringInFlightRequest(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	httpmock.RegisterResponder("GET", "http://defaulthost/slow", func(r *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return httpmock.NewStringResponse(200, "finished"), nil
+	})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	config := buildConfiguration()
+	config.DefaultRoute = "http://defaulthost"
+	config.DebugDumpRate = 1
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-started
+
+	// Close does not wait for the request, but logs what it has dumped
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error closing the handler: %s", err.Error())
+	}
+	if !strings.Contains(logged.String(), "proxy: dump of GET /slow (incomplete)") {
+		t.Errorf("expected the in-flight exchange's dump to be flushed\nreceived: %v", logged.String())
+	}
+	refused := httptest.NewRecorder()
+	h.ServeHTTP(refused, httptest.NewRequest("GET", "/slow", nil))
+	if refused.Code != http.StatusServiceUnavailable || !strings.Contains(refused.Body.String(), errClosed.Error()) {
+		t.Errorf("expected requests after Close to be refused as closed\nexpected: %v %v\nreceived: %v %v", http.StatusServiceUnavailable, errClosed, refused.Code, refused.Body.String())
+	}
+	close(release)
+	<-done
+	if dumps := strings.Count(logged.String(), "proxy: dump of"); dumps != 1 {
+		t.Errorf("expected the exchange to be dumped once\nexpected: %v\nreceived: %v", 1, dumps)
+	}
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "finished" {
+		t.Errorf("expected the in-flight request to complete\nexpected: %v %v\nreceived: %v %v", 200, "finished", recorder.Code, recorder.Body.String())
+	}
+	if err := h.Close(); err != nil {
+		t.Errorf("expected closing again to succeed\nreceived: %s", err.Error())
+	}
+}
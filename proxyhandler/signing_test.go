@@ -0,0 +1,141 @@
+package proxyhandler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSigningSecret = []byte("signing secret")
+
+// checkTestSignature verifies the HMACSigner headers of request
+// independently of the signer.
+func checkTestSignature(request *http.Request, body []byte) error {
+	date := request.Header.Get("X-Signature-Date")
+	if _, err := time.Parse(time.RFC3339, date); err != nil {
+		return fmt.Errorf("invalid signature date %q", date)
+	}
+	bodyHash := sha256.Sum256(body)
+	stringToSign := request.Method + "\n" + request.URL.EscapedPath() + "\n" + date + "\n" + hex.EncodeToString(bodyHash[:])
+	mac := hmac.New(sha256.New, testSigningSecret)
+	mac.Write([]byte(stringToSign))
+	if expected := hex.EncodeToString(mac.Sum(nil)); request.Header.Get("X-Signature") != expected {
+		return fmt.Errorf("signature %q does not match %q", request.Header.Get("X-Signature"), expected)
+	}
+	return nil
+}
+
+func TestHMACSignerSignsUpstreamRequests(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			var failures []string
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				var body []byte
+				if r.Body != nil {
+					body, _ = io.ReadAll(r.Body)
+				}
+				if err := checkTestSignature(r, body); err != nil {
+					failures = append(failures, err.Error())
+				}
+				return httpmock.NewStringResponse(200, string(body)), nil
+			})
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.BufferBodyBytes = 1024
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/signed", Endpoint: "http://internal", Signer: HMACSigner(testSigningSecret)},
+				&RouteRule{Path: "/rewritten", Endpoint: "http://internal", Signer: HMACSigner(testSigningSecret), Director: func(r *http.Request) {
+					r.Body = io.NopCloser(strings.NewReader("replaced by director"))
+				}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+
+			tests := []struct {
+				method, path, body, expected string
+			}{
+				{"GET", "/signed/orders?page=2", "", ""},
+				{"POST", "/signed/orders%2Fall", `{"item":"widget"}`, `{"item":"widget"}`},
+				{"PUT", "/rewritten", "original", "replaced by director"},
+			}
+			for _, test := range tests {
+				failures = nil
+				var body io.Reader
+				if test.body != "" {
+					body = strings.NewReader(test.body)
+				}
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, body))
+				if recorder.Code != 200 || recorder.Body.String() != test.expected {
+					t.Errorf("unexpected response for %s %s\nexpected: %v %q\nreceived: %v %q", test.method, test.path, 200, test.expected, recorder.Code, recorder.Body.String())
+				}
+				if len(failures) > 0 {
+					t.Errorf("unexpected signature for %s %s\nreceived: %v", test.method, test.path, failures)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestSigningFailuresAbortBeforeSending(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			sent := 0
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				sent++
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.BufferBodyBytes = 8
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/signed", Endpoint: "http://internal", Signer: HMACSigner(testSigningSecret)},
+				&RouteRule{Path: "/failing", Endpoint: "http://internal", Signer: func(*http.Request, []byte) error {
+					return fmt.Errorf("key unavailable")
+				}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/failing", nil))
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("unexpected status for a failing signer\nexpected: %v\nreceived: %v", http.StatusInternalServerError, recorder.Code)
+			}
+			recorder = httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("POST", "/signed", strings.NewReader("longer than eight bytes")))
+			if recorder.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("unexpected status for a body too large to sign\nexpected: %v\nreceived: %v", http.StatusRequestEntityTooLarge, recorder.Code)
+			}
+			if sent != 0 {
+				t.Errorf("expected no request to reach the upstream\nreceived: %d", sent)
+			}
+		})
+	}
+}
+
+func TestRequestSigningRequiresBufferedBodies(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes[0].Signer = HMACSigner(testSigningSecret)
+	if _, err := New(config); err == nil {
+		t.Error("expected signing without BufferBodyBytes to be rejected")
+	}
+}
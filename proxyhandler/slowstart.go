@@ -0,0 +1,116 @@
+package proxyhandler
+
+import (
+	"sync"
+	"time"
+)
+
+// slowStartMinWeight is the share of traffic, relative to a warm endpoint,
+// which an endpoint receives at the start of its SlowStart.
+const slowStartMinWeight = 0.1
+
+// slowStart spreads requests across a route's endpoints by smooth weighted
+// round robin, weighting each endpoint by how far it is through its warm-up.
+// Endpoints which have never been warmed up have full weight.
+type slowStart struct {
+	duration time.Duration
+	mutex    sync.Mutex
+	addedAt  []time.Time
+	current  []float64
+}
+
+func newSlowStart(duration time.Duration, endpoints int) *slowStart {
+	return &slowStart{duration: duration, addedAt: make([]time.Time, endpoints), current: make([]float64, endpoints)}
+}
+
+// restart begins the warm-up of the endpoint at index at now.
+func (warmup *slowStart) restart(index int, now time.Time) {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	warmup.addedAt[index] = now
+}
+
+// weight returns the share of traffic the endpoint at index receives at now,
+// relative to a warm endpoint. It must be called with mutex held.
+func (warmup *slowStart) weight(index int, now time.Time) float64 {
+	if warmup.addedAt[index].IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(warmup.addedAt[index])
+	if elapsed >= warmup.duration {
+		warmup.addedAt[index] = time.Time{}
+		return 1
+	}
+	ramp := float64(elapsed) / float64(warmup.duration)
+	if ramp < slowStartMinWeight {
+		return slowStartMinWeight
+	}
+	return ramp
+}
+
+// choose returns the index of the next endpoint, passing over those for
+// which skip reports true unless every endpoint is skipped.
+func (warmup *slowStart) choose(now time.Time, skip func(int) bool) int {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	best, total := -1, 0.0
+	for index := range warmup.current {
+		if skip(index) {
+			continue
+		}
+		weight := warmup.weight(index, now)
+		warmup.current[index] += weight
+		total += weight
+		if best < 0 || warmup.current[index] > warmup.current[best] {
+			best = index
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	warmup.current[best] -= total
+	return best
+}
+
+// startSlowStart begins the warm-up of the endpoints of routes in table which
+// were not endpoints of the route for the same path in previous. Endpoints
+// which were keep the progress of their warm-up. It must be called with
+// routesMutex held, before table is installed.
+func (handler *ProxyHandler) startSlowStart(previous, table *routeTable) {
+	now := handler.now()
+	for _, route := range table.routes {
+		if route.slowStart == nil {
+			continue
+		}
+		var previousRoute *validRouteRule
+		if index := previous.indexOf(route.Path); index >= 0 {
+			previousRoute = previous.routes[index]
+		}
+		if previousRoute == route {
+			continue
+		}
+		for index, endpointURL := range route.EndpointURLs {
+			route.slowStart.addedAt[index] = previousRoute.addedAt(endpointURL.String(), now)
+		}
+	}
+}
+
+// addedAt returns the time the warm-up of endpoint began on route, which is
+// zero if it is warm and now if route is nil or does not have the endpoint.
+func (route *validRouteRule) addedAt(endpoint string, now time.Time) time.Time {
+	if route == nil {
+		return now
+	}
+	for index, endpointURL := range route.EndpointURLs {
+		if endpointURL.String() != endpoint {
+			continue
+		}
+		if route.slowStart == nil {
+			return time.Time{}
+		}
+		route.slowStart.mutex.Lock()
+		defer route.slowStart.mutex.Unlock()
+		return route.slowStart.addedAt[index]
+	}
+	return now
+}
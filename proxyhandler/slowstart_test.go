@@ -0,0 +1,120 @@
+package proxyhandler
+
+import (
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countHosts dispatches count requests to path and tallies the upstream hosts
+// which answered them.
+func countHosts(h *ProxyHandler, path string, count int) map[string]int {
+	paths := make([]string, count)
+	for index := range paths {
+		paths[index] = path
+	}
+	hosts := make(map[string]int)
+	for _, body := range dispatchBodies(h, paths) {
+		hosts[body]++
+	}
+	return hosts
+}
+
+func TestSlowStartRampsUpAddedEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"}, SlowStart: 100 * time.Second},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+
+	if hosts := countHosts(h, "/api", 100); hosts["one"] != 50 || hosts["two"] != 50 {
+		t.Errorf("expected endpoints passed to New to be warm\nreceived: %v", hosts)
+	}
+
+	err = h.Reload(&Configuration{
+		DefaultRoute: "http://default.endpoint",
+		Routes: []*RouteRule{
+			&RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two", "http://three"}, SlowStart: 100 * time.Second},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to reload: %s", err.Error())
+	}
+	// three's share of 100 requests grows from 0.1/2.1 to 0.5/2.5 to 1/3
+	steps := []struct {
+		advance  time.Duration
+		expected int
+	}{
+		{0, 5},
+		{50 * time.Second, 20},
+		{50 * time.Second, 33},
+	}
+	for index, step := range steps {
+		clock = clock.Add(step.advance)
+		hosts := countHosts(h, "/api", 100)
+		if received := hosts["three"]; received < step.expected-1 || received > step.expected+1 {
+			t.Errorf("unexpected share for added endpoint at step %d\nexpected: %v\nreceived: %v", index, step.expected, hosts)
+		}
+		if difference := hosts["one"] - hosts["two"]; difference < -1 || difference > 1 {
+			t.Errorf("expected kept endpoints to share equally at step %d\nreceived: %v", index, hosts)
+		}
+	}
+}
+
+func TestSlowStartRampsUpReadmittedEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	failing := true
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		if failing && r.URL.Host == "two" {
+			return httpmock.NewStringResponse(500, r.URL.Host), nil
+		}
+		return httpmock.NewStringResponse(200, r.URL.Host), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:      "/api",
+			Endpoints: []string{"http://one", "http://two"},
+			SlowStart: 100 * time.Second,
+			OutlierDetection: &OutlierDetection{
+				Window:           1,
+				MaxErrorRate:     0.5,
+				BaseEjectionTime: 10 * time.Second,
+			},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return clock }
+
+	if hosts := countHosts(h, "/api", 10); hosts["one"] != 9 || hosts["two"] != 1 {
+		t.Errorf("expected two to be ejected after its first failure\nreceived: %v", hosts)
+	}
+	failing = false
+	clock = clock.Add(10 * time.Second)
+	// two returns with a tenth of one's weight
+	if hosts := countHosts(h, "/api", 110); hosts["two"] < 9 || hosts["two"] > 11 {
+		t.Errorf("unexpected share for readmitted endpoint\nexpected: %v\nreceived: %v", 10, hosts)
+	}
+	clock = clock.Add(100 * time.Second)
+	if hosts := countHosts(h, "/api", 100); hosts["one"] != 50 || hosts["two"] != 50 {
+		t.Errorf("expected readmitted endpoint to be warm\nreceived: %v", hosts)
+	}
+}
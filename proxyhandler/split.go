@@ -0,0 +1,70 @@
+package proxyhandler
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+)
+
+// Variants assigned to requests on routes with a SplitEndpoint or
+// CanaryEndpoint. The variant is returned to the client in the
+// X-Upstream-Variant response header.
+const (
+	VariantStable     = "stable"
+	VariantExperiment = "experiment"
+	VariantCanary     = "canary"
+)
+
+// selectUpstream chooses the endpoint which will serve request and names the
+// variant it belongs to. The variant is empty for routes without a canary or
+// split. It fails only when the route's EndpointSelector does.
+func (handler *ProxyHandler) selectUpstream(route *validRouteRule, request *http.Request) (*url.URL, string, error) {
+	if route.CanaryEndpointURL != nil && route.CanaryMatcher(request) {
+		return route.CanaryEndpointURL, VariantCanary, nil
+	}
+	variant := ""
+	if route.SplitEndpointURL != nil {
+		if handler.splitSample(route, request) < route.SplitRatio {
+			return route.SplitEndpointURL, VariantExperiment, nil
+		}
+		variant = VariantStable
+	} else if route.CanaryEndpointURL != nil {
+		variant = VariantStable
+	}
+	if route.EndpointSelector != nil {
+		upstream, err := route.selectEndpoint(request)
+		return upstream, variant, err
+	}
+	return handler.pickEndpoint(route, request), variant, nil
+}
+
+// splitSample returns a number in [0, 1) which is stable for requests sharing
+// a split key and random otherwise.
+func (handler *ProxyHandler) splitSample(route *validRouteRule, request *http.Request) float64 {
+	if route.SplitKey != nil {
+		if key := route.SplitKey(request); key != "" {
+			hash := fnv.New32a()
+			hash.Write([]byte(key))
+			return float64(hash.Sum32()) / (math.MaxUint32 + 1)
+		}
+	}
+	return handler.random()
+}
+
+// HeaderEquals returns a CanaryMatcher which matches requests carrying the
+// header name with exactly value.
+func HeaderEquals(name, value string) func(*http.Request) bool {
+	return func(request *http.Request) bool {
+		return request.Header.Get(name) == value
+	}
+}
+
+// CookiePresent returns a CanaryMatcher which matches requests carrying a
+// cookie called name.
+func CookiePresent(name string) func(*http.Request) bool {
+	return func(request *http.Request) bool {
+		_, err := request.Cookie(name)
+		return err == nil
+	}
+}
@@ -0,0 +1,175 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func seededRandom(seed int64) func() float64 {
+	var mutex sync.Mutex
+	source := rand.New(rand.NewSource(seed))
+	return func() float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return source.Float64()
+	}
+}
+
+func TestSplitEndpointReceivesConfiguredRatio(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	hits := make(map[string]int)
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		hits[r.URL.Host]++
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	variants := make(map[string]int)
+	config := buildConfiguration()
+	config.Random = seededRandom(42)
+	config.Observer = func(o *Observation) { variants[o.Variant]++ }
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: "http://stable", SplitEndpoint: "http://experiment", SplitRatio: 0.05},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	requests := 10000
+	for i := 0; i < requests; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+	}
+
+	ratio := float64(hits["experiment"]) / float64(requests)
+	if math.Abs(ratio-0.05) > 0.01 {
+		t.Errorf("split ratio outside tolerance\nexpected: %v\nreceived: %v", 0.05, ratio)
+	}
+	if hits["stable"]+hits["experiment"] != requests {
+		t.Errorf("expected every request to reach an upstream\nreceived: %v", hits)
+	}
+	if variants[VariantExperiment] != hits["experiment"] || variants[VariantStable] != hits["stable"] {
+		t.Errorf("expected observed variants to match upstream hits\nexpected: %v\nreceived: %v", hits, variants)
+	}
+}
+
+func TestSplitKeyKeepsRequestsOnOneVariant(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	hits := make(map[string]int)
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		hits[r.URL.Host]++
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:          "/api",
+			Endpoint:      "http://stable",
+			SplitEndpoint: "http://experiment",
+			SplitRatio:    0.5,
+			SplitKey:      func(r *http.Request) string { return r.Header.Get("X-User") },
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.Header.Set("X-User", "user-1234")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if len(hits) != 1 {
+		t.Errorf("expected one user to land on a single variant\nreceived: %v", hits)
+	}
+}
+
+func TestSplitRatioIsValidated(t *testing.T) {
+	route := RouteRule{Path: "/api", Endpoint: "http://stable", SplitEndpoint: "http://experiment", SplitRatio: 1.5}
+	if _, err := route.validate(); err == nil {
+		t.Error("expected split ratio above 1 to be invalid")
+	}
+}
+
+func TestCanaryMatcherSelectsCanaryEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://stable/api", httpmock.NewStringResponder(200, "stable"))
+	httpmock.RegisterResponder("GET", "http://canary/api", httpmock.NewStringResponder(200, "canary"))
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: "http://stable", CanaryEndpoint: "http://canary", CanaryMatcher: HeaderEquals("X-Canary", "1")},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	for _, canary := range []bool{true, false} {
+		expected := VariantStable
+		req := httptest.NewRequest("GET", "/api", nil)
+		if canary {
+			expected = VariantCanary
+			req.Header.Set("X-Canary", "1")
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, req)
+		if recorder.Body.String() != expected {
+			t.Errorf("unexpected upstream\nexpected: %v\nreceived: %v", expected, recorder.Body.String())
+		}
+		if recorder.Header().Get("X-Upstream-Variant") != expected {
+			t.Errorf("unexpected variant header\nexpected: %v\nreceived: %v", expected, recorder.Header().Get("X-Upstream-Variant"))
+		}
+	}
+}
+
+func TestCanaryFailureDoesNotFallBackToStable(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	stableHits := 0
+	httpmock.RegisterResponder("GET", "http://stable/api", func(r *http.Request) (*http.Response, error) {
+		stableHits++
+		return httpmock.NewStringResponse(200, "stable"), nil
+	})
+	httpmock.RegisterResponder("GET", "http://canary/api", httpmock.NewErrorResponder(fmt.Errorf("connection refused")))
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: "http://stable", CanaryEndpoint: "http://canary", CanaryMatcher: CookiePresent("canary")},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.AddCookie(&http.Cookie{Name: "canary", Value: "yes"})
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("expected canary failure to be returned\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+	if stableHits != 0 {
+		t.Errorf("expected stable endpoint not to be contacted\nreceived: %v requests", stableHits)
+	}
+	if recorder.Header().Get("X-Upstream-Variant") != VariantCanary {
+		t.Errorf("unexpected variant header\nexpected: %v\nreceived: %v", VariantCanary, recorder.Header().Get("X-Upstream-Variant"))
+	}
+}
+
+func TestCanaryEndpointRequiresMatcher(t *testing.T) {
+	route := RouteRule{Path: "/api", Endpoint: "http://stable", CanaryEndpoint: "http://canary"}
+	if _, err := route.validate(); err == nil {
+		t.Error("expected canary endpoint without matcher to be invalid")
+	}
+}
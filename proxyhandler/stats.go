@@ -0,0 +1,158 @@
+package proxyhandler
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ProxyEndpoint is the endpoint to which Stats and Observation.Endpoint
+// attribute responses the proxy wrote itself because no upstream response
+// could be relayed, such as a 502 Bad Gateway for an unreachable upstream.
+const ProxyEndpoint = "proxy"
+
+// RouteStats counts the HTTP requests proxied for a route. Errors counts the
+// requests answered with a 5xx status, whether by the upstream or by the proxy
+// itself, and Retries the additional attempts made on their behalf. BytesIn
+// and BytesOut total the requests' Observation.BytesIn and BytesOut.
+// Endpoints breaks the responses down by the endpoint which served them,
+// keyed by Observation.Endpoint. Panics counts the panics recovered from the
+// route's callbacks, keyed by the callback's name, "Director" or
+// "ModifyResponse". InFlight is the number of the route's requests, including
+// websocket tunnels, being served when Stats was called.
+type RouteStats struct {
+	InFlight  int64
+	Requests  uint64
+	Errors    uint64
+	Retries   uint64
+	BytesIn   uint64
+	BytesOut  uint64
+	Endpoints map[string]EndpointStats
+	Panics    map[string]uint64
+}
+
+// EndpointStats counts the responses served by one endpoint of a route by
+// the class of their status.
+type EndpointStats struct {
+	Status2xx uint64
+	Status3xx uint64
+	Status4xx uint64
+	Status5xx uint64
+}
+
+type routeCounters struct {
+	inFlight  atomic.Int64
+	requests  atomic.Uint64
+	errors    atomic.Uint64
+	retries   atomic.Uint64
+	bytesIn   atomic.Uint64
+	bytesOut  atomic.Uint64
+	endpoints sync.Map
+	panics    callbackPanics
+}
+
+// endpointCounters counts responses by status class, from 2xx to 5xx.
+type endpointCounters struct {
+	classes [4]atomic.Uint64
+}
+
+// Endpoint returns the endpoint which served the response: the Upstream's
+// URL, or ProxyEndpoint when the proxy answered the request itself.
+func (observation *Observation) Endpoint() string {
+	if observation.Upstream == nil || (observation.Err != nil && !errors.Is(observation.Err, errStreamIdle)) {
+		return ProxyEndpoint
+	}
+	return observation.Upstream.String()
+}
+
+// StatusClass returns the class of the status written to the client, such as
+// "2xx", or an empty string for a status outside 2xx to 5xx.
+func (observation *Observation) StatusClass() string {
+	if observation.StatusCode < 200 || observation.StatusCode >= 600 {
+		return ""
+	}
+	return strconv.Itoa(observation.StatusCode/100) + "xx"
+}
+
+// routeStats holds a routeCounters for each route which has served or is
+// serving a request, keyed by the route's Path.
+type routeStats struct {
+	counters sync.Map
+}
+
+// route returns the counters of the route with Path path.
+func (stats *routeStats) route(path string) *routeCounters {
+	value, ok := stats.counters.Load(path)
+	if !ok {
+		value, _ = stats.counters.LoadOrStore(path, &routeCounters{})
+	}
+	return value.(*routeCounters)
+}
+
+func (stats *routeStats) record(observation *Observation) {
+	counters := stats.route(observation.Route)
+	counters.requests.Add(1)
+	if observation.StatusCode >= 500 {
+		counters.errors.Add(1)
+	}
+	if observation.Attempts > 1 {
+		counters.retries.Add(uint64(observation.Attempts - 1))
+	}
+	counters.bytesIn.Add(uint64(observation.BytesIn))
+	counters.bytesOut.Add(uint64(observation.BytesOut))
+	if observation.StatusClass() != "" {
+		endpoint := observation.Endpoint()
+		value, ok := counters.endpoints.Load(endpoint)
+		if !ok {
+			value, _ = counters.endpoints.LoadOrStore(endpoint, &endpointCounters{})
+		}
+		value.(*endpointCounters).classes[observation.StatusCode/100-2].Add(1)
+	}
+}
+
+// begin counts a request of the route with Path path as in flight until the
+// function it returns is called.
+func (stats *routeStats) begin(path string) func() {
+	counters := stats.route(path)
+	counters.inFlight.Add(1)
+	return func() { counters.inFlight.Add(-1) }
+}
+
+// recordPanic counts a panic of the callback of the route with Path path.
+func (stats *routeStats) recordPanic(path, callback string) {
+	stats.route(path).panics.counter(callback).Add(1)
+}
+
+// Stats returns the counters of every route which has served or is serving a
+// request, keyed by the route's Path. The default route is keyed by the empty string.
+// Counters are kept for routes which have since been removed.
+func (handler *ProxyHandler) Stats() map[string]RouteStats {
+	stats := make(map[string]RouteStats)
+	handler.stats.counters.Range(func(key, value interface{}) bool {
+		counters := value.(*routeCounters)
+		routeStats := RouteStats{
+			InFlight:  counters.inFlight.Load(),
+			Requests:  counters.requests.Load(),
+			Errors:    counters.errors.Load(),
+			Retries:   counters.retries.Load(),
+			BytesIn:   counters.bytesIn.Load(),
+			BytesOut:  counters.bytesOut.Load(),
+			Endpoints: make(map[string]EndpointStats),
+			Panics:    counters.panics.counts(),
+		}
+		counters.endpoints.Range(func(key, value interface{}) bool {
+			classes := &value.(*endpointCounters).classes
+			routeStats.Endpoints[key.(string)] = EndpointStats{
+				Status2xx: classes[0].Load(),
+				Status3xx: classes[1].Load(),
+				Status4xx: classes[2].Load(),
+				Status5xx: classes[3].Load(),
+			}
+			return true
+		})
+		stats[key.(string)] = routeStats
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,53 @@
+package proxyhandler
+
+import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestStatsBreakDownResponsesByEndpoint(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var statuses []string
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		switch r.URL.Host + r.URL.Path {
+		case "two/api/missing":
+			return httpmock.NewStringResponse(404, "missing"), nil
+		case "one/api/broken":
+			return httpmock.NewStringResponse(500, "broken"), nil
+		case "two/api/broken":
+			return nil, errors.New("connection refused")
+		}
+		return httpmock.NewStringResponse(200, "ok"), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoints: []string{"http://one", "http://two"}},
+	}
+	config.Observer = func(observation *Observation) {
+		statuses = append(statuses, observation.Endpoint()+" "+observation.StatusClass())
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	// requests alternate between the endpoints, starting with one
+	dispatchBodies(h, []string{"/api/ok", "/api/ok", "/api/ok", "/api/missing", "/api/broken", "/api/broken"})
+
+	expectedStatuses := []string{"http://one 2xx", "http://two 2xx", "http://one 2xx", "http://two 4xx", "http://one 5xx", "proxy 5xx"}
+	if !reflect.DeepEqual(statuses, expectedStatuses) {
+		t.Errorf("unexpected observed attribution\nexpected: %v\nreceived: %v", expectedStatuses, statuses)
+	}
+	expected := map[string]EndpointStats{
+		"http://one":  {Status2xx: 2, Status5xx: 1},
+		"http://two":  {Status2xx: 1, Status4xx: 1},
+		ProxyEndpoint: {Status5xx: 1},
+	}
+	if received := h.Stats()["/api"].Endpoints; !reflect.DeepEqual(received, expected) {
+		t.Errorf("unexpected endpoint breakdown\nexpected: %v\nreceived: %v", expected, received)
+	}
+}
@@ -0,0 +1,40 @@
+package proxyhandler
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mapStatus applies the route's StatusMapping and StatusBodies to an upstream
+// response before it is written to the client. 206 Partial Content is never
+// mapped, as its body is only meaningful alongside its Content-Range.
+func (route *validRouteRule) mapStatus(response *http.Response) {
+	upstreamStatus := response.StatusCode
+	if upstreamStatus == http.StatusPartialContent {
+		return
+	}
+	if status, ok := route.StatusMapping[upstreamStatus]; ok {
+		response.StatusCode = status
+		response.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	}
+	if body, ok := route.StatusBodies[upstreamStatus]; ok && hasBody(response) {
+		response.Body.Close()
+		response.Body = io.NopCloser(strings.NewReader(body))
+		response.ContentLength = int64(len(body))
+		response.Header.Del("Content-Encoding")
+		response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+}
+
+func validStatus(status int) bool {
+	return status >= 100 && status <= 999
+}
+
+// validMappedStatus reports whether status may replace an upstream's: a final
+// status of a class defined by HTTP, since a 1xx would be followed by an
+// implicit 200.
+func validMappedStatus(status int) bool {
+	return status >= 200 && status <= 599
+}
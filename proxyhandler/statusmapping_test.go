@@ -0,0 +1,90 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusMappingAppliesPerRoute(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://search/search/empty", httpmock.NewStringResponder(404, "no results"))
+	httpmock.RegisterResponder("GET", "http://other/other/missing", httpmock.NewStringResponder(404, "not found"))
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:          "/search",
+			Endpoint:      "http://search",
+			StatusMapping: map[int]int{404: 200},
+			StatusBodies:  map[int]string{404: "[]"},
+		},
+		&RouteRule{Path: "/other", Endpoint: "http://other"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/search/empty", 200, "[]"},
+		{"/other/missing", 404, "not found"},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", c.path, nil))
+		if recorder.Code != c.status {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", c.path, c.status, recorder.Code)
+		}
+		if recorder.Body.String() != c.body {
+			t.Errorf("unexpected body for %s\nexpected: %v\nreceived: %v", c.path, c.body, recorder.Body.String())
+		}
+	}
+}
+
+func TestStatusMappingSkipsProxyErrors(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterResponder("GET", "http://search/search", httpmock.NewErrorResponder(fmt.Errorf("connection refused")))
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{
+			Path:          "/search",
+			Endpoint:      "http://search",
+			StatusMapping: map[int]int{502: 200},
+		},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/search", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("expected proxy error to be left unmapped\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+}
+
+func TestStatusMappingIsValidated(t *testing.T) {
+	expectedError := "invalid status mapping"
+	for _, mapping := range []map[int]int{{404: 20}, {404: 103}, {404: 600}, {404: 999}, {20: 404}} {
+		route := RouteRule{Path: "/", Endpoint: "http://upstream", StatusMapping: mapping}
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("%v: expected error not found\nexpected: %v\nreceived: %v", mapping, expectedError, err)
+		}
+	}
+	route := RouteRule{Path: "/", Endpoint: "http://upstream", StatusMapping: map[int]int{404: 200, 500: 599}}
+	if _, err := route.validate(); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
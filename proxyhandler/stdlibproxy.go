@@ -0,0 +1,206 @@
+package proxyhandler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"time"
+)
+
+// modifyResponseError marks an error returned while modifying an upstream
+// response, which is answered with a 500 rather than treated as an upstream
+// failure.
+type modifyResponseError struct {
+	err error
+}
+
+func (err *modifyResponseError) Error() string { return err.err.Error() }
+func (err *modifyResponseError) Unwrap() error { return err.err }
+
+// reverseProxyBuffers lends the handler's copy buffers to an
+// httputil.ReverseProxy.
+type reverseProxyBuffers struct {
+	buffers *bufferPool
+}
+
+func (pool reverseProxyBuffers) Get() []byte {
+	return *pool.buffers.pool.Get().(*[]byte)
+}
+
+func (pool reverseProxyBuffers) Put(buffer []byte) {
+	pool.buffers.pool.Put(&buffer)
+}
+
+// forwardWithReverseProxy is the counterpart of forwardHTTPRequest used when
+// the Configuration enables StdlibProxy. The request is forwarded by an
+// httputil.ReverseProxy configured with the route's rewriting, Director,
+// ModifyResponse and status mapping and the handler's error handling.
+func (handler *ProxyHandler) forwardWithReverseProxy(route *validRouteRule, observation *Observation, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) (int, error) {
+	start := time.Now()
+	if observation.Variant != "" {
+		upstreamWriter.Header().Set("X-Upstream-Variant", observation.Variant)
+	}
+	progress := &upstreamProgress{}
+	var sent, sentAt time.Time
+	var status int
+	var proxyErr error
+	transport := handler.clientFor(route).Transport
+	if len(route.RequestHeaderCase) > 0 {
+		transport = &headerCaseTransport{transport, route.RequestHeaderCase}
+	}
+	if route.Signer != nil {
+		transport = &signingTransport{transport, route.Signer, handler.configuration.BufferBodyBytes}
+	}
+	guard := &headerGuardTransport{transport: transport}
+	if len(route.ResponseHeaderCase) > 0 {
+		upstreamWriter = &headerCaseWriter{upstreamWriter, route.ResponseHeaderCase}
+	}
+	informational := newInformationalFilter(upstreamWriter, route.ForwardInformational)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(proxyRequest *httputil.ProxyRequest) {
+			// ReverseProxy drops the forwarding headers; the handler's policy
+			// decides which of them reach the upstream
+			for _, name := range forwardingHeaders {
+				if values, ok := proxyRequest.In.Header[name]; ok {
+					proxyRequest.Out.Header[name] = values
+				}
+			}
+			handler.forwardClient(proxyRequest.Out.Header, proxyRequest.In)
+			handler.setUserAgent(proxyRequest.Out.Header, proxyRequest.In)
+			handler.setQueueDurationHeader(proxyRequest.Out.Header, proxyRequest.In)
+			if handler.configuration.DevOverrideHeader != "" {
+				proxyRequest.Out.Header.Del(handler.configuration.DevOverrideHeader)
+			}
+			if handler.configuration.DebugToken != "" {
+				proxyRequest.Out.Header.Del(debugRequestHeader)
+			}
+			proxyRequest.Out.URL = route.rewritePath(buildDownstreamRequestURL(proxyRequest.In.URL, observation.Upstream))
+			handler.mapHost(proxyRequest.Out.URL, proxyRequest.In.Host)
+			proxyRequest.Out.Host = proxyRequest.Out.URL.Host
+			route.addJarCookies(proxyRequest.Out)
+			var before http.Header
+			if handler.guardsHeaders(route) {
+				before = proxyRequest.Out.Header.Clone()
+			}
+			route.setContextHeaders(proxyRequest.Out, proxyRequest.In)
+			route.setSubdomainHeader(proxyRequest.Out, proxyRequest.In)
+			if route.Director != nil {
+				originalBody, originalLength := proxyRequest.Out.Body, proxyRequest.Out.ContentLength
+				guard.err = handler.callDirector(route, proxyRequest.Out)
+				syncRequestLength(proxyRequest.Out, originalBody, originalLength)
+			}
+			if before != nil && guard.err == nil {
+				guard.err = handler.checkHeaderRules(route, before, proxyRequest.Out)
+			}
+			ctx := progress.trace(proxyRequest.Out.Context())
+			if route.ProxyProtocol != 0 {
+				ctx = withProxyProtocolAddresses(ctx, proxyRequest.In)
+			}
+			if handler.configuration.ClientTrace != nil {
+				if trace := handler.configuration.ClientTrace(proxyRequest.Out); trace != nil {
+					ctx = httptrace.WithClientTrace(ctx, trace)
+				}
+			}
+			proxyRequest.Out = proxyRequest.Out.WithContext(ctx)
+			sent, sentAt = time.Now(), handler.now()
+		},
+		Transport:  guard,
+		BufferPool: reverseProxyBuffers{handler.buffers},
+		ModifyResponse: func(response *http.Response) error {
+			informational.settle()
+			upstreamLatency := time.Since(sent)
+			observation.Ejected = handler.recordAttempt(route, observation, response, nil, handler.now().Sub(sentAt))
+			route.keepJarCookies(response)
+			if err := handler.checkResponseHeaders(route, response); err != nil {
+				// reported to ErrorHandler as an upstream failure
+				return err
+			}
+			originalBody, originalLength := response.Body, response.ContentLength
+			route.unrewriteResponse(response, upstreamRequest)
+			if handler.configuration.DecompressForClients {
+				if err := decompressForClient(response, upstreamRequest); err != nil {
+					return err
+				}
+			}
+			buffered, err := route.bufferResponse(response)
+			if err != nil {
+				return err
+			}
+			if route.ModifyResponse != nil {
+				if err := handler.modifyResponse(route, response, buffered); err != nil {
+					return &modifyResponseError{err}
+				}
+			}
+			route.wrapResponseBody(response)
+			route.mapStatus(response)
+			syncResponseLength(response, originalBody, originalLength)
+			dropBody(response)
+			handler.setStrictTransportSecurity(response.Header, upstreamRequest)
+			handler.configuration.SecurityHeaders.apply(response.Header)
+			route.setCORSHeaders(response.Header, upstreamRequest)
+			if handler.wantsDebugHeaders(upstreamRequest) {
+				// the handler's own are already set on the client's response,
+				// which ReverseProxy adds the upstream's headers to
+				response.Header.Del("X-Proxy-Route")
+				response.Header.Del("X-Proxy-Upstream")
+			}
+			if handler.configuration.TimingHeaders {
+				setTimingHeaders(response.Header, upstreamLatency, time.Since(start))
+			}
+			status = response.StatusCode
+			return nil
+		},
+		ErrorHandler: func(writer http.ResponseWriter, request *http.Request, err error) {
+			informational.settle()
+			var modifyErr *modifyResponseError
+			if errors.As(err, &modifyErr) {
+				handler.handleUnexpectedError(modifyErr.err, writer, request)
+				status, proxyErr = http.StatusInternalServerError, modifyErr.err
+				return
+			}
+			var ruleErr *headerRuleError
+			if errors.As(err, &ruleErr) {
+				handler.handleUnexpectedError(ruleErr.err, writer, request)
+				status, proxyErr = http.StatusInternalServerError, ruleErr.err
+				return
+			}
+			var signErr *signRequestError
+			if errors.As(err, &signErr) {
+				if errors.Is(signErr.err, errBodyTooLargeToSign) {
+					handler.handleError(signErr.err, http.StatusRequestEntityTooLarge, writer, request)
+					status, proxyErr = http.StatusRequestEntityTooLarge, signErr.err
+					return
+				}
+				handler.handleUnexpectedError(signErr.err, writer, request)
+				status, proxyErr = http.StatusInternalServerError, signErr.err
+				return
+			}
+			if !sentAt.IsZero() {
+				observation.Ejected = handler.recordAttempt(route, observation, nil, err, handler.now().Sub(sentAt))
+			}
+			status, proxyErr = handler.handleUpstreamError(err, progress, writer, request)
+		},
+	}
+	if aborted := serveAborting(proxy, informational, upstreamRequest); aborted {
+		proxyErr = errResponseAborted
+	}
+	observation.ConnWait = progress.waited()
+	return status, proxyErr
+}
+
+// serveAborting serves request with proxy, reporting whether it aborted the
+// response, as an httputil.ReverseProxy does when copying the body fails, so
+// that the request is observed before the abort is raised again.
+func serveAborting(proxy http.Handler, writer http.ResponseWriter, request *http.Request) (aborted bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != http.ErrAbortHandler {
+				panic(recovered)
+			}
+			aborted = true
+		}
+	}()
+	proxy.ServeHTTP(writer, request)
+	return false
+}
@@ -0,0 +1,107 @@
+package proxyhandler
+
+import (
+	"errors"
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"testing"
+)
+
+func TestStdlibProxyForwardsInformationalResponsesOnlyWhenRoutesOptIn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstream.URL
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/hints", Endpoint: upstream.URL, ForwardInformational: true},
+	}
+	config.StdlibProxy = true
+	config.DebugHeaders = true
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	expectations := map[string]int{"/hints": 1, "/": 0}
+	for path, expectedHints := range expectations {
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		}
+		request, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		response, err := http.DefaultClient.Do(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status\nexpected: %v\nreceived: %v", path, http.StatusOK, response.StatusCode)
+		}
+		if len(hints) != expectedHints || (expectedHints > 0 && hints[0] != "</style.css>; rel=preload; as=style") {
+			t.Errorf("%s: unexpected early hints\nexpected: %v\nreceived: %v", path, expectedHints, hints)
+		}
+		if response.Header.Get("X-Proxy-Route") == "" {
+			t.Errorf("%s: expected the handler's headers to survive the early hints", path)
+		}
+	}
+}
+
+func TestProxyModesAnswerFailuresAlike(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			httpmock.RegisterResponder("GET", "http://unreachable/", httpmock.NewErrorResponder(errors.New("connection refused")))
+			httpmock.RegisterResponder("GET", "http://endpoint.one/route1", httpmock.NewStringResponder(200, "ok"))
+			var observations []*Observation
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = "http://unreachable"
+			config.Routes[0].ModifyResponse = func(*http.Response) error { return errors.New("rejected") }
+			config.Observer = func(observation *Observation) { observations = append(observations, observation) }
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+
+			expectations := map[string]int{
+				"/":       http.StatusBadGateway,
+				"/route1": http.StatusInternalServerError,
+			}
+			for path, expected := range expectations {
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+				if recorder.Code != expected {
+					t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", path, expected, recorder.Code)
+				}
+				observation := observations[len(observations)-1]
+				if observation.StatusCode != expected || observation.Err == nil {
+					t.Errorf("unexpected observation for %s\nexpected: %v\nreceived: %v %v", path, expected, observation.StatusCode, observation.Err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var errTemplateValue = errors.New("invalid endpoint template value")
+
+// templatePlaceholder matches the placeholders of an EndpointTemplate, such
+// as {tenant}.
+var templatePlaceholder = regexp.MustCompile(`\{[A-Za-z0-9_]+\}`)
+
+// maxTemplateValueLength is the length of the longest DNS label.
+const maxTemplateValueLength = 63
+
+// parseEndpointTemplate validates a route's EndpointTemplate by filling it
+// with a sample value. The resulting URL stands for the route's endpoint
+// until a request supplies the real value.
+func parseEndpointTemplate(route RouteRule) (*url.URL, error) {
+	if len(route.Endpoint) > 0 || len(route.Endpoints) > 0 {
+		return nil, fmt.Errorf("endpoint template cannot be combined with endpoints")
+	}
+	if route.TemplateValue == nil {
+		return nil, fmt.Errorf("endpoint template requires a template value function")
+	}
+	if !templatePlaceholder.MatchString(route.EndpointTemplate) {
+		return nil, fmt.Errorf("endpoint template %q has no placeholder", route.EndpointTemplate)
+	}
+	endpointURL, err := parseEndpoint(templatePlaceholder.ReplaceAllLiteralString(route.EndpointTemplate, "placeholder"))
+	if err != nil {
+		return nil, fmt.Errorf("endpoint template: %s", err.Error())
+	}
+	return endpointURL, nil
+}
+
+// validTemplateValue reports whether value may be substituted into an
+// endpoint template. Only letters, digits and hyphens are allowed, so that a
+// value can neither leave the host label it fills nor add a path, port,
+// userinfo or query to the URL.
+func validTemplateValue(value string) bool {
+	if value == "" || len(value) > maxTemplateValueLength {
+		return false
+	}
+	for _, char := range value {
+		if !('a' <= char && char <= 'z' || 'A' <= char && char <= 'Z' || '0' <= char && char <= '9' || char == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveTemplate returns a copy of the route directed to the endpoint its
+// template names for request.
+func (route *validRouteRule) resolveTemplate(request *http.Request) (*validRouteRule, error) {
+	value, err := route.TemplateValue(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errTemplateValue, err.Error())
+	}
+	if !validTemplateValue(value) {
+		return nil, fmt.Errorf("%w %q", errTemplateValue, value)
+	}
+	endpointURL, err := parseEndpoint(templatePlaceholder.ReplaceAllLiteralString(route.EndpointTemplate, value))
+	if err == nil && route.EndpointURL.Scheme == "https" {
+		// the template was upgraded when the route was validated if ForceHTTPS
+		// applies to it
+		endpointURL = upgradeToHTTPS(endpointURL)
+	}
+	if err != nil || endpointURL.Scheme != route.EndpointURL.Scheme {
+		return nil, fmt.Errorf("%w %q", errTemplateValue, value)
+	}
+	resolved := *route
+	resolved.EndpointURL = endpointURL
+	resolved.EndpointURLs = []*url.URL{endpointURL}
+	resolved.rotation = nil
+	return &resolved, nil
+}
+
+// TemplateFromHeader returns a TemplateValue which reads the header name. It
+// fails for requests without the header.
+func TemplateFromHeader(name string) func(*http.Request) (string, error) {
+	return func(request *http.Request) (string, error) {
+		value := request.Header.Get(name)
+		if value == "" {
+			return "", fmt.Errorf("header %s is missing", name)
+		}
+		return value, nil
+	}
+}
+
+// TemplateFromPathSegment returns a TemplateValue which reads the segment of
+// the request path at index, counting from zero. It fails for requests whose
+// path has no such segment.
+func TemplateFromPathSegment(index int) func(*http.Request) (string, error) {
+	return func(request *http.Request) (string, error) {
+		segments := strings.Split(strings.TrimPrefix(request.URL.Path, "/"), "/")
+		if index < 0 || index >= len(segments) || segments[index] == "" {
+			return "", fmt.Errorf("path has no segment %d", index)
+		}
+		return segments[index], nil
+	}
+}
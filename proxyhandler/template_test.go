@@ -0,0 +1,107 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEndpointTemplateRoutesByTenant(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	var hosts []string
+	httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		return httpmock.NewStringResponse(200, r.URL.Host+r.URL.Path), nil
+	})
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", EndpointTemplate: "http://{tenant}.internal.svc", TemplateValue: TemplateFromHeader("X-Tenant")},
+		&RouteRule{Path: "/t/", EndpointTemplate: "http://{tenant}.internal.svc:8080", TemplateValue: TemplateFromPathSegment(1)},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	tests := []struct {
+		path     string
+		tenant   string
+		status   int
+		expected string
+	}{
+		{"/api/orders", "acme", 200, "acme.internal.svc/api/orders"},
+		{"/api/orders", "Globex-2", 200, "Globex-2.internal.svc/api/orders"},
+		{"/t/initech/orders", "", 200, "initech.internal.svc:8080/t/initech/orders"},
+		{"/api/orders", "", 400, ""},
+		{"/t/", "", 400, ""},
+		{"/api/orders", "evil.com/", 400, ""},
+		{"/api/orders", "evil.com", 400, ""},
+		{"/api/orders", "user@evil.com", 400, ""},
+		{"/api/orders", "evil.com:80", 400, ""},
+		{"/api/orders", "evil.com#", 400, ""},
+		{"/api/orders", "evil%2ecom", 400, ""},
+		{"/t/evil.com%2F/orders", "", 400, ""},
+		{"/t/evil.com/orders", "", 400, ""},
+	}
+	for _, test := range tests {
+		hosts = nil
+		request := httptest.NewRequest("GET", test.path, nil)
+		if test.tenant != "" {
+			request.Header.Set("X-Tenant", test.tenant)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("unexpected status for %s with tenant %q\nexpected: %v\nreceived: %v", test.path, test.tenant, test.status, recorder.Code)
+		}
+		if test.status != 200 {
+			if len(hosts) > 0 {
+				t.Errorf("expected no upstream request for %s with tenant %q\nreceived: %v", test.path, test.tenant, hosts)
+			}
+			continue
+		}
+		if received := recorder.Body.String(); received != test.expected {
+			t.Errorf("unexpected upstream for %s with tenant %q\nexpected: %v\nreceived: %v", test.path, test.tenant, test.expected, received)
+		}
+	}
+}
+
+func TestEndpointTemplateValueErrorsAreBadRequests(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/", EndpointTemplate: "http://{tenant}.internal.svc", TemplateValue: func(*http.Request) (string, error) {
+			return "", fmt.Errorf("no tenant")
+		}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestEndpointTemplatesAreValidated(t *testing.T) {
+	tenant := TemplateFromHeader("X-Tenant")
+	tests := []RouteRule{
+		{Path: "/", EndpointTemplate: "http://internal.svc", TemplateValue: tenant},
+		{Path: "/", EndpointTemplate: "http://{tenant}.internal.svc"},
+		{Path: "/", EndpointTemplate: "ftp://{tenant}.internal.svc", TemplateValue: tenant},
+		{Path: "/", EndpointTemplate: "http://{tenant}.internal.svc", Endpoint: "http://other", TemplateValue: tenant},
+	}
+	for _, route := range tests {
+		if _, err := route.validate(); err == nil {
+			t.Errorf("expected endpoint template %q to be rejected", route.EndpointTemplate)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxyhandler
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Errors wrapped by upstream failures which timed out, identifying the stage
+// of the upstream exchange which took too long.
+var (
+	ErrDialTimeout           = errors.New("timed out connecting to upstream")
+	ErrTLSHandshakeTimeout   = errors.New("timed out in TLS handshake with upstream")
+	ErrResponseHeaderTimeout = errors.New("timed out awaiting upstream response headers")
+)
+
+// upstreamProgress records how far an upstream request got, so a timeout can
+// be attributed to the stage it interrupted, and how long it waited for a
+// connection.
+type upstreamProgress struct {
+	mutex          sync.Mutex
+	connectStarted bool
+	tlsStarted     bool
+	tlsDone        bool
+	gotConn        bool
+	getConnAt      time.Time
+	connWait       time.Duration
+}
+
+func (progress *upstreamProgress) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			progress.mutex.Lock()
+			progress.getConnAt = time.Now()
+			progress.mutex.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			progress.mark(&progress.connectStarted)
+		},
+		TLSHandshakeStart: func() {
+			progress.mark(&progress.tlsStarted)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				progress.mark(&progress.tlsDone)
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			progress.mutex.Lock()
+			progress.gotConn = true
+			if !progress.getConnAt.IsZero() {
+				progress.connWait += time.Since(progress.getConnAt)
+			}
+			progress.mutex.Unlock()
+		},
+	})
+}
+
+func (progress *upstreamProgress) mark(stage *bool) {
+	progress.mutex.Lock()
+	*stage = true
+	progress.mutex.Unlock()
+}
+
+// waited returns the time spent waiting for upstream connections, including
+// dialing them.
+func (progress *upstreamProgress) waited() time.Duration {
+	if progress == nil {
+		return 0
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return progress.connWait
+}
+
+// connected reports whether the request was given a connection, after which
+// the upstream may have received it.
+func (progress *upstreamProgress) connected() bool {
+	if progress == nil {
+		return false
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return progress.gotConn
+}
+
+// classify wraps a timeout err with the sentinel for the stage it interrupted,
+// or an oversized response header with ErrResponseHeadersTooLarge, and returns
+// the status it should be answered with.
+func (progress *upstreamProgress) classify(err error) (int, error) {
+	if isResponseHeaderSizeError(err) {
+		return http.StatusBadGateway, fmt.Errorf("%w: %w", ErrResponseHeadersTooLarge, err)
+	}
+	var netErr net.Error
+	if !errors.Is(err, context.DeadlineExceeded) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusBadGateway, err
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	switch {
+	case progress.gotConn:
+		return http.StatusGatewayTimeout, fmt.Errorf("%w: %w", ErrResponseHeaderTimeout, err)
+	case progress.tlsStarted && !progress.tlsDone:
+		return http.StatusBadGateway, fmt.Errorf("%w: %w", ErrTLSHandshakeTimeout, err)
+	case progress.connectStarted:
+		return http.StatusBadGateway, fmt.Errorf("%w: %w", ErrDialTimeout, err)
+	}
+	return http.StatusGatewayTimeout, err
+}
@@ -0,0 +1,70 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newBlackholeAddress returns a loopback address which never completes a TCP
+// handshake. The listener's backlog is filled and never accepted from, so the
+// kernel drops further connection attempts as a blackholed host would.
+func newBlackholeAddress(t *testing.T) (string, func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("unable to create socket: %s", err.Error())
+	}
+	closeSocket := func() { syscall.Close(fd) }
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		closeSocket()
+		t.Fatalf("unable to bind: %s", err.Error())
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		closeSocket()
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	socketAddr, _ := syscall.Getsockname(fd)
+	addr := fmt.Sprintf("127.0.0.1:%d", socketAddr.(*syscall.SockaddrInet4).Port)
+
+	var filling []net.Conn
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 50*time.Millisecond)
+		if err != nil {
+			break
+		}
+		filling = append(filling, conn)
+	}
+	return addr, func() {
+		for _, conn := range filling {
+			conn.Close()
+		}
+		closeSocket()
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	addr, closeBlackhole := newBlackholeAddress(t)
+	defer closeBlackhole()
+	config := buildConfiguration()
+	config.DefaultRoute = "http://" + addr
+	config.DialTimeout = 50 * time.Millisecond
+
+	started := time.Now()
+	status, err := serveTimingOut(t, config, "/")
+	if status != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, status)
+	}
+	if !errors.Is(err, ErrDialTimeout) {
+		t.Errorf("expected dial timeout\nexpected: %v\nreceived: %v", ErrDialTimeout, err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("expected dial to fail fast\nreceived: %v", elapsed)
+	}
+}
@@ -0,0 +1,200 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStallingListener accepts connections and holds them open without ever
+// writing to them, stalling TLS handshakes and HTTP responses alike.
+func newStallingListener(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	var mutex sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// serveTimingOut sends a request through a handler built from config and
+// returns the status written and the error reported to the Observer.
+func serveTimingOut(t *testing.T, config *Configuration, path string) (int, error) {
+	var observed error
+	config.Transport = nil
+	config.Observer = func(observation *Observation) {
+		observed = observation.Err
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder.Code, observed
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	addr, closeListener := newStallingListener(t)
+	defer closeListener()
+	config := buildConfiguration()
+	config.DefaultRoute = "https://" + addr
+	config.TLSHandshakeTimeout = 50 * time.Millisecond
+
+	status, err := serveTimingOut(t, config, "/")
+	if status != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, status)
+	}
+	if !errors.Is(err, ErrTLSHandshakeTimeout) {
+		t.Errorf("expected TLS handshake timeout\nexpected: %v\nreceived: %v", ErrTLSHandshakeTimeout, err)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	addr, closeListener := newStallingListener(t)
+	defer closeListener()
+	config := buildConfiguration()
+	config.DefaultRoute = "http://" + addr
+	config.ResponseHeaderTimeout = 50 * time.Millisecond
+
+	status, err := serveTimingOut(t, config, "/")
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusGatewayTimeout, status)
+	}
+	if !errors.Is(err, ErrResponseHeaderTimeout) {
+		t.Errorf("expected response header timeout\nexpected: %v\nreceived: %v", ErrResponseHeaderTimeout, err)
+	}
+}
+
+func TestRouteResponseHeaderTimeoutOverridesHandler(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	config := buildConfiguration()
+	config.DefaultRoute = slow.URL
+	config.ResponseHeaderTimeout = 20 * time.Millisecond
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/patient", Endpoint: slow.URL, ResponseHeaderTimeout: time.Second},
+	}
+
+	if status, _ := serveTimingOut(t, config, "/hasty"); status != http.StatusGatewayTimeout {
+		t.Errorf("expected handler timeout to apply\nexpected: %v\nreceived: %v", http.StatusGatewayTimeout, status)
+	}
+	if status, err := serveTimingOut(t, config, "/patient"); status != http.StatusOK {
+		t.Errorf("expected route timeout to apply\nexpected: %v\nreceived: %v (%v)", http.StatusOK, status, err)
+	}
+}
+
+func TestRouteResponseHeaderTimeoutWithIdleTimeout(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	addr, closeListener := newStallingListener(t)
+	defer closeListener()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/stalled", Endpoint: "http://" + addr, ResponseHeaderTimeout: 100 * time.Millisecond, IdleTimeout: 20 * time.Millisecond},
+		&RouteRule{Path: "/slow", Endpoint: slow.URL, IdleTimeout: 20 * time.Millisecond},
+	}
+
+	// the idle timeout only applies once the response has begun
+	status, err := serveTimingOut(t, config, "/stalled")
+	if status != http.StatusGatewayTimeout || !errors.Is(err, ErrResponseHeaderTimeout) {
+		t.Errorf("expected response header timeout\nexpected: %v %v\nreceived: %v %v", http.StatusGatewayTimeout, ErrResponseHeaderTimeout, status, err)
+	}
+	if status, err := serveTimingOut(t, config, "/slow"); status != http.StatusOK || err != nil {
+		t.Errorf("expected a slow response to complete\nexpected: %v\nreceived: %v (%v)", http.StatusOK, status, err)
+	}
+}
+
+func TestIdleTimeoutBoundsGapsNotTransfers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+		if r.URL.Path == "/stall" {
+			<-r.Context().Done()
+		}
+	}))
+	defer upstream.Close()
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/", Endpoint: upstream.URL, ResponseHeaderTimeout: 100 * time.Millisecond, IdleTimeout: 100 * time.Millisecond},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	// the download outlasts both timeouts while it keeps making progress
+	response, err := http.Get(proxy.URL + "/download")
+	if err != nil {
+		t.Fatalf("unable to download: %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || strings.Count(string(body), "chunk") != 8 {
+		t.Errorf("expected the download to complete\nreceived: %q %v", body, err)
+	}
+
+	// the response may be aborted before its buffered header is sent
+	response, err = http.Get(proxy.URL + "/stall")
+	if err == nil {
+		body, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("expected a stalled download to be aborted\nreceived: %q", body)
+	}
+}
@@ -0,0 +1,66 @@
+package proxyhandler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errNoPinnedCertificate fails the TLS handshake with an upstream whose leaf
+// certificate does not match the route's TLSPins.
+var errNoPinnedCertificate = errors.New("no upstream certificate matches the route's pins")
+
+// SPKIPin returns the pin of certificate for a route's TLSPins: the base64
+// encoded SHA-256 hash of its DER encoded SubjectPublicKeyInfo.
+func SPKIPin(certificate *x509.Certificate) string {
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// parseTLSPins decodes pins, which may be prefixed with "sha256/" as they are
+// in HTTP Public Key Pinning.
+func parseTLSPins(pins []string) ([][]byte, error) {
+	hashes := make([][]byte, len(pins))
+	for index, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("tls pin %q is not a base64 encoded SHA-256 hash", pin)
+		}
+		hashes[index] = hash
+	}
+	return hashes, nil
+}
+
+// pinnedTLSConfig returns a copy of config which accepts an upstream only when
+// the public key of its leaf certificate matches one of pins, in place of
+// verifying its chain and host name. The handshake proves possession of the
+// leaf's key alone, so certificates further up the chain are not compared.
+func pinnedTLSConfig(config *tls.Config, pins [][]byte) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errNoPinnedCertificate
+		}
+		certificate, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(hash[:], pin) == 1 {
+				return nil
+			}
+		}
+		return errNoPinnedCertificate
+	}
+	return config
+}
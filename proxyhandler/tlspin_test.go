@@ -0,0 +1,95 @@
+package proxyhandler
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRouteTLSPins(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	pin := SPKIPin(upstream.Certificate())
+	wrongHash := sha256.Sum256([]byte("another key"))
+	wrongPin := base64.StdEncoding.EncodeToString(wrongHash[:])
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/pinned", Endpoint: upstream.URL, TLSPins: []string{pin}},
+		&RouteRule{Path: "/rotating", Endpoint: upstream.URL, TLSPins: []string{"sha256/" + wrongPin, "sha256/" + pin}},
+		&RouteRule{Path: "/wrong", Endpoint: upstream.URL, TLSPins: []string{wrongPin}},
+		&RouteRule{Path: "/unpinned", Endpoint: upstream.URL},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	// the test server's certificate is not signed by a trusted authority
+	expectations := map[string]int{
+		"/pinned":   http.StatusOK,
+		"/rotating": http.StatusOK,
+		"/wrong":    http.StatusBadGateway,
+		"/unpinned": http.StatusBadGateway,
+	}
+	for path, expected := range expectations {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != expected {
+			t.Errorf("%s: unexpected status\nexpected: %v\nreceived: %v", path, expected, recorder.Code)
+		}
+	}
+}
+
+func TestRouteTLSPinsValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"tls pins require an https endpoint": RouteRule{Path: "/", Endpoint: "http://one", TLSPins: []string{strings.Repeat("A", 43) + "="}},
+		"is not a base64 encoded SHA-256":    RouteRule{Path: "/", Endpoint: "https://one", TLSPins: []string{"c2hvcnQ="}},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestRouteTLSPinsIgnoreCertificatesAfterTheLeaf(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	pinned := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pinned.Close()
+	// an impostor presenting its own leaf followed by the pinned certificate
+	certificate, _, _ := newSelfSignedCertificate(t, "impostor", 1)
+	certificate.Certificate = append(certificate.Certificate, pinned.Certificate().Raw)
+	impostor := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	impostor.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	impostor.StartTLS()
+	defer impostor.Close()
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/impostor", Endpoint: impostor.URL, TLSPins: []string{SPKIPin(pinned.Certificate())}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/impostor", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadGateway, recorder.Code)
+	}
+}
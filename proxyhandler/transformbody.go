@@ -0,0 +1,45 @@
+package proxyhandler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var (
+	errBodyTransform           = errors.New("request body transform failed")
+	errBodyTooLargeToTransform = errors.New("request body is too large to transform")
+)
+
+// transformRequestBody applies the route's TransformBody to the body of
+// request, replacing the body and its length. It returns the status to
+// refuse the request with when the body cannot be transformed.
+func (route *validRouteRule) transformRequestBody(request *http.Request) (int, error) {
+	if route.TransformBody == nil || request.Body == nil || request.Body == http.NoBody {
+		return 0, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(request.Body, route.TransformBodyBytes+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("reading request body: %s", err.Error())
+	}
+	if int64(len(body)) > route.TransformBodyBytes {
+		if route.RejectOversizedBodies {
+			return http.StatusRequestEntityTooLarge, errBodyTooLargeToTransform
+		}
+		request.Body = &replacedBody{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return 0, nil
+	}
+	body, err = route.TransformBody(request.Header.Get("Content-Type"), body)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("%w: %s", errBodyTransform, err.Error())
+	}
+	request.Body = &replacedBody{bytes.NewReader(body), request.Body}
+	request.ContentLength = int64(len(body))
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	request.Header.Del("Transfer-Encoding")
+	request.TransferEncoding = nil
+	return 0, nil
+}
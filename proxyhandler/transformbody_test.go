@@ -0,0 +1,95 @@
+package proxyhandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// injectTenant adds a tenant field to JSON objects.
+func injectTenant(contentType string, body []byte) ([]byte, error) {
+	if contentType != "application/json" {
+		return body, nil
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+	object["tenant"] = "acme"
+	return json.Marshal(object)
+}
+
+type receivedBody struct {
+	body          string
+	contentLength int64
+}
+
+func TestTransformBodyRewritesRequests(t *testing.T) {
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			beforeTest()
+			defer afterTest()
+
+			var received []receivedBody
+			httpmock.RegisterNoResponder(func(r *http.Request) (*http.Response, error) {
+				body, _ := io.ReadAll(r.Body)
+				received = append(received, receivedBody{string(body), r.ContentLength})
+				return httpmock.NewStringResponse(200, ""), nil
+			})
+			config := buildConfiguration()
+			config.StdlibProxy = mode.stdlib
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/orders", Endpoint: "http://orders", TransformBody: injectTenant, TransformBodyBytes: 64},
+				&RouteRule{Path: "/strict", Endpoint: "http://orders", TransformBody: injectTenant, TransformBodyBytes: 64, RejectOversizedBodies: true},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			oversized := `{"items":"` + strings.Repeat("x", 100) + `"}`
+
+			tests := []struct {
+				path, contentType, body string
+				status                  int
+				expected                *receivedBody
+			}{
+				{"/orders", "application/json", `{"item":"widget"}`, 200, &receivedBody{`{"item":"widget","tenant":"acme"}`, 33}},
+				{"/orders", "text/plain", "unchanged", 200, &receivedBody{"unchanged", 9}},
+				{"/orders", "application/json", "not json", 400, nil},
+				{"/orders", "application/json", oversized, 200, &receivedBody{oversized, -1}},
+				{"/strict", "application/json", oversized, 413, nil},
+			}
+			for _, test := range tests {
+				received = nil
+				// a reader of unknown length makes the body stream
+				request := httptest.NewRequest("POST", test.path, io.MultiReader(strings.NewReader(test.body)))
+				request.Header.Set("Content-Type", test.contentType)
+				recorder := httptest.NewRecorder()
+				h.ServeHTTP(recorder, request)
+				if recorder.Code != test.status {
+					t.Errorf("unexpected status for %s %q\nexpected: %v\nreceived: %v", test.path, test.body, test.status, recorder.Code)
+				}
+				var expected []receivedBody
+				if test.expected != nil {
+					expected = []receivedBody{*test.expected}
+				}
+				if fmt.Sprint(received) != fmt.Sprint(expected) {
+					t.Errorf("unexpected upstream body for %s %q\nexpected: %v\nreceived: %v", test.path, test.body, expected, received)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformBodyRequiresALimit(t *testing.T) {
+	config := buildConfiguration()
+	config.Routes[0].TransformBody = injectTenant
+	if _, err := config.validate(); err == nil {
+		t.Error("expected a body transform without TransformBodyBytes to be rejected")
+	}
+}
@@ -0,0 +1,244 @@
+package proxyhandler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerHost is the number of idle keep-alive connections
+// retained for each upstream host when the Configuration does not specify one.
+const DefaultMaxIdleConnsPerHost = 32
+
+// DefaultDialTimeout, DefaultTCPKeepAlive and DefaultTLSHandshakeTimeout
+// configure upstream connections when the Configuration leaves them unset.
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultTCPKeepAlive        = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// DialContextFunc establishes network connections to upstream hosts. It has the
+// signature of net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTransport builds the keep-alive transport shared by every upstream
+// request made through a ProxyHandler. Requests are sent through proxyURL when
+// it is set, or through the proxy named by the environment otherwise.
+func newTransport(config *Configuration, proxyURL *url.URL, cache *dnsCache) *http.Transport {
+	maxIdleConnsPerHost := config.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	tlsHandshakeTimeout := config.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Transport{
+		Proxy:                  proxy,
+		DialContext:            newDialContext(config, cache),
+		ForceAttemptHTTP2:      true,
+		MaxIdleConns:           100,
+		MaxIdleConnsPerHost:    maxIdleConnsPerHost,
+		MaxConnsPerHost:        config.MaxConnsPerUpstream,
+		IdleConnTimeout:        90 * time.Second,
+		TLSHandshakeTimeout:    tlsHandshakeTimeout,
+		ResponseHeaderTimeout:  config.ResponseHeaderTimeout,
+		ExpectContinueTimeout:  1 * time.Second,
+		MaxResponseHeaderBytes: config.MaxResponseHeaderBytes,
+	}
+}
+
+// outboundProxySchemes are the proxy protocols supported by http.Transport.
+var outboundProxySchemes = map[string]struct{}{
+	"http":    struct{}{},
+	"https":   struct{}{},
+	"socks5":  struct{}{},
+	"socks5h": struct{}{},
+}
+
+// parseOutboundProxy parses the URL of a proxy which upstream requests are sent
+// through, returning nil when proxy is empty.
+func parseOutboundProxy(proxy string) (*url.URL, error) {
+	if len(proxy) == 0 {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		// the URL is left out of the error as it may hold credentials
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("parsing outbound proxy: %s", err.Error())
+	}
+	if _, ok := outboundProxySchemes[proxyURL.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported outbound proxy scheme: %q", proxyURL.Scheme)
+	}
+	if len(proxyURL.Host) == 0 {
+		return nil, fmt.Errorf("outbound proxy host is empty")
+	}
+	return proxyURL, nil
+}
+
+// newConfiguredDNSCache returns the DNS cache of config's transport, or nil
+// when DNSCacheTTL is not set.
+func newConfiguredDNSCache(config *Configuration) *dnsCache {
+	if config.DNSCacheTTL == 0 {
+		return nil
+	}
+	return newDNSCache(configuredResolver(config), config.DNSCacheTTL)
+}
+
+func configuredResolver(config *Configuration) Resolver {
+	if config.Resolver != nil {
+		return config.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// newDialContext returns the DialContext of config's transport, which looks
+// hostnames up through cache when one is given.
+func newDialContext(config *Configuration, cache *dnsCache) DialContextFunc {
+	dial := newBaseDialContext(config)
+	if cache == nil && !config.DNSRoundRobin {
+		return dial
+	}
+	lookup := configuredResolver(config).LookupIPAddr
+	if cache != nil {
+		lookup = cache.lookup
+	}
+	var balancer *addressBalancer
+	if config.DNSRoundRobin {
+		balancer = newAddressBalancer()
+	}
+	return resolvingDialContext(lookup, balancer, config.FallbackDelay, dial)
+}
+
+func newBaseDialContext(config *Configuration) DialContextFunc {
+	if config.DialContext != nil {
+		return config.DialContext
+	}
+	dialer := &net.Dialer{
+		Timeout:   DefaultDialTimeout,
+		KeepAlive: DefaultTCPKeepAlive,
+	}
+	if config.DialTimeout != 0 {
+		dialer.Timeout = config.DialTimeout
+	}
+	if config.TCPKeepAlive != 0 {
+		dialer.KeepAlive = config.TCPKeepAlive
+	}
+	dialer.FallbackDelay = config.FallbackDelay
+	return dialer.DialContext
+}
+
+// dialNetworks are the networks a route's connections may be forced onto.
+var dialNetworks = map[string]struct{}{
+	"tcp4": struct{}{},
+	"tcp6": struct{}{},
+}
+
+// forceNetworkDialContext wraps dial so that connections the transport asks
+// for over "tcp" are made over network instead.
+func forceNetworkDialContext(dial DialContextFunc, network string) DialContextFunc {
+	return func(ctx context.Context, requested, addr string) (net.Conn, error) {
+		if requested == "tcp" {
+			requested = network
+		}
+		return dial(ctx, requested, addr)
+	}
+}
+
+// prepareRouteClient sets up the client of route: its own Client, when it has
+// one, or else a routeTransport to be built on first use by routes which need
+// their own transport. Other routes share the handler's client.
+func prepareRouteClient(route *validRouteRule, base http.RoundTripper) error {
+	ownTransport := route.DialContext != nil || route.ResponseHeaderTimeout != 0 || route.TLSServerName != "" ||
+		route.outboundProxyURL != nil || route.ProxyProtocol != 0 || route.MaxConnsPerUpstream != 0 ||
+		route.MaxResponseHeaderBytes != 0 || route.DialNetwork != "" || len(route.tlsPins) > 0
+	if route.Client != nil {
+		if ownTransport {
+			return fmt.Errorf("route %s: per-route transport settings cannot be combined with a client", route.Path)
+		}
+		route.client = route.Client
+		return nil
+	}
+	if !ownTransport {
+		return nil
+	}
+	if _, ok := base.(*http.Transport); !ok {
+		return fmt.Errorf("route %s: per-route transport settings require the default transport", route.Path)
+	}
+	route.transport = &routeTransport{}
+	return nil
+}
+
+// newRouteTransport builds the transport of a route which needs its own, from
+// a clone of the handler's transport.
+func newRouteTransport(route *validRouteRule, base *http.Transport) *http.Transport {
+	transport := base.Clone()
+	if route.DialContext != nil {
+		transport.DialContext = route.DialContext
+	}
+	if route.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = route.ResponseHeaderTimeout
+	}
+	if route.MaxConnsPerUpstream != 0 {
+		transport.MaxConnsPerHost = route.MaxConnsPerUpstream
+	}
+	if route.MaxResponseHeaderBytes != 0 {
+		transport.MaxResponseHeaderBytes = route.MaxResponseHeaderBytes
+	}
+	if route.outboundProxyURL != nil {
+		transport.Proxy = http.ProxyURL(route.outboundProxyURL)
+	}
+	if route.DialNetwork != "" {
+		dial := DialContextFunc(transport.DialContext)
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		transport.DialContext = forceNetworkDialContext(dial, route.DialNetwork)
+	}
+	if route.ProxyProtocol != 0 {
+		// each connection announces a single client, so none may be shared
+		dial := DialContextFunc(transport.DialContext)
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		transport.DialContext = proxyProtocolDialContext(dial, route.ProxyProtocol)
+		transport.Proxy = nil
+		transport.DisableKeepAlives = true
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if route.TLSServerName != "" {
+		// Clone has already copied the base TLSClientConfig, if any
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = route.TLSServerName
+	}
+	if len(route.tlsPins) > 0 {
+		transport.TLSClientConfig = pinnedTLSConfig(transport.TLSClientConfig, route.tlsPins)
+	}
+	return transport
+}
+
+// newClient returns a client which relays redirects to the caller rather than
+// following them, leaving that decision to the proxied client.
+func newClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,698 @@
+package proxyhandler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/jarcoal/httpmock"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRealUpstreamHandler(t testing.TB, upstreamURL string) *ProxyHandler {
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = upstreamURL
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	return h
+}
+
+func TestUpstreamConnectionsAreReused(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	h := newRealUpstreamHandler(t, upstream.URL)
+
+	var reused []bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+	}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if len(reused) != 3 {
+		t.Fatalf("expected a connection per request\nexpected: %v\nreceived: %v", 3, len(reused))
+	}
+	if reused[0] {
+		t.Error("expected first request to open a new connection")
+	}
+	if !reused[1] || !reused[2] {
+		t.Errorf("expected subsequent requests to reuse the connection\nreceived: %v", reused)
+	}
+}
+
+func BenchmarkRealUpstream(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	b.Run("shared-transport", func(b *testing.B) {
+		h := newRealUpstreamHandler(b, upstream.URL)
+		for i := 0; i < b.N; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+	})
+	b.Run("stdlib-proxy", func(b *testing.B) {
+		h := newRealUpstreamHandler(b, upstream.URL)
+		h.configuration.StdlibProxy = true
+		for i := 0; i < b.N; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+	})
+	// Approximates the previous behavior where no connection outlived its request.
+	b.Run("connection-per-request", func(b *testing.B) {
+		h := newRealUpstreamHandler(b, upstream.URL)
+		h.client.Transport.(*http.Transport).DisableKeepAlives = true
+		for i := 0; i < b.N; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+	})
+}
+
+type recordingDialer struct {
+	mutex     sync.Mutex
+	addresses []string
+	networks  []string
+	target    string
+}
+
+func (dialer *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer.mutex.Lock()
+	dialer.addresses = append(dialer.addresses, addr)
+	dialer.networks = append(dialer.networks, network)
+	dialer.mutex.Unlock()
+	var d net.Dialer
+	return d.DialContext(ctx, network, dialer.target)
+}
+
+func TestConfiguredDialContextIsUsed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	handlerDialer := &recordingDialer{target: upstreamAddr}
+	routeDialer := &recordingDialer{target: upstreamAddr}
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = "http://default.consul:8500"
+	config.DialContext = handlerDialer.DialContext
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/shared", Endpoint: "http://shared.consul:8600"},
+		&RouteRule{Path: "/tunnel", Endpoint: "http://tunnel.consul:8700", DialContext: routeDialer.DialContext},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for _, path := range []string{"/", "/shared", "/tunnel"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	expectedHandlerDials := []string{"default.consul:8500", "shared.consul:8600"}
+	if !reflect.DeepEqual(handlerDialer.addresses, expectedHandlerDials) {
+		t.Errorf("unexpected handler dials\nexpected: %v\nreceived: %v", expectedHandlerDials, handlerDialer.addresses)
+	}
+	expectedRouteDials := []string{"tunnel.consul:8700"}
+	if !reflect.DeepEqual(routeDialer.addresses, expectedRouteDials) {
+		t.Errorf("unexpected route dials\nexpected: %v\nreceived: %v", expectedRouteDials, routeDialer.addresses)
+	}
+}
+
+func TestRouteDialNetworkIsForced(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	dialer := &recordingDialer{target: strings.TrimPrefix(upstream.URL, "http://")}
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DialContext = dialer.DialContext
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/dual", Endpoint: "http://dual.example:80"},
+		&RouteRule{Path: "/ipv4", Endpoint: "http://ipv4.example:80", DialNetwork: "tcp4"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for _, path := range []string{"/dual", "/ipv4"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	expected := []string{"tcp", "tcp4"}
+	if !reflect.DeepEqual(dialer.networks, expected) {
+		t.Errorf("unexpected dial networks\nexpected: %v\nreceived: %v", expected, dialer.networks)
+	}
+}
+
+func TestRouteDialNetworkValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"unsupported dial network":           RouteRule{Path: "/", Endpoint: "http://one", DialNetwork: "udp"},
+		"not supported for websocket routes": RouteRule{Path: "/", Endpoint: "ws://one", DialNetwork: "tcp6"},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
+
+func TestRouteDialContextRequiresDefaultTransport(t *testing.T) {
+	expectedError := "per-route transport settings require the default transport"
+	config := buildConfiguration()
+	config.Routes[0].DialContext = (&net.Dialer{}).DialContext
+
+	_, err := New(config)
+	if err == nil {
+		t.Fatal("expected configuration to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+func TestInternationalizedEndpointIsDialedAsPunycode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var receivedHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHost = r.Host
+	}))
+	defer upstream.Close()
+
+	dialer := &recordingDialer{target: strings.TrimPrefix(upstream.URL, "http://")}
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DialContext = dialer.DialContext
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/books", Endpoint: "http://bücher.example:8080"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books", nil))
+
+	expectedHost := "xn--bcher-kva.example:8080"
+	if !reflect.DeepEqual(dialer.addresses, []string{expectedHost}) {
+		t.Errorf("unexpected dialed address\nexpected: %v\nreceived: %v", expectedHost, dialer.addresses)
+	}
+	if receivedHost != expectedHost {
+		t.Errorf("unexpected Host header\nexpected: %v\nreceived: %v", expectedHost, receivedHost)
+	}
+}
+
+// newSelfSignedCertificate creates a certificate for name, returning it along
+// with its PEM encoded certificate and key.
+func newSelfSignedCertificate(t *testing.T, name string, serial int64) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err.Error())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to encode key: %s", err.Error())
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}, certPEM, keyPEM
+}
+
+// newNamedTLSServer starts a TLS server whose certificate is valid only for
+// name, along with a transport which trusts that certificate.
+func newNamedTLSServer(t *testing.T, name string, handler http.Handler) (*httptest.Server, *http.Transport) {
+	certificate, _, _ := newSelfSignedCertificate(t, name, 1)
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	return server, server.Client().Transport.(*http.Transport)
+}
+
+func TestRouteTLSServerName(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var serverNames []string
+	var mutex sync.Mutex
+	upstream, transport := newNamedTLSServer(t, "backend.internal", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		serverNames = append(serverNames, r.TLS.ServerName)
+		mutex.Unlock()
+	}))
+	defer upstream.Close()
+
+	config := buildConfiguration()
+	config.Transport = transport
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/named", Endpoint: upstream.URL, TLSServerName: "backend.internal"},
+		&RouteRule{Path: "/unnamed", Endpoint: upstream.URL},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expectations := map[string]int{"/named": http.StatusOK, "/unnamed": http.StatusBadGateway}
+	for path, expected := range expectations {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != expected {
+			t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", path, expected, recorder.Code)
+		}
+	}
+	if !reflect.DeepEqual(serverNames, []string{"backend.internal"}) {
+		t.Errorf("unexpected server names\nexpected: %v\nreceived: %v", []string{"backend.internal"}, serverNames)
+	}
+	if transport.TLSClientConfig.ServerName != "" {
+		t.Errorf("expected the shared transport to be left unchanged\nreceived: %v", transport.TLSClientConfig.ServerName)
+	}
+}
+
+func TestRouteTLSServerNameRequiresHTTPS(t *testing.T) {
+	expectedError := "tls server name requires an https endpoint"
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes[0].TLSServerName = "backend.internal"
+
+	_, err := New(config)
+	if err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+}
+
+// connectProxy is a minimal CONNECT proxy which records the targets it
+// tunnels to and requires credentials when authorization is set.
+type connectProxy struct {
+	authorization string
+	mutex         sync.Mutex
+	targets       []string
+}
+
+func (proxy *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if proxy.authorization != "" && r.Header.Get("Proxy-Authorization") != proxy.authorization {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	proxy.mutex.Lock()
+	proxy.targets = append(proxy.targets, r.Host)
+	proxy.mutex.Unlock()
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, buffered)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+func (proxy *connectProxy) tunneled() []string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return append([]string(nil), proxy.targets...)
+}
+
+func TestRouteOutboundProxy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	proxy := &connectProxy{authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("scott:tiger"))}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL := strings.Replace(proxyServer.URL, "http://", "http://scott:tiger@", 1)
+
+	config := buildConfiguration()
+	config.Transport = upstream.Client().Transport
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/proxied", Endpoint: upstream.URL, OutboundProxy: proxyURL},
+		&RouteRule{Path: "/direct", Endpoint: upstream.URL},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	for _, path := range []string{"/proxied", "/direct"} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "upstream" {
+			t.Errorf("unexpected response for %s\nexpected: %v\nreceived: %v %v", path, "200 upstream", recorder.Code, recorder.Body.String())
+		}
+	}
+	expectedTargets := []string{strings.TrimPrefix(upstream.URL, "https://")}
+	if targets := proxy.tunneled(); !reflect.DeepEqual(targets, expectedTargets) {
+		t.Errorf("unexpected proxied targets\nexpected: %v\nreceived: %v", expectedTargets, targets)
+	}
+}
+
+func TestOutboundProxyDefaultRequiresCredentials(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	proxy := &connectProxy{authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("scott:tiger"))}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	expectations := map[string]int{
+		proxyServer.URL: http.StatusBadGateway,
+		strings.Replace(proxyServer.URL, "http://", "http://scott:tiger@", 1): http.StatusOK,
+	}
+	for proxyURL, expected := range expectations {
+		config := buildConfiguration()
+		config.Transport = nil
+		config.DefaultRoute = upstream.URL
+		config.OutboundProxy = proxyURL
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("unable to create proxyhandler: %s", err.Error())
+		}
+		// trust the upstream's certificate while keeping the configured proxy
+		h.transport.(*http.Transport).TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+		if recorder.Code != expected {
+			t.Errorf("unexpected status through %s\nexpected: %v\nreceived: %v", proxyURL, expected, recorder.Code)
+		}
+	}
+	expectedTargets := []string{strings.TrimPrefix(upstream.URL, "https://")}
+	if targets := proxy.tunneled(); !reflect.DeepEqual(targets, expectedTargets) {
+		t.Errorf("expected only the authorized request to be tunneled\nexpected: %v\nreceived: %v", expectedTargets, targets)
+	}
+}
+
+func TestOutboundProxyIsValidated(t *testing.T) {
+	config := buildConfiguration()
+	config.OutboundProxy = "ftp://proxy.internal:21"
+	expectedError := "unsupported outbound proxy scheme"
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+
+	config = buildConfiguration()
+	config.OutboundProxy = "http://proxy.internal:3128"
+	expectedError = "cannot be combined with a custom transport"
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+	}
+
+	config = buildConfiguration()
+	config.Routes[0].OutboundProxy = "socks5://user:secret@[::1"
+	if _, err := New(config); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected an error which omits the proxy credentials\nreceived: %v", err)
+	}
+}
+
+func TestClientTraceObservesUpstreamPhases(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	// dial by name so the lookup is traced; the certificate is for example.com
+	endpoint := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+
+	var mutex sync.Mutex
+	var events []string
+	record := func(event string) {
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}
+	var tracedHosts []string
+	config := buildConfiguration()
+	config.Transport = upstream.Client().Transport
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/traced", Endpoint: endpoint, TLSServerName: "example.com"},
+	}
+	config.ClientTrace = func(r *http.Request) *httptrace.ClientTrace {
+		tracedHosts = append(tracedHosts, r.URL.Host)
+		start := time.Now()
+		return &httptrace.ClientTrace{
+			DNSDone: func(info httptrace.DNSDoneInfo) {
+				if info.Err == nil && len(info.Addrs) > 0 {
+					record("dns")
+				}
+			},
+			ConnectDone: func(network, addr string, err error) {
+				if err == nil {
+					record("connect")
+				}
+			},
+			TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+				if err == nil && state.HandshakeComplete {
+					record("tls")
+				}
+			},
+			GotConn: func(info httptrace.GotConnInfo) {
+				record(fmt.Sprintf("conn reused=%v", info.Reused))
+			},
+			GotFirstResponseByte: func() {
+				if time.Since(start) > 0 {
+					record("response")
+				}
+			},
+		}
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/traced", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+		}
+	}
+
+	expectedHost := strings.TrimPrefix(endpoint, "https://")
+	if !reflect.DeepEqual(tracedHosts, []string{expectedHost, expectedHost}) {
+		t.Errorf("expected a trace per outbound request\nexpected: %v\nreceived: %v", expectedHost, tracedHosts)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	expectedEvents := []string{"dns", "connect", "tls", "conn reused=false", "response", "conn reused=true", "response"}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("unexpected trace events\nexpected: %v\nreceived: %v", expectedEvents, events)
+	}
+}
+
+type countingTransport struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (transport *countingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport.mutex.Lock()
+	transport.requests = append(transport.requests, request.URL.String())
+	transport.mutex.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("custom")),
+		Request:    request,
+	}, nil
+}
+
+func TestRouteClientIsUsedForItsRouteOnly(t *testing.T) {
+	beforeTest()
+	defer afterTest()
+
+	httpmock.RegisterNoResponder(httpmock.NewStringResponder(200, "shared"))
+	transport := &countingTransport{}
+	config := buildConfiguration()
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/custom", Endpoint: "http://custom.endpoint", Client: &http.Client{Transport: transport}},
+		&RouteRule{Path: "/shared", Endpoint: "http://shared.endpoint"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	expectations := map[string]string{"/custom/a": "custom", "/shared/b": "shared", "/": "shared"}
+	for path, expected := range expectations {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Body.String() != expected {
+			t.Errorf("unexpected client for %s\nexpected: %v\nreceived: %v", path, expected, recorder.Body.String())
+		}
+	}
+	expectedRequests := []string{"http://custom.endpoint/custom/a"}
+	if !reflect.DeepEqual(transport.requests, expectedRequests) {
+		t.Errorf("unexpected requests through the route's client\nexpected: %v\nreceived: %v", expectedRequests, transport.requests)
+	}
+}
+
+func TestRouteClientExcludesRouteTransportSettings(t *testing.T) {
+	expectedError := "per-route transport settings cannot be combined with a client"
+	config := buildConfiguration()
+	config.Routes[0].Client = &http.Client{}
+	config.Routes[0].ResponseHeaderTimeout = time.Second
+
+	_, err := New(config)
+	if err == nil {
+		t.Fatal("expected configuration to be invalid")
+	}
+	if !strings.Contains(err.Error(), expectedError) {
+		t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err.Error())
+	}
+}
+
+// newConnectionCountingServer starts a slow upstream which records the most
+// connections it had open at once.
+func newConnectionCountingServer(delay time.Duration) (*httptest.Server, func() int64) {
+	var open, peak atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			current := open.Add(1)
+			for {
+				previous := peak.Load()
+				if current <= previous || peak.CompareAndSwap(previous, current) {
+					break
+				}
+			}
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	upstream.Start()
+	return upstream, peak.Load
+}
+
+func TestMaxConnsPerUpstreamCapsConnections(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	shared, sharedPeak := newConnectionCountingServer(20 * time.Millisecond)
+	defer shared.Close()
+	dedicated, dedicatedPeak := newConnectionCountingServer(20 * time.Millisecond)
+	defer dedicated.Close()
+	var waited atomic.Int64
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DefaultRoute = shared.URL
+	config.MaxConnsPerUpstream = 3
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/dedicated", Endpoint: dedicated.URL, MaxConnsPerUpstream: 1},
+	}
+	config.Observer = func(observation *Observation) {
+		if observation.ConnWait >= 10*time.Millisecond {
+			waited.Add(1)
+		}
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	var wait sync.WaitGroup
+	for client := 0; client < 12; client++ {
+		wait.Add(1)
+		go func(client int) {
+			defer wait.Done()
+			path := "/shared"
+			if client%2 == 0 {
+				path = "/dedicated"
+			}
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("unexpected status for %s\nexpected: %v\nreceived: %v", path, http.StatusOK, recorder.Code)
+			}
+		}(client)
+	}
+	wait.Wait()
+
+	if peak := sharedPeak(); peak > 3 {
+		t.Errorf("expected at most 3 connections to the shared upstream\nreceived: %d", peak)
+	}
+	if peak := dedicatedPeak(); peak != 1 {
+		t.Errorf("expected a single connection to the route's upstream\nreceived: %d", peak)
+	}
+	if waited.Load() == 0 {
+		t.Error("expected queued requests to record their wait for a connection")
+	}
+}
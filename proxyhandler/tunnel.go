@@ -0,0 +1,85 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// bufferedConn reads from a hijacked connection through the reader which
+// may already hold bytes the client sent after its handshake.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(buffer []byte) (int, error) {
+	return conn.reader.Read(buffer)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	return closeWrite(conn.Conn)
+}
+
+// closeWrite shuts down the write side of conn when it supports doing so,
+// as TCP and TLS connections do.
+func closeWrite(conn io.Writer) error {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return fmt.Errorf("connection cannot be half-closed")
+}
+
+// activityWriter records every write to a tunnel with its idle timer.
+type activityWriter struct {
+	io.Writer
+	idle *idleTimer
+}
+
+func (writer *activityWriter) Write(data []byte) (int, error) {
+	writer.idle.touch()
+	return writer.Writer.Write(data)
+}
+
+// tunnel copies bytes between client and upstream in both directions and
+// returns once both are closed. When one side stops sending, the write side
+// of the other is half-closed so that data still flowing back is delivered;
+// where half-closing is not supported both sides are closed at once. A
+// positive idleTimeout closes a tunnel which carried nothing in either
+// direction for that long.
+func tunnel(client, upstream io.ReadWriteCloser, idleTimeout time.Duration) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			upstream.Close()
+		})
+	}
+	var idle *idleTimer
+	if idleTimeout > 0 {
+		idle = newIdleTimer(idleTimeout, func() {
+			log.Printf("proxy: closing tunnel idle for %s", idleTimeout)
+			closeBoth()
+		})
+		idle.start()
+	}
+
+	var relays sync.WaitGroup
+	relays.Add(2)
+	relay := func(destination, source io.ReadWriteCloser) {
+		defer relays.Done()
+		_, err := io.Copy(&activityWriter{Writer: destination, idle: idle}, source)
+		if err != nil || closeWrite(destination) != nil {
+			closeBoth()
+		}
+	}
+	go relay(upstream, client)
+	go relay(client, upstream)
+	relays.Wait()
+	closeBoth()
+	idle.stop()
+}
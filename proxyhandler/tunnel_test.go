@@ -0,0 +1,177 @@
+package proxyhandler
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %s", err.Error())
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// startTunnel runs a tunnel between clientSide and upstreamSide, returning a
+// channel closed when it returns.
+func startTunnel(clientSide, upstreamSide io.ReadWriteCloser, idleTimeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel(clientSide, upstreamSide, idleTimeout)
+	}()
+	return done
+}
+
+func expectTunnelClosed(t *testing.T, done <-chan struct{}, baseline int) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the tunnel to close")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked\nexpected: %v\nreceived: %v", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelHalfClosesTowardsUpstream(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	baseline := runtime.NumGoroutine()
+	done := startTunnel(clientSide, upstreamSide, 0)
+
+	client.Write([]byte("request"))
+	client.CloseWrite()
+	received, err := ioutil.ReadAll(upstream)
+	if err != nil || string(received) != "request" {
+		t.Fatalf("unexpected request at upstream\nexpected: %v\nreceived: %v %v", "request", string(received), err)
+	}
+	// the upstream can still respond after the client has finished sending
+	upstream.Write([]byte("response"))
+	upstream.Close()
+	received, err = ioutil.ReadAll(client)
+	if err != nil || string(received) != "response" {
+		t.Fatalf("unexpected response at client\nexpected: %v\nreceived: %v %v", "response", string(received), err)
+	}
+	expectTunnelClosed(t, done, baseline)
+}
+
+func TestTunnelHalfClosesTowardsClient(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	baseline := runtime.NumGoroutine()
+	done := startTunnel(clientSide, upstreamSide, 0)
+
+	upstream.Write([]byte("goodbye"))
+	upstream.Close()
+	received, err := ioutil.ReadAll(client)
+	if err != nil || string(received) != "goodbye" {
+		t.Fatalf("unexpected data at client\nexpected: %v\nreceived: %v %v", "goodbye", string(received), err)
+	}
+	client.Close()
+	expectTunnelClosed(t, done, baseline)
+}
+
+func TestTunnelClosesBothWithoutHalfClose(t *testing.T) {
+	client, clientSide := net.Pipe()
+	upstreamSide, upstream := net.Pipe()
+	defer upstream.Close()
+	baseline := runtime.NumGoroutine()
+	done := startTunnel(clientSide, upstreamSide, 0)
+
+	go client.Write([]byte("hello"))
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(upstream, buffer); err != nil || string(buffer) != "hello" {
+		t.Fatalf("unexpected data at upstream\nexpected: %v\nreceived: %v %v", "hello", string(buffer), err)
+	}
+	client.Close()
+	if _, err := upstream.Read(buffer); err != io.EOF {
+		t.Errorf("expected the upstream to be closed\nreceived: %v", err)
+	}
+	expectTunnelClosed(t, done, baseline)
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	upstreamSide, upstream := tcpPair(t)
+	baseline := runtime.NumGoroutine()
+	done := startTunnel(clientSide, upstreamSide, 100*time.Millisecond)
+
+	// traffic in either direction keeps the tunnel open
+	buffer := make([]byte, 1)
+	for i := 0; i < 6; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if i%2 == 0 {
+			client.Write([]byte("c"))
+			io.ReadFull(upstream, buffer)
+		} else {
+			upstream.Write([]byte("u"))
+			io.ReadFull(client, buffer)
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("expected an active tunnel to stay open")
+	default:
+	}
+
+	expectTunnelClosed(t, done, baseline)
+	if _, err := client.Read(buffer); err != io.EOF {
+		t.Errorf("expected the client to be closed\nreceived: %v", err)
+	}
+	if _, err := upstream.Read(buffer); err != io.EOF {
+		t.Errorf("expected the upstream to be closed\nreceived: %v", err)
+	}
+}
+
+func TestTunnelIdleTimeoutOverPipes(t *testing.T) {
+	client, clientSide := net.Pipe()
+	upstreamSide, upstream := net.Pipe()
+	baseline := runtime.NumGoroutine()
+	done := startTunnel(clientSide, upstreamSide, 100*time.Millisecond)
+
+	// an active tunnel outlives the timeout
+	buffer := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte("c"))
+		io.ReadFull(upstream, buffer)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected an active tunnel to stay open")
+	default:
+	}
+
+	expectTunnelClosed(t, done, baseline)
+	if _, err := client.Read(buffer); err != io.EOF {
+		t.Errorf("expected the client to be closed\nreceived: %v", err)
+	}
+	if _, err := upstream.Read(buffer); err != io.EOF {
+		t.Errorf("expected the upstream to be closed\nreceived: %v", err)
+	}
+}
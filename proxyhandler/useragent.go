@@ -0,0 +1,59 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// UserAgentPolicy determines the User-Agent sent with requests forwarded
+// upstream.
+type UserAgentPolicy string
+
+// UserAgentPassthrough sends the client's User-Agent unchanged, and none at
+// all when the client sent none. UserAgentReplace sends the Configuration's
+// UserAgent in its place. UserAgentAppend sends the client's User-Agent
+// followed by "via" and the configured UserAgent, or the configured UserAgent
+// alone when the client sent none.
+const (
+	UserAgentPassthrough UserAgentPolicy = "passthrough"
+	UserAgentReplace     UserAgentPolicy = "replace"
+	UserAgentAppend      UserAgentPolicy = "append"
+)
+
+func (config *Configuration) validateUserAgent() error {
+	if strings.ContainsAny(config.UserAgent, "\r\n") {
+		return fmt.Errorf("user agent contains a line break")
+	}
+	switch config.UserAgentPolicy {
+	case "", UserAgentPassthrough:
+		if config.UserAgent != "" {
+			return fmt.Errorf("user agent is set but the user agent policy passes the client's through")
+		}
+		return nil
+	case UserAgentReplace, UserAgentAppend:
+		if config.UserAgent == "" {
+			return fmt.Errorf("user agent policy %q requires a user agent", config.UserAgentPolicy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown user agent policy %q", config.UserAgentPolicy)
+}
+
+// setUserAgent applies the user agent policy to header, the header of a
+// request forwarded on behalf of request. The header is always left present,
+// if empty, so that the transport does not add a User-Agent of its own.
+func (handler *ProxyHandler) setUserAgent(header http.Header, request *http.Request) {
+	userAgent := request.Header.Get("User-Agent")
+	switch handler.configuration.UserAgentPolicy {
+	case UserAgentReplace:
+		userAgent = handler.configuration.UserAgent
+	case UserAgentAppend:
+		if userAgent == "" {
+			userAgent = handler.configuration.UserAgent
+		} else {
+			userAgent += " via " + handler.configuration.UserAgent
+		}
+	}
+	header.Set("User-Agent", userAgent)
+}
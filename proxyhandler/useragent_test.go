@@ -0,0 +1,71 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestUserAgentPolicies(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	received := make(chan []string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Values("User-Agent")
+	}))
+	defer upstream.Close()
+
+	examples := []struct {
+		policy    UserAgentPolicy
+		value     string
+		userAgent string
+		expected  []string
+	}{
+		{"", "", "curl/8.0", []string{"curl/8.0"}},
+		{UserAgentPassthrough, "", "", nil},
+		{UserAgentReplace, "proxyhandler/1.0", "curl/8.0", []string{"proxyhandler/1.0"}},
+		{UserAgentReplace, "proxyhandler/1.0", "", []string{"proxyhandler/1.0"}},
+		{UserAgentAppend, "proxyhandler/1.0", "curl/8.0", []string{"curl/8.0 via proxyhandler/1.0"}},
+		{UserAgentAppend, "proxyhandler/1.0", "", []string{"proxyhandler/1.0"}},
+	}
+	for _, mode := range proxyModes {
+		for _, example := range examples {
+			h := newRealUpstreamHandler(t, upstream.URL)
+			h.configuration.StdlibProxy = mode.stdlib
+			h.configuration.UserAgentPolicy = example.policy
+			h.configuration.UserAgent = example.value
+			request := httptest.NewRequest("GET", "/", nil)
+			if example.userAgent != "" {
+				request.Header.Set("User-Agent", example.userAgent)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), request)
+
+			userAgent := <-received
+			if len(userAgent) != len(example.expected) || (len(userAgent) > 0 && userAgent[0] != example.expected[0]) {
+				t.Errorf("unexpected User-Agent for %s policy %q with %q\nexpected: %v\nreceived: %v", mode.name, example.policy, example.userAgent, example.expected, userAgent)
+			}
+		}
+	}
+}
+
+func TestUserAgentPolicyValidation(t *testing.T) {
+	invalid := map[string]func(*Configuration){
+		"replace without a value": func(config *Configuration) { config.UserAgentPolicy = UserAgentReplace },
+		"value without a policy":  func(config *Configuration) { config.UserAgent = "proxyhandler/1.0" },
+		"unknown policy":          func(config *Configuration) { config.UserAgentPolicy = "prepend" },
+		"line break": func(config *Configuration) {
+			config.UserAgentPolicy, config.UserAgent = UserAgentAppend, "proxy\r\nX-Injected: 1"
+		},
+	}
+	for name, configure := range invalid {
+		config := buildConfiguration()
+		configure(config)
+		if _, err := New(config); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package proxyhandler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// warmupTimeout bounds each warm-up request, including establishing its
+// connection.
+const warmupTimeout = 5 * time.Second
+
+// warmUp sends the warm-up requests of the routes in table to the endpoints
+// which previous, which may be nil, has not already warmed up for them. The
+// requests are sent in the background, and those still pending when the
+// handler is closed are canceled.
+func (handler *ProxyHandler) warmUp(previous, table *routeTable) {
+	for _, route := range table.routes {
+		if route.WarmupPath == "" {
+			continue
+		}
+		requests := route.WarmupRequests
+		if requests == 0 {
+			requests = 1
+		}
+		for _, endpointURL := range route.EndpointURLs {
+			if previous.warmed(route, endpointURL) {
+				continue
+			}
+			for request := 0; request < requests; request++ {
+				handler.goBackground(func() { handler.warmUpEndpoint(route, endpointURL) })
+			}
+		}
+	}
+}
+
+// warmUpEndpoint sends a HEAD request for the route's WarmupPath to the host
+// of endpointURL, so that the connection it opens is left in the transport's
+// pool for the route's first requests. Failures are logged and otherwise
+// ignored.
+func (handler *ProxyHandler) warmUpEndpoint(route *validRouteRule, endpointURL *url.URL) {
+	// WarmupPath was checked to be an absolute path when the route was validated
+	target, _ := endpointURL.Parse(route.WarmupPath)
+	status, err := handler.sendWarmup(route, target)
+	if err != nil {
+		log.Printf("proxy: warm-up of %s for route %s failed: %s", target.String(), route.Path, err.Error())
+		return
+	}
+	log.Printf("proxy: warmed up %s for route %s with status %d", target.String(), route.Path, status)
+}
+
+func (handler *ProxyHandler) sendWarmup(route *validRouteRule, target *url.URL) (int, error) {
+	ctx, cancel := context.WithTimeout(handler.lifetime, warmupTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if handler.configuration.ClientTrace != nil {
+		if trace := handler.configuration.ClientTrace(request); trace != nil {
+			request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
+		}
+	}
+	response, err := handler.clientFor(route).Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	return response.StatusCode, nil
+}
+
+// warmed reports whether the route of table, which may be nil, matching the
+// same requests as route warmed up endpointURL through the connections route
+// uses, as it has when a reload keeps the route or changes only its other
+// endpoints. A route with a transport of its own starts with none, so it is
+// warmed up afresh each time it is registered.
+func (table *routeTable) warmed(route *validRouteRule, endpointURL *url.URL) bool {
+	if table == nil {
+		return false
+	}
+	index := table.indexOfRule(&route.RouteRule)
+	if index < 0 {
+		return false
+	}
+	previous := table.routes[index]
+	if previous == route {
+		return true
+	}
+	if previous.WarmupPath == "" || previous.transport != nil || route.transport != nil || previous.client != route.client {
+		return false
+	}
+	for _, candidate := range previous.EndpointURLs {
+		if candidate.String() == endpointURL.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (route *validRouteRule) validateWarmup() error {
+	if route.WarmupRequests < 0 {
+		return fmt.Errorf("warm-up requests is negative")
+	}
+	if route.WarmupPath == "" {
+		if route.WarmupRequests > 0 {
+			return fmt.Errorf("warm-up requests set without a warm-up path")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(route.WarmupPath, "/") || strings.HasPrefix(route.WarmupPath, "//") {
+		return fmt.Errorf("warm-up path %q must be a path beginning with a single /", route.WarmupPath)
+	}
+	if _, err := url.Parse(route.WarmupPath); err != nil {
+		return fmt.Errorf("warm-up path: %s", err.Error())
+	}
+	if route.EndpointURL.Scheme == "ws" || len(route.EndpointTemplate) > 0 {
+		return fmt.Errorf("warm-up is not supported for websocket or templated routes")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package proxyhandler
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWarmupConnectionIsReused(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	release := make(chan struct{})
+	warmedUp := make(chan string, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			<-release
+			warmedUp <- r.Method
+		}
+		w.Write([]byte("ok"))
+	}))
+	upstream.Start()
+	defer upstream.Close()
+
+	pooled := make(chan struct{}, 1)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: upstream.URL, WarmupPath: "/health"},
+	}
+	config.ClientTrace = func(request *http.Request) *httptrace.ClientTrace {
+		if request.Method != http.MethodHead {
+			return nil
+		}
+		return &httptrace.ClientTrace{
+			PutIdleConn: func(err error) { pooled <- struct{}{} },
+		}
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	// New returned while the warm-up request is still held by the upstream
+	close(release)
+	if method := <-warmedUp; method != http.MethodHead {
+		t.Errorf("unexpected warm-up method\nexpected: %v\nreceived: %v", http.MethodHead, method)
+	}
+	// the client returns the connection to its pool as it reads the response
+	<-pooled
+
+	var reused []bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+	}
+	request := httptest.NewRequest("GET", "/api", nil)
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusOK, recorder.Code)
+	}
+	if len(reused) != 1 || !reused[0] {
+		t.Errorf("expected the first request to reuse the warm-up connection\nreceived: %v", reused)
+	}
+}
+
+func TestWarmupIsNotRepeatedForUnchangedRoutes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var warmups atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			warmups.Add(1)
+		}
+	}))
+	defer upstream.Close()
+	otherUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			warmups.Add(1)
+		}
+	}))
+	defer otherUpstream.Close()
+
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/api", Endpoint: upstream.URL, WarmupPath: "/health"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	defer h.Close()
+	h.tasks.Wait()
+
+	if err := h.Reload(config); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	h.tasks.Wait()
+	if err := h.Restore(h.Snapshot()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	h.tasks.Wait()
+	if count := warmups.Load(); count != 1 {
+		t.Errorf("expected unchanged routes not to be warmed up again\nexpected: %v\nreceived: %v", 1, count)
+	}
+
+	if err := h.SetEndpoint("/api", otherUpstream.URL); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	h.tasks.Wait()
+	if count := warmups.Load(); count != 2 {
+		t.Errorf("expected a new endpoint to be warmed up\nexpected: %v\nreceived: %v", 2, count)
+	}
+}
+
+func TestWarmupValidation(t *testing.T) {
+	examples := map[string]RouteRule{
+		"warm-up requests is negative": RouteRule{Path: "/", Endpoint: "http://one", WarmupPath: "/health", WarmupRequests: -1},
+		"without a warm-up path":       RouteRule{Path: "/", Endpoint: "http://one", WarmupRequests: 2},
+		"beginning with a single /":    RouteRule{Path: "/", Endpoint: "http://one", WarmupPath: "//elsewhere/health"},
+		"not supported for websocket":  RouteRule{Path: "/", Endpoint: "ws://one", WarmupPath: "/health"},
+	}
+	for expectedError, route := range examples {
+		if _, err := route.validate(); err == nil || !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error not found\nexpected: %v\nreceived: %v", expectedError, err)
+		}
+	}
+}
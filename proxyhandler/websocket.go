@@ -0,0 +1,212 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	errOriginDenied  = errors.New("websocket origin is not allowed")
+	errNotWebSocket  = errors.New("websocket upgrade required")
+	errUpgradeFailed = errors.New("upstream did not switch to the websocket protocol")
+)
+
+// parseWebSocketOrigins normalizes the origins allowed to open websockets to
+// scheme://host[:port], leaving out default ports as browsers do.
+func parseWebSocketOrigins(origins []string) ([]string, error) {
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	normalized := make([]string, len(origins))
+	for index, origin := range origins {
+		originURL, err := parseOrigin(origin)
+		if err != nil {
+			return nil, fmt.Errorf("websocket origin %q: %s", origin, err.Error())
+		}
+		normalized[index] = originURL
+	}
+	return normalized, nil
+}
+
+func parseOrigin(origin string) (string, error) {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if originURL.Scheme == "" || originURL.Host == "" {
+		return "", fmt.Errorf("origin must be of the form scheme://host")
+	}
+	if originURL.User != nil || (originURL.Path != "" && originURL.Path != "/") || originURL.RawQuery != "" || originURL.Fragment != "" {
+		return "", fmt.Errorf("origin must not have a path, query or fragment")
+	}
+	scheme, host := strings.ToLower(originURL.Scheme), strings.ToLower(originURL.Host)
+	if port := originURL.Port(); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return scheme + "://" + host, nil
+}
+
+// originAllowed reports whether a websocket may be opened from the Origin of
+// request. Requests without an Origin do not come from a browser and are
+// allowed, as are all requests when no origins are configured.
+func (handler *ProxyHandler) originAllowed(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if len(handler.webSocketOrigins) == 0 || origin == "" {
+		return true
+	}
+	normalized, err := parseOrigin(origin)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range handler.webSocketOrigins {
+		if normalized == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade reports whether request asks to switch to the websocket
+// protocol.
+func isWebSocketUpgrade(request *http.Request) bool {
+	return headerHasToken(request.Header, "Connection", "upgrade") && headerHasToken(request.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports whether the comma separated values of the header
+// name include token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebsocketRequest relays a websocket handshake to the route's upstream
+// and, once the upstream switches protocols, tunnels the connection's bytes in
+// both directions. The handshake headers, including the subprotocols and
+// extensions offered by the client and those selected by the upstream, pass
+// through unchanged, so frames are never decoded by the proxy. The route's
+// ContextHeaders and SubdomainHeader replace any the client sent, as they do
+// for other requests.
+func (handler *ProxyHandler) handleWebsocketRequest(route *validRouteRule, upstreamWriter http.ResponseWriter, upstreamRequest *http.Request) {
+	defer handler.stats.begin(route.Path)()
+	if !isWebSocketUpgrade(upstreamRequest) {
+		handler.handleError(errNotWebSocket, http.StatusBadRequest, upstreamWriter, upstreamRequest)
+		return
+	}
+	if err := handler.checkCallbacks(route); err != nil {
+		handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+		return
+	}
+	if !handler.originAllowed(upstreamRequest) {
+		handler.handleError(fmt.Errorf("%w: %s", errOriginDenied, upstreamRequest.Header.Get("Origin")), http.StatusForbidden, upstreamWriter, upstreamRequest)
+		return
+	}
+	endpoint := *route.EndpointURL
+	endpoint.Scheme = "http"
+	downstreamRequest, err := buildProxyRequest(upstreamRequest, route, &endpoint)
+	if err != nil {
+		handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+		return
+	}
+	handler.forwardClient(downstreamRequest.Header, upstreamRequest)
+	handler.setUserAgent(downstreamRequest.Header, upstreamRequest)
+	if handler.configuration.DevOverrideHeader != "" {
+		downstreamRequest.Header.Del(handler.configuration.DevOverrideHeader)
+	}
+	if handler.configuration.DebugToken != "" {
+		downstreamRequest.Header.Del(debugRequestHeader)
+	}
+	if handler.mapHost(downstreamRequest.URL, upstreamRequest.Host) {
+		downstreamRequest.Host = downstreamRequest.URL.Host
+	}
+	downstreamRequest.Header.Set("Connection", "Upgrade")
+	var before http.Header
+	if handler.guardsHeaders(route) {
+		before = downstreamRequest.Header.Clone()
+	}
+	route.setContextHeaders(downstreamRequest, upstreamRequest)
+	route.setSubdomainHeader(downstreamRequest, upstreamRequest)
+	if route.Director != nil {
+		if err := handler.callDirector(route, downstreamRequest); err != nil {
+			handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+			return
+		}
+	}
+	if before != nil {
+		if err := handler.checkHeaderRules(route, before, downstreamRequest); err != nil {
+			handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+			return
+		}
+	}
+	log.Printf("proxy: websocket %s -> %s", upstreamRequest.URL.String(), downstreamRequest.URL.String())
+
+	progress := &upstreamProgress{}
+	downstreamRequest = downstreamRequest.WithContext(progress.trace(downstreamRequest.Context()))
+	downstreamResponse, err := handler.clientFor(route).Do(downstreamRequest)
+	if err != nil {
+		handler.handleUpstreamError(err, progress, upstreamWriter, upstreamRequest)
+		return
+	}
+	defer downstreamResponse.Body.Close()
+	if downstreamResponse.StatusCode != http.StatusSwitchingProtocols {
+		// the upstream refused the handshake; its answer is relayed as is
+		copyHeaders(upstreamWriter.Header(), downstreamResponse.Header)
+		upstreamWriter.WriteHeader(downstreamResponse.StatusCode)
+		handler.buffers.copy(upstreamWriter, downstreamResponse.Body)
+		return
+	}
+	upstreamConn, ok := downstreamResponse.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(downstreamResponse.Header.Get("Upgrade"), "websocket") {
+		handler.handleError(errUpgradeFailed, http.StatusBadGateway, upstreamWriter, upstreamRequest)
+		return
+	}
+	hijacker, ok := upstreamWriter.(http.Hijacker)
+	if !ok {
+		handler.handleUnexpectedError(fmt.Errorf("response writer does not support hijacking"), upstreamWriter, upstreamRequest)
+		return
+	}
+	clientConn, clientBuffer, err := hijacker.Hijack()
+	if err != nil {
+		handler.handleUnexpectedError(err, upstreamWriter, upstreamRequest)
+		return
+	}
+	defer clientConn.Close()
+	if err := writeSwitchingProtocols(clientBuffer.Writer, downstreamResponse.Header); err != nil {
+		log.Printf("proxy: websocket handshake with client failed: %s", err.Error())
+		return
+	}
+	// the tunnel may stay open indefinitely, so it does not hold a slot
+	// under MaxInFlight
+	releaseSlot(upstreamRequest)
+	idleTimeout := handler.configuration.TunnelIdleTimeout
+	if route.IdleTimeout > 0 {
+		idleTimeout = route.IdleTimeout
+	}
+	tunnel(&bufferedConn{Conn: clientConn, reader: clientBuffer.Reader}, upstreamConn, idleTimeout)
+}
+
+// writeSwitchingProtocols completes the client's handshake with the headers
+// of the upstream's 101 response.
+func writeSwitchingProtocols(writer *bufio.Writer, header http.Header) error {
+	if _, err := writer.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,334 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newEchoWebSocketServer starts an upstream which completes websocket
+// handshakes, selecting the chat.v2 subprotocol when offered and accepting
+// any extensions, then echoes whatever bytes it receives.
+func newEchoWebSocketServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		digest := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		header := http.Header{}
+		header.Set("Upgrade", "websocket")
+		header.Set("Connection", "Upgrade")
+		header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(digest[:]))
+		if headerHasToken(r.Header, "Sec-WebSocket-Protocol", "chat.v2") {
+			header.Set("Sec-WebSocket-Protocol", "chat.v2")
+		}
+		if extensions := r.Header.Get("Sec-WebSocket-Extensions"); extensions != "" {
+			header.Set("Sec-WebSocket-Extensions", extensions)
+		}
+		writeSwitchingProtocols(buffer.Writer, header)
+		io.Copy(conn, buffer.Reader)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialWebSocket performs a websocket handshake with the server at addr.
+func dialWebSocket(t *testing.T, addr string, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	request, _ := http.NewRequest("GET", "http://"+addr+"/ws", nil)
+	request.Header = header
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := request.Write(conn); err != nil {
+		t.Fatalf("unable to send handshake: %s", err.Error())
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatalf("unable to read handshake response: %s", err.Error())
+	}
+	return conn, reader, response
+}
+
+func newWebSocketProxy(t *testing.T, upstream string, origins ...string) *httptest.Server {
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Endpoint: strings.Replace(upstream, "http://", "ws://", 1)},
+	}
+	config.WebSocketOrigins = origins
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	proxy := httptest.NewServer(h)
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestWebSocketSubprotocolAndExtensionsPassThrough(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream := newEchoWebSocketServer(t)
+	proxy := newWebSocketProxy(t, upstream.URL, "https://app.example.com")
+
+	header := http.Header{}
+	header.Set("Origin", "https://app.example.com")
+	header.Set("Sec-WebSocket-Protocol", "chat.v1, chat.v2")
+	header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits")
+	conn, reader, response := dialWebSocket(t, strings.TrimPrefix(proxy.URL, "http://"), header)
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status\nexpected: %v\nreceived: %v", http.StatusSwitchingProtocols, response.StatusCode)
+	}
+	expectations := map[string]string{
+		"Sec-WebSocket-Protocol":   "chat.v2",
+		"Sec-WebSocket-Extensions": "permessage-deflate; client_max_window_bits",
+		"Sec-WebSocket-Accept":     "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+	}
+	for name, expected := range expectations {
+		if received := response.Header.Get(name); received != expected {
+			t.Errorf("unexpected %s\nexpected: %v\nreceived: %v", name, expected, received)
+		}
+	}
+
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatalf("unable to read echo: %s", err.Error())
+	}
+	if string(echo) != "ping" {
+		t.Errorf("unexpected echo\nexpected: %v\nreceived: %v", "ping", string(echo))
+	}
+}
+
+func TestWebSocketDisallowedOriginIsRefused(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	contacted := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contacted = true
+	}))
+	defer upstream.Close()
+	proxy := newWebSocketProxy(t, upstream.URL, "https://app.example.com")
+
+	header := http.Header{}
+	header.Set("Origin", "https://evil.example.com")
+	_, _, response := dialWebSocket(t, strings.TrimPrefix(proxy.URL, "http://"), header)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusForbidden, response.StatusCode)
+	}
+	if contacted {
+		t.Error("expected the upstream not to be contacted")
+	}
+}
+
+func TestWebSocketOriginsAreNormalized(t *testing.T) {
+	config := buildConfiguration()
+	config.WebSocketOrigins = []string{"HTTPS://App.Example.com:443", "http://localhost:3000"}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+	expectations := map[string]bool{
+		"":                          true,
+		"https://app.example.com":   true,
+		"http://localhost:3000":     true,
+		"http://app.example.com":    false,
+		"http://localhost:3001":     false,
+		"null":                      false,
+		"https://app.example.com.x": false,
+	}
+	for origin, expected := range expectations {
+		request := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			request.Header.Set("Origin", origin)
+		}
+		if received := h.originAllowed(request); received != expected {
+			t.Errorf("unexpected result for origin %q\nexpected: %v\nreceived: %v", origin, expected, received)
+		}
+	}
+
+	config.WebSocketOrigins = []string{"app.example.com"}
+	if _, err := New(config); err == nil {
+		t.Error("expected an origin without a scheme to be rejected")
+	}
+}
+
+func TestWebSocketRouteRequiresUpgrade(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	proxy := newWebSocketProxy(t, "http://127.0.0.1:1")
+	response, err := http.Get(proxy.URL + "/ws")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+// newHandshakeRecorder starts an upstream which records the headers of the
+// websocket handshakes it receives and refuses them.
+func newHandshakeRecorder(t *testing.T) (*httptest.Server, *http.Header) {
+	received := &http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// newWebSocketRequest builds a websocket handshake for target.
+func newWebSocketRequest(target string) *http.Request {
+	request := httptest.NewRequest("GET", target, nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	return request
+}
+
+func TestWebSocketContextHeadersReplaceClientValues(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream, received := newHandshakeRecorder(t)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.MaxUpstreamHeaderValueBytes = 64
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Endpoint: strings.Replace(upstream.URL, "http://", "ws://", 1), ContextHeaders: []ContextHeader{
+			{Header: "X-Tenant", Key: contextKey("tenant")},
+		}},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	request := newWebSocketRequest("/ws")
+	request.Header.Set("X-Tenant", "other")
+	h.ServeHTTP(httptest.NewRecorder(), request.WithContext(context.WithValue(request.Context(), contextKey("tenant"), "acme")))
+	if tenant := received.Get("X-Tenant"); tenant != "acme" {
+		t.Errorf("unexpected X-Tenant\nexpected: %v\nreceived: %v", "acme", tenant)
+	}
+
+	request = newWebSocketRequest("/ws")
+	request.Header.Set("X-Tenant", "other")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	if _, ok := (*received)["X-Tenant"]; ok {
+		t.Errorf("expected the client's X-Tenant to be removed\nreceived: %v", received.Get("X-Tenant"))
+	}
+
+	// the header guard applies to the handshake
+	*received = http.Header{}
+	request = newWebSocketRequest("/ws")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), contextKey("tenant"), strings.Repeat("a", 100))))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status\nexpected: %v\nreceived: %v", http.StatusInternalServerError, recorder.Code)
+	}
+	if len(*received) != 0 {
+		t.Error("expected the upstream not to be contacted")
+	}
+}
+
+func TestWebSocketSubdomainHeaderReplacesClientValue(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream, received := newHandshakeRecorder(t)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Host: "*.preview.example.com", Endpoint: strings.Replace(upstream.URL, "http://", "ws://", 1), SubdomainHeader: "X-Preview-Branch"},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	request := newWebSocketRequest("http://feature-x.preview.example.com/ws")
+	request.Header.Set("X-Preview-Branch", "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	if branch := received.Get("X-Preview-Branch"); branch != "feature-x" {
+		t.Errorf("unexpected branch header\nexpected: %v\nreceived: %v", "feature-x", branch)
+	}
+}
+
+func TestWebSocketHandshakeOmitsDevOverrideHeader(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream, received := newHandshakeRecorder(t)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DevOverrideHeader = "X-Proxy-Target"
+	config.DevOverrideTargets = []string{"http://localhost:3000"}
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Endpoint: strings.Replace(upstream.URL, "http://", "ws://", 1)},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	request := newWebSocketRequest("/ws")
+	request.Header.Set("X-Proxy-Target", "http://localhost:3000")
+	request.Header.Set("X-Unrelated", "kept")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	if _, ok := (*received)["X-Proxy-Target"]; ok || received.Get("X-Unrelated") != "kept" {
+		t.Errorf("expected only the override header to be removed\nreceived: %v", *received)
+	}
+}
+
+func TestWebSocketHandshakeOmitsDebugToken(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	upstream, received := newHandshakeRecorder(t)
+	config := buildConfiguration()
+	config.Transport = nil
+	config.DebugHeaders = true
+	config.DebugToken = "secret"
+	config.Routes = []*RouteRule{
+		&RouteRule{Path: "/ws", Endpoint: strings.Replace(upstream.URL, "http://", "ws://", 1)},
+	}
+	h, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create proxyhandler: %s", err.Error())
+	}
+
+	request := newWebSocketRequest("/ws")
+	request.Header.Set("X-Proxy-Debug", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+	if _, ok := (*received)["X-Proxy-Debug"]; ok {
+		t.Errorf("expected the debug token not to reach the upstream\nreceived: %v", received.Get("X-Proxy-Debug"))
+	}
+}
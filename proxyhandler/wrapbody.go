@@ -0,0 +1,63 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// errResponseAborted is wrapped by the error reported for a response cut
+// short after it began, which must be aborted rather than completed.
+var errResponseAborted = errors.New("response aborted")
+
+// replacedBody is a body whose content is read from a replacement, such as a
+// transformed or wrapped copy, while closing still closes the original.
+type replacedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// wrapResponseBody passes the body of response through the route's
+// WrapResponseBody. The length of the wrapped body is unknown, so it is sent
+// chunked. Responses which cannot carry a body are not wrapped.
+func (route *validRouteRule) wrapResponseBody(response *http.Response) {
+	if route.WrapResponseBody == nil || !hasBody(response) {
+		return
+	}
+	body := response.Body
+	response.Body = &replacedBody{route.WrapResponseBody(body, response), body}
+	response.ContentLength = -1
+	response.Header.Del("Content-Length")
+}
+
+// flushingWriter flushes every write, so that a wrapped body reaches the
+// client as it is produced.
+type flushingWriter struct {
+	io.Writer
+	flusher http.Flusher
+}
+
+func (writer *flushingWriter) Write(data []byte) (int, error) {
+	written, err := writer.Writer.Write(data)
+	writer.flusher.Flush()
+	return written, err
+}
+
+// copyWrappedBody streams a wrapped response body to the client. An error
+// from the wrapper cannot be reported once the response has begun, so it is
+// logged and returned wrapping errResponseAborted, and the response is
+// aborted once the request has been observed, leaving the client with an
+// incomplete rather than a seemingly complete body.
+func (handler *ProxyHandler) copyWrappedBody(writer http.ResponseWriter, body io.Reader, request *http.Request) error {
+	destination := io.Writer(writer)
+	if flusher, ok := writer.(http.Flusher); ok {
+		destination = &flushingWriter{writer, flusher}
+	}
+	if _, err := handler.buffers.copy(destination, body); err != nil {
+		log.Printf("proxy: aborting response for %s: %s", request.URL.String(), err.Error())
+		return fmt.Errorf("%w: %w", errResponseAborted, err)
+	}
+	return nil
+}
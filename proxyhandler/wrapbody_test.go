@@ -0,0 +1,156 @@
+package proxyhandler
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upperReader uppercases what it reads and fails once it reads failOn.
+type upperReader struct {
+	source io.Reader
+	failOn string
+}
+
+func (reader *upperReader) Read(data []byte) (int, error) {
+	read, err := reader.source.Read(data)
+	if reader.failOn != "" && bytes.Contains(data[:read], []byte(reader.failOn)) {
+		return 0, fmt.Errorf("unable to transform %q", reader.failOn)
+	}
+	copy(data, bytes.ToUpper(data[:read]))
+	return read, err
+}
+
+func TestWrapResponseBodyStreamsTransformedChunks(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			next := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "25")
+				for _, line := range []string{"first line\n", "second line\n", "x\n"} {
+					io.WriteString(w, line)
+					w.(http.Flusher).Flush()
+					select {
+					case <-next:
+					case <-time.After(5 * time.Second):
+						return
+					}
+				}
+			}))
+			defer upstream.Close()
+			config := buildConfiguration()
+			config.Transport = nil
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = upstream.URL
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/", Endpoint: upstream.URL, WrapResponseBody: func(body io.Reader, response *http.Response) io.Reader {
+					return &upperReader{source: body}
+				}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			proxy := httptest.NewServer(h)
+			defer proxy.Close()
+
+			response, err := http.Get(proxy.URL + "/export")
+			if err != nil {
+				t.Fatalf("request failed: %s", err.Error())
+			}
+			defer response.Body.Close()
+			if response.ContentLength != -1 || len(response.TransferEncoding) == 0 || response.TransferEncoding[0] != "chunked" {
+				t.Errorf("expected a chunked response\nreceived: length %d, transfer encoding %v", response.ContentLength, response.TransferEncoding)
+			}
+			lines := bufio.NewReader(response.Body)
+			for _, expected := range []string{"FIRST LINE\n", "SECOND LINE\n", "X\n"} {
+				// each line must arrive before the upstream is allowed to send the next
+				line, err := lines.ReadString('\n')
+				if err != nil || line != expected {
+					t.Fatalf("unexpected streamed line\nexpected: %q\nreceived: %q (%v)", expected, line, err)
+				}
+				next <- struct{}{}
+			}
+		})
+	}
+}
+
+func TestWrapResponseBodyErrorsAbortTheResponse(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, mode := range proxyModes {
+		t.Run(mode.name, func(t *testing.T) {
+			next := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "good line\n")
+				w.(http.Flusher).Flush()
+				select {
+				case <-next:
+				case <-time.After(5 * time.Second):
+				}
+				io.WriteString(w, "bad line\n")
+			}))
+			defer upstream.Close()
+			config := buildConfiguration()
+			config.Transport = nil
+			config.StdlibProxy = mode.stdlib
+			config.DefaultRoute = upstream.URL
+			observed := make(chan *Observation, 1)
+			config.Observer = func(observation *Observation) {
+				observed <- observation
+			}
+			config.Routes = []*RouteRule{
+				&RouteRule{Path: "/", Endpoint: upstream.URL, WrapResponseBody: func(body io.Reader, response *http.Response) io.Reader {
+					return &upperReader{source: body, failOn: "bad"}
+				}},
+			}
+			h, err := New(config)
+			if err != nil {
+				t.Fatalf("unable to create proxyhandler: %s", err.Error())
+			}
+			proxy := httptest.NewServer(h)
+			defer proxy.Close()
+
+			response, err := http.Get(proxy.URL + "/export")
+			if err != nil {
+				t.Fatalf("request failed: %s", err.Error())
+			}
+			defer response.Body.Close()
+			lines := bufio.NewReader(response.Body)
+			if line, err := lines.ReadString('\n'); err != nil || line != "GOOD LINE\n" {
+				t.Fatalf("unexpected first line\nexpected: %q\nreceived: %q (%v)", "GOOD LINE\n", line, err)
+			}
+			next <- struct{}{}
+			rest, err := io.ReadAll(lines)
+			if err == nil {
+				t.Errorf("expected the response to be aborted\nreceived: %q", rest)
+			}
+			if strings.Contains(strings.ToUpper(string(rest)), "BAD") {
+				t.Errorf("expected the failing chunk to be withheld\nreceived: %q", rest)
+			}
+			// the aborted response is still observed
+			select {
+			case observation := <-observed:
+				if !errors.Is(observation.Err, errResponseAborted) || observation.StatusCode != http.StatusOK {
+					t.Errorf("unexpected observation\nexpected: %v %v\nreceived: %v %v", http.StatusOK, errResponseAborted, observation.StatusCode, observation.Err)
+				}
+			case <-time.After(time.Second):
+				t.Error("expected the aborted response to be observed")
+			}
+		})
+	}
+}